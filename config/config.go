@@ -0,0 +1,633 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package config holds the typed configuration of the integrator. It is read from an optional YAML file,
+// overridden by ENV variables and validated as a whole at startup.
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Config is the complete configuration of the integrator. The env tags name the ENV variables overriding a setting,
+// the first one set wins.
+type Config struct {
+	Gitlab           Gitlab           `yaml:"gitlab"`
+	Kubernetes       Kubernetes       `yaml:"kubernetes"`
+	Roles            Roles            `yaml:"roles"`
+	Namespaces       Namespaces       `yaml:"namespaces"`
+	Sync             Sync             `yaml:"sync"`
+	Webhooks         Webhooks         `yaml:"webhooks"`
+	LeaderElection   LeaderElection   `yaml:"leaderElection"`
+	Users            Users            `yaml:"users"`
+	ReviewNamespaces ReviewNamespaces `yaml:"reviewNamespaces"`
+	CustomRoleDir    string           `yaml:"customRoleDir" env:"CUSTOM_ROLE_DIR"`
+}
+
+type Gitlab struct {
+	Hostname string `yaml:"hostname" env:"GITLAB_HOSTNAME"`
+	// URL is the base URL of Gitlab, like http://localhost:8080/gitlab. It takes precedence over Hostname, which is
+	// always reached via HTTPS.
+	URL          string `yaml:"url" env:"GITLAB_URL"`
+	APIVersion   string `yaml:"apiVersion" env:"GITLAB_API_VERSION"`
+	PrivateToken string `yaml:"privateToken" env:"GITLAB_PRIVATE_TOKEN"`
+	// PrivateTokenFile takes precedence over PrivateToken and is read again when it changes, e.g. a mounted K8s Secret
+	PrivateTokenFile string `yaml:"privateTokenFile" env:"GITLAB_PRIVATE_TOKEN_FILE"`
+	// TokenType is the kind of the private token, see TokenPersonal, TokenGroup, TokenProject and TokenOAuth2
+	TokenType   string       `yaml:"tokenType" env:"GITLAB_TOKEN_TYPE"`
+	OAuth2      GitlabOAuth2 `yaml:"oauth2"`
+	SecretToken string       `yaml:"secretToken" env:"GITLAB_SECRET_TOKEN"`
+	// SecretTokens are accepted besides SecretToken, so the secret of the System Hook can be rotated without downtime
+	SecretTokens []string `yaml:"secretTokens" env:"GITLAB_SECRET_TOKENS"`
+	// SecretTokenFile holds further secret tokens, one per line, and is read again when it changes
+	SecretTokenFile string `yaml:"secretTokenFile" env:"GITLAB_SECRET_TOKEN_FILE"`
+	// CredentialReloadSeconds is the interval in which the credential files are checked for changes
+	CredentialReloadSeconds int    `yaml:"credentialReloadSeconds" env:"GITLAB_CREDENTIAL_RELOAD_SECONDS"`
+	EnvironmentName         string `yaml:"environmentName" env:"GITLAB_ENVIRONMENT_NAME"`
+	// ServiceAccountName is the name of the ServiceAccount created in each project namespace for the K8s integration
+	ServiceAccountName string `yaml:"serviceAccountName" env:"GITLAB_SERVICEACCOUNT_NAME"`
+	// Workers is the number of concurrent requests for the members of groups and projects during a sync run
+	Workers int `yaml:"workers" env:"GITLAB_WORKERS"`
+	// MaxRetries is the number of retries of a request failing with 429, a 5xx status or a network error
+	MaxRetries int `yaml:"maxRetries" env:"GITLAB_MAX_RETRIES"`
+	// MembershipInheritance decides whether the members of parent groups are bound in the namespaces of their subgroups
+	// and projects, see MembershipInherited and MembershipDirect
+	MembershipInheritance string `yaml:"membershipInheritance" env:"GITLAB_MEMBERSHIP_INHERITANCE"`
+	// Pagination is the pagination used for the lists of groups, projects and users, see PaginationOffset and
+	// PaginationKeyset
+	Pagination string     `yaml:"pagination" env:"GITLAB_PAGINATION"`
+	HTTP       GitlabHTTP `yaml:"http"`
+}
+
+// GitlabOAuth2 configures the client credentials grant used for the token type TokenOAuth2
+type GitlabOAuth2 struct {
+	// TokenURL defaults to /oauth/token of Gitlab
+	TokenURL     string `yaml:"tokenUrl" env:"GITLAB_OAUTH2_TOKEN_URL"`
+	ClientID     string `yaml:"clientId" env:"GITLAB_OAUTH2_CLIENT_ID"`
+	ClientSecret string `yaml:"clientSecret" env:"GITLAB_OAUTH2_CLIENT_SECRET"`
+	// ClientSecretFile takes precedence over ClientSecret and is read again when it changes
+	ClientSecretFile string   `yaml:"clientSecretFile" env:"GITLAB_OAUTH2_CLIENT_SECRET_FILE"`
+	Scopes           []string `yaml:"scopes" env:"GITLAB_OAUTH2_SCOPES"`
+}
+
+// GitlabHTTP configures the client shared by all requests to Gitlab
+type GitlabHTTP struct {
+	// CAFile is a PEM bundle trusted besides the system roots, e.g. for a Gitlab with a certificate of an internal CA
+	CAFile string `yaml:"caFile" env:"GITLAB_CA_FILE"`
+	// ClientCertFile and ClientKeyFile are presented to Gitlab if set
+	ClientCertFile string `yaml:"clientCertFile" env:"GITLAB_CLIENT_CERT_FILE"`
+	ClientKeyFile  string `yaml:"clientKeyFile" env:"GITLAB_CLIENT_KEY_FILE"`
+	// Proxy is the URL of the proxy for requests to Gitlab. If unset, HTTPS_PROXY, HTTP_PROXY and NO_PROXY apply.
+	Proxy string `yaml:"proxy" env:"GITLAB_PROXY"`
+	// TimeoutSeconds limits a single request to Gitlab including reading its answer. Retries get a new timeout.
+	TimeoutSeconds int    `yaml:"timeoutSeconds" env:"GITLAB_TIMEOUT_SECONDS"`
+	UserAgent      string `yaml:"userAgent" env:"GITLAB_USER_AGENT"`
+}
+
+const (
+	// MembershipInherited binds all members with access to a group or project, including those inherited from its
+	// parent groups, with their highest access level
+	MembershipInherited = "inherited"
+	// MembershipDirect only binds the members added to a group or project itself
+	MembershipDirect = "direct"
+
+	// PaginationOffset requests the pages of a list by their number, which Gitlab supports for all lists
+	PaginationOffset = "offset"
+	// PaginationKeyset requests the pages of a list following the last entity of the previous page, which stays
+	// fast on large instances but requires a recent Gitlab
+	PaginationKeyset = "keyset"
+
+	// TokenPersonal is the personal access token of an admin, which may act on behalf of other users
+	TokenPersonal = "personal"
+	// TokenGroup is a group access token, which only grants access to the group, its subgroups and their projects
+	TokenGroup = "group"
+	// TokenProject is a project access token, which only grants access to its project
+	TokenProject = "project"
+	// TokenOAuth2 is an access token requested by the OAuth2 client credentials grant
+	TokenOAuth2 = "oauth2"
+)
+
+type Kubernetes struct {
+	// Kubeconfig is only read from the file, the KUBECONFIG ENV is handled as usual by the K8s client
+	Kubeconfig     string `yaml:"kubeconfig"`
+	Context        string `yaml:"context" env:"KUBE_CONTEXT"`
+	ExternalAPIURL string `yaml:"externalApiUrl" env:"EXTERNAL_K8S_API_URL"`
+	CAPem          string `yaml:"caPem" env:"K8S_CA_PEM"`
+}
+
+type Roles struct {
+	GroupMaster      string `yaml:"groupMaster" env:"GROUP_MASTER_ROLENAME"`
+	GroupDeveloper   string `yaml:"groupDeveloper" env:"GROUP_DEVELOPER_ROLENAME"`
+	GroupReporter    string `yaml:"groupReporter" env:"GROUP_REPORTER_ROLENAME"`
+	GroupDefault     string `yaml:"groupDefault" env:"GROUP_DEFAULT_ROLENAME"`
+	ProjectMaster    string `yaml:"projectMaster" env:"PROJECT_MASTER_ROLENAME"`
+	ProjectDeveloper string `yaml:"projectDeveloper" env:"PROJECT_DEVELOPER_ROLENAME"`
+	ProjectReporter  string `yaml:"projectReporter" env:"PROJECT_REPORTER_ROLENAME"`
+	ProjectDefault   string `yaml:"projectDefault" env:"PROJECT_DEFAULT_ROLENAME"`
+}
+
+type Namespaces struct {
+	CephUserKey            string      `yaml:"cephUserKey" env:"CEPH_USER_KEY"`
+	NetAdminPSPClusterRole string      `yaml:"netAdminPspClusterRole" env:"NET_ADMIN_PSP_CLUSTER_ROLE_NAME"`
+	LimitRanges            LimitRanges `yaml:"limitRanges"`
+}
+
+// LimitRanges holds the defaults written to each namespace. Plain numbers are millicores for CPU and Mi for memory.
+type LimitRanges struct {
+	Enabled              bool   `yaml:"enabled" env:"ENABLE_LIMITRANGES"`
+	DefaultCPURequest    string `yaml:"defaultCpuRequest" env:"DEFAULT_CPU_REQ"`
+	DefaultCPULimit      string `yaml:"defaultCpuLimit" env:"DEFAULT_CPU_LIM"`
+	DefaultMemoryRequest string `yaml:"defaultMemoryRequest" env:"DEFAULT_MEM_REQ"`
+	DefaultMemoryLimit   string `yaml:"defaultMemoryLimit" env:"DEFAULT_MEM_LIM"`
+}
+
+type Sync struct {
+	DryRun         bool   `yaml:"dryRun" env:"ENABLE_DRY_RUN"`
+	PlanFormat     string `yaml:"planFormat" env:"DRY_RUN_PLAN_FORMAT"`
+	Debug          bool   `yaml:"debug" env:"ENABLE_GITLAB_SYNC_DEBUG"`
+	EnableEndpoint bool   `yaml:"enableEndpoint" env:"ENABLE_SYNC_ENDPOINT"`
+	// FullIntervalMinutes is the interval of full sync runs, which fetch all of Gitlab
+	FullIntervalMinutes int `yaml:"fullIntervalMinutes" env:"SYNC_FULL_INTERVAL_MINUTES"`
+	// IncrementalIntervalMinutes is the interval of sync runs which fetch only the projects with activity and the users
+	// created since the last run, 0 disables them. Groups and membership changes are left to the full runs
+	IncrementalIntervalMinutes int `yaml:"incrementalIntervalMinutes" env:"SYNC_INCREMENTAL_INTERVAL_MINUTES"`
+	// MigratedNamespaceTTLHours is the number of hours after which the first full sync run deletes a namespace left
+	// behind by a migration, unless it holds PersistentVolumeClaims. 0 keeps them until an operator deletes them
+	MigratedNamespaceTTLHours int `yaml:"migratedNamespaceTtlHours" env:"MIGRATED_NAMESPACE_TTL_HOURS"`
+}
+
+type Webhooks struct {
+	Debug                bool   `yaml:"debug" env:"ENABLE_GITLAB_HOOKS_DEBUG"`
+	QueueDir             string `yaml:"queueDir" env:"WEBHOOK_QUEUE_DIR"`
+	Workers              int    `yaml:"workers" env:"WEBHOOK_WORKERS"`
+	MaxAttempts          int    `yaml:"maxAttempts" env:"WEBHOOK_MAX_ATTEMPTS"`
+	EnableAdminEndpoints bool   `yaml:"enableAdminEndpoints" env:"ENABLE_ADMIN_ENDPOINTS"`
+	// AdminToken must be presented as bearer token to the admin endpoints and /sync/plan, it is required if the admin
+	// endpoints are enabled
+	AdminToken string `yaml:"adminToken" env:"WEBHOOK_ADMIN_TOKEN"`
+	// JournalMaxMegabytes limits the disk space of the journal of received hooks, it is disabled with 0
+	JournalMaxMegabytes int `yaml:"journalMaxMegabytes" env:"WEBHOOK_JOURNAL_MAX_MEGABYTES"`
+	// DedupWindowSeconds is the time in which repeated deliveries of a hook are dropped, 0 disables it
+	DedupWindowSeconds int `yaml:"dedupWindowSeconds" env:"WEBHOOK_DEDUP_WINDOW_SECONDS"`
+	// AllowedCIDRs restricts the source addresses hooks are accepted from, all are accepted if empty
+	AllowedCIDRs []string   `yaml:"allowedCidrs" env:"WEBHOOK_ALLOWED_CIDRS"`
+	TLS          WebhookTLS `yaml:"tls"`
+	// AllowUnauthenticated accepts System Hooks without token if no secret token is configured. Without it, a secret
+	// token is required, as System Hooks create and delete namespaces and RoleBindings.
+	AllowUnauthenticated bool `yaml:"allowUnauthenticated" env:"WEBHOOK_ALLOW_UNAUTHENTICATED"`
+}
+
+// WebhookTLS enables HTTPS for the listener and, if a client CA is given, requires hooks to present a client
+// certificate signed by it. Health checks and metrics are served without client certificate.
+type WebhookTLS struct {
+	CertFile     string `yaml:"certFile" env:"WEBHOOK_TLS_CERT_FILE"`
+	KeyFile      string `yaml:"keyFile" env:"WEBHOOK_TLS_KEY_FILE"`
+	ClientCAFile string `yaml:"clientCaFile" env:"WEBHOOK_TLS_CLIENT_CA_FILE"`
+}
+
+type LeaderElection struct {
+	Enabled   bool   `yaml:"enabled" env:"ENABLE_LEADER_ELECTION"`
+	Namespace string `yaml:"namespace" env:"LEADER_ELECTION_NAMESPACE,POD_NAMESPACE"`
+	LeaseName string `yaml:"leaseName" env:"LEADER_ELECTION_LEASE_NAME"`
+	// Identity of this replica, defaults to the hostname
+	Identity string `yaml:"identity" env:"POD_NAME"`
+	// URL under which this replica accepts forwarded webhooks, defaults to http://$POD_IP:8080/hook
+	URL   string `yaml:"url" env:"LEADER_ELECTION_URL"`
+	PodIP string `yaml:"podIP" env:"POD_IP"`
+	// ForwardingToken is shared by all replicas, hooks forwarded with it are accepted from the ForwardingCIDRs besides
+	// the allowed CIDRs of the webhooks, as the follower already checked the address of the original sender
+	ForwardingToken string `yaml:"forwardingToken" env:"LEADER_ELECTION_FORWARDING_TOKEN"`
+	// ForwardingCIDRs are the addresses of the replicas, usually the pod CIDR of the cluster
+	ForwardingCIDRs []string `yaml:"forwardingCidrs" env:"LEADER_ELECTION_FORWARDING_CIDRS"`
+	// ClientCertFile and ClientKeyFile are presented to the leader when forwarding hooks, if it requires client
+	// certificates. The certificate of the listener can't be used, as it is usually only valid for server auth.
+	ClientCertFile string `yaml:"clientCertFile" env:"LEADER_ELECTION_CLIENT_CERT_FILE"`
+	ClientKeyFile  string `yaml:"clientKeyFile" env:"LEADER_ELECTION_CLIENT_KEY_FILE"`
+}
+
+// Users configures how access of blocked, banned and deactivated users is revoked
+type Users struct {
+	// StateCheckIntervalMinutes is the number of minutes between two checks of all user states, 0 disables the check.
+	// It only catches missed hooks, as the user_block and user_unblock hooks are applied right away.
+	StateCheckIntervalMinutes int `yaml:"stateCheckIntervalMinutes" env:"USER_STATE_CHECK_INTERVAL_MINUTES"`
+	// ScaleDownInactive scales the Deployments and StatefulSets in the personal namespace of inactive users to zero
+	ScaleDownInactive bool `yaml:"scaleDownInactive" env:"SCALE_DOWN_INACTIVE_USER_NAMESPACE"`
+}
+
+// ReviewNamespaces configures the namespaces created for open merge requests
+type ReviewNamespaces struct {
+	Enabled bool `yaml:"enabled" env:"ENABLE_REVIEW_NAMESPACES"`
+	// TTLHours is the number of hours without merge request event after which a review namespace is deleted, 0 keeps
+	// it until the merge request is merged or closed
+	TTLHours int `yaml:"ttlHours" env:"REVIEW_NAMESPACE_TTL_HOURS"`
+	// SecretTokens are the secret tokens of the project webhooks sending merge request events. They are only accepted
+	// for hooks with the Merge Request Hook header, which in turn don't accept the secret tokens of the System Hook.
+	SecretTokens []string `yaml:"secretTokens" env:"REVIEW_NAMESPACE_SECRET_TOKENS"`
+}
+
+// Default returns the configuration used for all settings which are neither set in the file nor via ENV
+func Default() *Config {
+	return &Config{
+		Gitlab: Gitlab{
+			APIVersion:              "v4",
+			ServiceAccountName:      "gitlab-serviceaccount",
+			Workers:                 4,
+			MaxRetries:              5,
+			MembershipInheritance:   MembershipInherited,
+			Pagination:              PaginationOffset,
+			TokenType:               TokenPersonal,
+			CredentialReloadSeconds: 30,
+			OAuth2:                  GitlabOAuth2{Scopes: []string{"api"}},
+			HTTP: GitlabHTTP{
+				TimeoutSeconds: 30,
+				UserAgent:      "gitlab-k8s-integrator",
+			},
+		},
+		Roles: Roles{
+			GroupMaster:      "gitlab-group-master",
+			GroupDeveloper:   "gitlab-group-developer",
+			GroupReporter:    "gitlab-group-reporter",
+			GroupDefault:     "gitlab-group-guest",
+			ProjectMaster:    "gitlab-project-master",
+			ProjectDeveloper: "gitlab-project-developer",
+			ProjectReporter:  "gitlab-project-reporter",
+			ProjectDefault:   "gitlab-project-guest",
+		},
+		Namespaces: Namespaces{
+			LimitRanges: LimitRanges{
+				DefaultCPURequest:    "20m",
+				DefaultCPULimit:      "150m",
+				DefaultMemoryRequest: "25Mi",
+				DefaultMemoryLimit:   "120Mi",
+			},
+		},
+		Sync: Sync{
+			PlanFormat:          "text",
+			FullIntervalMinutes: 180,
+		},
+		Webhooks: Webhooks{
+			QueueDir:            "/var/lib/gitlab-integrator/webhooks",
+			Workers:             4,
+			MaxAttempts:         10,
+			JournalMaxMegabytes: 10,
+			DedupWindowSeconds:  600,
+		},
+		LeaderElection: LeaderElection{
+			LeaseName: "gitlab-k8s-integrator",
+		},
+		Users: Users{
+			StateCheckIntervalMinutes: 30,
+		},
+		ReviewNamespaces: ReviewNamespaces{
+			TTLHours: 168,
+		},
+		CustomRoleDir: "/etc/custom-roles",
+	}
+}
+
+var (
+	current *Config
+	lock    sync.RWMutex
+)
+
+// Get returns the configuration loaded at startup. If none has been set, e.g. in tests, the defaults overridden by
+// the ENV variables are returned.
+func Get() *Config {
+	lock.RLock()
+	cfg := current
+	lock.RUnlock()
+	if cfg == nil {
+		cfg = Default()
+		applyEnv(reflect.ValueOf(cfg).Elem(), "", &ValidationError{})
+	}
+	return cfg
+}
+
+// Set replaces the configuration returned by Get
+func Set(cfg *Config) {
+	lock.Lock()
+	defer lock.Unlock()
+	current = cfg
+}
+
+// ValidationError lists every invalid setting of a configuration
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "Invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+func (e *ValidationError) add(setting, format string, args ...interface{}) {
+	e.Problems = append(e.Problems, setting+": "+fmt.Sprintf(format, args...))
+}
+
+// Load reads the configuration file at path, if given, applies the ENV overrides and validates the result.
+// All problems found are reported at once by the returned *ValidationError.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not read config file %s", path)
+		}
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse config file %s", path)
+		}
+	}
+
+	problems := &ValidationError{}
+	applyEnv(reflect.ValueOf(cfg).Elem(), "", problems)
+	cfg.validate(problems)
+	if len(problems.Problems) > 0 {
+		return cfg, problems
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides all fields having an env tag with the value of the first of their ENV variables which is set
+func applyEnv(v reflect.Value, path string, problems *ValidationError) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fieldPath := strings.TrimPrefix(path+"."+strings.Split(field.Tag.Get("yaml"), ",")[0], ".")
+		if field.Type.Kind() == reflect.Struct {
+			applyEnv(v.Field(i), fieldPath, problems)
+			continue
+		}
+		for _, env := range strings.Split(field.Tag.Get("env"), ",") {
+			value := os.Getenv(env)
+			if env == "" || value == "" {
+				continue
+			}
+			setting := fmt.Sprintf("%s (%s)", fieldPath, env)
+			switch field.Type.Kind() {
+			case reflect.String:
+				v.Field(i).SetString(value)
+			case reflect.Bool:
+				b, err := strconv.ParseBool(value)
+				if err != nil {
+					problems.add(setting, "%q is not a boolean, use true or false", value)
+				}
+				v.Field(i).SetBool(b)
+			case reflect.Int:
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					problems.add(setting, "%q is not a number", value)
+				}
+				v.Field(i).SetInt(int64(n))
+			case reflect.Slice:
+				// lists are given comma separated
+				var values []string
+				for _, item := range strings.Split(value, ",") {
+					if item = strings.TrimSpace(item); item != "" {
+						values = append(values, item)
+					}
+				}
+				v.Field(i).Set(reflect.ValueOf(values))
+			}
+			break
+		}
+	}
+}
+
+var apiVersion = regexp.MustCompile(`^v\d+$`)
+
+func (c *Config) validate(problems *ValidationError) {
+	if c.Gitlab.URL != "" {
+		if u, err := url.Parse(c.Gitlab.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems.add("gitlab.url (GITLAB_URL)", "%q is not an absolute http or https URL", c.Gitlab.URL)
+		}
+	} else if c.Gitlab.Hostname == "" {
+		problems.add("gitlab.hostname (GITLAB_HOSTNAME)", "must be set, unless gitlab.url (GITLAB_URL) is set")
+	}
+	if !apiVersion.MatchString(c.Gitlab.APIVersion) {
+		problems.add("gitlab.apiVersion (GITLAB_API_VERSION)", "%q is not an API version like v4", c.Gitlab.APIVersion)
+	}
+	switch c.Gitlab.TokenType {
+	case TokenPersonal, TokenGroup, TokenProject:
+		if c.Gitlab.PrivateToken == "" && c.Gitlab.PrivateTokenFile == "" {
+			problems.add("gitlab.privateToken (GITLAB_PRIVATE_TOKEN)", "must be set, unless gitlab.privateTokenFile (GITLAB_PRIVATE_TOKEN_FILE) is set")
+		}
+	case TokenOAuth2:
+		if c.Gitlab.OAuth2.ClientID == "" {
+			problems.add("gitlab.oauth2.clientId (GITLAB_OAUTH2_CLIENT_ID)", "must be set for the token type %s", TokenOAuth2)
+		}
+		if c.Gitlab.OAuth2.ClientSecret == "" && c.Gitlab.OAuth2.ClientSecretFile == "" {
+			problems.add("gitlab.oauth2.clientSecret (GITLAB_OAUTH2_CLIENT_SECRET)", "must be set for the token type %s, unless gitlab.oauth2.clientSecretFile (GITLAB_OAUTH2_CLIENT_SECRET_FILE) is set", TokenOAuth2)
+		}
+		if c.Gitlab.OAuth2.TokenURL != "" {
+			if u, err := url.Parse(c.Gitlab.OAuth2.TokenURL); err != nil || u.Scheme == "" || u.Host == "" {
+				problems.add("gitlab.oauth2.tokenUrl (GITLAB_OAUTH2_TOKEN_URL)", "%q is not an absolute URL", c.Gitlab.OAuth2.TokenURL)
+			}
+		}
+	default:
+		problems.add("gitlab.tokenType (GITLAB_TOKEN_TYPE)", "%q is none of %s, %s, %s and %s", c.Gitlab.TokenType, TokenPersonal, TokenGroup, TokenProject, TokenOAuth2)
+	}
+	if c.Gitlab.CredentialReloadSeconds < 1 {
+		problems.add("gitlab.credentialReloadSeconds (GITLAB_CREDENTIAL_RELOAD_SECONDS)", "must be at least 1")
+	}
+	if c.Gitlab.Workers < 1 {
+		problems.add("gitlab.workers (GITLAB_WORKERS)", "must be at least 1")
+	}
+	if c.Gitlab.MaxRetries < 0 {
+		problems.add("gitlab.maxRetries (GITLAB_MAX_RETRIES)", "must not be negative")
+	}
+	if c.Gitlab.Pagination != PaginationOffset && c.Gitlab.Pagination != PaginationKeyset {
+		problems.add("gitlab.pagination (GITLAB_PAGINATION)", "%q is neither %s nor %s", c.Gitlab.Pagination, PaginationOffset, PaginationKeyset)
+	}
+	if c.Gitlab.MembershipInheritance != MembershipInherited && c.Gitlab.MembershipInheritance != MembershipDirect {
+		problems.add("gitlab.membershipInheritance (GITLAB_MEMBERSHIP_INHERITANCE)", "%q is neither %s nor %s", c.Gitlab.MembershipInheritance, MembershipInherited, MembershipDirect)
+	}
+	if (c.Gitlab.HTTP.ClientCertFile == "") != (c.Gitlab.HTTP.ClientKeyFile == "") {
+		problems.add("gitlab.http.clientCertFile (GITLAB_CLIENT_CERT_FILE)", "must be set together with gitlab.http.clientKeyFile (GITLAB_CLIENT_KEY_FILE)")
+	}
+	if c.Gitlab.HTTP.Proxy != "" {
+		if u, err := url.Parse(c.Gitlab.HTTP.Proxy); err != nil || u.Scheme == "" || u.Host == "" {
+			problems.add("gitlab.http.proxy (GITLAB_PROXY)", "%q is not an absolute URL", c.Gitlab.HTTP.Proxy)
+		}
+	}
+	if c.Gitlab.HTTP.TimeoutSeconds < 1 {
+		problems.add("gitlab.http.timeoutSeconds (GITLAB_TIMEOUT_SECONDS)", "must be at least 1")
+	}
+	if errs := validation.IsDNS1123Label(c.Gitlab.ServiceAccountName); len(errs) != 0 {
+		problems.add("gitlab.serviceAccountName (GITLAB_SERVICEACCOUNT_NAME)", "%q is not a DNS-1123 compliant name: %s", c.Gitlab.ServiceAccountName, strings.Join(errs, ", "))
+	}
+
+	if c.Kubernetes.ExternalAPIURL != "" {
+		if u, err := url.Parse(c.Kubernetes.ExternalAPIURL); err != nil || u.Scheme == "" || u.Host == "" {
+			problems.add("kubernetes.externalApiUrl (EXTERNAL_K8S_API_URL)", "%q is not an absolute URL", c.Kubernetes.ExternalAPIURL)
+		}
+	}
+
+	roles := []struct{ setting, name string }{
+		{"roles.groupMaster (GROUP_MASTER_ROLENAME)", c.Roles.GroupMaster},
+		{"roles.groupDeveloper (GROUP_DEVELOPER_ROLENAME)", c.Roles.GroupDeveloper},
+		{"roles.groupReporter (GROUP_REPORTER_ROLENAME)", c.Roles.GroupReporter},
+		{"roles.groupDefault (GROUP_DEFAULT_ROLENAME)", c.Roles.GroupDefault},
+		{"roles.projectMaster (PROJECT_MASTER_ROLENAME)", c.Roles.ProjectMaster},
+		{"roles.projectDeveloper (PROJECT_DEVELOPER_ROLENAME)", c.Roles.ProjectDeveloper},
+		{"roles.projectReporter (PROJECT_REPORTER_ROLENAME)", c.Roles.ProjectReporter},
+		{"roles.projectDefault (PROJECT_DEFAULT_ROLENAME)", c.Roles.ProjectDefault},
+	}
+	for _, role := range roles {
+		if errs := validation.IsDNS1123Subdomain(role.name); len(errs) != 0 {
+			problems.add(role.setting, "%q is not a valid role name: %s", role.name, strings.Join(errs, ", "))
+		}
+	}
+
+	limits := c.Namespaces.LimitRanges
+	cpuReq, cpuReqErr := Quantity(limits.DefaultCPURequest, "m")
+	cpuLim, cpuLimErr := Quantity(limits.DefaultCPULimit, "m")
+	memReq, memReqErr := Quantity(limits.DefaultMemoryRequest, "Mi")
+	memLim, memLimErr := Quantity(limits.DefaultMemoryLimit, "Mi")
+	for _, quantity := range []struct {
+		setting string
+		err     error
+	}{
+		{"namespaces.limitRanges.defaultCpuRequest (DEFAULT_CPU_REQ)", cpuReqErr},
+		{"namespaces.limitRanges.defaultCpuLimit (DEFAULT_CPU_LIM)", cpuLimErr},
+		{"namespaces.limitRanges.defaultMemoryRequest (DEFAULT_MEM_REQ)", memReqErr},
+		{"namespaces.limitRanges.defaultMemoryLimit (DEFAULT_MEM_LIM)", memLimErr},
+	} {
+		if quantity.err != nil {
+			problems.add(quantity.setting, "%s", quantity.err)
+		}
+	}
+	if cpuReqErr == nil && cpuLimErr == nil && cpuReq.Cmp(cpuLim) > 0 {
+		problems.add("namespaces.limitRanges.defaultCpuRequest (DEFAULT_CPU_REQ)", "%s exceeds the CPU limit of %s", cpuReq.String(), cpuLim.String())
+	}
+	if memReqErr == nil && memLimErr == nil && memReq.Cmp(memLim) > 0 {
+		problems.add("namespaces.limitRanges.defaultMemoryRequest (DEFAULT_MEM_REQ)", "%s exceeds the memory limit of %s", memReq.String(), memLim.String())
+	}
+
+	if c.Sync.PlanFormat != "text" && c.Sync.PlanFormat != "json" {
+		problems.add("sync.planFormat (DRY_RUN_PLAN_FORMAT)", "%q is neither text nor json", c.Sync.PlanFormat)
+	}
+
+	if c.Sync.FullIntervalMinutes < 1 {
+		problems.add("sync.fullIntervalMinutes (SYNC_FULL_INTERVAL_MINUTES)", "must be at least 1")
+	}
+	if c.Sync.IncrementalIntervalMinutes < 0 {
+		problems.add("sync.incrementalIntervalMinutes (SYNC_INCREMENTAL_INTERVAL_MINUTES)", "must not be negative")
+	} else if c.Sync.IncrementalIntervalMinutes > 0 && c.Sync.IncrementalIntervalMinutes >= c.Sync.FullIntervalMinutes {
+		problems.add("sync.incrementalIntervalMinutes (SYNC_INCREMENTAL_INTERVAL_MINUTES)", "must be shorter than sync.fullIntervalMinutes")
+	}
+
+	if c.Sync.MigratedNamespaceTTLHours < 0 {
+		problems.add("sync.migratedNamespaceTtlHours (MIGRATED_NAMESPACE_TTL_HOURS)", "must not be negative")
+	}
+
+	if c.Webhooks.QueueDir == "" {
+		problems.add("webhooks.queueDir (WEBHOOK_QUEUE_DIR)", "must be set")
+	}
+	if c.Webhooks.Workers < 1 {
+		problems.add("webhooks.workers (WEBHOOK_WORKERS)", "must be at least 1")
+	}
+	if c.Webhooks.MaxAttempts < 1 {
+		problems.add("webhooks.maxAttempts (WEBHOOK_MAX_ATTEMPTS)", "must be at least 1")
+	}
+	if c.Gitlab.SecretToken == "" && len(c.Gitlab.SecretTokens) == 0 && c.Gitlab.SecretTokenFile == "" && !c.Webhooks.AllowUnauthenticated {
+		problems.add("gitlab.secretToken (GITLAB_SECRET_TOKEN)", "must be set, unless gitlab.secretTokens (GITLAB_SECRET_TOKENS) or "+
+			"gitlab.secretTokenFile (GITLAB_SECRET_TOKEN_FILE) is set or webhooks.allowUnauthenticated (WEBHOOK_ALLOW_UNAUTHENTICATED) is enabled")
+	}
+	if c.Webhooks.EnableAdminEndpoints && c.Webhooks.AdminToken == "" {
+		problems.add("webhooks.adminToken (WEBHOOK_ADMIN_TOKEN)", "must be set if webhooks.enableAdminEndpoints (ENABLE_ADMIN_ENDPOINTS) is enabled")
+	}
+	if c.Webhooks.JournalMaxMegabytes < 0 {
+		problems.add("webhooks.journalMaxMegabytes (WEBHOOK_JOURNAL_MAX_MEGABYTES)", "must not be negative")
+	}
+	if c.Webhooks.DedupWindowSeconds < 0 {
+		problems.add("webhooks.dedupWindowSeconds (WEBHOOK_DEDUP_WINDOW_SECONDS)", "must not be negative")
+	}
+	for _, cidr := range c.Webhooks.AllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			problems.add("webhooks.allowedCidrs (WEBHOOK_ALLOWED_CIDRS)", "%q is not a CIDR like 10.0.0.0/8", cidr)
+		}
+	}
+	tls := c.Webhooks.TLS
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		problems.add("webhooks.tls.certFile (WEBHOOK_TLS_CERT_FILE)", "must be set together with webhooks.tls.keyFile (WEBHOOK_TLS_KEY_FILE)")
+	}
+	if tls.ClientCAFile != "" && tls.CertFile == "" {
+		problems.add("webhooks.tls.clientCaFile (WEBHOOK_TLS_CLIENT_CA_FILE)", "requires webhooks.tls.certFile (WEBHOOK_TLS_CERT_FILE) to be set")
+	}
+	for _, file := range []struct{ setting, path string }{
+		{"webhooks.tls.certFile (WEBHOOK_TLS_CERT_FILE)", tls.CertFile},
+		{"webhooks.tls.keyFile (WEBHOOK_TLS_KEY_FILE)", tls.KeyFile},
+		{"webhooks.tls.clientCaFile (WEBHOOK_TLS_CLIENT_CA_FILE)", tls.ClientCAFile},
+	} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			problems.add(file.setting, "%q can't be read: %s", file.path, err)
+		}
+	}
+
+	if c.LeaderElection.Enabled {
+		if errs := validation.IsDNS1123Subdomain(c.LeaderElection.LeaseName); len(errs) != 0 {
+			problems.add("leaderElection.leaseName (LEADER_ELECTION_LEASE_NAME)", "%q is not a valid Lease name: %s", c.LeaderElection.LeaseName, strings.Join(errs, ", "))
+		}
+		if c.Webhooks.TLS.ClientCAFile != "" && c.LeaderElection.ClientCertFile == "" {
+			problems.add("leaderElection.clientCertFile (LEADER_ELECTION_CLIENT_CERT_FILE)", "must be set if webhooks.tls.clientCaFile (WEBHOOK_TLS_CLIENT_CA_FILE) is set, as the leader requires a client certificate of forwarded hooks")
+		}
+	}
+	if (c.LeaderElection.ClientCertFile == "") != (c.LeaderElection.ClientKeyFile == "") {
+		problems.add("leaderElection.clientCertFile (LEADER_ELECTION_CLIENT_CERT_FILE)", "must be set together with leaderElection.clientKeyFile (LEADER_ELECTION_CLIENT_KEY_FILE)")
+	}
+	for _, cidr := range c.LeaderElection.ForwardingCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			problems.add("leaderElection.forwardingCidrs (LEADER_ELECTION_FORWARDING_CIDRS)", "%q is not a CIDR like 10.244.0.0/16", cidr)
+		}
+	}
+
+	if c.Users.StateCheckIntervalMinutes < 0 {
+		problems.add("users.stateCheckIntervalMinutes (USER_STATE_CHECK_INTERVAL_MINUTES)", "must not be negative, use 0 to disable the check")
+	}
+	if c.ReviewNamespaces.TTLHours < 0 {
+		problems.add("reviewNamespaces.ttlHours (REVIEW_NAMESPACE_TTL_HOURS)", "must not be negative, use 0 to disable the TTL")
+	}
+}
+
+// Quantity parses a resource quantity like 150m or 1Gi. Plain numbers are interpreted in the given unit.
+func Quantity(value, unit string) (resource.Quantity, error) {
+	if _, err := strconv.Atoi(value); err == nil {
+		value += unit
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return quantity, errors.Errorf("%q is not a resource quantity like 150m or 128Mi", value)
+	}
+	if quantity.Sign() <= 0 {
+		return quantity, errors.Errorf("%q must be greater than 0", value)
+	}
+	return quantity, nil
+}
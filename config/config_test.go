@@ -0,0 +1,133 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func setEnv(t *testing.T, env map[string]string) func() {
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestLoadFileWithEnvOverrides(t *testing.T) {
+	path := writeConfigFile(t, `
+gitlab:
+  hostname: gitlab.example.com
+  privateToken: file-token
+  secretToken: hook-token
+roles:
+  groupMaster: custom-group-master
+namespaces:
+  limitRanges:
+    enabled: true
+    defaultCpuLimit: 500m
+`)
+	defer os.Remove(path)
+	defer setEnv(t, map[string]string{"GITLAB_PRIVATE_TOKEN": "env-token", "DEFAULT_MEM_LIM": "256", "WEBHOOK_WORKERS": "8"})()
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Gitlab.Hostname != "gitlab.example.com" || cfg.Gitlab.PrivateToken != "env-token" {
+		t.Errorf("Expected hostname from file and token from env, got %+v", cfg.Gitlab)
+	}
+	if cfg.Gitlab.APIVersion != "v4" || cfg.Roles.GroupDeveloper != "gitlab-group-developer" {
+		t.Error("Expected defaults for settings neither in file nor env")
+	}
+	if cfg.Roles.GroupMaster != "custom-group-master" || !cfg.Namespaces.LimitRanges.Enabled || cfg.Webhooks.Workers != 8 {
+		t.Errorf("Unexpected config %+v", cfg)
+	}
+	memLimit, err := Quantity(cfg.Namespaces.LimitRanges.DefaultMemoryLimit, "Mi")
+	if err != nil || memLimit.String() != "256Mi" {
+		t.Errorf("Expected plain number to be interpreted as Mi, got %s (%v)", memLimit.String(), err)
+	}
+}
+
+func TestLoadReportsAllProblems(t *testing.T) {
+	defer setEnv(t, map[string]string{
+		"GITLAB_HOSTNAME":               "gitlab.example.com",
+		"DEFAULT_CPU_LIM":               "150mm",
+		"DEFAULT_CPU_REQ":               "1",
+		"ENABLE_SYNC_ENDPOINT":          "yes",
+		"GITLAB_SERVICEACCOUNT_NAME":    "Gitlab_SA",
+		"GITLAB_MEMBERSHIP_INHERITANCE": "parent",
+	})()
+
+	_, err := Load("")
+	validationErr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("Expected a ValidationError, got %v", err)
+	}
+	for _, expected := range []string{"GITLAB_PRIVATE_TOKEN", "GITLAB_SECRET_TOKEN", "DEFAULT_CPU_LIM", "ENABLE_SYNC_ENDPOINT", "GITLAB_SERVICEACCOUNT_NAME", "GITLAB_MEMBERSHIP_INHERITANCE"} {
+		if !strings.Contains(validationErr.Error(), expected) {
+			t.Errorf("Expected problem with %s to be reported, got:\n%s", expected, validationErr)
+		}
+	}
+	if len(validationErr.Problems) != 6 {
+		t.Errorf("Expected 6 problems, got:\n%s", validationErr)
+	}
+}
+
+func TestLoadRejectsUnknownKeys(t *testing.T) {
+	path := writeConfigFile(t, "gitlab:\n  hostnam: gitlab.example.com\n")
+	defer os.Remove(path)
+
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "hostnam") {
+		t.Errorf("Expected unknown key to be rejected, got %v", err)
+	}
+}
+
+func TestLoadListsFromEnv(t *testing.T) {
+	defer setEnv(t, map[string]string{
+		"GITLAB_HOSTNAME":       "gitlab.example.com",
+		"GITLAB_PRIVATE_TOKEN":  "token",
+		"GITLAB_SECRET_TOKENS":  "old, new",
+		"WEBHOOK_ALLOWED_CIDRS": "10.0.0.0/8,gitlab",
+	})()
+
+	cfg, err := Load("")
+	if len(cfg.Gitlab.SecretTokens) != 2 || cfg.Gitlab.SecretTokens[1] != "new" {
+		t.Errorf("Expected secret tokens old and new, got %v", cfg.Gitlab.SecretTokens)
+	}
+	validationErr, ok := err.(*ValidationError)
+	if !ok || len(validationErr.Problems) != 1 || !strings.Contains(validationErr.Error(), `"gitlab" is not a CIDR`) {
+		t.Errorf("Expected only the invalid CIDR to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package config
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ReadSecretFile reads a credential from a file, without surrounding whitespace like the trailing newline
+func ReadSecretFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "Could not read credential file %s", path)
+	}
+	secret := strings.TrimSpace(string(content))
+	if secret == "" {
+		return "", errors.Errorf("Credential file %s is empty", path)
+	}
+	return secret, nil
+}
+
+// WatchSecretFile reads a credential from a file and passes it to reload. The file is checked for changes in the given
+// interval, e.g. when the K8s Secret it is mounted from has been updated, and reload is called again with the changed
+// credential. A file which can't be read or is empty on a later check keeps the last credential in use.
+func WatchSecretFile(path string, interval time.Duration, reload func(secret string)) error {
+	secret, err := ReadSecretFile(path)
+	if err != nil {
+		return err
+	}
+	reload(secret)
+	hash := sha256.Sum256([]byte(secret))
+
+	go func() {
+		for range time.Tick(interval) {
+			secret, err := ReadSecretFile(path)
+			if err != nil {
+				log.Println(fmt.Sprintf("WARNING: Keeping the current credential. Err: %s", err))
+				continue
+			}
+			if changed := sha256.Sum256([]byte(secret)); changed != hash {
+				hash = changed
+				log.Println("Reloading changed credential file " + path)
+				reload(secret)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,61 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatchSecretFileReloadsChanges(t *testing.T) {
+	file, err := ioutil.TempFile("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("old-token\n")
+	file.Close()
+
+	secrets := make(chan string, 10)
+	if err := WatchSecretFile(file.Name(), 10*time.Millisecond, func(secret string) { secrets <- secret }); err != nil {
+		t.Fatal(err)
+	}
+	if secret := <-secrets; secret != "old-token" {
+		t.Errorf("Expected the initial secret without newline, got %q", secret)
+	}
+
+	// an empty file, e.g. while the Secret is updated, keeps the current secret
+	ioutil.WriteFile(file.Name(), []byte(""), 0600)
+	time.Sleep(30 * time.Millisecond)
+	ioutil.WriteFile(file.Name(), []byte("new-token"), 0600)
+
+	select {
+	case secret := <-secrets:
+		if secret != "new-token" {
+			t.Errorf("Expected the changed secret, got %q", secret)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected the changed secret to be reloaded")
+	}
+}
+
+func TestWatchSecretFileRequiresFile(t *testing.T) {
+	if err := WatchSecretFile("/does/not/exist", time.Second, func(string) {}); err == nil {
+		t.Error("Expected a missing credential file to be reported")
+	}
+}
@@ -2,16 +2,40 @@ package gitlabclient
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
-	"os"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/metrics"
+	"github.com/pkg/errors"
 )
 
-const UserStateBlocked = "blocked"
+const (
+	UserStateBlocked     = "blocked"
+	UserStateBanned      = "banned"
+	UserStateDeactivated = "deactivated"
+)
+
+// IsInactiveUserState returns true for all states in which a user must not have access to the cluster
+func IsInactiveUserState(state string) bool {
+	switch state {
+	case UserStateBlocked, UserStateBanned, UserStateDeactivated, "ldap_blocked", "blocked_pending_approval":
+		return true
+	}
+	return false
+}
 
 type GitlabGroup struct {
 	Id       int
 	FullPath string `json:"full_path"`
 	Members  []Member
+	// MembersError is set if the members of the group could not be retrieved
+	MembersError error `json:"-"`
 }
 
 type GitlabProject struct {
@@ -21,6 +45,8 @@ type GitlabProject struct {
 	Links             Links     `json:"_links"`
 	Namespace         Namespace `json:"namespace"`
 	Path              string    `json:"path"`
+	// MembersError is set if the members of the project could not be retrieved
+	MembersError error `json:"-"`
 }
 
 type Namespace struct {
@@ -36,10 +62,18 @@ type Links struct {
 }
 
 type GitlabUser struct {
+	Id       int    `json:"id"`
 	Username string `json:"username"`
 	State    string `json:"state"`
 }
 
+// GitlabMergeRequest is a merge request of a project, identified by its iid within the project
+type GitlabMergeRequest struct {
+	Iid       int    `json:"iid"`
+	ProjectId int    `json:"project_id"`
+	State     string `json:"state"`
+}
+
 type Member struct {
 	Id          int    `json:"id"`
 	Username    string `json:"username"`
@@ -48,37 +82,105 @@ type Member struct {
 	AccessLevel int    `json:"access_level"`
 }
 
-type GitlabContent struct {
-	Groups   []GitlabGroup
-	Projects []GitlabProject
-	Users    []GitlabUser
+func check(err error) bool {
+	if err != nil {
+		log.Println("Error : ", err.Error())
+		return true
+	}
+	return false
 }
 
-func contains(s []Member, e Member) bool {
-	for _, a := range s {
-		if a.Id == e.Id {
-			return true
-		}
+// getGitlabUrl returns the url of Gitlab, without trailing slash
+func getGitlabUrl() (string, error) {
+	gitlab := config.Get().Gitlab
+	if gitlab.URL != "" {
+		return strings.TrimRight(gitlab.URL, "/"), nil
 	}
-	return false
+	if gitlab.Hostname == "" {
+		return "", errors.New("The Gitlab hostname has not been configured!")
+	}
+	return "https://" + gitlab.Hostname, nil
 }
 
-func check(err error) bool {
+// getGitlabBaseUrl returns the url of the Gitlab API, ending with a slash
+func getGitlabBaseUrl() (string, error) {
+	gitlabUrl, err := getGitlabUrl()
 	if err != nil {
-		log.Println("Error : ", err.Error())
-		return true
+		return "", err
 	}
-	return false
+	return fmt.Sprintf("%s/api/%s/", gitlabUrl, config.Get().Gitlab.APIVersion), nil
 }
 
-func getGitlabBaseUrl() string {
-	apiVersion := os.Getenv("GITLAB_API_VERSION")
-	if apiVersion == "" {
-		apiVersion = "v4"
+// doGitlabRequest authorizes and performs a request against the Gitlab API and records its outcome and latency. The
+// request is paced by the rate limit of Gitlab and retried with backoff on 429, 5xx answers and network errors.
+func doGitlabRequest(req *http.Request) (*http.Response, error) {
+	return sendGitlabRequest(req, authorize)
+}
+
+// sendGitlabRequest performs a request like doGitlabRequest. If authorize is set, it is called before every attempt,
+// so a retry never goes out with a token which expired during the backoff.
+func sendGitlabRequest(req *http.Request, authorize func(*http.Request) error) (*http.Response, error) {
+	endpoint := endpointLabel(req.URL.Path)
+	req.Header.Set("User-Agent", config.Get().Gitlab.HTTP.UserAgent)
+	for retry := 1; ; retry++ {
+		if authorize != nil {
+			if err := authorize(req); err != nil {
+				return nil, err
+			}
+		}
+		throttle.wait()
+		start := time.Now()
+		resp, err := getHTTPClient().Do(req)
+		metrics.GitlabRequestDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+		code := "error"
+		if err == nil {
+			code = strconv.Itoa(resp.StatusCode)
+			throttle.update(resp.Header, time.Now())
+		}
+		metrics.GitlabRequests.WithLabelValues(endpoint, code).Inc()
+
+		if retry > config.Get().Gitlab.MaxRetries || !retryable(resp, err) {
+			return resp, err
+		}
+		// a request with a body can only be repeated if the body can be read again
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return resp, err
+			}
+			body, bodyErr := req.GetBody()
+			if bodyErr != nil {
+				return resp, err
+			}
+			req.Body = body
+		}
+
+		delay := retryDelay(resp, retry, time.Now())
+		if err == nil {
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusTooManyRequests {
+				throttle.pause(time.Now().Add(delay))
+			}
+		}
+		log.Println(fmt.Sprintf("WARNING: Request to Gitlab endpoint %s failed with %s, retry %d in %s", endpoint, code, retry, delay))
+		metrics.GitlabRequestRetries.WithLabelValues(endpoint).Inc()
+		time.Sleep(delay)
 	}
-	hostName := os.Getenv("GITLAB_HOSTNAME")
-	if hostName == "" {
-		log.Fatal("The GITLAB_HOSTNAME ENV has not been set!")
+}
+
+var (
+	apiPrefix      = regexp.MustCompile(`^.*/api/v\d+/`)
+	numericSegment = regexp.MustCompile(`^\d+$`)
+)
+
+// endpointLabel reduces a request path to its endpoint, e.g. /api/v4/projects/42/members becomes projects/:id/members,
+// so the metrics do not get a label value per entity
+func endpointLabel(path string) string {
+	segments := strings.Split(strings.Trim(apiPrefix.ReplaceAllString(path, ""), "/"), "/")
+	for i, segment := range segments {
+		if numericSegment.MatchString(segment) {
+			segments[i] = ":id"
+		}
 	}
-	return fmt.Sprintf("https://%s/api/%s/", hostName, apiVersion)
+	return strings.Join(segments, "/")
 }
@@ -0,0 +1,59 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package gitlabclient
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEndpointLabel(t *testing.T) {
+	cases := map[string]string{
+		"/api/v4/groups":                                "groups",
+		"/api/v4/projects/42/members":                   "projects/:id/members",
+		"/gitlab/api/v4/projects/7/services/kubernetes": "projects/:id/services/kubernetes",
+		"/api/v3/users/":                                "users",
+	}
+	for path, expected := range cases {
+		if actual := endpointLabel(path); actual != expected {
+			t.Errorf("Expected endpoint label %s for path %s, got %s", expected, path, actual)
+		}
+	}
+}
+
+func TestIsInactiveUserState(t *testing.T) {
+	for state, inactive := range map[string]bool{
+		"active":                   false,
+		"":                         false,
+		"blocked":                  true,
+		"ldap_blocked":             true,
+		"blocked_pending_approval": true,
+		"banned":                   true,
+		"deactivated":              true,
+	} {
+		if IsInactiveUserState(state) != inactive {
+			t.Errorf("Expected state %q to be inactive: %t", state, inactive)
+		}
+	}
+}
+
+func TestChangedSinceUrl(t *testing.T) {
+	since := time.Date(2018, 3, 1, 12, 30, 0, 0, time.FixedZone("CET", 3600))
+	url := changedSinceUrl("https://gitlab.example.com/api/v4/projects", "last_activity_after", since)
+	if url != "https://gitlab.example.com/api/v4/projects?last_activity_after=2018-03-01T11%3A30%3A00Z" {
+		t.Errorf("Unexpected url %s", url)
+	}
+}
@@ -0,0 +1,318 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package gitlabclient
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/pkg/errors"
+)
+
+const (
+	// oauth2ExpiryMargin is the time before its expiry at which an OAuth2 access token is requested again
+	oauth2ExpiryMargin = time.Minute
+	// tokenExpiryWarning is the time before the expiry of a token from which a warning is logged at startup
+	tokenExpiryWarning = 7 * 24 * time.Hour
+)
+
+// gitlabCredentials authorizes all requests to Gitlab. Until SetupCredentials is called, e.g. in tests, the configured
+// private token is used.
+type gitlabCredentials struct {
+	lock sync.Mutex
+	// token is the private token, or the current OAuth2 access token
+	token        string
+	expires      time.Time
+	clientSecret string
+	// refreshing is closed once the OAuth2 access token being requested has arrived, it is nil if none is requested
+	refreshing chan struct{}
+}
+
+var credentials = &gitlabCredentials{}
+
+// SetupCredentials loads the credentials configured for Gitlab and starts watching the credential files for changes
+func SetupCredentials() error {
+	cfg := config.Get().Gitlab
+	interval := time.Duration(cfg.CredentialReloadSeconds) * time.Second
+	if cfg.TokenType == config.TokenOAuth2 {
+		credentials.setClientSecret(cfg.OAuth2.ClientSecret)
+		if cfg.OAuth2.ClientSecretFile != "" {
+			return config.WatchSecretFile(cfg.OAuth2.ClientSecretFile, interval, credentials.setClientSecret)
+		}
+		return nil
+	}
+	credentials.setToken(cfg.PrivateToken)
+	if cfg.PrivateTokenFile != "" {
+		return config.WatchSecretFile(cfg.PrivateTokenFile, interval, credentials.setToken)
+	}
+	return nil
+}
+
+func (c *gitlabCredentials) setToken(token string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.token = token
+}
+
+// setClientSecret replaces the OAuth2 client secret, the next request gets an access token with the new secret
+func (c *gitlabCredentials) setClientSecret(secret string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.clientSecret = secret
+	c.token = ""
+}
+
+// authorize adds the token to a request to Gitlab. An OAuth2 access token is requested if there is none yet or it is
+// about to expire. Concurrent requests wait for it instead of requesting their own.
+func authorize(req *http.Request) error {
+	return credentials.authorize(req)
+}
+
+func (c *gitlabCredentials) authorize(req *http.Request) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if config.Get().Gitlab.TokenType != config.TokenOAuth2 {
+		token := c.token
+		if token == "" {
+			token = config.Get().Gitlab.PrivateToken
+		}
+		req.Header.Set("PRIVATE-TOKEN", token)
+		return nil
+	}
+
+	// the token is requested without holding the lock, so a slow token endpoint neither blocks the reload of the
+	// client secret nor other requests with a valid token
+	for c.token == "" || (!c.expires.IsZero() && time.Now().After(c.expires.Add(-oauth2ExpiryMargin))) {
+		if refreshing := c.refreshing; refreshing != nil {
+			c.lock.Unlock()
+			<-refreshing
+			c.lock.Lock()
+			continue
+		}
+		refreshing := make(chan struct{})
+		c.refreshing = refreshing
+		secret := c.clientSecret
+		c.lock.Unlock()
+		token, expires, err := requestOAuth2Token(secret)
+		c.lock.Lock()
+		c.refreshing = nil
+		close(refreshing)
+		if err != nil {
+			return err
+		}
+		// a token for a replaced secret is dropped, the loop requests one with the new secret
+		if secret == c.clientSecret {
+			c.token, c.expires = token, expires
+		}
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	return nil
+}
+
+// requestOAuth2Token requests an access token by the client credentials grant. It returns the token and its expiry,
+// which is zero if Gitlab doesn't tell.
+func requestOAuth2Token(clientSecret string) (string, time.Time, error) {
+	cfg := config.Get().Gitlab.OAuth2
+	tokenUrl := cfg.TokenURL
+	if tokenUrl == "" {
+		gitlabUrl, err := getGitlabUrl()
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		tokenUrl = gitlabUrl + "/oauth/token"
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {cfg.ClientID},
+		"client_secret": {clientSecret},
+	}
+	if len(cfg.Scopes) > 0 {
+		form.Set("scope", strings.Join(cfg.Scopes, " "))
+	}
+	req, err := http.NewRequest(http.MethodPost, tokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "Error while creating OAuth2 token request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := sendGitlabRequest(req, nil)
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "Could not request OAuth2 access token")
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "Could not read OAuth2 access token")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, errors.Errorf("OAuth2 token request failed with status %d: %s", resp.StatusCode, body)
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &token); err != nil || token.AccessToken == "" {
+		return "", time.Time{}, errors.New("OAuth2 token response contains no access token")
+	}
+
+	var expires time.Time
+	if token.ExpiresIn > 0 {
+		expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	return token.AccessToken, expires, nil
+}
+
+// mayImpersonate returns true if requests may act on behalf of other users via the Sudo header, which requires the
+// personal access token of an admin
+func mayImpersonate() bool {
+	return config.Get().Gitlab.TokenType == config.TokenPersonal
+}
+
+// tokenInfo is what Gitlab tells about the token in use
+type tokenInfo struct {
+	Scopes  []string
+	Active  bool
+	Expires time.Time
+}
+
+// requiredScopes returns the scopes the integrator needs. Setting up the K8s integration and environments of projects
+// requires write access, otherwise read access suffices.
+func requiredScopes() []string {
+	cfg := config.Get()
+	if cfg.Kubernetes.ExternalAPIURL != "" || cfg.Gitlab.EnvironmentName != "" {
+		return []string{"api"}
+	}
+	return []string{"read_api"}
+}
+
+// checkToken returns an error if the token can't be used by the integrator and a warning if it expires soon
+func checkToken(info tokenInfo, required []string, now time.Time) (string, error) {
+	if !info.Active {
+		return "", errors.New("The Gitlab token is revoked or inactive")
+	}
+	if !info.Expires.IsZero() && !now.Before(info.Expires) {
+		return "", errors.Errorf("The Gitlab token expired on %s", info.Expires.Format("2006-01-02"))
+	}
+	granted := map[string]bool{}
+	for _, scope := range info.Scopes {
+		granted[scope] = true
+	}
+	var missing []string
+	for _, scope := range required {
+		// api includes read_api
+		if !granted[scope] && !(scope == "read_api" && granted["api"]) {
+			missing = append(missing, scope)
+		}
+	}
+	if len(missing) > 0 {
+		return "", errors.Errorf("The Gitlab token lacks the scopes %s, it has %s", strings.Join(missing, ", "), strings.Join(info.Scopes, ", "))
+	}
+	if !info.Expires.IsZero() && info.Expires.Sub(now) < tokenExpiryWarning {
+		return fmt.Sprintf("The Gitlab token expires on %s, replace it in time", info.Expires.Format("2006-01-02")), nil
+	}
+	return "", nil
+}
+
+// CheckCredentials checks at startup that the token is active, not expired and has the scopes the integrator needs.
+// A token expiring within a week is only logged. If Gitlab can't tell about the token, e.g. as it is too old to know
+// the endpoint or not reachable, the check is skipped with a warning.
+func CheckCredentials() error {
+	info, err := getTokenInfo()
+	if err != nil {
+		return err
+	}
+	if info == nil {
+		return nil
+	}
+	warning, err := checkToken(*info, requiredScopes(), time.Now())
+	if warning != "" {
+		log.Println("WARNING: " + warning)
+	}
+	return err
+}
+
+// getTokenInfo asks Gitlab about the token in use. It returns nil, if Gitlab could not tell.
+func getTokenInfo() (*tokenInfo, error) {
+	infoUrl, err := getGitlabBaseUrl()
+	if err != nil {
+		return nil, err
+	}
+	if config.Get().Gitlab.TokenType == config.TokenOAuth2 {
+		if infoUrl, err = getGitlabUrl(); err != nil {
+			return nil, err
+		}
+		infoUrl += "/oauth/token/info"
+	} else {
+		infoUrl += "personal_access_tokens/self"
+	}
+
+	resp, err := performGitlabHTTPRequest(infoUrl)
+	if err != nil {
+		log.Println("WARNING: Could not check the Gitlab token. Err: " + err.Error())
+		return nil, nil
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return nil, errors.New("The Gitlab token was rejected by Gitlab")
+	case resp.StatusCode != http.StatusOK:
+		log.Println(fmt.Sprintf("WARNING: Could not check the Gitlab token, Gitlab answered with status %d", resp.StatusCode))
+		return nil, nil
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Println("WARNING: Could not check the Gitlab token. Err: " + err.Error())
+		return nil, nil
+	}
+
+	if config.Get().Gitlab.TokenType == config.TokenOAuth2 {
+		// OAuth2 access tokens are requested again before they expire, so only their scopes matter
+		var oauth2Info struct {
+			Scope  []string `json:"scope"`
+			Scopes []string `json:"scopes"`
+		}
+		if err := json.Unmarshal(body, &oauth2Info); err != nil {
+			return nil, errors.Wrap(err, "Could not decode the Gitlab token info")
+		}
+		return &tokenInfo{Scopes: append(oauth2Info.Scope, oauth2Info.Scopes...), Active: true}, nil
+	}
+
+	var tokenSelf struct {
+		Scopes    []string `json:"scopes"`
+		Active    bool     `json:"active"`
+		Revoked   bool     `json:"revoked"`
+		ExpiresAt string   `json:"expires_at"`
+	}
+	if err := json.Unmarshal(body, &tokenSelf); err != nil {
+		return nil, errors.Wrap(err, "Could not decode the Gitlab token info")
+	}
+	info := &tokenInfo{Scopes: tokenSelf.Scopes, Active: tokenSelf.Active && !tokenSelf.Revoked}
+	if tokenSelf.ExpiresAt != "" {
+		if info.Expires, err = time.Parse("2006-01-02", tokenSelf.ExpiresAt); err != nil {
+			return nil, errors.Wrap(err, "Could not decode the expiry of the Gitlab token")
+		}
+	}
+	return info, nil
+}
@@ -0,0 +1,222 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package gitlabclient
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+)
+
+func TestCheckToken(t *testing.T) {
+	now := time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name     string
+		info     tokenInfo
+		required []string
+		warning  bool
+		err      bool
+	}{
+		{"valid", tokenInfo{Scopes: []string{"api"}, Active: true}, []string{"api"}, false, false},
+		{"api includes read_api", tokenInfo{Scopes: []string{"api"}, Active: true}, []string{"read_api"}, false, false},
+		{"missing scope", tokenInfo{Scopes: []string{"read_api"}, Active: true}, []string{"api"}, false, true},
+		{"revoked", tokenInfo{Scopes: []string{"api"}}, []string{"api"}, false, true},
+		{"expired", tokenInfo{Scopes: []string{"api"}, Active: true, Expires: now.Add(-time.Hour)}, []string{"api"}, false, true},
+		{"expires soon", tokenInfo{Scopes: []string{"api"}, Active: true, Expires: now.Add(48 * time.Hour)}, []string{"api"}, true, false},
+		{"expires later", tokenInfo{Scopes: []string{"api"}, Active: true, Expires: now.Add(30 * 24 * time.Hour)}, []string{"api"}, false, false},
+	}
+	for _, c := range cases {
+		warning, err := checkToken(c.info, c.required, now)
+		if (warning != "") != c.warning || (err != nil) != c.err {
+			t.Errorf("%s: unexpected warning %q and error %v", c.name, warning, err)
+		}
+	}
+}
+
+func TestOAuth2TokenIsRequestedAgainAfterSecretChange(t *testing.T) {
+	defer config.Set(config.Default())
+	defer func() { credentials = &gitlabCredentials{} }()
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("grant_type") != "client_credentials" || r.Form.Get("client_id") != "integrator" || r.Form.Get("scope") != "api" {
+			t.Errorf("Unexpected token request %v", r.Form)
+		}
+		requests++
+		fmt.Fprintf(w, `{"access_token": "token-%s", "token_type": "Bearer", "expires_in": 7200}`, r.Form.Get("client_secret"))
+	}))
+	defer ts.Close()
+
+	cfg := config.Default()
+	cfg.Gitlab.URL = ts.URL
+	cfg.Gitlab.TokenType = config.TokenOAuth2
+	cfg.Gitlab.OAuth2.ClientID = "integrator"
+	cfg.Gitlab.OAuth2.ClientSecret = "first"
+	config.Set(cfg)
+	if err := SetupCredentials(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"Bearer token-first", "Bearer token-first"} {
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		if err := authorize(req); err != nil {
+			t.Fatal(err)
+		}
+		if actual := req.Header.Get("Authorization"); actual != expected {
+			t.Errorf("Expected %s, got %s", expected, actual)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Expected the access token to be reused, but it was requested %d times", requests)
+	}
+
+	credentials.setClientSecret("second")
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	if err := authorize(req); err != nil {
+		t.Fatal(err)
+	}
+	if actual := req.Header.Get("Authorization"); actual != "Bearer token-second" {
+		t.Errorf("Expected an access token for the new secret, got %s", actual)
+	}
+	if req.Header.Get("PRIVATE-TOKEN") != "" {
+		t.Error("Expected no private token with OAuth2")
+	}
+}
+
+func TestAuthorizeUsesReloadedPrivateToken(t *testing.T) {
+	defer config.Set(config.Default())
+	defer func() { credentials = &gitlabCredentials{} }()
+
+	cfg := config.Default()
+	cfg.Gitlab.PrivateToken = "configured"
+	config.Set(cfg)
+
+	req, _ := http.NewRequest("GET", "https://gitlab.example.com", nil)
+	authorize(req)
+	if req.Header.Get("PRIVATE-TOKEN") != "configured" {
+		t.Errorf("Expected the configured token, got %s", req.Header.Get("PRIVATE-TOKEN"))
+	}
+
+	credentials.setToken("rotated")
+	authorize(req)
+	if req.Header.Get("PRIVATE-TOKEN") != "rotated" {
+		t.Errorf("Expected the reloaded token, got %s", req.Header.Get("PRIVATE-TOKEN"))
+	}
+}
+
+func TestOAuth2TokenIsRequestedWithoutHoldingTheLock(t *testing.T) {
+	defer config.Set(config.Default())
+	defer func() { credentials = &gitlabCredentials{} }()
+
+	var lock sync.Mutex
+	requests := 0
+	arrived := make(chan struct{})
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		lock.Lock()
+		requests++
+		first := requests == 1
+		lock.Unlock()
+		if first {
+			close(arrived)
+			<-release
+		}
+		fmt.Fprintf(w, `{"access_token": "token-%s", "expires_in": 7200}`, r.Form.Get("client_secret"))
+	}))
+	defer ts.Close()
+
+	cfg := config.Default()
+	cfg.Gitlab.URL = ts.URL
+	cfg.Gitlab.TokenType = config.TokenOAuth2
+	cfg.Gitlab.OAuth2.ClientSecret = "first"
+	config.Set(cfg)
+	if err := SetupCredentials(); err != nil {
+		t.Fatal(err)
+	}
+
+	headers := make(chan string, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			req, _ := http.NewRequest("GET", ts.URL, nil)
+			if err := authorize(req); err != nil {
+				t.Error(err)
+			}
+			headers <- req.Header.Get("Authorization")
+		}()
+	}
+
+	// the secret can be replaced while the token endpoint hangs
+	<-arrived
+	replaced := make(chan struct{})
+	go func() {
+		credentials.setClientSecret("second")
+		close(replaced)
+	}()
+	select {
+	case <-replaced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the client secret to be replaced while the token is requested")
+	}
+	close(release)
+
+	for i := 0; i < 3; i++ {
+		if actual := <-headers; actual != "Bearer token-second" {
+			t.Errorf("Expected the token of the replaced secret to be dropped, got %s", actual)
+		}
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if requests != 2 {
+		t.Errorf("Expected concurrent requests to share the token request, but it was requested %d times", requests)
+	}
+}
+
+func TestRetriedRequestsAreAuthorizedAgain(t *testing.T) {
+	defer config.Set(config.Default())
+	defer func() { credentials = &gitlabCredentials{} }()
+
+	var tokens []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get("PRIVATE-TOKEN"))
+		if len(tokens) == 1 {
+			credentials.setToken("rotated")
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	cfg := config.Default()
+	cfg.Gitlab.PrivateToken = "configured"
+	cfg.Gitlab.MaxRetries = 1
+	config.Set(cfg)
+
+	resp, err := performGitlabHTTPRequest(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(tokens) != 2 || tokens[0] != "configured" || tokens[1] != "rotated" {
+		t.Errorf("Expected the retry to carry the current token, got %v", tokens)
+	}
+}
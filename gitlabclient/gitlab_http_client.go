@@ -0,0 +1,99 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package gitlabclient
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/pkg/errors"
+)
+
+var (
+	httpClientLock sync.RWMutex
+	// httpClient is used until SetHTTPClient is called, e.g. in tests
+	httpClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// NewHTTPClient creates the client for all requests to Gitlab from its configuration
+func NewHTTPClient(cfg config.GitlabHTTP, workers int) (*http.Client, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not read Gitlab CA bundle")
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, errors.New("Gitlab CA bundle " + cfg.CAFile + " contains no PEM certificate")
+		}
+	}
+	tlsCfg := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	if cfg.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not load Gitlab client certificate")
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if cfg.Proxy != "" {
+		proxyUrl, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid Gitlab proxy")
+		}
+		proxy = http.ProxyURL(proxyUrl)
+	}
+
+	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsCfg,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		// keep a connection for each worker fetching members, besides the one reading the list
+		MaxIdleConnsPerHost: workers + 1,
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// SetHTTPClient sets the client for all requests to Gitlab
+func SetHTTPClient(client *http.Client) {
+	httpClientLock.Lock()
+	defer httpClientLock.Unlock()
+	httpClient = client
+}
+
+func getHTTPClient() *http.Client {
+	httpClientLock.RLock()
+	defer httpClientLock.RUnlock()
+	return httpClient
+}
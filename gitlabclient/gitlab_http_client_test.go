@@ -0,0 +1,89 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package gitlabclient
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+)
+
+func TestGetGitlabBaseUrl(t *testing.T) {
+	defer config.Set(config.Default())
+	cfg := config.Default()
+	cfg.Gitlab.Hostname = "gitlab.example.com"
+	config.Set(cfg)
+	if url, _ := getGitlabBaseUrl(); url != "https://gitlab.example.com/api/v4/" {
+		t.Errorf("Expected https url of the hostname, got %s", url)
+	}
+
+	cfg.Gitlab.URL = "http://localhost:8080/gitlab/"
+	if url, _ := getGitlabBaseUrl(); url != "http://localhost:8080/gitlab/api/v4/" {
+		t.Errorf("Expected the configured url to take precedence, got %s", url)
+	}
+}
+
+func TestHTTPClientTrustsCABundle(t *testing.T) {
+	defer config.Set(config.Default())
+	defer SetHTTPClient(getHTTPClient())
+
+	userAgent := ""
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+	}))
+	defer ts.Close()
+
+	caFile, err := ioutil.TempFile("", "gitlab-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	caFile.Close()
+
+	cfg := config.Default()
+	cfg.Gitlab.MaxRetries = 0
+	cfg.Gitlab.HTTP.CAFile = caFile.Name()
+	config.Set(cfg)
+
+	client, err := NewHTTPClient(cfg.Gitlab.HTTP, cfg.Gitlab.Workers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Timeout != 30*time.Second {
+		t.Errorf("Expected the default timeout of 30s, got %s", client.Timeout)
+	}
+	SetHTTPClient(client)
+
+	resp, err := performGitlabHTTPRequest(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if userAgent != "gitlab-k8s-integrator" {
+		t.Errorf("Expected the configured User-Agent, got %q", userAgent)
+	}
+
+	if _, err := NewHTTPClient(config.GitlabHTTP{CAFile: "/does/not/exist"}, 1); err == nil {
+		t.Error("Expected a missing CA bundle to be reported")
+	}
+}
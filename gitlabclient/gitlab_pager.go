@@ -0,0 +1,99 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package gitlabclient
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"strconv"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/peterhellberg/link"
+	"github.com/pkg/errors"
+)
+
+// perPage is the largest page size Gitlab allows
+const perPage = 100
+
+// gitlabPager reads a Gitlab list page by page. Gitlab sends the url of the following page as next link for offset
+// and keyset pagination alike, so the pager just follows it until the last page.
+type gitlabPager struct {
+	url string
+	err error
+}
+
+// newGitlabPager returns a pager for the list at listUrl. With keyset pagination configured, the list is ordered by
+// the given attribute, which must be supported by the keyset pagination of the list. Lists without keyset pagination,
+// like members, pass an empty order and are always read by offset.
+func newGitlabPager(listUrl, keysetOrder string) *gitlabPager {
+	u, err := url.Parse(listUrl)
+	if err != nil {
+		return &gitlabPager{err: errors.Wrap(err, "invalid Gitlab list url")}
+	}
+	query := u.Query()
+	query.Set("per_page", strconv.Itoa(perPage))
+	if keysetOrder != "" && config.Get().Gitlab.Pagination == config.PaginationKeyset {
+		query.Set("pagination", "keyset")
+		query.Set("order_by", keysetOrder)
+		query.Set("sort", "asc")
+	}
+	u.RawQuery = query.Encode()
+	return &gitlabPager{url: u.String()}
+}
+
+// next reads the next page into page, which must point to a slice. It returns false once the last page has been read
+// or reading failed, which is reported by err.
+func (p *gitlabPager) next(page interface{}) bool {
+	if p.err != nil || p.url == "" {
+		return false
+	}
+	result, err := performGitlabHTTPRequest(p.url)
+	if check(err) {
+		log.Println("Error occured while calling Gitlab! Cancelling Sync! Err:" + err.Error())
+		p.err = err
+		return false
+	}
+	defer result.Body.Close()
+	switch {
+	case result.StatusCode == 401:
+		p.err = errors.New("GITLAB_PRIVATE_TOKEN was not set or wrong. Stopping now.")
+	case result.StatusCode == 404:
+		p.err = errors.New("The requested URL was invalid! Stopping now. Url was: " + p.url)
+	case result.StatusCode >= 400:
+		p.err = errors.Errorf("Gitlab answered %s for %s", result.Status, p.url)
+	}
+	if p.err != nil {
+		return false
+	}
+
+	content, err := ioutil.ReadAll(result.Body)
+	if check(err) {
+		p.err = err
+		return false
+	}
+	if err := json.Unmarshal(content, page); check(err) {
+		p.err = err
+		return false
+	}
+
+	p.url = ""
+	if next := link.ParseHeader(result.Header)["next"]; next != nil {
+		p.url = next.URI
+	}
+	return true
+}
@@ -0,0 +1,141 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package gitlabclient
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+)
+
+func TestGitlabPagerRequestsKeysetPages(t *testing.T) {
+	cfg := config.Default()
+	cfg.Gitlab.Pagination = config.PaginationKeyset
+	config.Set(cfg)
+	defer config.Set(config.Default())
+
+	pager := newGitlabPager("https://gitlab.example.com/api/v4/projects?last_activity_after=2018", "id")
+	expected := "https://gitlab.example.com/api/v4/projects?last_activity_after=2018&order_by=id&pagination=keyset&per_page=100&sort=asc"
+	if pager.url != expected {
+		t.Errorf("Expected url %s, got %s", expected, pager.url)
+	}
+
+	pager = newGitlabPager("https://gitlab.example.com/api/v4/projects/1/members/all", "")
+	if pager.url != "https://gitlab.example.com/api/v4/projects/1/members/all?per_page=100" {
+		t.Errorf("Expected offset pagination for lists without keyset, got %s", pager.url)
+	}
+}
+
+func TestForEachUserKeepsPageOrder(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("per_page") != "100" {
+			t.Errorf("Expected pages of 100 users, got %s", r.URL.RawQuery)
+		}
+		switch r.URL.Query().Get("id_after") {
+		case "":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/users?id_after=2&per_page=100>; rel="next"`, ts.URL))
+			fmt.Fprintln(w, `[{"username": "alice"}, {"username": "bob"}]`)
+		case "2":
+			fmt.Fprintln(w, `[{"username": "carol"}]`)
+		}
+	}))
+	defer ts.Close()
+
+	users, err := GetAllUsers(make([]GitlabUser, 0), ts.URL+"/users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 3 || users[0].Username != "alice" || users[2].Username != "carol" {
+		t.Errorf("Expected the users in the order of their pages, got %+v", users)
+	}
+}
+
+func TestGitlabStreamReportsIncompleteReads(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/users" {
+			fmt.Fprintln(w, `[{"username": "alice"}]`)
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	stream := streamGitlabContent(context.Background(), nil, []projectSource{projectList(ts.URL + "/projects")}, []userSource{userList(ts.URL + "/users")})
+	for range stream.Groups {
+		t.Error("Expected no groups without a group source")
+	}
+	for range stream.Projects {
+		t.Error("Expected no projects from a forbidden list")
+	}
+	users := 0
+	for range stream.Users {
+		users++
+	}
+
+	if users != 1 {
+		t.Errorf("Expected 1 user, got %d", users)
+	}
+	if stream.Err() == nil {
+		t.Error("Expected the forbidden project list to be reported")
+	}
+	if names := stream.Names(); len(names) != 1 || !names["alice"] {
+		t.Errorf("Expected only the name of alice, got %v", names)
+	}
+}
+
+func TestGitlabStreamStopsOnCancel(t *testing.T) {
+	defer config.Set(config.Default())
+	cfg := config.Default()
+	cfg.Gitlab.Pagination = config.PaginationOffset
+	config.Set(cfg)
+
+	pages := 0
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/projects" {
+			fmt.Fprintln(w, `[]`)
+			return
+		}
+		pages++
+		// an endless list of users
+		w.Header().Set("Link", fmt.Sprintf(`<%s/users?page=%d&per_page=100>; rel="next"`, ts.URL, pages+1))
+		fmt.Fprintf(w, `[{"username": "user%d"}]`, pages)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := streamGitlabContent(ctx, nil, []projectSource{projectList(ts.URL + "/projects")}, []userSource{userList(ts.URL + "/users")})
+	for range stream.Projects {
+	}
+	<-stream.Users
+	cancel()
+	for range stream.Users {
+	}
+
+	if stream.Err() != context.Canceled {
+		t.Errorf("Expected the stream to report its cancellation, got %v", stream.Err())
+	}
+	ts.Close()
+	// the endless list ends, only the pages of the buffered users have been read ahead
+	if pages > perPage+2 {
+		t.Errorf("Expected reading to stop on cancel, but %d pages were read", pages)
+	}
+}
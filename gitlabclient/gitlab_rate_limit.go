@@ -0,0 +1,164 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package gitlabclient
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/metrics"
+)
+
+// throttleThreshold is the share of the rate limit below which requests are spread over the rest of the window
+const throttleThreshold = 10
+
+var (
+	// retryBaseDelay is doubled with every retry up to retryMaxDelay, unless Gitlab sends a Retry-After header
+	retryBaseDelay = time.Second
+	retryMaxDelay  = time.Minute
+)
+
+// gitlabThrottle paces all requests to Gitlab by the RateLimit headers of its answers. As long as plenty of requests
+// are remaining, requests are not delayed. Below a tenth of the limit, the remaining requests are spread evenly until
+// the limit resets. After a 429 answer, no request is sent until the time Gitlab asked for.
+type gitlabThrottle struct {
+	lock      sync.Mutex
+	notBefore time.Time
+	next      time.Time
+	interval  time.Duration
+}
+
+var throttle = &gitlabThrottle{}
+
+// reserve returns the time at which the next request may be sent and reserves it
+func (t *gitlabThrottle) reserve(now time.Time) time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	at := now
+	if t.notBefore.After(at) {
+		at = t.notBefore
+	}
+	if t.interval > 0 {
+		if t.next.After(at) {
+			at = t.next
+		}
+		t.next = at.Add(t.interval)
+	}
+	return at
+}
+
+// wait blocks until the next request may be sent
+func (t *gitlabThrottle) wait() {
+	if delay := time.Until(t.reserve(time.Now())); delay > 0 {
+		metrics.GitlabThrottleSeconds.Add(delay.Seconds())
+		time.Sleep(delay)
+	}
+}
+
+// update adapts the pace to the RateLimit headers of an answer. Answers without them leave the pace unchanged.
+func (t *gitlabThrottle) update(header http.Header, now time.Time) {
+	remaining, err := strconv.Atoi(header.Get("RateLimit-Remaining"))
+	if err != nil {
+		return
+	}
+	limit, err := strconv.Atoi(header.Get("RateLimit-Limit"))
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseInt(header.Get("RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	window := time.Unix(reset, 0).Sub(now)
+	if remaining > limit/throttleThreshold || window <= 0 {
+		t.interval = 0
+		return
+	}
+	t.interval = window / time.Duration(remaining+1)
+}
+
+// pause holds back all requests until the given time
+func (t *gitlabThrottle) pause(until time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if until.After(t.notBefore) {
+		t.notBefore = until
+	}
+}
+
+// retryable returns true for answers which may succeed if the request is repeated
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// retryDelay returns the time to wait before the given retry. Gitlab's Retry-After header, given in seconds or as
+// date, or else the reset of its rate limit take precedence over the exponential backoff. The first retry is 1.
+func retryDelay(resp *http.Response, retry int, now time.Time) time.Duration {
+	if resp != nil {
+		if after := resp.Header.Get("Retry-After"); after != "" {
+			if seconds, err := strconv.Atoi(after); err == nil && seconds >= 0 {
+				return time.Duration(seconds) * time.Second
+			}
+			if date, err := http.ParseTime(after); err == nil && date.After(now) {
+				return date.Sub(now)
+			}
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			if reset, err := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64); err == nil && time.Unix(reset, 0).After(now) {
+				return time.Unix(reset, 0).Sub(now)
+			}
+		}
+	}
+	delay := retryBaseDelay
+	for i := 1; i < retry && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay
+}
+
+// forEachConcurrently calls fn for the indices 0 to n-1, with at most workers calls at a time
+func forEachConcurrently(n, workers int, fn func(i int)) {
+	if workers < 1 {
+		workers = 1
+	}
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+}
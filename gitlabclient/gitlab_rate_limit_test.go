@@ -0,0 +1,141 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package gitlabclient
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	backoff := func(code int) *http.Response {
+		return &http.Response{StatusCode: code, Header: http.Header{}}
+	}
+	withHeader := func(code int, key, value string) *http.Response {
+		resp := backoff(code)
+		resp.Header.Set(key, value)
+		return resp
+	}
+
+	cases := []struct {
+		name     string
+		resp     *http.Response
+		retry    int
+		expected time.Duration
+	}{
+		{"first retry", backoff(503), 1, retryBaseDelay},
+		{"third retry", backoff(502), 3, 4 * retryBaseDelay},
+		{"capped", backoff(500), 20, retryMaxDelay},
+		{"connection error", nil, 2, 2 * retryBaseDelay},
+		{"retry after seconds", withHeader(429, "Retry-After", "7"), 1, 7 * time.Second},
+		{"retry after date", withHeader(503, "Retry-After", now.Add(30*time.Second).UTC().Format(http.TimeFormat)), 1, 30 * time.Second},
+		{"rate limit reset", withHeader(429, "RateLimit-Reset", strconv.FormatInt(now.Add(12*time.Second).Unix(), 10)), 1, 12 * time.Second},
+		{"reset ignored without 429", withHeader(503, "RateLimit-Reset", strconv.FormatInt(now.Add(12*time.Second).Unix(), 10)), 1, retryBaseDelay},
+	}
+	for _, c := range cases {
+		if actual := retryDelay(c.resp, c.retry, now); actual != c.expected {
+			t.Errorf("%s: expected delay %s, got %s", c.name, c.expected, actual)
+		}
+	}
+}
+
+func TestGitlabThrottle(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	th := &gitlabThrottle{}
+	header := http.Header{}
+	header.Set("RateLimit-Limit", "600")
+	header.Set("RateLimit-Reset", strconv.FormatInt(now.Add(10*time.Second).Unix(), 10))
+
+	header.Set("RateLimit-Remaining", "300")
+	th.update(header, now)
+	if at := th.reserve(now); !at.Equal(now) {
+		t.Errorf("Expected no delay with plenty of remaining requests, got %s", at.Sub(now))
+	}
+
+	header.Set("RateLimit-Remaining", "4")
+	th.update(header, now)
+	first, second := th.reserve(now), th.reserve(now)
+	if !first.Equal(now) || second.Sub(first) != 2*time.Second {
+		t.Errorf("Expected the remaining requests to be spread by 2s, got %s and %s", first.Sub(now), second.Sub(now))
+	}
+
+	th = &gitlabThrottle{}
+	th.pause(now.Add(5 * time.Second))
+	th.pause(now.Add(time.Second))
+	if at := th.reserve(now); at.Sub(now) != 5*time.Second {
+		t.Errorf("Expected requests to be paused for 5s, got %s", at.Sub(now))
+	}
+}
+
+func TestForEachConcurrently(t *testing.T) {
+	var lock sync.Mutex
+	running, maxRunning := 0, 0
+	done := make([]bool, 10)
+	forEachConcurrently(len(done), 3, func(i int) {
+		lock.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		lock.Lock()
+		running--
+		done[i] = true
+		lock.Unlock()
+	})
+	for i, d := range done {
+		if !d {
+			t.Errorf("Index %d was not processed", i)
+		}
+	}
+	if maxRunning > 3 {
+		t.Errorf("Expected at most 3 concurrent calls, got %d", maxRunning)
+	}
+}
+
+func TestDoGitlabRequestRetries(t *testing.T) {
+	defer func(base time.Duration) { retryBaseDelay = base }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch calls {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte("[]"))
+		}
+	}))
+	defer ts.Close()
+
+	resp, err := performGitlabHTTPRequest(ts.URL + "/api/v4/groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || calls != 3 {
+		t.Errorf("Expected success on the third call, got %d after %d calls", resp.StatusCode, calls)
+	}
+}
@@ -15,142 +15,503 @@
 package gitlabclient
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
+	"net/url"
+	"sort"
 	"strconv"
+	"sync"
+	"time"
 
-	"github.com/peterhellberg/link"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
 	"github.com/pkg/errors"
 )
 
-func GetFullGitlabContent() (*GitlabContent, error) {
-	groupUrl := getGitlabBaseUrl() + "groups"
-	foundGroups, err := GetAllGroups(make([]GitlabGroup, 0), groupUrl)
-	if check(err) {
-		log.Fatal(err.Error())
-	}
-	projectUrl := getGitlabBaseUrl() + "projects"
-	foundProjects, err := GetAllProjects(make([]GitlabProject, 0), projectUrl)
-	if check(err) {
-		log.Fatal(err.Error())
-	}
-	userUrl := getGitlabBaseUrl() + "users"
-	foundUsers, err := GetAllUsers(make([]GitlabUser, 0), userUrl)
+// GitlabStream delivers the groups, projects and users of a sync run while their pages are read from Gitlab, so
+// they can be synced before the last page has arrived. Each channel is closed after its last entity.
+type GitlabStream struct {
+	Groups   <-chan GitlabGroup
+	Projects <-chan GitlabProject
+	Users    <-chan GitlabUser
+
+	wg    sync.WaitGroup
+	lock  sync.Mutex
+	err   error
+	names map[string]bool
+}
+
+// Err waits until all lists have been read and returns the first error. After an error the delivered entities are
+// incomplete.
+func (s *GitlabStream) Err() error {
+	s.wg.Wait()
+	return s.err
+}
+
+// Names waits until all lists have been read and returns the full paths of all delivered groups and projects and the
+// names of all delivered users
+func (s *GitlabStream) Names() map[string]bool {
+	s.wg.Wait()
+	return s.names
+}
+
+// read runs a reader of a list in the background
+func (s *GitlabStream) read(reader func() error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := reader(); err != nil {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			if s.err == nil {
+				s.err = err
+			}
+		}
+	}()
+}
+
+// delivered records the name of a delivered entity
+func (s *GitlabStream) delivered(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.names[name] = true
+}
+
+// StreamFullGitlabContent starts reading all groups, projects and users. Reading stops once ctx is cancelled.
+func StreamFullGitlabContent(ctx context.Context) (*GitlabStream, error) {
+	baseUrl, err := getGitlabBaseUrl()
 	if check(err) {
-		log.Fatal(err.Error())
+		return nil, err
 	}
-	return &GitlabContent{Groups: foundGroups, Projects: foundProjects, Users: foundUsers}, nil
+	return streamGitlabContent(ctx, []groupSource{groupList(baseUrl + "groups")},
+		[]projectSource{projectList(baseUrl + "projects")}, []userSource{userList(baseUrl + "users")}), nil
 }
 
-func GetAllGroups(gitlabGroups []GitlabGroup, url string) ([]GitlabGroup, error) {
-	result, err := performGitlabHTTPRequest(url)
+// ChangedEntities are the ids of groups, projects and users to read, e.g. those known to have changed from hooks
+type ChangedEntities struct {
+	Groups   map[int]bool
+	Projects map[int]bool
+	Users    map[int]bool
+}
 
+// StreamChangedGitlabContent starts reading the entities changed since the given time: the projects updated since
+// then, the users created since then and the given changed entities. Of a changed group, its subgroups and the
+// projects below it are read as well, as they inherit its members. Gitlab can't filter groups and the members of
+// projects by their changes, so they are only read if they are given as changed. Each entity is delivered once.
+func StreamChangedGitlabContent(ctx context.Context, since time.Time, changed ChangedEntities) (*GitlabStream, error) {
+	baseUrl, err := getGitlabBaseUrl()
 	if check(err) {
-		log.Println("Error occured while calling Gitlab! Cancelling Sync! Err:" + err.Error())
 		return nil, err
 	}
-	if result.StatusCode == 401 {
-		return nil, errors.New("GITLAB_PRIVATE_TOKEN was not set or wrong. Stopping now")
-	}
-	content, err := ioutil.ReadAll(result.Body)
-
-	groups := make([]GitlabGroup, 0)
+	groups, projects, users := entitySources(baseUrl, changed)
+	projects = append([]projectSource{projectList(changedSinceUrl(baseUrl+"projects", "updated_after", since))}, projects...)
+	users = append([]userSource{userList(changedSinceUrl(baseUrl+"users", "created_after", since))}, users...)
+	return streamGitlabContent(ctx, groups, projects, users), nil
+}
 
-	err = json.Unmarshal(content, &groups)
+// StreamGitlabEntities starts reading only the given entities. Of a group, its subgroups and the projects below it
+// are read as well, as they inherit its members. Each entity is delivered once.
+func StreamGitlabEntities(ctx context.Context, entities ChangedEntities) (*GitlabStream, error) {
+	baseUrl, err := getGitlabBaseUrl()
 	if check(err) {
 		return nil, err
 	}
+	groups, projects, users := entitySources(baseUrl, entities)
+	return streamGitlabContent(ctx, groups, projects, users), nil
+}
+
+// entitySources returns the sources reading the given entities and the subgroups and projects below the groups
+func entitySources(baseUrl string, entities ChangedEntities) ([]groupSource, []projectSource, []userSource) {
+	groups := []groupSource{}
+	projects := []projectSource{}
+	users := []userSource{}
+	for _, id := range sortedIds(entities.Groups) {
+		groupUrl := fmt.Sprintf("%sgroups/%d", baseUrl, id)
+		groups = append(groups, singleGroup(groupUrl+"?with_projects=false"), subgroupList(groupUrl+"/descendant_groups"))
+		projects = append(projects, subgroupProjectList(groupUrl+"/projects?include_subgroups=true"))
+	}
+	for _, id := range sortedIds(entities.Projects) {
+		projects = append(projects, singleProject(fmt.Sprintf("%sprojects/%d", baseUrl, id)))
+	}
+	for _, id := range sortedIds(entities.Users) {
+		users = append(users, singleUser(fmt.Sprintf("%susers/%d", baseUrl, id)))
+	}
+	return groups, projects, users
+}
 
-	for i := range groups {
-		err := groups[i].getMembers()
-		check(err)
+func sortedIds(ids map[int]bool) []int {
+	sorted := make([]int, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
 	}
+	sort.Ints(sorted)
+	return sorted
+}
 
-	// DEEP APPEND here
-	gitlabGroups = append(gitlabGroups, groups...)
+// groupSource, projectSource and userSource read entities of a stream and call fn for each of them
+type (
+	groupSource   func(fn func(GitlabGroup) error) error
+	projectSource func(fn func(GitlabProject) error) error
+	userSource    func(fn func(GitlabUser) error) error
+)
 
-	group := link.ParseHeader(result.Header)
-	next := group["next"]
-	if next != nil {
-		finalGroups, err := GetAllGroups(gitlabGroups, next.URI)
-		if err != nil {
-			return nil, err
+// groupList reads the top level group list, projectList and userList the top level project and user lists
+func groupList(url string) groupSource {
+	return func(fn func(GitlabGroup) error) error { return ForEachGroup(url, fn) }
+}
+
+func projectList(url string) projectSource {
+	return func(fn func(GitlabProject) error) error { return ForEachProject(url, fn) }
+}
+
+func userList(url string) userSource {
+	return func(fn func(GitlabUser) error) error { return ForEachUser(url, fn) }
+}
+
+// subgroupList and subgroupProjectList read the lists below a group, which have no keyset pagination
+func subgroupList(url string) groupSource {
+	return func(fn func(GitlabGroup) error) error { return forEachGroup(newGitlabPager(url, ""), fn) }
+}
+
+func subgroupProjectList(url string) projectSource {
+	return func(fn func(GitlabProject) error) error { return forEachProject(newGitlabPager(url, ""), fn) }
+}
+
+// singleGroup, singleProject and singleUser read a single entity, which is skipped if it has been deleted meanwhile
+func singleGroup(url string) groupSource {
+	return func(fn func(GitlabGroup) error) error {
+		var group GitlabGroup
+		if found, err := getGitlabEntity(url, &group); !found || err != nil {
+			return err
 		}
-		gitlabGroups = finalGroups
+		group.MembersError = group.getMembers()
+		check(group.MembersError)
+		return fn(group)
 	}
-	return gitlabGroups, nil
 }
 
-func GetAllProjects(gitlabProjects []GitlabProject, url string) ([]GitlabProject, error) {
-	result, err := performGitlabHTTPRequest(url)
+func singleProject(url string) projectSource {
+	return func(fn func(GitlabProject) error) error {
+		var project GitlabProject
+		if found, err := getGitlabEntity(url, &project); !found || err != nil {
+			return err
+		}
+		project.MembersError = project.getMembers()
+		check(project.MembersError)
+		return fn(project)
+	}
+}
 
+func singleUser(url string) userSource {
+	return func(fn func(GitlabUser) error) error {
+		var user GitlabUser
+		if found, err := getGitlabEntity(url, &user); !found || err != nil {
+			return err
+		}
+		return fn(user)
+	}
+}
+
+// getGitlabEntity reads the entity at the given url into entity. It returns false if the entity does not exist.
+func getGitlabEntity(url string, entity interface{}) (bool, error) {
+	resp, err := performGitlabHTTPRequest(url)
 	if check(err) {
-		log.Println("Error occured while calling Gitlab! Cancelling Sync! Err:" + err.Error())
+		return false, err
 	}
-	if result.StatusCode == 401 {
-		return nil, errors.New("GITLAB_PRIVATE_TOKEN was not set or wrong. Stopping now.")
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		log.Println(fmt.Sprintf("INFO: %s has been deleted meanwhile, skipping it", url))
+		return false, nil
+	case resp.StatusCode >= 400:
+		return false, errors.Errorf("Gitlab answered %s for %s", resp.Status, url)
 	}
-	content, err := ioutil.ReadAll(result.Body)
+	if err := json.NewDecoder(resp.Body).Decode(entity); check(err) {
+		return false, errors.Wrapf(err, "Could not decode %s", url)
+	}
+	return true, nil
+}
 
-	projects := make([]GitlabProject, 0)
+// streamGitlabContent starts reading the given sources, one after another per kind of entity. Entities delivered by
+// an earlier source are skipped. At most a page of each list is buffered, so a slow consumer holds back the reading
+// of further pages. Once ctx is cancelled, no further page is read, the channels are closed and Err returns the error
+// of ctx.
+func streamGitlabContent(ctx context.Context, groupSources []groupSource, projectSources []projectSource, userSources []userSource) *GitlabStream {
+	groups := make(chan GitlabGroup, perPage)
+	projects := make(chan GitlabProject, perPage)
+	users := make(chan GitlabUser, perPage)
+	s := &GitlabStream{Groups: groups, Projects: projects, Users: users, names: map[string]bool{}}
+
+	s.read(func() error {
+		defer close(groups)
+		seen := map[string]bool{}
+		for _, source := range groupSources {
+			err := source(func(group GitlabGroup) error {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if seen[group.FullPath] {
+					return nil
+				}
+				seen[group.FullPath] = true
+				s.delivered(group.FullPath)
+				select {
+				case groups <- group:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	s.read(func() error {
+		defer close(projects)
+		seen := map[string]bool{}
+		for _, source := range projectSources {
+			err := source(func(project GitlabProject) error {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if seen[project.PathWithNameSpace] {
+					return nil
+				}
+				seen[project.PathWithNameSpace] = true
+				s.delivered(project.PathWithNameSpace)
+				select {
+				case projects <- project:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	s.read(func() error {
+		defer close(users)
+		seen := map[string]bool{}
+		for _, source := range userSources {
+			err := source(func(user GitlabUser) error {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				if seen[user.Username] {
+					return nil
+				}
+				seen[user.Username] = true
+				s.delivered(user.Username)
+				select {
+				case users <- user:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return s
+}
 
-	err = json.Unmarshal(content, &projects)
+// changedSinceUrl adds the filter for entities changed since the given time to a list url
+func changedSinceUrl(listUrl, filter string, since time.Time) string {
+	return listUrl + "?" + url.Values{filter: []string{since.UTC().Format(time.RFC3339)}}.Encode()
+}
 
+// GetUsers returns all Gitlab users with their state
+func GetUsers() ([]GitlabUser, error) {
+	baseUrl, err := getGitlabBaseUrl()
 	if check(err) {
 		return nil, err
 	}
+	return GetAllUsers(make([]GitlabUser, 0), baseUrl+"users")
+}
 
-	for i := range projects {
-		err := projects[i].getMembers()
-		check(err)
+// GetProject returns the project with the given id, without its members, or nil if it does not exist
+func GetProject(id int) (*GitlabProject, error) {
+	baseUrl, err := getGitlabBaseUrl()
+	if check(err) {
+		return nil, err
 	}
+	return getProject(fmt.Sprintf("%sprojects/%d", baseUrl, id))
+}
 
-	gitlabProjects = append(projects, gitlabProjects...)
+func getProject(url string) (*GitlabProject, error) {
+	var project GitlabProject
+	if found, err := getGitlabEntity(url, &project); !found || err != nil {
+		return nil, err
+	}
+	return &project, nil
+}
 
-	group := link.ParseHeader(result.Header)
-	next := group["next"]
-	if next != nil {
-		finalProjects, err := GetAllProjects(gitlabProjects, next.URI)
-		if err != nil {
-			return nil, err
-		}
-		gitlabProjects = finalProjects
+// GetMergeRequest returns the merge request with the given iid of the project with the given id, or nil if it does
+// not exist
+func GetMergeRequest(projectId, iid int) (*GitlabMergeRequest, error) {
+	baseUrl, err := getGitlabBaseUrl()
+	if check(err) {
+		return nil, err
 	}
-	return gitlabProjects, nil
+	return getMergeRequest(fmt.Sprintf("%sprojects/%d/merge_requests/%d", baseUrl, projectId, iid))
 }
 
-func GetAllUsers(gitlabUsers []GitlabUser, url string) ([]GitlabUser, error) {
-	result, err := performGitlabHTTPRequest(url)
+func getMergeRequest(url string) (*GitlabMergeRequest, error) {
+	var mr GitlabMergeRequest
+	if found, err := getGitlabEntity(url, &mr); !found || err != nil {
+		return nil, err
+	}
+	return &mr, nil
+}
 
+// membership is a direct membership of a user in a group or project
+type membership struct {
+	SourceId   int    `json:"source_id"`
+	SourceType string `json:"source_type"`
+}
+
+// GetUserMemberships returns the groups and projects the user with the given id is a direct member of
+func GetUserMemberships(userId int) (ChangedEntities, error) {
+	baseUrl, err := getGitlabBaseUrl()
 	if check(err) {
-		log.Println("Error occured while calling Gitlab! Cancelling Sync! Err:" + err.Error())
+		return ChangedEntities{}, err
 	}
-	if result.StatusCode == 401 {
-		return nil, errors.New("GITLAB_PRIVATE_TOKEN was not set or wrong. Stopping now.")
+	return getUserMemberships(fmt.Sprintf("%susers/%d/memberships", baseUrl, userId))
+}
+
+// getUserMemberships reads all pages of a membership list, which Gitlab only paginates by offset
+func getUserMemberships(url string) (ChangedEntities, error) {
+	memberships := ChangedEntities{Groups: map[int]bool{}, Projects: map[int]bool{}}
+	pager := newGitlabPager(url, "")
+	for {
+		page := make([]membership, 0, perPage)
+		if !pager.next(&page) {
+			return memberships, pager.err
+		}
+		for _, m := range page {
+			switch m.SourceType {
+			case "Namespace":
+				memberships.Groups[m.SourceId] = true
+			case "Project":
+				memberships.Projects[m.SourceId] = true
+			}
+		}
 	}
-	content, err := ioutil.ReadAll(result.Body)
+}
 
-	Users := make([]GitlabUser, 0)
+// ForEachGroup reads the groups listed at the given url page by page. The members of each page are retrieved by the
+// configured number of workers, then fn is called for each group of the page. An error of fn stops the reading and is
+// returned.
+func ForEachGroup(url string, fn func(GitlabGroup) error) error {
+	return forEachGroup(newGitlabPager(url, "name"), fn)
+}
 
-	err = json.Unmarshal(content, &Users)
-	if check(err) {
-		return nil, err
+func forEachGroup(pager *gitlabPager, fn func(GitlabGroup) error) error {
+	for {
+		groups := make([]GitlabGroup, 0, perPage)
+		if !pager.next(&groups) {
+			return pager.err
+		}
+		forEachConcurrently(len(groups), config.Get().Gitlab.Workers, func(i int) {
+			// a group whose members could not be retrieved is kept, so that its namespace is not deleted,
+			// but it is skipped when syncing rolebindings
+			groups[i].MembersError = groups[i].getMembers()
+			check(groups[i].MembersError)
+		})
+		for _, group := range groups {
+			if err := fn(group); err != nil {
+				return err
+			}
+		}
 	}
+}
 
-	gitlabUsers = append(Users, gitlabUsers...)
+// ForEachProject reads the projects listed at the given url page by page. The members of each page are retrieved by
+// the configured number of workers, then fn is called for each project of the page. An error of fn stops the reading
+// and is returned.
+func ForEachProject(url string, fn func(GitlabProject) error) error {
+	return forEachProject(newGitlabPager(url, "id"), fn)
+}
 
-	group := link.ParseHeader(result.Header)
-	next := group["next"]
-	if next != nil {
-		finalUsers, err := GetAllUsers(gitlabUsers, next.URI)
-		if err != nil {
-			return nil, err
+func forEachProject(pager *gitlabPager, fn func(GitlabProject) error) error {
+	for {
+		projects := make([]GitlabProject, 0, perPage)
+		if !pager.next(&projects) {
+			return pager.err
+		}
+		forEachConcurrently(len(projects), config.Get().Gitlab.Workers, func(i int) {
+			// a project whose members could not be retrieved is kept, so that its namespace is not deleted,
+			// but it is skipped when syncing rolebindings
+			projects[i].MembersError = projects[i].getMembers()
+			check(projects[i].MembersError)
+		})
+		for _, project := range projects {
+			if err := fn(project); err != nil {
+				return err
+			}
 		}
-		gitlabUsers = finalUsers
+	}
+}
+
+// ForEachUser reads the users listed at the given url page by page and calls fn for each of them. An error of fn stops
+// the reading and is returned.
+func ForEachUser(url string, fn func(GitlabUser) error) error {
+	pager := newGitlabPager(url, "id")
+	for {
+		users := make([]GitlabUser, 0, perPage)
+		if !pager.next(&users) {
+			return pager.err
+		}
+		for _, user := range users {
+			if err := fn(user); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// GetAllGroups appends all groups listed at the given url, with their members, to gitlabGroups
+func GetAllGroups(gitlabGroups []GitlabGroup, url string) ([]GitlabGroup, error) {
+	err := ForEachGroup(url, func(group GitlabGroup) error {
+		gitlabGroups = append(gitlabGroups, group)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return gitlabGroups, nil
+}
+
+// GetAllProjects appends all projects listed at the given url, with their members, to gitlabProjects
+func GetAllProjects(gitlabProjects []GitlabProject, url string) ([]GitlabProject, error) {
+	err := ForEachProject(url, func(project GitlabProject) error {
+		gitlabProjects = append(gitlabProjects, project)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return gitlabProjects, nil
+}
+
+// GetAllUsers appends all users listed at the given url to gitlabUsers
+func GetAllUsers(gitlabUsers []GitlabUser, url string) ([]GitlabUser, error) {
+	err := ForEachUser(url, func(user GitlabUser) error {
+		gitlabUsers = append(gitlabUsers, user)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return gitlabUsers, nil
 }
@@ -179,91 +540,91 @@ func TranslateIntAccessLevels(lvl int) string {
 }
 
 func (g *GitlabGroup) getMembers() error {
-	url := getGitlabBaseUrl() + "groups/" + strconv.Itoa(g.Id) + "/members"
-	result, err := performGitlabHTTPRequest(url)
-
-	if check(err) {
-		log.Println("Error occured while calling Gitlab! Cancelling Sync! Err:" + err.Error())
+	members, err := getMembers("groups/" + strconv.Itoa(g.Id))
+	if err != nil {
 		return err
 	}
-	if result.StatusCode == 401 {
-		return errors.New("GITLAB_PRIVATE_TOKEN was not set or wrong. Stopping now.")
-	}
-	if result.StatusCode == 404 {
-		return errors.New("The requested URL was invalid! Stopping now.")
-	}
-
-	content, err := ioutil.ReadAll(result.Body)
-
-	members := make([]Member, 0)
-	err = json.Unmarshal(content, &members)
-
-	if check(err) {
-		return err
-	}
-
 	g.Members = members
 	if len(g.Members) == 0 {
-		log.Println(fmt.Sprintf("WARNING: No Group Members were found for group %s . StatusCode of Request was: %d . This is a potential bug in Gitlab, will continue to sync anyway", g.FullPath, result.StatusCode))
+		log.Println(fmt.Sprintf("WARNING: No Group Members were found for group %s . This is a potential bug in Gitlab, will continue to sync anyway", g.FullPath))
 	}
 	return nil
 }
 
 func (p *GitlabProject) getMembers() error {
-	url := getGitlabBaseUrl() + "projects/" + strconv.Itoa(p.Id) + "/members"
-	result, err := performGitlabHTTPRequest(url)
-
-	if check(err) {
-		log.Println("Error occured while calling Gitlab! Cancelling Sync! Err:" + err.Error())
+	members, err := getMembers("projects/" + strconv.Itoa(p.Id))
+	if err != nil {
 		return err
 	}
-	if result.StatusCode == 401 {
-		return errors.New("GITLAB_PRIVATE_TOKEN was not set or wrong. Stopping now.")
-	}
-	if result.StatusCode == 404 {
-		return errors.New("The requested URL was invalid! Stopping now. Url was: " + url)
+	p.Members = members
+	if len(p.Members) == 0 {
+		log.Println(fmt.Sprintf("WARNING: No Project Members were found for project %s . This is a potential bug in Gitlab, will continue to sync anyway", p.PathWithNameSpace))
 	}
+	return nil
+}
 
-	content, err := ioutil.ReadAll(result.Body)
+// GetProjectMembers returns the members of the project with the given id, with their highest access level
+func GetProjectMembers(id int) ([]Member, error) {
+	return getMembers("projects/" + strconv.Itoa(id))
+}
 
-	members := make([]Member, 0)
-	err = json.Unmarshal(content, &members)
-	if check(err) {
-		return err
+// getMembers retrieves the members of the group or project at the given API path. With the inherited membership
+// policy, the members of all parent groups are included, each with the highest access level granted to it.
+func getMembers(path string) ([]Member, error) {
+	baseUrl, err := getGitlabBaseUrl()
+	if err != nil {
+		return nil, err
 	}
+	url := baseUrl + path + "/members"
+	if config.Get().Gitlab.MembershipInheritance == config.MembershipInherited {
+		url += "/all"
+	}
+	members, err := getMemberPages(make([]Member, 0), url)
+	if err != nil {
+		return nil, err
+	}
+	return highestAccessLevels(members), nil
+}
 
-	p.Members = members
-
-	// aggregate with members from parent group(s)
-	if p.Namespace.Kind == "group" {
-		glGroup := GitlabGroup{FullPath: p.Namespace.FullPath, Id: p.Namespace.Id}
-		err := glGroup.getMembers()
-		if check(err) {
-			return err
-		}
-		// merge with project members
-		for _, gm := range glGroup.Members {
-			if !contains(p.Members, gm) {
-				p.Members = append(p.Members, gm)
+// getMemberPages reads all pages of a member list, which Gitlab only paginates by offset
+func getMemberPages(members []Member, url string) ([]Member, error) {
+	pager := newGitlabPager(url, "")
+	for {
+		page := make([]Member, 0, perPage)
+		if !pager.next(&page) {
+			if pager.err != nil {
+				return nil, pager.err
 			}
+			return members, nil
 		}
+		members = append(members, page...)
 	}
+}
 
-	if len(p.Members) == 0 {
-		log.Println(fmt.Sprintf("WARNING: No Project Members were found for project %s . StatusCode of Request was: %d . This is a potential bug in Gitlab, will continue to sync anyway", p.PathWithNameSpace, result.StatusCode))
+// highestAccessLevels reduces members listed more than once, e.g. as member of a project and of its parent group,
+// to a single entry with their highest access level
+func highestAccessLevels(members []Member) []Member {
+	result := make([]Member, 0, len(members))
+	index := map[int]int{}
+	for _, m := range members {
+		if i, ok := index[m.Id]; ok {
+			if m.AccessLevel > result[i].AccessLevel {
+				result[i].AccessLevel = m.AccessLevel
+			}
+			continue
+		}
+		index[m.Id] = len(result)
+		result = append(result, m)
 	}
-
-	return nil
+	return result
 }
 
 func performGitlabHTTPRequest(url string) (*http.Response, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if check(err) {
-		log.Fatal("Fatal Error while creating new HTTP Request! Err:" + err.Error())
+		return nil, errors.Wrap(err, "Error while creating new HTTP Request")
 	}
 
-	req.Header.Add("PRIVATE-TOKEN", os.Getenv("GITLAB_PRIVATE_TOKEN"))
-	result, err := http.DefaultClient.Do(req)
-	return result, err
+	return doGitlabRequest(req)
 
 }
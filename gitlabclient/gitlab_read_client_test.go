@@ -2499,3 +2499,85 @@ func TestGetAllUsers(t *testing.T) {
 		t.Error("deserialization didnt work for Users. Username was empty!")
 	}
 }
+
+func TestGetMemberPages(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			fmt.Fprintln(w, `[{"id": 2, "username": "parent-master", "access_level": 40}, {"id": 1, "username": "dev", "access_level": 50}]`)
+			return
+		}
+		w.Header().Set("Link", fmt.Sprintf(`<%s/members/all?page=2>; rel="next"`, ts.URL))
+		fmt.Fprintln(w, `[{"id": 1, "username": "dev", "access_level": 30}]`)
+	}))
+	defer ts.Close()
+
+	members, err := getMemberPages(make([]Member, 0), ts.URL+"/members/all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 3 {
+		t.Fatalf("Expected the members of both pages, got %d", len(members))
+	}
+
+	members = highestAccessLevels(members)
+	if len(members) != 2 {
+		t.Fatalf("Expected each member once, got %+v", members)
+	}
+	if members[0].Username != "dev" || members[0].AccessLevel != 50 {
+		t.Errorf("Expected the highest access level of dev, got %+v", members[0])
+	}
+	if members[1].Username != "parent-master" || members[1].AccessLevel != 40 {
+		t.Errorf("Unexpected member %+v", members[1])
+	}
+}
+
+func TestGetUserMemberships(t *testing.T) {
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "2" {
+			fmt.Fprintln(w, `[{"source_id": 3, "source_name": "project", "source_type": "Project", "access_level": 30}]`)
+			return
+		}
+		w.Header().Set("Link", fmt.Sprintf(`<%s/users/1/memberships?page=2>; rel="next"`, ts.URL))
+		fmt.Fprintln(w, `[{"source_id": 1, "source_name": "group", "source_type": "Namespace", "access_level": 40}, {"source_id": 2, "source_name": "other", "source_type": "Namespace", "access_level": 20}]`)
+	}))
+	defer ts.Close()
+
+	memberships, err := getUserMemberships(ts.URL + "/users/1/memberships")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(memberships.Groups) != 2 || !memberships.Groups[1] || !memberships.Groups[2] {
+		t.Errorf("Expected the groups 1 and 2, got %v", memberships.Groups)
+	}
+	if len(memberships.Projects) != 1 || !memberships.Projects[3] {
+		t.Errorf("Expected the project 3, got %v", memberships.Projects)
+	}
+}
+
+func TestGetMergeRequest(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/projects/42":
+			fmt.Fprintln(w, `{"id": 42, "path_with_namespace": "group/project"}`)
+		case "/projects/42/merge_requests/3":
+			fmt.Fprintln(w, `{"id": 1003, "iid": 3, "project_id": 42, "state": "opened"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	project, err := getProject(ts.URL + "/projects/42")
+	if err != nil || project == nil || project.PathWithNameSpace != "group/project" {
+		t.Errorf("Expected project group/project, got %+v, %v", project, err)
+	}
+	mr, err := getMergeRequest(ts.URL + "/projects/42/merge_requests/3")
+	if err != nil || mr == nil || mr.Iid != 3 || mr.ProjectId != 42 || mr.State != "opened" {
+		t.Errorf("Expected opened merge request 3 of project 42, got %+v, %v", mr, err)
+	}
+	if mr, err := getMergeRequest(ts.URL + "/projects/42/merge_requests/4"); err != nil || mr != nil {
+		t.Errorf("Expected no merge request 4, got %+v, %v", mr, err)
+	}
+}
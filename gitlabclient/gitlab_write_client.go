@@ -7,22 +7,28 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/pkg/errors"
 )
 
-func SetupK8sIntegrationForGitlabProject(projectId, namespace, token string) {
-	k8sUrl := os.Getenv("EXTERNAL_K8S_API_URL")
+func SetupK8sIntegrationForGitlabProject(projectId, namespace, token string) error {
+	k8sUrl := config.Get().Kubernetes.ExternalAPIURL
 	if k8sUrl == "" {
-		// abort if K8S_API_URL was not set
-		log.Println("K8S_API_URL was not set, skipping setup of K8s integration in Gitlab...")
-		return
+		// abort if EXTERNAL_K8S_API_URL was not set
+		log.Println("EXTERNAL_K8S_API_URL was not set, skipping setup of K8s integration in Gitlab...")
+		return nil
 	}
 
-	url := fmt.Sprintf("%sprojects/%s/services/kubernetes", getGitlabBaseUrl(), projectId)
+	baseUrl, err := getGitlabBaseUrl()
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%sprojects/%s/services/kubernetes", baseUrl, projectId)
 
 	req, err := http.NewRequest(http.MethodPut, url, nil)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 
 	q := req.URL.Query()
@@ -30,33 +36,33 @@ func SetupK8sIntegrationForGitlabProject(projectId, namespace, token string) {
 	q.Add("namespace", namespace)
 	q.Add("api_url", k8sUrl)
 
-	caPem := os.Getenv("K8S_CA_PEM")
+	caPem := config.Get().Kubernetes.CAPem
 	if caPem != "" {
 		q.Add("ca_pem", caPem)
 	}
 
 	req.URL.RawQuery = q.Encode()
 
-	req.Header.Add("Private-Token", os.Getenv("GITLAB_PRIVATE_TOKEN"))
-	req.Header.Add("Sudo", "root")
+	if mayImpersonate() {
+		req.Header.Add("Sudo", "root")
+	}
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doGitlabRequest(req)
 
 	if err != nil {
-		log.Println(fmt.Sprintf("Could not set up Kubernetes Integration for project %s . Err was: %s ", projectId, err.Error()))
+		return errors.Wrapf(err, "Could not set up Kubernetes Integration for project %s", projectId)
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		msg := ""
 		body, err := ioutil.ReadAll(resp.Body)
-		if err != nil {
+		if err == nil {
 			msg = string(body[:])
-
 		}
-		log.Println(fmt.Sprintf("Setting up Kubernetes Integration for project %s failed with errorCode %d and message %s", projectId, resp.StatusCode, msg))
+		return errors.New(fmt.Sprintf("Setting up Kubernetes Integration for project %s failed with errorCode %d and message %s", projectId, resp.StatusCode, msg))
 	}
 
-	setupEnvironment(projectId)
+	return setupEnvironment(projectId)
 }
 
 type ErrorMessage struct {
@@ -68,47 +74,51 @@ type Msg struct {
 	Slug []string
 }
 
-func setupEnvironment(projectId string) {
-	envName := os.Getenv("GITLAB_ENVIRONMENT_NAME")
+func setupEnvironment(projectId string) error {
+	envName := config.Get().Gitlab.EnvironmentName
 	if envName == "" {
 		// abort if GITLAB_ENVIRONMENT_NAME was not set
 		log.Println("GITLAB_ENVIRONMENT_NAME was not set, skipping creation of environment in Gitlab...")
-		return
+		return nil
 	}
 
-	url := fmt.Sprintf("%sprojects/%s/environments", getGitlabBaseUrl(), projectId)
+	baseUrl, err := getGitlabBaseUrl()
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%sprojects/%s/environments", baseUrl, projectId)
 	values := map[string]string{"id": projectId, "name": envName}
 	jsonValue, err := json.Marshal(values)
 	if err != nil {
-		log.Fatalln(err)
+		return err
 	}
 
 	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(jsonValue))
-	req.Header.Add("PRIVATE-TOKEN", os.Getenv("GITLAB_PRIVATE_TOKEN"))
+	if err != nil {
+		return err
+	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Accept", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doGitlabRequest(req)
 	if err != nil {
-		log.Fatalln(err)
+		return errors.Wrapf(err, "Creation of environment failed for projectID %s", projectId)
 	}
 
 	switch resp.StatusCode {
 	case http.StatusCreated:
-		return
+		return nil
 
 	case http.StatusBadRequest:
 		var msg ErrorMessage
 		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 		json.Unmarshal(body, &msg)
 		if len(msg.Message.Name) > 0 && msg.Message.Name[0] == "has already been taken" {
-			return
+			return nil
 		}
-		log.Println(fmt.Sprintf("Creation of environment failed with http error %d, projectID was: %s", resp.StatusCode, projectId))
-	default:
-		log.Println(fmt.Sprintf("Creation of environment failed with http error %d, projectID was: %s", resp.StatusCode, projectId))
 	}
+	return errors.New(fmt.Sprintf("Creation of environment failed with http error %d, projectID was: %s", resp.StatusCode, projectId))
 }
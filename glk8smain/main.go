@@ -16,27 +16,58 @@
 package glk8smain
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/gitlabclient"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/k8sclient"
 	"github.com/k8s-tamias/gitlab-k8s-integrator/usecases"
 	"github.com/k8s-tamias/gitlab-k8s-integrator/webhooklistener"
 )
 
 func Main() {
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "Path to a YAML config file. Defaults to the CONFIG_FILE env. Settings can be overridden via env.")
+	kubeconfig := flag.String("kubeconfig", "", "Path to a kubeconfig file. Defaults to the config file, the KUBECONFIG env or the in-cluster config if unset.")
+	kubeContext := flag.String("context", "", "The kubeconfig context to use. Defaults to the config file, the KUBE_CONTEXT env or the current context.")
+	flag.Parse()
+
 	log.Println("Gitlab K8s Integrator starting up!")
-	if os.Getenv("GITLAB_HOSTNAME") == "" {
-		log.Fatalln("Please provide GITLAB_HOSTNAME env!")
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		// report all problems at once, so they can be fixed in one go
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	if *kubeconfig != "" {
+		cfg.Kubernetes.Kubeconfig = *kubeconfig
+	}
+	if *kubeContext != "" {
+		cfg.Kubernetes.Context = *kubeContext
+	}
+	config.Set(cfg)
+
+	gitlabHTTPClient, err := gitlabclient.NewHTTPClient(cfg.Gitlab.HTTP, cfg.Gitlab.Workers)
+	if err != nil {
+		log.Fatalln("Could not create Gitlab client! Err: " + err.Error())
+	}
+	gitlabclient.SetHTTPClient(gitlabHTTPClient)
+	if err := gitlabclient.SetupCredentials(); err != nil {
+		log.Fatalln("Could not load Gitlab credentials! Err: " + err.Error())
 	}
-	if os.Getenv("GITLAB_API_VERSION") == "" {
-		log.Fatalln("Please provide GITLAB_API_VERSION env!")
+	if err := gitlabclient.CheckCredentials(); err != nil {
+		log.Fatalln("Gitlab token can't be used! Err: " + err.Error())
 	}
-	if os.Getenv("GITLAB_PRIVATE_TOKEN") == "" {
-		log.Fatalln("Please provide GITLAB_PRIVATE_TOKEN env!")
+
+	clientset, err := k8sclient.NewClientset(cfg.Kubernetes.Kubeconfig, cfg.Kubernetes.Context)
+	if err != nil {
+		log.Fatalln("Could not create K8s client! Err: " + err.Error())
 	}
+	k8sclient.SetClient(clientset)
 
 	quit := make(chan int)
 
@@ -60,10 +91,21 @@ func Main() {
 	// listen in sep. routine
 	go webhooklistener.Listen(quit)
 	go usecases.StartRecurringSyncTimer()
+	usecases.StartUserStateCheck()
+	usecases.StartReviewNamespaceCleanup()
 	log.Println("Gitlab K8s Integrator listening!")
 
-	// Perform 1st sync now:
-	go usecases.PerformGlK8sSync()
+	if usecases.LeaderElectionEnabled() {
+		// the 1st sync is performed by whichever replica wins the election
+		go func() {
+			if err := usecases.RunLeaderElection(); err != nil {
+				log.Fatalln("Leader election failed! Err: " + err.Error())
+			}
+		}()
+	} else {
+		// Perform 1st sync now:
+		go usecases.PerformGlK8sSync()
+	}
 	// Wait until server signals quit
 	select {
 	case <-quit:
@@ -1,57 +1,70 @@
 package k8sclient
 
 import (
-	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
 	"github.com/pkg/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 // Utils
 
-func GetAllGitlabOriginNamesFromNamespacesWithOriginLabel() []string {
-	nsList, err := getK8sClient().CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: "gitlab-origin"})
+// GetAllGitlabOriginNamesFromNamespacesWithOriginLabel returns the original gitlab names of all namespaces carrying a
+// gitlab-origin label. Labels which can not be transformed back to a gitlab name are skipped.
+func GetAllGitlabOriginNamesFromNamespacesWithOriginLabel() ([]string, error) {
+	client, err := getK8sClient()
 	if check(err) {
-		log.Fatal(err)
+		return nil, err
+	}
+	nsList, err := client.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: "gitlab-origin"})
+	if check(err) {
+		return nil, errors.Wrap(err, "Error while retrieving namespaces")
 	}
 	vsf := make([]string, 0)
 	for _, v := range nsList.Items {
 		if labelName := v.Labels["gitlab-origin"]; labelName != "" {
 			gitlabName, err := k8sLabelToGitlabName(labelName)
 			if check(err) {
-				log.Fatal("Error while transforming labelName back to Gitlab Name. Err: " + err.Error())
+				log.Printf("WARNING: Skipping namespace %s, its label %s could not be transformed back to a Gitlab Name. Err: %s", v.Name, labelName, err)
+				continue
 			}
 			vsf = append(vsf, gitlabName)
 		}
 	}
-	return vsf
+	return vsf, nil
 }
 
 // GetActualNameSpaceNameByGitlabName looks for the original name from gitlab in the gitlab-origin labels of namespaces
 // and returns the given namespace name in the K8s cluster or an empty string if namespace has not been found
-func GetActualNameSpaceNameByGitlabName(gitlabOriginName string) string {
+func GetActualNameSpaceNameByGitlabName(gitlabOriginName string) (string, error) {
 	correctName := ""
 
 	if gitlabOriginName == "kube-system" {
-		return correctName
+		return correctName, nil
 	}
 
-	client := getK8sClient()
+	client, err := getK8sClient()
+	if check(err) {
+		return "", err
+	}
 
 	k8sName, err := GitlabNameToK8sLabel(gitlabOriginName)
 	if check(err) {
-		log.Fatal("Error while transforming gitlab name to k8s label: " + err.Error())
+		return "", errors.Wrapf(err, "Error while transforming gitlab name %s to k8s label", gitlabOriginName)
 	}
 
 	namespaces, err := client.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: "gitlab-origin=" + k8sName})
 	if check(err) {
-		log.Fatal("Error while retrieving namespaces: " + err.Error())
+		return "", errors.Wrap(err, "Error while retrieving namespaces")
 	}
 	if len(namespaces.Items) > 1 {
 		log.Println("WARNING: Found mutliple namespaces with gitlab-origin= " + k8sName + ". This is potentially very bad, consult a cloud admin!")
@@ -60,15 +73,19 @@ func GetActualNameSpaceNameByGitlabName(gitlabOriginName string) string {
 	} else {
 		correctName = namespaces.Items[0].Name
 	}
-	return correctName
+	return correctName, nil
 }
 
 /// GetRoleBindingsByNamespace retrieves the rolebindings present in K8s for the provided namespace
 /// the namespace parameter is assumed to be the real namespace name in k8s!
-func GetRoleBindingsByNamespace(namespace string) map[string]bool {
-	rbs, err := getK8sClient().RbacV1().RoleBindings(namespace).List(metav1.ListOptions{})
+func GetRoleBindingsByNamespace(namespace string) (map[string]bool, error) {
+	client, err := getK8sClient()
 	if check(err) {
-		log.Fatal(fmt.Sprintf("Error while retrieving rolebindings for namespace %s. Error: %s", namespace, err))
+		return nil, err
+	}
+	rbs, err := client.RbacV1().RoleBindings(namespace).List(metav1.ListOptions{})
+	if check(err) {
+		return nil, errors.Wrapf(err, "Error while retrieving rolebindings for namespace %s", namespace)
 	}
 	res := map[string]bool{}
 
@@ -76,7 +93,20 @@ func GetRoleBindingsByNamespace(namespace string) map[string]bool {
 		res[rb.Name] = true
 	}
 
-	return res
+	return res, nil
+}
+
+// IsNamespaceIgnored checks whether the given namespace carries the gitlab-ignored label and thus must not be synced
+func IsNamespaceIgnored(namespace string) (bool, error) {
+	client, err := getK8sClient()
+	if check(err) {
+		return false, err
+	}
+	ns, err := client.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if check(err) {
+		return false, errors.Wrapf(err, "Error while retrieving namespace %s", namespace)
+	}
+	return ns.Labels["gitlab-ignored"] != "", nil
 }
 
 func ConstructRoleBindingName(username, rolename, ns string) string {
@@ -84,59 +114,31 @@ func ConstructRoleBindingName(username, rolename, ns string) string {
 }
 
 func GetProjectRoleName(accessLevel string) string {
-	var rname string
+	roles := config.Get().Roles
 	switch accessLevel {
-	case "Master", "Owner":
-		rname = os.Getenv("PROJECT_MASTER_ROLENAME")
-		if rname == "" {
-			rname = "gitlab-project-master"
-		}
+	case "Master", "Maintainer", "Owner":
+		return roles.ProjectMaster
 	case "Reporter":
-		rname = os.Getenv("PROJECT_REPORTER_ROLENAME")
-		if rname == "" {
-			rname = "gitlab-project-reporter"
-		}
+		return roles.ProjectReporter
 	case "Developer":
-		rname = os.Getenv("PROJECT_DEVELOPER_ROLENAME")
-		if rname == "" {
-			rname = "gitlab-project-developer"
-		}
-
+		return roles.ProjectDeveloper
 	default:
-		rname = os.Getenv("PROJECT_DEFAULT_ROLENAME")
-		if rname == "" {
-			rname = "gitlab-project-guest"
-		}
+		return roles.ProjectDefault
 	}
-	return rname
 }
 
 func GetGroupRoleName(accessLevel string) string {
-	var rname string
+	roles := config.Get().Roles
 	switch accessLevel {
-	case "Master", "Owner":
-		rname = os.Getenv("GROUP_MASTER_ROLENAME")
-		if rname == "" {
-			rname = "gitlab-group-master"
-		}
+	case "Master", "Maintainer", "Owner":
+		return roles.GroupMaster
 	case "Reporter":
-		rname = os.Getenv("GROUP_REPORTER_ROLENAME")
-		if rname == "" {
-			rname = "gitlab-group-reporter"
-		}
+		return roles.GroupReporter
 	case "Developer":
-		rname = os.Getenv("GROUP_DEVELOPER_ROLENAME")
-		if rname == "" {
-			rname = "gitlab-group-developer"
-		}
-
+		return roles.GroupDeveloper
 	default:
-		rname = os.Getenv("GROUP_DEFAULT_ROLENAME")
-		if rname == "" {
-			rname = "gitlab-group-guest"
-		}
+		return roles.GroupDefault
 	}
-	return rname
 }
 
 // Internal Functions
@@ -222,20 +224,67 @@ func k8sLabelToGitlabName(givenName string) (string, error) {
 	return labelName, nil
 }
 
-func getK8sClient() *kubernetes.Clientset {
-	// creates the in-cluster config
-	config, err := rest.InClusterConfig()
-	if check(err) {
-		log.Fatal(err)
+var (
+	clientset     kubernetes.Interface
+	clientsetLock sync.Mutex
+)
+
+// NewClientset builds a clientset from the given kubeconfig file and context. If no kubeconfig is given, the
+// KUBECONFIG env is used. If that is unset as well, the in-cluster config of the pod the integrator runs in is used.
+func NewClientset(kubeconfig, context string) (kubernetes.Interface, error) {
+	config, err := buildConfig(kubeconfig, context)
+	if err != nil {
+		return nil, err
 	}
 
 	// creates the clientset
-	clientset, err := kubernetes.NewForConfig(config)
+	return kubernetes.NewForConfig(config)
+}
 
-	if check(err) {
-		log.Fatal(err)
+func buildConfig(kubeconfig, context string) (*rest.Config, error) {
+	rules := &clientcmd.ClientConfigLoadingRules{}
+	if kubeconfig != "" {
+		rules.ExplicitPath = kubeconfig
+	} else if envKubeconfig := os.Getenv("KUBECONFIG"); envKubeconfig != "" {
+		rules.Precedence = filepath.SplitList(envKubeconfig)
+	} else {
+		if context != "" {
+			log.Printf("WARNING: No kubeconfig has been found, ignoring context %s and using in-cluster config", context)
+		}
+		// creates the in-cluster config
+		return rest.InClusterConfig()
+	}
+
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: context}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, overrides).ClientConfig()
+}
+
+// SetClient sets the client which is used by all functions of this package. It is supposed to be called
+// once at startup. Tests may pass a fake clientset here.
+func SetClient(client kubernetes.Interface) {
+	clientsetLock.Lock()
+	defer clientsetLock.Unlock()
+	clientset = client
+}
+
+// GetClient returns the client which is used by all functions of this package. If SetClient has not been
+// called yet, a clientset is built from the KUBECONFIG env or the in-cluster config and kept for subsequent calls.
+// An error is returned if that clientset can not be built, the next call tries again.
+func GetClient() (kubernetes.Interface, error) {
+	clientsetLock.Lock()
+	defer clientsetLock.Unlock()
+	if clientset == nil {
+		client, err := NewClientset("", "")
+		if check(err) {
+			return nil, errors.Wrap(err, "Error while creating the K8s client")
+		}
+		clientset = client
 	}
-	return clientset
+	return clientset, nil
+}
+
+func getK8sClient() (kubernetes.Interface, error) {
+	return GetClient()
 }
 
 func check(err error) bool {
@@ -0,0 +1,112 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const testKubeconfig = `
+apiVersion: v1
+kind: Config
+clusters:
+- name: kind
+  cluster:
+    server: https://127.0.0.1:6443
+- name: remote
+  cluster:
+    server: https://remote.example.com:6443
+contexts:
+- name: kind
+  context:
+    cluster: kind
+    user: admin
+- name: remote
+  context:
+    cluster: remote
+    user: admin
+current-context: kind
+users:
+- name: admin
+  user:
+    token: secret
+`
+
+func writeTestKubeconfig(t *testing.T) string {
+	f, err := ioutil.TempFile("", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(testKubeconfig); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestBuildConfigFromKubeconfig(t *testing.T) {
+	path := writeTestKubeconfig(t)
+	defer os.Remove(path)
+
+	config, err := buildConfig(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != "https://127.0.0.1:6443" {
+		t.Errorf("Expected host of current context, but was %s", config.Host)
+	}
+
+	config, err = buildConfig(path, "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != "https://remote.example.com:6443" {
+		t.Errorf("Expected host of context remote, but was %s", config.Host)
+	}
+}
+
+func TestBuildConfigFromKubeconfigEnv(t *testing.T) {
+	path := writeTestKubeconfig(t)
+	defer os.Remove(path)
+
+	oldEnv := os.Getenv("KUBECONFIG")
+	os.Setenv("KUBECONFIG", path)
+	defer os.Setenv("KUBECONFIG", oldEnv)
+
+	config, err := buildConfig("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Host != "https://remote.example.com:6443" {
+		t.Errorf("Expected host of context remote, but was %s", config.Host)
+	}
+}
+
+func TestGetClientReturnsErrorWithoutConfig(t *testing.T) {
+	SetClient(nil)
+	oldEnv := os.Getenv("KUBECONFIG")
+	os.Setenv("KUBECONFIG", "/nonexistent/kubeconfig")
+	defer os.Setenv("KUBECONFIG", oldEnv)
+
+	if _, err := GetClient(); err == nil {
+		t.Error("Expected an error without a usable kubeconfig")
+	}
+	if _, err := GetActualNameSpaceNameByGitlabName("group"); err == nil {
+		t.Error("Expected the error to be returned by functions using the client")
+	}
+}
@@ -19,16 +19,23 @@ import (
 	"fmt"
 	"log"
 
+	"github.com/k8s-tamias/gitlab-k8s-integrator/metrics"
+	"github.com/pkg/errors"
 	rbacv1 "k8s.io/api/rbac/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func CreateGroupRoleBinding(username, path, accessLevel string) {
-	ns := GetActualNameSpaceNameByGitlabName(path)
+func CreateGroupRoleBinding(username, path, accessLevel string) error {
+	ns, err := GetActualNameSpaceNameByGitlabName(path)
+	if err != nil {
+		return err
+	}
 	if ns == "" {
-		CreateNamespace(path)
-		ns = GetActualNameSpaceNameByGitlabName(path)
+		ns, err = CreateNamespace(path)
+		if err != nil {
+			return err
+		}
 	}
 	rolename := GetGroupRoleName(accessLevel)
 
@@ -36,41 +43,66 @@ func CreateGroupRoleBinding(username, path, accessLevel string) {
 		Subjects: []rbacv1.Subject{{Name: username, Kind: "User", APIGroup: "rbac.authorization.k8s.io"}},
 		RoleRef:  rbacv1.RoleRef{Kind: "ClusterRole", Name: GetGroupRoleName(accessLevel), APIGroup: "rbac.authorization.k8s.io"}}
 
-	_, err := getK8sClient().RbacV1().RoleBindings(ns).Create(&rB)
+	client, err := getK8sClient()
+	if err != nil {
+		return err
+	}
+	_, err = client.RbacV1().RoleBindings(ns).Create(&rB)
 	if k8serrors.IsNotFound(err) {
-		CreateNamespace(path)
-		_, err = getK8sClient().RbacV1().RoleBindings(ns).Create(&rB)
+		if _, err := CreateNamespace(path); err != nil {
+			return err
+		}
+		_, err = client.RbacV1().RoleBindings(ns).Create(&rB)
+	}
+	if k8serrors.IsAlreadyExists(err) {
+		// the hook has been delivered before or the binding was created by a sync run
+		return nil
 	}
 	if check(err) {
-		log.Fatal("Communication with K8s Server threw error, while creating RoleBinding. Err: " + err.Error())
+		return errors.Wrapf(err, "Communication with K8s Server threw error, while creating RoleBinding %s", rB.Name)
 	}
+	metrics.ObjectChange(metrics.KindRoleBinding, metrics.ActionCreated)
 	log.Println(fmt.Sprintf("INFO: Created GroupRoleBinding for user %s as %s in namespace %s", username, rolename, ns))
+	return nil
 }
 
-func DeleteGroupRoleBinding(username, path, accessLevel string) {
-
-	ns, err := GitlabNameToK8sNamespace(path)
-	if check(err) {
-		log.Fatal(err)
+func DeleteGroupRoleBinding(username, path, accessLevel string) error {
+	ns, err := GetActualNameSpaceNameByGitlabName(path)
+	if err != nil {
+		return err
+	}
+	if ns == "" {
+		// without a namespace there is no RoleBinding to delete
+		return nil
 	}
 
 	rolename := GetGroupRoleName(accessLevel)
 
 	if rolename != "" {
-		roleBindingName := ConstructRoleBindingName(username, rolename, GetActualNameSpaceNameByGitlabName(path))
-		DeleteGroupRoleBindingByName(roleBindingName, ns)
+		roleBindingName := ConstructRoleBindingName(username, rolename, ns)
+		return DeleteGroupRoleBindingByName(roleBindingName, ns)
 	}
+	return nil
 }
 
-func DeleteGroupRoleBindingByName(roleBindingName, actualNamespace string) {
-	ns, errGetNs := getK8sClient().CoreV1().Namespaces().Get(actualNamespace, metav1.GetOptions{})
-	if check(errGetNs) {
-		log.Fatal("Error while retrieving namespace. Error: " + errGetNs.Error())
+func DeleteGroupRoleBindingByName(roleBindingName, actualNamespace string) error {
+	ignored, err := IsNamespaceIgnored(actualNamespace)
+	if err != nil {
+		return err
 	}
-	if ns.Labels["gitlab-ignored"] == "" {
-		err := getK8sClient().RbacV1().RoleBindings(actualNamespace).Delete(roleBindingName, &metav1.DeleteOptions{})
-		if check(err) {
+	if !ignored {
+		client, err := getK8sClient()
+		if err != nil {
+			return err
+		}
+		err = client.RbacV1().RoleBindings(actualNamespace).Delete(roleBindingName, &metav1.DeleteOptions{})
+		if k8serrors.IsNotFound(err) {
 			log.Println("WARNING: Communication with K8s Server threw error, while deleting RoleBinding. Err: " + err.Error())
+		} else if check(err) {
+			return errors.Wrapf(err, "Communication with K8s Server threw error, while deleting RoleBinding %s", roleBindingName)
+		} else {
+			metrics.ObjectChange(metrics.KindRoleBinding, metrics.ActionDeleted)
 		}
 	}
+	return nil
 }
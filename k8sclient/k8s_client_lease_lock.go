@@ -0,0 +1,180 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	coordinationv1beta1 "k8s.io/api/coordination/v1beta1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// LeaderURLAnnotation holds the URL under which the current holder of the lease accepts forwarded webhooks
+const LeaderURLAnnotation = "gitlab-k8s-integrator/leader-url"
+
+// LeaseLock is a resourcelock.Interface which stores the leader election record in a coordination Lease.
+// Besides the record it stores the URL of the holder, so that followers are able to forward webhooks to it.
+type LeaseLock struct {
+	Namespace string
+	Name      string
+	// LockIdentity is the identity of this replica, usually the pod name
+	LockIdentity string
+	// URL under which this replica accepts forwarded webhooks
+	URL   string
+	lease *coordinationv1beta1.Lease
+}
+
+// Get returns the election record from the Lease
+func (l *LeaseLock) Get() (*resourcelock.LeaderElectionRecord, error) {
+	client, err := getK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	lease, err := client.CoordinationV1beta1().Leases(l.Namespace).Get(l.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	l.lease = lease
+	return leaseSpecToRecord(&lease.Spec), nil
+}
+
+// Create attempts to create a Lease holding the given record
+func (l *LeaseLock) Create(ler resourcelock.LeaderElectionRecord) error {
+	client, err := getK8sClient()
+	if err != nil {
+		return err
+	}
+	lease, err := client.CoordinationV1beta1().Leases(l.Namespace).Create(&coordinationv1beta1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        l.Name,
+			Namespace:   l.Namespace,
+			Annotations: map[string]string{LeaderURLAnnotation: l.URL},
+		},
+		Spec: recordToLeaseSpec(&ler),
+	})
+	if err != nil {
+		return err
+	}
+	l.lease = lease
+	return nil
+}
+
+// Update writes the given record to the Lease. As only the holder updates the Lease, the URL is set to our own.
+func (l *LeaseLock) Update(ler resourcelock.LeaderElectionRecord) error {
+	if l.lease == nil {
+		return errors.New("Lease not initialized, call get or create first")
+	}
+	l.lease.Spec = recordToLeaseSpec(&ler)
+	if l.lease.Annotations == nil {
+		l.lease.Annotations = map[string]string{}
+	}
+	l.lease.Annotations[LeaderURLAnnotation] = l.URL
+	client, err := getK8sClient()
+	if err != nil {
+		return err
+	}
+	lease, err := client.CoordinationV1beta1().Leases(l.Namespace).Update(l.lease)
+	if err != nil {
+		return err
+	}
+	l.lease = lease
+	return nil
+}
+
+// RecordEvent logs leader election events, as the integrator does not publish K8s events
+func (l *LeaseLock) RecordEvent(s string) {
+	log.Println(fmt.Sprintf("Leader election: %s %s", l.LockIdentity, s))
+}
+
+// Identity returns the identity of this replica
+func (l *LeaseLock) Identity() string {
+	return l.LockIdentity
+}
+
+// Describe returns namespace/name of the Lease
+func (l *LeaseLock) Describe() string {
+	return fmt.Sprintf("%s/%s", l.Namespace, l.Name)
+}
+
+// GetLeaderURL returns the URL of the current holder of the Lease or an empty string if it is not held by anyone, or
+// the holder did not renew it within its duration
+func GetLeaderURL(namespace, name string) (string, error) {
+	client, err := getK8sClient()
+	if err != nil {
+		return "", err
+	}
+	lease, err := client.CoordinationV1beta1().Leases(namespace).Get(name, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return "", nil
+	}
+	if check(err) {
+		return "", errors.Wrapf(err, "Error while retrieving Lease %s/%s", namespace, name)
+	}
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == "" {
+		return "", nil
+	}
+	if leaseExpired(&lease.Spec, time.Now()) {
+		return "", nil
+	}
+	return lease.Annotations[LeaderURLAnnotation], nil
+}
+
+// leaseExpired returns true if the holder did not renew the Lease within its duration, as the replicas do before they
+// take it over
+func leaseExpired(spec *coordinationv1beta1.LeaseSpec, now time.Time) bool {
+	if spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second).Before(now)
+}
+
+func leaseSpecToRecord(spec *coordinationv1beta1.LeaseSpec) *resourcelock.LeaderElectionRecord {
+	record := resourcelock.LeaderElectionRecord{}
+	if spec.HolderIdentity != nil {
+		record.HolderIdentity = *spec.HolderIdentity
+	}
+	if spec.LeaseDurationSeconds != nil {
+		record.LeaseDurationSeconds = int(*spec.LeaseDurationSeconds)
+	}
+	if spec.LeaseTransitions != nil {
+		record.LeaderTransitions = int(*spec.LeaseTransitions)
+	}
+	if spec.AcquireTime != nil {
+		record.AcquireTime = metav1.Time{Time: spec.AcquireTime.Time}
+	}
+	if spec.RenewTime != nil {
+		record.RenewTime = metav1.Time{Time: spec.RenewTime.Time}
+	}
+	return &record
+}
+
+func recordToLeaseSpec(ler *resourcelock.LeaderElectionRecord) coordinationv1beta1.LeaseSpec {
+	holderIdentity := ler.HolderIdentity
+	leaseDurationSeconds := int32(ler.LeaseDurationSeconds)
+	leaseTransitions := int32(ler.LeaderTransitions)
+	return coordinationv1beta1.LeaseSpec{
+		HolderIdentity:       &holderIdentity,
+		LeaseDurationSeconds: &leaseDurationSeconds,
+		AcquireTime:          &metav1.MicroTime{Time: ler.AcquireTime.Time},
+		RenewTime:            &metav1.MicroTime{Time: ler.RenewTime.Time},
+		LeaseTransitions:     &leaseTransitions,
+	}
+}
@@ -0,0 +1,99 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+func TestLeaseLock(t *testing.T) {
+	setupFakeClient()
+
+	url, err := GetLeaderURL("integrator", "lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "" {
+		t.Errorf("Expected no leader URL without Lease, got %s", url)
+	}
+
+	first := &LeaseLock{Namespace: "integrator", Name: "lease", LockIdentity: "pod-a", URL: "http://10.0.0.1:8080/hook"}
+	if _, err := first.Get(); err == nil {
+		t.Fatal("Expected Get to fail before the Lease has been created")
+	}
+	now := metav1.Now()
+	if err := first.Create(resourcelock.LeaderElectionRecord{HolderIdentity: "pod-a", LeaseDurationSeconds: 15, AcquireTime: now, RenewTime: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	second := &LeaseLock{Namespace: "integrator", Name: "lease", LockIdentity: "pod-b", URL: "http://10.0.0.2:8080/hook"}
+	record, err := second.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.HolderIdentity != "pod-a" || record.LeaseDurationSeconds != 15 {
+		t.Errorf("Unexpected election record %+v", record)
+	}
+	url, err = GetLeaderURL("integrator", "lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != first.URL {
+		t.Errorf("Expected leader URL %s, got %s", first.URL, url)
+	}
+
+	// the second replica takes over the Lease
+	record.HolderIdentity = "pod-b"
+	record.LeaderTransitions++
+	if err := second.Update(*record); err != nil {
+		t.Fatal(err)
+	}
+	record, err = first.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.HolderIdentity != "pod-b" || record.LeaderTransitions != 1 {
+		t.Errorf("Unexpected election record after takeover %+v", record)
+	}
+	url, err = GetLeaderURL("integrator", "lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != second.URL {
+		t.Errorf("Expected leader URL %s after takeover, got %s", second.URL, url)
+	}
+}
+
+func TestGetLeaderURLIgnoresExpiredLease(t *testing.T) {
+	setupFakeClient()
+
+	lock := &LeaseLock{Namespace: "integrator", Name: "lease", LockIdentity: "pod-a", URL: "http://10.0.0.1:8080/hook"}
+	renewed := metav1.NewTime(time.Now().Add(-20 * time.Second))
+	if err := lock.Create(resourcelock.LeaderElectionRecord{HolderIdentity: "pod-a", LeaseDurationSeconds: 15, AcquireTime: renewed, RenewTime: renewed}); err != nil {
+		t.Fatal(err)
+	}
+	url, err := GetLeaderURL("integrator", "lease")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url != "" {
+		t.Errorf("Expected no leader URL for an expired Lease, got %s", url)
+	}
+}
@@ -1,60 +1,53 @@
 package k8sclient
 
 import (
-	"os"
-	"strconv"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/pkg/errors"
 	"k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
-	"log"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func CreateLimitRange(namespace string) {
-	if namespace == "" {
-		return
-	}
-	enableLimitRanges, err := strconv.ParseBool(os.Getenv("ENABLE_LIMITRANGES"))
-	if err != nil || !enableLimitRanges {
-		return
+func CreateLimitRange(namespace string) error {
+	limits := config.Get().Namespaces.LimitRanges
+	if namespace == "" || !limits.Enabled {
+		return nil
 	}
 
-	defaultCpuReq, err := strconv.Atoi(os.Getenv("DEFAULT_CPU_REQ"))
-	if err != nil || defaultCpuReq <= 0 {
-		defaultCpuReq = 20
+	// the quantities have been validated at startup
+	defaultCpuReqQty, err := config.Quantity(limits.DefaultCPURequest, "m")
+	if err != nil {
+		return errors.Wrap(err, "Invalid default CPU request")
 	}
-	defaultCpuReqQty := resource.NewQuantity(int64(defaultCpuReq), resource.BinarySI)
-
-	defaulCpuLimit, err := strconv.Atoi(os.Getenv("DEFAULT_CPU_LIM"))
-	if err != nil || defaulCpuLimit <= 0 {
-		defaulCpuLimit = 150
+	defaultCpuLimitQty, err := config.Quantity(limits.DefaultCPULimit, "m")
+	if err != nil {
+		return errors.Wrap(err, "Invalid default CPU limit")
 	}
-	defaultCpuLimitQty := resource.NewQuantity(int64(defaulCpuLimit), resource.BinarySI)
-
-	defaultMemReq, err := strconv.Atoi(os.Getenv("DEFAULT_MEM_REQ"))
-	if err != nil || defaultMemReq <= 0 {
-		defaultMemReq = 25
+	defaultMemReqQty, err := config.Quantity(limits.DefaultMemoryRequest, "Mi")
+	if err != nil {
+		return errors.Wrap(err, "Invalid default memory request")
 	}
-	defaultMemReqQty := resource.NewQuantity(int64(defaultMemReq), resource.BinarySI)
-
-	defaultMemLimit, err := strconv.Atoi(os.Getenv("DEFAULT_MEM_LIM"))
-	if err != nil || defaultMemLimit <= 0 {
-		defaultMemLimit = 120
+	defaultMemLimitQty, err := config.Quantity(limits.DefaultMemoryLimit, "Mi")
+	if err != nil {
+		return errors.Wrap(err, "Invalid default memory limit")
 	}
 
-	defaultMemLimitQty := resource.NewQuantity(int64(defaultMemLimit), resource.BinarySI)
-
 	// build LimitRange
-	lR := &v1.LimitRange{Spec: v1.LimitRangeSpec{
-		Limits:[]v1.LimitRangeItem{
+	lR := &v1.LimitRange{ObjectMeta: metav1.ObjectMeta{Name: LimitRangeName, Namespace: namespace}, Spec: v1.LimitRangeSpec{
+		Limits: []v1.LimitRangeItem{
 			{Type: "Container",
-			DefaultRequest: v1.ResourceList{v1.ResourceMemory: *defaultMemReqQty, v1.ResourceCPU: *defaultCpuReqQty},
-			Default: v1.ResourceList{v1.ResourceMemory: *defaultMemLimitQty, v1.ResourceCPU: *defaultCpuLimitQty}},
+				DefaultRequest: v1.ResourceList{v1.ResourceMemory: defaultMemReqQty, v1.ResourceCPU: defaultCpuReqQty},
+				Default:        v1.ResourceList{v1.ResourceMemory: defaultMemLimitQty, v1.ResourceCPU: defaultCpuLimitQty}},
 		}}}
 
 	// write to Cluster
-	client := getK8sClient()
+	client, err := getK8sClient()
+	if err != nil {
+		return err
+	}
 	_, err = client.CoreV1().LimitRanges(namespace).Create(lR)
 	if err != nil && !k8serrors.IsAlreadyExists(err) {
-		log.Fatalf("Error creating LimitRange for Namespace %s. Error was: %s", namespace, err.Error())
+		return errors.Wrapf(err, "Error creating LimitRange for Namespace %s", namespace)
 	}
-}
\ No newline at end of file
+	return nil
+}
@@ -0,0 +1,786 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/metrics"
+	"github.com/pkg/errors"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	"k8s.io/api/core/v1"
+	extensionsv1beta1 "k8s.io/api/extensions/v1beta1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// RedirectLabel is set on the namespace left behind by a migration and names the namespace it moved to
+	RedirectLabel = "gitlab-redirect"
+	// RedirectOriginLabel replaces the gitlab-origin label of a migrated namespace, so it is not deleted by the sync
+	RedirectOriginLabel = "gitlab-redirect-origin"
+	// RedirectSinceAnnotation holds the time of the migration, from which the TTL of the old namespace is counted
+	RedirectSinceAnnotation = "gitlab-k8s-integrator/redirect-since"
+	// SuspendedAnnotation marks the CronJobs suspended in the old namespace, so their copies are not suspended
+	SuspendedAnnotation = "gitlab-k8s-integrator/suspended-by-migration"
+	// MigratedReplicasAnnotation keeps the replicas of a workload scaled down in the old namespace, so its copy gets them
+	MigratedReplicasAnnotation = "gitlab-k8s-integrator/replicas-before-migration"
+	// MigratedFromAnnotation is set on the workloads copied stopped from a namespace holding PersistentVolumeClaims and
+	// names the namespace they were copied from, whose workloads keep running on the claims
+	MigratedFromAnnotation = "gitlab-k8s-integrator/migrated-from"
+	// lastAppliedAnnotation holds the configuration last applied by kubectl, including the namespace of the object
+	lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+)
+
+// MigrateNamespace moves the namespace of a renamed or transferred Gitlab entity to the namespace of its new path.
+// If the namespace name does not change, only the gitlab-origin label is updated. Otherwise the new namespace is
+// created, all namespaced workload and config objects are copied into it and the old namespace is retired: its
+// RoleBindings are deleted, its DaemonSets are deleted, its Deployments and StatefulSets scaled down to zero and its
+// CronJobs suspended. If it holds PersistentVolumeClaims, which can't be copied, its workloads keep running instead
+// and are copied stopped. It is kept, labeled with a redirect to the new one, until DeleteExpiredRedirectNamespaces
+// deletes it.
+// The RoleBindings of the members are not copied, as a transferred project may have other members at its new path,
+// so the caller creates them from the current membership in Gitlab.
+// The migration may be repeated if it failed, objects already copied are skipped.
+func MigrateNamespace(oldPath, newPath string) (string, error) {
+	return migrateNamespace(oldPath, newPath, false)
+}
+
+// migrateNamespace implements MigrateNamespace, copyMembers decides whether the RoleBindings of the members are copied
+func migrateNamespace(oldPath, newPath string, copyMembers bool) (string, error) {
+	oldLabel, err := GitlabNameToK8sLabel(oldPath)
+	if check(err) {
+		return "", errors.Wrapf(err, "Error while transforming gitlab name %s to k8s label", oldPath)
+	}
+	newLabel, err := GitlabNameToK8sLabel(newPath)
+	if check(err) {
+		return "", errors.Wrapf(err, "Error while transforming gitlab name %s to k8s label", newPath)
+	}
+	newNsName, err := GitlabNameToK8sNamespace(newPath)
+	if check(err) {
+		return "", errors.Wrapf(err, "Error while transforming gitlab name %s to k8s namespace", newPath)
+	}
+
+	if err := relabelReviewNamespaces(oldLabel, newLabel); err != nil {
+		return "", err
+	}
+
+	oldNs, err := findMigrationSource(oldLabel)
+	if err != nil {
+		return "", err
+	}
+	if oldNs == nil {
+		log.Println(fmt.Sprintf("INFO: No namespace found for %s, creating a new one for %s", oldPath, newPath))
+		return CreateNamespace(newPath)
+	}
+
+	client, err := getK8sClient()
+	if err != nil {
+		return "", err
+	}
+	if oldNs.Labels == nil {
+		oldNs.Labels = map[string]string{}
+	}
+	if oldNs.Name == newNsName {
+		oldNs.Labels["gitlab-origin"] = newLabel
+		delete(oldNs.Labels, RedirectOriginLabel)
+		if _, err := client.CoreV1().Namespaces().Update(oldNs); check(err) {
+			return "", errors.Wrapf(err, "Error while relabeling namespace %s", oldNs.Name)
+		}
+		log.Println(fmt.Sprintf("Relabeled namespace %s from %s to %s", oldNs.Name, oldPath, newPath))
+		return oldNs.Name, nil
+	}
+
+	// release the old namespace first, so that neither a sync run nor a later project with the old path claims it
+	if oldNs.Labels["gitlab-origin"] != "" {
+		delete(oldNs.Labels, "gitlab-origin")
+		oldNs.Labels[RedirectOriginLabel] = oldLabel
+		released, err := client.CoreV1().Namespaces().Update(oldNs)
+		if check(err) {
+			return "", errors.Wrapf(err, "Error while releasing namespace %s", oldNs.Name)
+		}
+		oldNs = released
+	}
+
+	claims, err := client.CoreV1().PersistentVolumeClaims(oldNs.Name).List(metav1.ListOptions{})
+	if check(err) {
+		return "", errors.Wrapf(err, "Error while retrieving PersistentVolumeClaims of namespace %s", oldNs.Name)
+	}
+	holdsClaims := len(claims.Items) > 0
+
+	newNs, err := CreateNamespace(newPath)
+	if err != nil {
+		return "", err
+	}
+	if err := copyNamespaceObjects(oldNs.Name, newNs, holdsClaims, copyMembers); err != nil {
+		return newNs, errors.Wrapf(err, "Migration of namespace %s to %s is incomplete", oldNs.Name, newNs)
+	}
+	if err := retireNamespace(oldNs.Name, holdsClaims); err != nil {
+		return newNs, errors.Wrapf(err, "Migration of namespace %s to %s is incomplete", oldNs.Name, newNs)
+	}
+
+	oldNs.Labels[RedirectLabel] = newNs
+	if oldNs.Annotations == nil {
+		oldNs.Annotations = map[string]string{}
+	}
+	oldNs.Annotations[RedirectSinceAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	if _, err := client.CoreV1().Namespaces().Update(oldNs); check(err) {
+		return newNs, errors.Wrapf(err, "Error while labeling namespace %s with redirect to %s", oldNs.Name, newNs)
+	}
+	log.Println(fmt.Sprintf("Migrated namespace %s of %s to %s of %s", oldNs.Name, oldPath, newNs, newPath))
+	return newNs, nil
+}
+
+// MigrateNamespaceTree migrates the namespace of a renamed group and the namespaces of all its subgroups and
+// projects, i.e. every namespace whose origin starts with the old path, to the new path. It continues with the
+// remaining namespaces if one of them fails and returns the namespaces migrated successfully.
+// A rename keeps the members of the group, so unlike MigrateNamespace their RoleBindings are copied.
+func MigrateNamespaceTree(oldPath, newPath string) ([]string, error) {
+	names, err := getGitlabNamesBelow(oldPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrated, messages []string
+	for _, name := range names {
+		ns, err := migrateNamespace(name, newPath+strings.TrimPrefix(name, oldPath), true)
+		if err != nil {
+			messages = append(messages, err.Error())
+			continue
+		}
+		migrated = append(migrated, ns)
+	}
+	if len(messages) > 0 {
+		return migrated, errors.Errorf("Migration of %s to %s failed for %d of %d namespaces: %s", oldPath, newPath, len(messages), len(names), strings.Join(messages, "; "))
+	}
+	return migrated, nil
+}
+
+// DeleteExpiredRedirectNamespaces deletes the namespaces left behind by migrations longer than ttl ago and returns
+// their names. Namespaces without the time of their migration, e.g. migrated by an older version, get the current
+// time, so their TTL starts now.
+func DeleteExpiredRedirectNamespaces(ttl time.Duration) ([]string, error) {
+	expired, err := GetExpiredRedirectNamespaces(ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := getK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	var deleted, messages []string
+	for _, name := range expired {
+		err := client.CoreV1().Namespaces().Delete(name, &metav1.DeleteOptions{})
+		if k8serrors.IsNotFound(err) {
+			continue
+		}
+		if check(err) {
+			messages = append(messages, fmt.Sprintf("%s: %s", name, err))
+			continue
+		}
+		metrics.ObjectChange(metrics.KindNamespace, metrics.ActionDeleted)
+		log.Println(fmt.Sprintf("Deleted Namespace %s left behind by a migration", name))
+		deleted = append(deleted, name)
+	}
+	if len(messages) > 0 {
+		return deleted, errors.Errorf("Deletion of migrated namespaces failed: %s", strings.Join(messages, "; "))
+	}
+	return deleted, nil
+}
+
+// GetExpiredRedirectNamespaces returns the namespaces left behind by migrations longer than ttl ago. Namespaces which
+// still hold PersistentVolumeClaims are kept, as their data has not been moved to the new namespace.
+func GetExpiredRedirectNamespaces(ttl time.Duration) ([]string, error) {
+	client, err := getK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := client.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: RedirectLabel})
+	if check(err) {
+		return nil, errors.Wrap(err, "Error while retrieving migrated namespaces")
+	}
+
+	var expired []string
+	for _, ns := range namespaces.Items {
+		since, err := time.Parse(time.RFC3339, ns.Annotations[RedirectSinceAnnotation])
+		if err != nil {
+			if ns.Annotations == nil {
+				ns.Annotations = map[string]string{}
+			}
+			ns.Annotations[RedirectSinceAnnotation] = time.Now().UTC().Format(time.RFC3339)
+			if _, err := client.CoreV1().Namespaces().Update(&ns); check(err) {
+				log.Println(fmt.Sprintf("WARNING: Could not annotate migrated namespace %s. Err: %s", ns.Name, err))
+			}
+			continue
+		}
+		if time.Since(since) <= ttl {
+			continue
+		}
+		claims, err := client.CoreV1().PersistentVolumeClaims(ns.Name).List(metav1.ListOptions{})
+		if check(err) {
+			return nil, errors.Wrapf(err, "Error while retrieving PersistentVolumeClaims of namespace %s", ns.Name)
+		}
+		if len(claims.Items) > 0 {
+			log.Println(fmt.Sprintf("WARNING: Migrated namespace %s has expired, but still holds %d PersistentVolumeClaims, "+
+				"move their data and delete it manually", ns.Name, len(claims.Items)))
+			continue
+		}
+		expired = append(expired, ns.Name)
+	}
+	sort.Strings(expired)
+	return expired, nil
+}
+
+// getGitlabNamesBelow returns the given Gitlab path and all paths below it, which have a namespace or a namespace
+// released by an incomplete migration, ordered by their path
+func getGitlabNamesBelow(path string) ([]string, error) {
+	client, err := getK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	found := map[string]bool{}
+	for _, label := range []string{"gitlab-origin", RedirectOriginLabel} {
+		namespaces, err := client.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: label})
+		if check(err) {
+			return nil, errors.Wrap(err, "Error while retrieving namespaces")
+		}
+		for _, ns := range namespaces.Items {
+			if ns.Labels[label] == "" || ns.Labels[RedirectLabel] != "" {
+				continue
+			}
+			name, err := k8sLabelToGitlabName(ns.Labels[label])
+			if check(err) {
+				log.Printf("WARNING: Skipping namespace %s, its label %s could not be transformed back to a Gitlab Name. Err: %s", ns.Name, ns.Labels[label], err)
+				continue
+			}
+			if name == path || strings.HasPrefix(name, path+"/") {
+				found[name] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// findMigrationSource returns the namespace labeled with the given origin, or the namespace released for it by an
+// incomplete migration
+func findMigrationSource(label string) (*v1.Namespace, error) {
+	client, err := getK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	for _, selector := range []string{"gitlab-origin=" + label, RedirectOriginLabel + "=" + label} {
+		namespaces, err := client.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: selector})
+		if check(err) {
+			return nil, errors.Wrap(err, "Error while retrieving namespaces")
+		}
+		for i := range namespaces.Items {
+			// a namespace which already redirects has been migrated completely before
+			if namespaces.Items[i].Labels[RedirectLabel] == "" {
+				return &namespaces.Items[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// copyNamespaceObjects copies all namespaced workload and config objects. Config objects are copied first, so
+// workloads find them when they start. PersistentVolumeClaims are not copied, as their data can't be moved. If the
+// namespace holds claims, its workloads keep running on them, so the workloads are copied stopped: Deployments and
+// StatefulSets with zero replicas, CronJobs suspended, and DaemonSets, which can't be stopped, not at all.
+func copyNamespaceObjects(from, to string, holdsClaims, copyMembers bool) error {
+	copiers := []struct {
+		kind string
+		copy func(from, to string) []error
+	}{
+		{"ServiceAccount", copyServiceAccounts},
+		{"Secret", copySecrets},
+		{"ConfigMap", copyConfigMaps},
+		{"Role", copyRoles},
+		{"RoleBinding", func(from, to string) []error { return copyRoleBindings(from, to, copyMembers) }},
+		{"ResourceQuota", copyResourceQuotas},
+		{"LimitRange", copyLimitRanges},
+		{"Service", copyServices},
+		{"Deployment", func(from, to string) []error { return copyDeployments(from, to, holdsClaims) }},
+		{"StatefulSet", func(from, to string) []error { return copyStatefulSets(from, to, holdsClaims) }},
+		{"DaemonSet", func(from, to string) []error { return copyDaemonSets(from, to, holdsClaims) }},
+		{"CronJob", func(from, to string) []error { return copyCronJobs(from, to, holdsClaims) }},
+		{"Ingress", copyIngresses},
+	}
+
+	var messages []string
+	for _, c := range copiers {
+		for _, err := range c.copy(from, to) {
+			messages = append(messages, fmt.Sprintf("%s: %s", c.kind, err))
+		}
+	}
+	if len(messages) > 0 {
+		return errors.New(strings.Join(messages, "; "))
+	}
+	return nil
+}
+
+// retireNamespace removes the access to the namespace left behind by a migration and stops its workloads, which run
+// in the new namespace now. The workloads of a namespace holding PersistentVolumeClaims keep running, as the claims
+// have not been copied and their data is only available there, so only its RoleBindings are deleted. It may be
+// repeated, e.g. if a migration is retried.
+func retireNamespace(ns string, holdsClaims bool) error {
+	client, err := getK8sClient()
+	if err != nil {
+		return err
+	}
+	var messages []string
+	roleBindings, err := client.RbacV1().RoleBindings(ns).List(metav1.ListOptions{})
+	if check(err) {
+		return errors.Wrapf(err, "Error while retrieving RoleBindings of namespace %s", ns)
+	}
+	for _, rb := range roleBindings.Items {
+		if err := client.RbacV1().RoleBindings(ns).Delete(rb.Name, &metav1.DeleteOptions{}); check(err) && !k8serrors.IsNotFound(err) {
+			messages = append(messages, fmt.Sprintf("RoleBinding %s: %s", rb.Name, err))
+		}
+	}
+	if holdsClaims {
+		if len(messages) > 0 {
+			return errors.Errorf("Could not retire namespace %s: %s", ns, strings.Join(messages, "; "))
+		}
+		log.Println(fmt.Sprintf("WARNING: Retired namespace %s only partly: deleted its RoleBindings, but its workloads keep "+
+			"running, as it holds PersistentVolumeClaims. Their copies, annotated with %s, are stopped and its DaemonSets "+
+			"have not been copied. Move the data, then stop the old workloads and start the copies manually", ns, MigratedFromAnnotation))
+		return nil
+	}
+	daemonSets, err := client.AppsV1().DaemonSets(ns).List(metav1.ListOptions{})
+	if check(err) {
+		return errors.Wrapf(err, "Error while retrieving DaemonSets of namespace %s", ns)
+	}
+	for _, d := range daemonSets.Items {
+		if err := client.AppsV1().DaemonSets(ns).Delete(d.Name, &metav1.DeleteOptions{}); check(err) && !k8serrors.IsNotFound(err) {
+			messages = append(messages, fmt.Sprintf("DaemonSet %s: %s", d.Name, err))
+		}
+	}
+	if err := scaleNamespace(ns, MigratedReplicasAnnotation, true); err != nil {
+		messages = append(messages, err.Error())
+	}
+	cronJobs, err := client.BatchV1beta1().CronJobs(ns).List(metav1.ListOptions{})
+	if check(err) {
+		return errors.Wrapf(err, "Error while retrieving CronJobs of namespace %s", ns)
+	}
+	for _, c := range cronJobs.Items {
+		if c.Spec.Suspend != nil && *c.Spec.Suspend {
+			continue
+		}
+		suspend := true
+		c.Spec.Suspend = &suspend
+		if c.Annotations == nil {
+			c.Annotations = map[string]string{}
+		}
+		c.Annotations[SuspendedAnnotation] = "true"
+		if _, err := client.BatchV1beta1().CronJobs(ns).Update(&c); check(err) {
+			messages = append(messages, fmt.Sprintf("CronJob %s: %s", c.Name, err))
+		}
+	}
+	if len(messages) > 0 {
+		return errors.Errorf("Could not retire namespace %s: %s", ns, strings.Join(messages, "; "))
+	}
+	log.Println(fmt.Sprintf("Retired namespace %s: deleted its RoleBindings and stopped its workloads", ns))
+	return nil
+}
+
+// copyMeta returns the metadata of an object to be created as copy in the given namespace. The configuration last
+// applied by kubectl is dropped like the resourceVersion and uid, as it names the old namespace.
+func copyMeta(meta metav1.ObjectMeta, namespace string) metav1.ObjectMeta {
+	var annotations map[string]string
+	for key, value := range meta.Annotations {
+		if key == lastAppliedAnnotation {
+			continue
+		}
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[key] = value
+	}
+	return metav1.ObjectMeta{
+		Name:        meta.Name,
+		Namespace:   namespace,
+		Labels:      meta.Labels,
+		Annotations: annotations,
+	}
+}
+
+// created returns nil for objects which have been copied by an earlier attempt
+func created(name string, err error) error {
+	if err == nil || k8serrors.IsAlreadyExists(err) {
+		return nil
+	}
+	return errors.Wrapf(err, "could not copy %s", name)
+}
+
+func listFailed(err error) []error {
+	return []error{errors.Wrap(err, "could not list objects")}
+}
+
+func copyServiceAccounts(from, to string) []error {
+	client, err := getK8sClient()
+	if err != nil {
+		return []error{err}
+	}
+	list, err := client.CoreV1().ServiceAccounts(from).List(metav1.ListOptions{})
+	if err != nil {
+		return listFailed(err)
+	}
+	var errs []error
+	for _, o := range list.Items {
+		if o.Name == "default" {
+			continue
+		}
+		// token secrets are generated for the copy, only image pull secrets are kept
+		copied := v1.ServiceAccount{ObjectMeta: copyMeta(o.ObjectMeta, to), ImagePullSecrets: o.ImagePullSecrets, AutomountServiceAccountToken: o.AutomountServiceAccountToken}
+		_, err := client.CoreV1().ServiceAccounts(to).Create(&copied)
+		if err := created(o.Name, err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func copySecrets(from, to string) []error {
+	client, err := getK8sClient()
+	if err != nil {
+		return []error{err}
+	}
+	list, err := client.CoreV1().Secrets(from).List(metav1.ListOptions{})
+	if err != nil {
+		return listFailed(err)
+	}
+	var errs []error
+	for _, o := range list.Items {
+		if o.Type == v1.SecretTypeServiceAccountToken {
+			continue
+		}
+		copied := v1.Secret{ObjectMeta: copyMeta(o.ObjectMeta, to), Data: o.Data, Type: o.Type}
+		_, err := client.CoreV1().Secrets(to).Create(&copied)
+		if err := created(o.Name, err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func copyConfigMaps(from, to string) []error {
+	client, err := getK8sClient()
+	if err != nil {
+		return []error{err}
+	}
+	list, err := client.CoreV1().ConfigMaps(from).List(metav1.ListOptions{})
+	if err != nil {
+		return listFailed(err)
+	}
+	var errs []error
+	for _, o := range list.Items {
+		o.ObjectMeta = copyMeta(o.ObjectMeta, to)
+		_, err := client.CoreV1().ConfigMaps(to).Create(&o)
+		if err := created(o.Name, err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func copyRoles(from, to string) []error {
+	client, err := getK8sClient()
+	if err != nil {
+		return []error{err}
+	}
+	list, err := client.RbacV1().Roles(from).List(metav1.ListOptions{})
+	if err != nil {
+		return listFailed(err)
+	}
+	var errs []error
+	for _, o := range list.Items {
+		o.ObjectMeta = copyMeta(o.ObjectMeta, to)
+		_, err := client.RbacV1().Roles(to).Create(&o)
+		if err := created(o.Name, err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// copyRoleBindings renames the RoleBindings of the integrator, whose names end with the namespace, and moves
+// ServiceAccount subjects of the old namespace to the new one. The RoleBindings of the members are skipped unless
+// copyMembers is set, the binding of the integrator's ServiceAccount and those of other subjects are always copied.
+func copyRoleBindings(from, to string, copyMembers bool) []error {
+	client, err := getK8sClient()
+	if err != nil {
+		return []error{err}
+	}
+	list, err := client.RbacV1().RoleBindings(from).List(metav1.ListOptions{})
+	if err != nil {
+		return listFailed(err)
+	}
+	var errs []error
+	for _, o := range list.Items {
+		if !copyMembers && isMemberRoleBinding(&o, from) {
+			continue
+		}
+		o.ObjectMeta = copyMeta(o.ObjectMeta, to)
+		if strings.HasSuffix(o.Name, "-"+from) {
+			o.Name = strings.TrimSuffix(o.Name, from) + to
+		}
+		for i, subject := range o.Subjects {
+			if subject.Kind == "ServiceAccount" && subject.Namespace == from {
+				o.Subjects[i].Namespace = to
+			}
+		}
+		_, err := client.RbacV1().RoleBindings(to).Create(&o)
+		if err := created(o.Name, err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// isMemberRoleBinding returns true if the RoleBinding has been created for a Gitlab member by the integrator, i.e.
+// it binds a single user to a ClusterRole and is named after both
+func isMemberRoleBinding(rb *rbacv1.RoleBinding, namespace string) bool {
+	if len(rb.Subjects) != 1 || rb.Subjects[0].Kind != "User" || rb.RoleRef.Kind != "ClusterRole" {
+		return false
+	}
+	return rb.Name == ConstructRoleBindingName(rb.Subjects[0].Name, rb.RoleRef.Name, namespace)
+}
+
+func copyResourceQuotas(from, to string) []error {
+	client, err := getK8sClient()
+	if err != nil {
+		return []error{err}
+	}
+	list, err := client.CoreV1().ResourceQuotas(from).List(metav1.ListOptions{})
+	if err != nil {
+		return listFailed(err)
+	}
+	var errs []error
+	for _, o := range list.Items {
+		copied := v1.ResourceQuota{ObjectMeta: copyMeta(o.ObjectMeta, to), Spec: o.Spec}
+		_, err := client.CoreV1().ResourceQuotas(to).Create(&copied)
+		if err := created(o.Name, err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func copyLimitRanges(from, to string) []error {
+	client, err := getK8sClient()
+	if err != nil {
+		return []error{err}
+	}
+	list, err := client.CoreV1().LimitRanges(from).List(metav1.ListOptions{})
+	if err != nil {
+		return listFailed(err)
+	}
+	var errs []error
+	for _, o := range list.Items {
+		o.ObjectMeta = copyMeta(o.ObjectMeta, to)
+		_, err := client.CoreV1().LimitRanges(to).Create(&o)
+		if err := created(o.Name, err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// copyServices lets K8s assign new cluster IPs and node ports, as the services of the old namespace keep theirs
+func copyServices(from, to string) []error {
+	client, err := getK8sClient()
+	if err != nil {
+		return []error{err}
+	}
+	list, err := client.CoreV1().Services(from).List(metav1.ListOptions{})
+	if err != nil {
+		return listFailed(err)
+	}
+	var errs []error
+	for _, o := range list.Items {
+		spec := o.Spec
+		if spec.ClusterIP != v1.ClusterIPNone {
+			spec.ClusterIP = ""
+		}
+		spec.HealthCheckNodePort = 0
+		spec.Ports = append([]v1.ServicePort(nil), spec.Ports...)
+		for i := range spec.Ports {
+			spec.Ports[i].NodePort = 0
+		}
+		copied := v1.Service{ObjectMeta: copyMeta(o.ObjectMeta, to), Spec: spec}
+		_, err := client.CoreV1().Services(to).Create(&copied)
+		if err := created(o.Name, err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// stopWorkloadCopy scales the copy of a workload of a namespace holding PersistentVolumeClaims down to zero, keeping
+// its replicas in the migration annotation like a retired workload, and annotates it with the namespace it was
+// copied from
+func stopWorkloadCopy(meta *metav1.ObjectMeta, replicas **int32, from string) {
+	scaleReplicas(meta, replicas, MigratedReplicasAnnotation, true)
+	if meta.Annotations == nil {
+		meta.Annotations = map[string]string{}
+	}
+	meta.Annotations[MigratedFromAnnotation] = from
+}
+
+func copyDeployments(from, to string, stopped bool) []error {
+	client, err := getK8sClient()
+	if err != nil {
+		return []error{err}
+	}
+	list, err := client.AppsV1().Deployments(from).List(metav1.ListOptions{})
+	if err != nil {
+		return listFailed(err)
+	}
+	var errs []error
+	for _, o := range list.Items {
+		o.ObjectMeta = copyMeta(o.ObjectMeta, to)
+		o.Status = appsv1.DeploymentStatus{}
+		// the old namespace may have been retired by an earlier attempt
+		scaleReplicas(&o.ObjectMeta, &o.Spec.Replicas, MigratedReplicasAnnotation, false)
+		if stopped {
+			stopWorkloadCopy(&o.ObjectMeta, &o.Spec.Replicas, from)
+		}
+		_, err := client.AppsV1().Deployments(to).Create(&o)
+		if err := created(o.Name, err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func copyStatefulSets(from, to string, stopped bool) []error {
+	client, err := getK8sClient()
+	if err != nil {
+		return []error{err}
+	}
+	list, err := client.AppsV1().StatefulSets(from).List(metav1.ListOptions{})
+	if err != nil {
+		return listFailed(err)
+	}
+	var errs []error
+	for _, o := range list.Items {
+		o.ObjectMeta = copyMeta(o.ObjectMeta, to)
+		o.Status = appsv1.StatefulSetStatus{}
+		scaleReplicas(&o.ObjectMeta, &o.Spec.Replicas, MigratedReplicasAnnotation, false)
+		if stopped {
+			stopWorkloadCopy(&o.ObjectMeta, &o.Spec.Replicas, from)
+		}
+		_, err := client.AppsV1().StatefulSets(to).Create(&o)
+		if err := created(o.Name, err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func copyDaemonSets(from, to string, stopped bool) []error {
+	if stopped {
+		return nil
+	}
+	client, err := getK8sClient()
+	if err != nil {
+		return []error{err}
+	}
+	list, err := client.AppsV1().DaemonSets(from).List(metav1.ListOptions{})
+	if err != nil {
+		return listFailed(err)
+	}
+	var errs []error
+	for _, o := range list.Items {
+		o.ObjectMeta = copyMeta(o.ObjectMeta, to)
+		o.Status = appsv1.DaemonSetStatus{}
+		_, err := client.AppsV1().DaemonSets(to).Create(&o)
+		if err := created(o.Name, err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func copyCronJobs(from, to string, stopped bool) []error {
+	client, err := getK8sClient()
+	if err != nil {
+		return []error{err}
+	}
+	list, err := client.BatchV1beta1().CronJobs(from).List(metav1.ListOptions{})
+	if err != nil {
+		return listFailed(err)
+	}
+	var errs []error
+	for _, o := range list.Items {
+		o.ObjectMeta = copyMeta(o.ObjectMeta, to)
+		o.Status = batchv1beta1.CronJobStatus{}
+		if o.Annotations[SuspendedAnnotation] != "" {
+			resume := false
+			o.Spec.Suspend = &resume
+			delete(o.Annotations, SuspendedAnnotation)
+		}
+		if stopped && (o.Spec.Suspend == nil || !*o.Spec.Suspend) {
+			suspend := true
+			o.Spec.Suspend = &suspend
+			if o.Annotations == nil {
+				o.Annotations = map[string]string{}
+			}
+			o.Annotations[SuspendedAnnotation] = "true"
+			o.Annotations[MigratedFromAnnotation] = from
+		}
+		_, err := client.BatchV1beta1().CronJobs(to).Create(&o)
+		if err := created(o.Name, err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+func copyIngresses(from, to string) []error {
+	client, err := getK8sClient()
+	if err != nil {
+		return []error{err}
+	}
+	list, err := client.ExtensionsV1beta1().Ingresses(from).List(metav1.ListOptions{})
+	if err != nil {
+		return listFailed(err)
+	}
+	var errs []error
+	for _, o := range list.Items {
+		o.ObjectMeta = copyMeta(o.ObjectMeta, to)
+		o.Status = extensionsv1beta1.IngressStatus{}
+		_, err := client.ExtensionsV1beta1().Ingresses(to).Create(&o)
+		if err := created(o.Name, err); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
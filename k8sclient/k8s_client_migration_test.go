@@ -0,0 +1,344 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	"k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestMigrateNamespaceCopiesObjects(t *testing.T) {
+	client := setupFakeClient(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "group-old", Labels: map[string]string{"gitlab-origin": "group_old"}}},
+		&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: "group-old"}, Data: map[string]string{"a": "b"}},
+		&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "group-old"}},
+		&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "default-token-abcde", Namespace: "group-old"}, Type: v1.SecretTypeServiceAccountToken},
+		&v1.Service{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "group-old"}, Spec: v1.ServiceSpec{ClusterIP: "10.0.0.1", Ports: []v1.ServicePort{{Port: 80, NodePort: 30080}}}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "group-old", ResourceVersion: "42"}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "alice-edit-group-old", Namespace: "group-old"}},
+	)
+
+	ns, err := MigrateNamespace("group/old", "group/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns != "group-new" {
+		t.Fatalf("Expected namespace group-new, but was %s", ns)
+	}
+
+	if _, err := client.CoreV1().ConfigMaps(ns).Get("settings", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected ConfigMap to be copied: %s", err)
+	}
+	if _, err := client.CoreV1().Secrets(ns).Get("credentials", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected Secret to be copied: %s", err)
+	}
+	if _, err := client.CoreV1().Secrets(ns).Get("default-token-abcde", metav1.GetOptions{}); err == nil {
+		t.Error("Expected ServiceAccount token not to be copied")
+	}
+	if _, err := client.AppsV1().Deployments(ns).Get("web", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected Deployment to be copied: %s", err)
+	}
+	svc, err := client.CoreV1().Services(ns).Get("web", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected Service to be copied: %s", err)
+	}
+	if svc.Spec.ClusterIP != "" || svc.Spec.Ports[0].NodePort != 0 {
+		t.Errorf("Expected cluster IP and node port of the copied Service to be cleared, but were %s and %d", svc.Spec.ClusterIP, svc.Spec.Ports[0].NodePort)
+	}
+	if _, err := client.RbacV1().RoleBindings(ns).Get("alice-edit-group-new", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected RoleBinding to be renamed for the new namespace: %s", err)
+	}
+
+	old, err := client.CoreV1().Namespaces().Get("group-old", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected old namespace to be kept: %s", err)
+	}
+	if old.Labels["gitlab-origin"] != "" || old.Labels[RedirectLabel] != "group-new" {
+		t.Errorf("Expected old namespace to redirect to group-new, but its labels were %v", old.Labels)
+	}
+	if actual, _ := GetActualNameSpaceNameByGitlabName("group/new"); actual != "group-new" {
+		t.Errorf("Expected group/new to be found in group-new, but was %s", actual)
+	}
+}
+
+func TestMigrateNamespaceSkipsMemberRoleBindings(t *testing.T) {
+	client := setupFakeClient(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "group-old", Labels: map[string]string{"gitlab-origin": "group_old"}}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "alice-edit-group-old", Namespace: "group-old"},
+			Subjects: []rbacv1.Subject{{Kind: "User", Name: "alice"}},
+			RoleRef:  rbacv1.RoleRef{Kind: "ClusterRole", Name: "edit", APIGroup: "rbac.authorization.k8s.io"}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "gitlab-serviceaccount", Namespace: "group-old"},
+			Subjects: []rbacv1.Subject{{Kind: "ServiceAccount", Name: "gitlab-serviceaccount", Namespace: "group-old"}},
+			RoleRef:  rbacv1.RoleRef{Kind: "ClusterRole", Name: "edit", APIGroup: "rbac.authorization.k8s.io"}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "monitoring", Namespace: "group-old"},
+			Subjects: []rbacv1.Subject{{Kind: "Group", Name: "ops"}},
+			RoleRef:  rbacv1.RoleRef{Kind: "ClusterRole", Name: "view", APIGroup: "rbac.authorization.k8s.io"}},
+	)
+
+	if _, err := MigrateNamespace("group/old", "group/new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RbacV1().RoleBindings("group-new").Get("alice-edit-group-new", metav1.GetOptions{}); err == nil {
+		t.Error("Expected the RoleBinding of a member not to be copied")
+	}
+	sa, err := client.RbacV1().RoleBindings("group-new").Get("gitlab-serviceaccount", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected the RoleBinding of the ServiceAccount to be copied: %s", err)
+	}
+	if sa.Subjects[0].Namespace != "group-new" {
+		t.Errorf("Expected the ServiceAccount subject to be moved to group-new, but was %s", sa.Subjects[0].Namespace)
+	}
+	if _, err := client.RbacV1().RoleBindings("group-new").Get("monitoring", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected the RoleBinding of another subject to be copied: %s", err)
+	}
+}
+
+func TestMigrateNamespaceRelabelsIdenticalName(t *testing.T) {
+	client := setupFakeClient(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "group-project", Labels: map[string]string{"gitlab-origin": "group_project"}}})
+
+	ns, err := MigrateNamespace("group/project", "Group/Project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns != "group-project" {
+		t.Errorf("Expected namespace group-project to be kept, but was %s", ns)
+	}
+	namespaces, _ := client.CoreV1().Namespaces().List(metav1.ListOptions{})
+	if len(namespaces.Items) != 1 {
+		t.Errorf("Expected no namespace to be created, but found %d", len(namespaces.Items))
+	}
+	if actual, _ := GetActualNameSpaceNameByGitlabName("Group/Project"); actual != "group-project" {
+		t.Errorf("Expected namespace to be relabeled for Group/Project, but found %s", actual)
+	}
+}
+
+func TestMigrateNamespaceWithoutOldNamespace(t *testing.T) {
+	setupFakeClient()
+
+	ns, err := MigrateNamespace("group/old", "group/new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns != "group-new" {
+		t.Errorf("Expected namespace group-new to be created, but was %s", ns)
+	}
+}
+
+func TestMigrateNamespaceTree(t *testing.T) {
+	setupFakeClient(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "old", Labels: map[string]string{"gitlab-origin": "old"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "old-sub", Labels: map[string]string{"gitlab-origin": "old_sub"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "old-sub-project", Labels: map[string]string{"gitlab-origin": "old_sub_project"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "older", Labels: map[string]string{"gitlab-origin": "older"}}},
+	)
+
+	migrated, err := MigrateNamespaceTree("old", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrated) != 3 {
+		t.Errorf("Expected 3 migrated namespaces, but were %v", migrated)
+	}
+	for _, name := range []string{"new", "new/sub", "new/sub/project"} {
+		if ns, _ := GetActualNameSpaceNameByGitlabName(name); ns == "" {
+			t.Errorf("Expected a namespace for %s", name)
+		}
+	}
+	if ns, _ := GetActualNameSpaceNameByGitlabName("older"); ns != "older" {
+		t.Errorf("Expected namespace of group older not to be migrated, but found %s", ns)
+	}
+}
+
+func TestMigrateNamespaceRetiresOldNamespace(t *testing.T) {
+	replicas := int32(3)
+	client := setupFakeClient(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "group-old", Labels: map[string]string{"gitlab-origin": "group_old"}}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "group-old",
+			Annotations: map[string]string{lastAppliedAnnotation: `{"metadata":{"namespace":"group-old"}}`}},
+			Spec: appsv1.DeploymentSpec{Replicas: &replicas}},
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "group-old"}, Spec: appsv1.StatefulSetSpec{Replicas: &replicas}},
+		&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "group-old"}},
+		&batchv1beta1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: "backup", Namespace: "group-old"}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "alice-edit-group-old", Namespace: "group-old"}},
+	)
+
+	if _, err := MigrateNamespace("group/old", "group/new"); err != nil {
+		t.Fatal(err)
+	}
+
+	if roleBindings, _ := client.RbacV1().RoleBindings("group-old").List(metav1.ListOptions{}); len(roleBindings.Items) != 0 {
+		t.Errorf("Expected the RoleBindings of the old namespace to be deleted, but found %d", len(roleBindings.Items))
+	}
+	if _, err := client.AppsV1().DaemonSets("group-old").Get("agent", metav1.GetOptions{}); err == nil {
+		t.Error("Expected the DaemonSet of the old namespace to be deleted")
+	}
+	deployment, _ := client.AppsV1().Deployments("group-old").Get("web", metav1.GetOptions{})
+	statefulSet, _ := client.AppsV1().StatefulSets("group-old").Get("db", metav1.GetOptions{})
+	if *deployment.Spec.Replicas != 0 || *statefulSet.Spec.Replicas != 0 {
+		t.Errorf("Expected the workloads of the old namespace to be scaled down, but had %d and %d replicas", *deployment.Spec.Replicas, *statefulSet.Spec.Replicas)
+	}
+	// restoring the access of a user must not revive the retired workloads
+	if deployment.Annotations[ReplicasAnnotation] != "" || deployment.Annotations[MigratedReplicasAnnotation] != "3" {
+		t.Errorf("Expected the replicas to be kept in the migration annotation, but annotations were %v", deployment.Annotations)
+	}
+	cronJob, _ := client.BatchV1beta1().CronJobs("group-old").Get("backup", metav1.GetOptions{})
+	if cronJob.Spec.Suspend == nil || !*cronJob.Spec.Suspend {
+		t.Error("Expected the CronJob of the old namespace to be suspended")
+	}
+
+	deployment, _ = client.AppsV1().Deployments("group-new").Get("web", metav1.GetOptions{})
+	if *deployment.Spec.Replicas != 3 {
+		t.Errorf("Expected the copied Deployment to keep its replicas, but had %d", *deployment.Spec.Replicas)
+	}
+	if deployment.Annotations[lastAppliedAnnotation] != "" {
+		t.Error("Expected the configuration last applied in the old namespace not to be copied")
+	}
+	cronJob, _ = client.BatchV1beta1().CronJobs("group-new").Get("backup", metav1.GetOptions{})
+	if cronJob.Spec.Suspend != nil && *cronJob.Spec.Suspend {
+		t.Error("Expected the copied CronJob not to be suspended")
+	}
+
+	// a repeated migration, e.g. after a failure, copies the retired workloads with their former state
+	client.AppsV1().Deployments("group-new").Delete("web", &metav1.DeleteOptions{})
+	client.BatchV1beta1().CronJobs("group-new").Delete("backup", &metav1.DeleteOptions{})
+	copyDeployments("group-old", "group-new", false)
+	copyCronJobs("group-old", "group-new", false)
+	deployment, _ = client.AppsV1().Deployments("group-new").Get("web", metav1.GetOptions{})
+	cronJob, _ = client.BatchV1beta1().CronJobs("group-new").Get("backup", metav1.GetOptions{})
+	if *deployment.Spec.Replicas != 3 {
+		t.Errorf("Expected the copy of the retired Deployment to get its replicas back, but had %d", *deployment.Spec.Replicas)
+	}
+	if cronJob.Spec.Suspend != nil && *cronJob.Spec.Suspend {
+		t.Error("Expected the copy of the retired CronJob not to be suspended")
+	}
+}
+
+func TestMigrateNamespaceKeepsWorkloadsWithPersistentVolumeClaims(t *testing.T) {
+	replicas := int32(2)
+	client := setupFakeClient(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "group-old", Labels: map[string]string{"gitlab-origin": "group_old"}}},
+		&v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data-db-0", Namespace: "group-old"}},
+		&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: "group-old"}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "group-old"}, Spec: appsv1.DeploymentSpec{Replicas: &replicas}},
+		&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "group-old"}, Spec: appsv1.StatefulSetSpec{Replicas: &replicas,
+			VolumeClaimTemplates: []v1.PersistentVolumeClaim{{ObjectMeta: metav1.ObjectMeta{Name: "data"}}}}},
+		&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "agent", Namespace: "group-old"}},
+		&batchv1beta1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: "backup", Namespace: "group-old"}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "alice-edit-group-old", Namespace: "group-old"}},
+	)
+
+	if _, err := MigrateNamespace("group/old", "group/new"); err != nil {
+		t.Fatal(err)
+	}
+
+	if roleBindings, _ := client.RbacV1().RoleBindings("group-old").List(metav1.ListOptions{}); len(roleBindings.Items) != 0 {
+		t.Errorf("Expected the RoleBindings of the old namespace to be deleted, but found %d", len(roleBindings.Items))
+	}
+	deployment, _ := client.AppsV1().Deployments("group-old").Get("web", metav1.GetOptions{})
+	statefulSet, _ := client.AppsV1().StatefulSets("group-old").Get("db", metav1.GetOptions{})
+	if *deployment.Spec.Replicas != 2 || *statefulSet.Spec.Replicas != 2 {
+		t.Errorf("Expected the workloads next to the PersistentVolumeClaim to keep running, but had %d and %d replicas", *deployment.Spec.Replicas, *statefulSet.Spec.Replicas)
+	}
+	if _, err := client.AppsV1().DaemonSets("group-old").Get("agent", metav1.GetOptions{}); err != nil {
+		t.Error("Expected the DaemonSet next to the PersistentVolumeClaim to keep running")
+	}
+	cronJob, _ := client.BatchV1beta1().CronJobs("group-old").Get("backup", metav1.GetOptions{})
+	if cronJob.Spec.Suspend != nil && *cronJob.Spec.Suspend {
+		t.Error("Expected the CronJob next to the PersistentVolumeClaim not to be suspended")
+	}
+
+	if _, err := client.CoreV1().ConfigMaps("group-new").Get("settings", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected ConfigMap to be copied: %s", err)
+	}
+	if claims, _ := client.CoreV1().PersistentVolumeClaims("group-new").List(metav1.ListOptions{}); len(claims.Items) != 0 {
+		t.Errorf("Expected no PersistentVolumeClaim to be copied, but found %d", len(claims.Items))
+	}
+	deployment, _ = client.AppsV1().Deployments("group-new").Get("web", metav1.GetOptions{})
+	statefulSet, _ = client.AppsV1().StatefulSets("group-new").Get("db", metav1.GetOptions{})
+	for _, copied := range []struct {
+		meta     metav1.ObjectMeta
+		replicas *int32
+	}{{deployment.ObjectMeta, deployment.Spec.Replicas}, {statefulSet.ObjectMeta, statefulSet.Spec.Replicas}} {
+		if *copied.replicas != 0 || copied.meta.Annotations[MigratedReplicasAnnotation] != "2" || copied.meta.Annotations[MigratedFromAnnotation] != "group-old" {
+			t.Errorf("Expected the copy of %s to be stopped and to point to group-old, but had %d replicas and annotations %v", copied.meta.Name, *copied.replicas, copied.meta.Annotations)
+		}
+	}
+	if _, err := client.AppsV1().DaemonSets("group-new").Get("agent", metav1.GetOptions{}); err == nil {
+		t.Error("Expected the DaemonSet not to be copied")
+	}
+	cronJob, _ = client.BatchV1beta1().CronJobs("group-new").Get("backup", metav1.GetOptions{})
+	if cronJob.Spec.Suspend == nil || !*cronJob.Spec.Suspend || cronJob.Annotations[MigratedFromAnnotation] != "group-old" {
+		t.Error("Expected the copied CronJob to be suspended and to point to group-old")
+	}
+}
+
+func TestMigrateNamespaceReportsFailedRelease(t *testing.T) {
+	client := setupFakeClient(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "group-old", Labels: map[string]string{"gitlab-origin": "group_old"}}})
+	client.PrependReactor("update", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("conflict")
+	})
+
+	_, err := MigrateNamespace("group/old", "group/new")
+	if err == nil || !strings.Contains(err.Error(), "group-old") {
+		t.Errorf("Expected an error naming the old namespace, but was %v", err)
+	}
+}
+
+func TestDeleteExpiredRedirectNamespaces(t *testing.T) {
+	redirect := func(name string, since time.Time) *v1.Namespace {
+		ns := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{RedirectLabel: "group-new"}}}
+		if !since.IsZero() {
+			ns.Annotations = map[string]string{RedirectSinceAnnotation: since.UTC().Format(time.RFC3339)}
+		}
+		return ns
+	}
+	client := setupFakeClient(
+		redirect("expired", time.Now().Add(-200*time.Hour)),
+		redirect("stateful", time.Now().Add(-200*time.Hour)),
+		&v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "stateful"}},
+		redirect("recent", time.Now().Add(-time.Hour)),
+		redirect("unknown", time.Time{}),
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "group-new", Labels: map[string]string{"gitlab-origin": "group_new"}}},
+	)
+
+	deleted, err := DeleteExpiredRedirectNamespaces(168 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0] != "expired" {
+		t.Errorf("Expected only the expired namespace to be deleted, but were %v", deleted)
+	}
+
+	for _, name := range []string{"stateful", "recent", "unknown", "group-new"} {
+		if _, err := client.CoreV1().Namespaces().Get(name, metav1.GetOptions{}); err != nil {
+			t.Errorf("Expected namespace %s to be kept", name)
+		}
+	}
+	unknown, _ := client.CoreV1().Namespaces().Get("unknown", metav1.GetOptions{})
+	if unknown.Annotations[RedirectSinceAnnotation] == "" {
+		t.Error("Expected the TTL of a namespace without migration time to start now")
+	}
+}
@@ -3,31 +3,53 @@ package k8sclient
 import (
 	"fmt"
 	"log"
-	"os"
 	"strconv"
 
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/metrics"
+	"github.com/pkg/errors"
 	"k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
 )
 
-// DeleteNamespace deletes a namespace by its originalName
-func DeleteNamespace(originalName string) string {
+// names of the objects DeployNamespaceDefaults adds to every gitlab namespace
+const (
+	CephSecretName             = "ceph-secret-user"
+	NetAdminServiceAccountName = "net-admin-serviceaccount"
+	NetAdminRoleBindingName    = "net-admin-psp-binding"
+	LimitRangeName             = "gitlab-integrator-limits"
+)
+
+// DeleteNamespace deletes a namespace by its originalName. Deleting a namespace which is already terminating
+// succeeds, so repeated hooks are harmless.
+func DeleteNamespace(originalName string) (string, error) {
 
-	client := getK8sClient()
-	correctNs := GetActualNameSpaceNameByGitlabName(originalName)
+	client, err := getK8sClient()
+	if err != nil {
+		return "", err
+	}
+	correctNs, err := GetActualNameSpaceNameByGitlabName(originalName)
+	if err != nil {
+		return "", err
+	}
 	if correctNs == "kube-system" {
-		return correctNs
+		return correctNs, nil
 	}
 	if correctNs != "" {
 		err := client.CoreV1().Namespaces().Delete(correctNs, &metav1.DeleteOptions{})
+		if k8serrors.IsNotFound(err) || k8serrors.IsConflict(err) {
+			// the namespace is already gone or terminating, as the hook has been delivered before
+			log.Println(fmt.Sprintf("INFO: Namespace %s is already being deleted", correctNs))
+			return correctNs, nil
+		}
 		if check(err) {
-			log.Fatal("Deletion of Namespace failed with error: " + err.Error())
+			return correctNs, errors.Wrapf(err, "Deletion of Namespace %s failed", correctNs)
 		}
+		metrics.ObjectChange(metrics.KindNamespace, metrics.ActionDeleted)
 	}
-	return correctNs
+	return correctNs, nil
 
 }
 
@@ -35,107 +57,244 @@ func DeleteNamespace(originalName string) string {
 // checks if that namespace has already been created by either CreateProjectRoleBinding or CreateGroupRoleBinding.
 // This has been implemented due to the asynchronous manner in which the webhook calls might be received.
 // GetActualNameSpaceNameByGitlabName checks for the origin label field, so it only finds the namespace if it's
-// the correct one.
-func CreateNamespace(name string) string {
+// the correct one. If that namespace is still terminating, an error is returned, so the caller retries later.
+func CreateNamespace(name string) (string, error) {
 	if name == "kube-system" {
-		return name
+		return name, nil
 	}
 
-	if actualNs := GetActualNameSpaceNameByGitlabName(name); actualNs != "" {
-		return actualNs
+	actualNs, err := GetActualNameSpaceNameByGitlabName(name)
+	if err != nil {
+		return "", err
+	}
+	if actualNs != "" {
+		client, err := getK8sClient()
+		if err != nil {
+			return "", err
+		}
+		ns, err := client.CoreV1().Namespaces().Get(actualNs, metav1.GetOptions{})
+		if check(err) && !k8serrors.IsNotFound(err) {
+			return "", errors.Wrapf(err, "Error while retrieving namespace %s", actualNs)
+		}
+		// a namespace deleted a moment ago can't be used, so the hook is retried until it is gone
+		if err == nil && ns.Status.Phase == v1.NamespaceTerminating {
+			return "", errors.Errorf("Namespace %s of %s is still terminating", actualNs, name)
+		}
+		if err == nil {
+			return actualNs, nil
+		}
 	}
 
 	nsName, err := GitlabNameToK8sNamespace(name)
 	if check(err) {
-		log.Fatal(err)
+		return "", errors.Wrapf(err, "Error while transforming gitlab name %s to k8s namespace", name)
 	}
 
 	labelName, err := GitlabNameToK8sLabel(name)
 	if check(err) {
-		log.Fatal("Error while transforming gitlab name to k8s label: " + err.Error())
+		return "", errors.Wrapf(err, "Error while transforming gitlab name %s to k8s label", name)
+	}
+	client, err := getK8sClient()
+	if err != nil {
+		return "", err
 	}
-	client := getK8sClient()
 	_, err = client.CoreV1().Namespaces().Create(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: nsName, Labels: map[string]string{"gitlab-origin": labelName}}})
+	created := err == nil
 
-	// if the already present namespace does not have "gitlab-ignored" label, we will update it with a  gitlab-origin label
 	if k8serrors.IsAlreadyExists(err) {
-		ns, errGetNs := getK8sClient().CoreV1().Namespaces().Get(nsName, metav1.GetOptions{})
+		ns, errGetNs := client.CoreV1().Namespaces().Get(nsName, metav1.GetOptions{})
 		if check(errGetNs) {
-			log.Fatal("Error while retrieving namespace. Error: " + errGetNs.Error())
+			return "", errors.Wrapf(errGetNs, "Error while retrieving namespace %s", nsName)
 		}
-		if ns.Labels["gitlab-ignored"] == "" {
+		if isAdoptable(ns) {
 			// add label to already present namespace
-			patchContent := fmt.Sprintf(`{"metadata":{"labels":{"gitlab-origin":"%s"}}}`, labelName)
-			patchByteArray := []byte(patchContent)
-			_, errPatch := client.CoreV1().Namespaces().Patch(nsName, types.MergePatchType, patchByteArray)
-			if check(errPatch) {
-				log.Fatal("Error while Updating namespace. Error: " + errPatch.Error())
+			if ns.Labels == nil {
+				ns.Labels = map[string]string{}
+			}
+			ns.Labels["gitlab-origin"] = labelName
+			_, err = client.CoreV1().Namespaces().Update(ns)
+			if check(err) {
+				return "", errors.Wrapf(err, "Error while updating namespace %s", nsName)
+			}
+		} else {
+			// the name is taken by an ignored namespace, a review namespace or another gitlab entity, so retry with
+			// suffixed number
+			baseName := nsName
+			i := 0
+			for k8serrors.IsAlreadyExists(err) {
+				i++
+				nsName = suffixedNamespaceName(baseName, i)
+				_, err = client.CoreV1().Namespaces().Create(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: nsName, Labels: map[string]string{"gitlab-origin": labelName}}})
 			}
+			created = err == nil
 		}
-	} else {
-		if err != nil {
-			log.Println(fmt.Sprintf("Namespace creation caused an error, which was not IsAlreadyExists. Error was: %s", err))
+	}
+	if check(err) {
+		return "", errors.Wrapf(err, "Creation of Namespace %s for Gitlab Ressource %s failed", nsName, name)
+	}
+	if created {
+		metrics.ObjectChange(metrics.KindNamespace, metrics.ActionCreated)
+	}
+	log.Println(fmt.Sprintf("Succesfully created Namespace %s for Gitlab Ressource %s", nsName, name))
+
+	// deploy CEPH Secret User, GPU SA and RoleBinding and LimitRange if specified via ENV vars
+	if err := DeployNamespaceDefaults(nsName); err != nil {
+		return nsName, err
+	}
+
+	return nsName, nil
+}
+
+// isAdoptable returns true if an already present namespace has neither a "gitlab-ignored" nor a "gitlab-origin" label
+// and is no review namespace, so CreateNamespace updates it with a gitlab-origin label instead of creating a new one
+func isAdoptable(ns *v1.Namespace) bool {
+	return ns.Labels["gitlab-ignored"] == "" && ns.Labels["gitlab-origin"] == "" && ns.Labels[ReviewOfLabel] == ""
+}
+
+// suffixedNamespaceName returns the name CreateNamespace tries after i collisions with namespaces it can't adopt
+func suffixedNamespaceName(baseName string, i int) string {
+	return baseName + "-" + strconv.Itoa(i)
+}
+
+// ProposeNamespaceName returns the name CreateNamespace would give the namespace of a gitlab entity, which has none
+// yet, and whether an already present namespace of that name would be adopted instead of a new one being created
+func ProposeNamespaceName(name string) (string, bool, error) {
+	nsName, err := GitlabNameToK8sNamespace(name)
+	if check(err) {
+		return "", false, errors.Wrapf(err, "Error while transforming gitlab name %s to k8s namespace", name)
+	}
+	client, err := getK8sClient()
+	if err != nil {
+		return "", false, err
+	}
+	ns, err := client.CoreV1().Namespaces().Get(nsName, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nsName, false, nil
+	}
+	if check(err) {
+		return "", false, errors.Wrapf(err, "Error while retrieving namespace %s", nsName)
+	}
+	if isAdoptable(ns) {
+		return nsName, true, nil
+	}
+	for i := 1; ; i++ {
+		candidate := suffixedNamespaceName(nsName, i)
+		_, err := client.CoreV1().Namespaces().Get(candidate, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			return candidate, false, nil
 		}
-		// if error is due to namespace name collision, retry with suffixed number
-		i := 0
-		for k8serrors.IsAlreadyExists(err) {
-			// it has gitlab-ignored label, so create new namespace with suffix counter
-			i++
-			nsName = nsName + "-" + strconv.Itoa(i)
-			_, err = client.CoreV1().Namespaces().Create(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: nsName, Labels: map[string]string{"gitlab-origin": labelName}}})
+		if check(err) {
+			return "", false, errors.Wrapf(err, "Error while retrieving namespace %s", candidate)
 		}
 	}
-	log.Println(fmt.Sprintf("Succesfully created Namespace %s for Gitlab Ressource %s", nsName, name))
-	// deploy CEPH Secret User if specified via ENV var
-	DeployCEPHSecretUser(nsName)
+}
 
-	// deploy GPU SA and RoleBinding
-	DeployAdditionalServiceAccounts(nsName)
+// NamespaceDefault is an object DeployNamespaceDefaults adds to a namespace if it is missing
+type NamespaceDefault struct {
+	Kind string
+	Name string
+}
 
-	CreateLimitRange(nsName)
+// GetNamespaceDefaults returns the objects DeployNamespaceDefaults deploys with the current configuration
+func GetNamespaceDefaults() []NamespaceDefault {
+	var defaults []NamespaceDefault
+	if config.Get().Namespaces.CephUserKey != "" {
+		defaults = append(defaults, NamespaceDefault{Kind: "Secret", Name: CephSecretName})
+	}
+	if config.Get().Namespaces.NetAdminPSPClusterRole != "" {
+		defaults = append(defaults, NamespaceDefault{Kind: "ServiceAccount", Name: NetAdminServiceAccountName}, NamespaceDefault{Kind: "RoleBinding", Name: NetAdminRoleBindingName})
+	}
+	if config.Get().Namespaces.LimitRanges.Enabled {
+		defaults = append(defaults, NamespaceDefault{Kind: "LimitRange", Name: LimitRangeName})
+	}
+	return defaults
+}
 
-	check(err)
+// GetMissingNamespaceDefaults returns the objects DeployNamespaceDefaults would add to the namespace
+func GetMissingNamespaceDefaults(namespace string) ([]NamespaceDefault, error) {
+	client, err := getK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	var missing []NamespaceDefault
+	for _, d := range GetNamespaceDefaults() {
+		switch d.Kind {
+		case "Secret":
+			_, err = client.CoreV1().Secrets(namespace).Get(d.Name, metav1.GetOptions{})
+		case "ServiceAccount":
+			_, err = client.CoreV1().ServiceAccounts(namespace).Get(d.Name, metav1.GetOptions{})
+		case "RoleBinding":
+			_, err = client.RbacV1().RoleBindings(namespace).Get(d.Name, metav1.GetOptions{})
+		case "LimitRange":
+			_, err = client.CoreV1().LimitRanges(namespace).Get(d.Name, metav1.GetOptions{})
+		}
+		if k8serrors.IsNotFound(err) {
+			missing = append(missing, d)
+		} else if check(err) {
+			return nil, errors.Wrapf(err, "Error while retrieving %s %s in namespace %s", d.Kind, d.Name, namespace)
+		}
+	}
+	return missing, nil
+}
 
-	return nsName
+// DeployNamespaceDefaults deploys the objects every gitlab namespace is supposed to contain, if they are missing
+func DeployNamespaceDefaults(namespace string) error {
+	if err := DeployCEPHSecretUser(namespace); err != nil {
+		return err
+	}
+	if err := DeployAdditionalServiceAccounts(namespace); err != nil {
+		return err
+	}
+	return CreateLimitRange(namespace)
 }
 
-func DeployCEPHSecretUser(namespace string) {
-	if userKey := os.Getenv("CEPH_USER_KEY"); userKey != "" {
-		client := getK8sClient()
-		_, err := client.CoreV1().Secrets(namespace).Create(&v1.Secret{
+func DeployCEPHSecretUser(namespace string) error {
+	if userKey := config.Get().Namespaces.CephUserKey; userKey != "" {
+		client, err := getK8sClient()
+		if err != nil {
+			return err
+		}
+		_, err = client.CoreV1().Secrets(namespace).Create(&v1.Secret{
 			TypeMeta: metav1.TypeMeta{
 				Kind:       "Secret",
 				APIVersion: "v1",
 			},
 			ObjectMeta: metav1.ObjectMeta{
-				Name:      "ceph-secret-user",
+				Name:      CephSecretName,
 				Namespace: namespace,
 			},
 			Data: map[string][]byte{"key": []byte(userKey)},
 			Type: "kubernetes.io/rbd",
 		})
 		if err != nil && !k8serrors.IsAlreadyExists(err) {
-			log.Fatalln("Error creating CEPH Secret User. Error was: " + err.Error())
+			return errors.Wrapf(err, "Error creating CEPH Secret User in namespace %s", namespace)
 		}
 	}
+	return nil
 }
 
-func DeployAdditionalServiceAccounts(namespace string) {
-	netClusterRoleName := os.Getenv("NET_ADMIN_PSP_CLUSTER_ROLE_NAME")
+func DeployAdditionalServiceAccounts(namespace string) error {
+	netClusterRoleName := config.Get().Namespaces.NetAdminPSPClusterRole
 	if netClusterRoleName != "" {
-		deployServiceAccountAndRoleBinding(namespace, netClusterRoleName, "net-admin-serviceaccount", "net-admin-psp-binding")
+		return deployServiceAccountAndRoleBinding(namespace, netClusterRoleName, NetAdminServiceAccountName, NetAdminRoleBindingName)
 	}
+	return nil
 }
 
-func deployServiceAccountAndRoleBinding(namespace, clusterRoleName, serviceAccountName, bindingName string) {
+func deployServiceAccountAndRoleBinding(namespace, clusterRoleName, serviceAccountName, bindingName string) error {
 
-	client := getK8sClient()
+	client, err := getK8sClient()
+	if err != nil {
+		return err
+	}
 
 	sa := &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: serviceAccountName, Namespace: namespace}}
 
-	_, err := client.CoreV1().ServiceAccounts(namespace).Create(sa)
+	_, err = client.CoreV1().ServiceAccounts(namespace).Create(sa)
 	if err != nil && !k8serrors.IsAlreadyExists(err) {
-		log.Fatalf("Error creating %s ServiceAccount. Error: %s", serviceAccountName, err.Error())
+		return errors.Wrapf(err, "Error creating %s ServiceAccount in namespace %s", serviceAccountName, namespace)
+	} else if err == nil {
+		metrics.ObjectChange(metrics.KindServiceAccount, metrics.ActionCreated)
 	}
 
 	rB := rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: bindingName, Namespace: namespace},
@@ -144,6 +303,9 @@ func deployServiceAccountAndRoleBinding(namespace, clusterRoleName, serviceAccou
 
 	_, err = client.RbacV1().RoleBindings(namespace).Create(&rB)
 	if err != nil && !k8serrors.IsAlreadyExists(err) {
-		log.Fatalf("Error creating %s ServiceAccount. Error: %s", serviceAccountName, err.Error())
+		return errors.Wrapf(err, "Error creating %s RoleBinding in namespace %s", bindingName, namespace)
+	} else if err == nil {
+		metrics.ObjectChange(metrics.KindRoleBinding, metrics.ActionCreated)
 	}
+	return nil
 }
@@ -0,0 +1,273 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"testing"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func setupFakeClient(objects ...runtime.Object) *fake.Clientset {
+	client := fake.NewSimpleClientset(objects...)
+	SetClient(client)
+	return client
+}
+
+func TestCreateNamespace(t *testing.T) {
+	client := setupFakeClient()
+
+	ns, err := CreateNamespace("Foo-Group/bar_project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns != "foo-group-bar-project" {
+		t.Errorf("Expected namespace foo-group-bar-project, but was %s", ns)
+	}
+
+	created, err := client.CoreV1().Namespaces().Get(ns, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Labels["gitlab-origin"] != "Foo-Group_bar__project" {
+		t.Errorf("Expected gitlab-origin label Foo-Group_bar__project, but was %s", created.Labels["gitlab-origin"])
+	}
+
+	if actual, _ := GetActualNameSpaceNameByGitlabName("Foo-Group/bar_project"); actual != ns {
+		t.Errorf("Expected to find namespace %s by its origin, but found %s", ns, actual)
+	}
+
+	// creating it a second time must return the present namespace
+	if again, _ := CreateNamespace("Foo-Group/bar_project"); again != ns {
+		t.Errorf("Expected namespace %s to be reused, but was %s", ns, again)
+	}
+}
+
+func TestCreateNamespaceLabelsUnlabeledNamespace(t *testing.T) {
+	client := setupFakeClient(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo-bar"}})
+
+	ns, err := CreateNamespace("foo_bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns != "foo-bar" {
+		t.Errorf("Expected namespace foo-bar, but was %s", ns)
+	}
+
+	labeled, err := client.CoreV1().Namespaces().Get("foo-bar", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if labeled.Labels["gitlab-origin"] != "foo__bar" {
+		t.Errorf("Expected gitlab-origin label foo__bar, but was %s", labeled.Labels["gitlab-origin"])
+	}
+}
+
+func TestCreateNamespaceDoesNotAdoptReviewNamespace(t *testing.T) {
+	client := setupFakeClient(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo-mr-1",
+		Labels: map[string]string{ReviewOfLabel: "foo", ReviewIIDLabel: "1"}}})
+
+	ns, err := CreateNamespace("foo-mr-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns != "foo-mr-1-1" {
+		t.Errorf("Expected namespace foo-mr-1-1, but was %s", ns)
+	}
+	review, _ := client.CoreV1().Namespaces().Get("foo-mr-1", metav1.GetOptions{})
+	if review.Labels["gitlab-origin"] != "" {
+		t.Error("Expected the review namespace not to be adopted")
+	}
+}
+
+func TestCreateNamespaceSuffixesOnCollision(t *testing.T) {
+	client := setupFakeClient(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo-bar", Labels: map[string]string{"gitlab-origin": "foo__bar"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo-bar-1", Labels: map[string]string{"gitlab-ignored": "true"}}},
+	)
+
+	ns, err := CreateNamespace("foo.bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns != "foo-bar-2" {
+		t.Errorf("Expected namespace foo-bar-2, but was %s", ns)
+	}
+
+	original, err := client.CoreV1().Namespaces().Get("foo-bar", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if original.Labels["gitlab-origin"] != "foo__bar" {
+		t.Errorf("Label of colliding namespace has been changed to %s", original.Labels["gitlab-origin"])
+	}
+	if actual, _ := GetActualNameSpaceNameByGitlabName("foo.bar"); actual != "foo-bar-2" {
+		t.Errorf("Expected to find namespace foo-bar-2 by its origin, but found %s", actual)
+	}
+}
+
+func TestProposeNamespaceNameMatchesCreateNamespace(t *testing.T) {
+	setupFakeClient(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo-bar", Labels: map[string]string{"gitlab-origin": "foo__bar"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo-bar-1", Labels: map[string]string{"gitlab-ignored": "true"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "unlabeled"}},
+	)
+
+	if ns, adopt, err := ProposeNamespaceName("foo.bar"); err != nil || ns != "foo-bar-2" || adopt {
+		t.Errorf("Expected namespace foo-bar-2 to be created, but was %s (adopt: %v, err: %v)", ns, adopt, err)
+	}
+	if ns, adopt, err := ProposeNamespaceName("unlabeled"); err != nil || ns != "unlabeled" || !adopt {
+		t.Errorf("Expected namespace unlabeled to be adopted, but was %s (adopt: %v, err: %v)", ns, adopt, err)
+	}
+	if ns, adopt, err := ProposeNamespaceName("new"); err != nil || ns != "new" || adopt {
+		t.Errorf("Expected namespace new to be created, but was %s (adopt: %v, err: %v)", ns, adopt, err)
+	}
+
+	if ns, _ := CreateNamespace("foo.bar"); ns != "foo-bar-2" {
+		t.Errorf("Expected CreateNamespace to create the proposed namespace foo-bar-2, but was %s", ns)
+	}
+}
+
+func TestGetMissingNamespaceDefaults(t *testing.T) {
+	cfg := config.Default()
+	cfg.Namespaces.CephUserKey = "key"
+	cfg.Namespaces.NetAdminPSPClusterRole = "net-admin"
+	cfg.Namespaces.LimitRanges.Enabled = true
+	config.Set(cfg)
+	defer config.Set(config.Default())
+	setupFakeClient(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo"}},
+		&v1.Secret{ObjectMeta: metav1.ObjectMeta{Name: CephSecretName, Namespace: "foo"}},
+		&v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: NetAdminServiceAccountName, Namespace: "foo"}},
+	)
+
+	missing, err := GetMissingNamespaceDefaults("foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []NamespaceDefault{{Kind: "RoleBinding", Name: NetAdminRoleBindingName}, {Kind: "LimitRange", Name: LimitRangeName}}
+	if len(missing) != len(expected) || missing[0] != expected[0] || missing[1] != expected[1] {
+		t.Errorf("Expected %v to be missing, but was %v", expected, missing)
+	}
+
+	if err := DeployNamespaceDefaults("foo"); err != nil {
+		t.Fatal(err)
+	}
+	if missing, _ := GetMissingNamespaceDefaults("foo"); len(missing) != 0 {
+		t.Errorf("Expected no defaults to be missing after deploying them, but was %v", missing)
+	}
+}
+
+func TestDeleteNamespace(t *testing.T) {
+	setupFakeClient(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo-bar-1", Labels: map[string]string{"gitlab-origin": "foo.bar"}}})
+
+	if deleted, err := DeleteNamespace("foo.bar"); err != nil || deleted != "foo-bar-1" {
+		t.Errorf("Expected namespace foo-bar-1 to be deleted, but was %s", deleted)
+	}
+	if names, _ := GetAllGitlabOriginNamesFromNamespacesWithOriginLabel(); len(names) != 0 {
+		t.Errorf("Expected no namespaces with origin label, but found %v", names)
+	}
+}
+
+func TestGroupRoleBindings(t *testing.T) {
+	client := setupFakeClient(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo", Labels: map[string]string{"gitlab-origin": "foo"}}})
+
+	if err := CreateGroupRoleBinding("bob", "foo", "Developer"); err != nil {
+		t.Fatal(err)
+	}
+	rbName := ConstructRoleBindingName("bob", "gitlab-group-developer", "foo")
+
+	rb, err := client.RbacV1().RoleBindings("foo").Get(rbName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rb.RoleRef.Name != "gitlab-group-developer" || len(rb.Subjects) != 1 || rb.Subjects[0].Name != "bob" {
+		t.Errorf("RoleBinding %s has not been constructed correctly: %v", rbName, rb)
+	}
+	if rbs, _ := GetRoleBindingsByNamespace("foo"); !rbs[rbName] {
+		t.Errorf("Expected RoleBinding %s to be listed, but got %v", rbName, rbs)
+	}
+
+	if err := DeleteGroupRoleBinding("bob", "foo", "Developer"); err != nil {
+		t.Fatal(err)
+	}
+	if rbs, _ := GetRoleBindingsByNamespace("foo"); rbs[rbName] {
+		t.Errorf("Expected RoleBinding %s to be deleted", rbName)
+	}
+}
+
+func TestDeleteRoleBindingByNameRespectsIgnoredNamespace(t *testing.T) {
+	setupFakeClient(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "foo", Labels: map[string]string{"gitlab-origin": "foo", "gitlab-ignored": "true"}}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "custom", Namespace: "foo"}},
+	)
+
+	if err := DeleteProjectRoleBindingByName("custom", "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if rbs, _ := GetRoleBindingsByNamespace("foo"); !rbs["custom"] {
+		t.Error("RoleBinding in ignored namespace has been deleted")
+	}
+}
+
+func TestCreateNamespaceReturnsErrorForInvalidName(t *testing.T) {
+	setupFakeClient()
+
+	if _, err := CreateNamespace("-invalid-"); err == nil {
+		t.Error("Expected an error for an invalid namespace name")
+	}
+}
+
+func TestCreateNamespaceFailsWhileTerminating(t *testing.T) {
+	setupFakeClient(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "project", Labels: map[string]string{"gitlab-origin": "project"}},
+		Status: v1.NamespaceStatus{Phase: v1.NamespaceTerminating}})
+
+	if _, err := CreateNamespace("project"); err == nil {
+		t.Error("Expected an error for a terminating namespace")
+	}
+}
+
+func TestRepeatedHooksAreHarmless(t *testing.T) {
+	setupFakeClient()
+
+	for i := 0; i < 2; i++ {
+		if _, err := CreateNamespace("project"); err != nil {
+			t.Fatal(err)
+		}
+		if err := CreateProjectRoleBinding("alice", "project", "Developer"); err != nil {
+			t.Fatalf("Repeated creation of RoleBinding failed: %s", err)
+		}
+		if err := CreateGroupRoleBinding("alice", "project", "Developer"); err != nil {
+			t.Fatalf("Repeated creation of group RoleBinding failed: %s", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := DeleteProjectRoleBinding("alice", "project", "Developer"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := DeleteNamespace("project"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeleteNamespace("project"); err != nil {
+		t.Fatalf("Repeated deletion of namespace failed: %s", err)
+	}
+}
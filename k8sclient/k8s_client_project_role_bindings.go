@@ -3,16 +3,23 @@ package k8sclient
 import (
 	"log"
 
+	"github.com/k8s-tamias/gitlab-k8s-integrator/metrics"
+	"github.com/pkg/errors"
 	rbacv1 "k8s.io/api/rbac/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func CreateProjectRoleBinding(username, path, accessLevel string) {
-	ns := GetActualNameSpaceNameByGitlabName(path)
+func CreateProjectRoleBinding(username, path, accessLevel string) error {
+	ns, err := GetActualNameSpaceNameByGitlabName(path)
+	if err != nil {
+		return err
+	}
 	if ns == "" {
-		CreateNamespace(path)
-		ns = GetActualNameSpaceNameByGitlabName(path)
+		ns, err = CreateNamespace(path)
+		if err != nil {
+			return err
+		}
 	}
 	rolename := GetProjectRoleName(accessLevel)
 
@@ -20,39 +27,65 @@ func CreateProjectRoleBinding(username, path, accessLevel string) {
 		Subjects: []rbacv1.Subject{{Name: username, Kind: "User"}},
 		RoleRef:  rbacv1.RoleRef{Kind: "ClusterRole", Name: rolename, APIGroup: "rbac.authorization.k8s.io"}}
 
-	_, err := getK8sClient().RbacV1().RoleBindings(ns).Create(&rB)
+	client, err := getK8sClient()
+	if err != nil {
+		return err
+	}
+	_, err = client.RbacV1().RoleBindings(ns).Create(&rB)
 	if k8serrors.IsNotFound(err) {
-		CreateNamespace(path)
-		_, err = getK8sClient().RbacV1().RoleBindings(ns).Create(&rB)
+		if _, err := CreateNamespace(path); err != nil {
+			return err
+		}
+		_, err = client.RbacV1().RoleBindings(ns).Create(&rB)
+	}
+	if k8serrors.IsAlreadyExists(err) {
+		// the hook has been delivered before or the binding was created by a sync run
+		return nil
 	}
 	if check(err) {
-		log.Fatal("Communication with K8s Server threw error, while creating RoleBinding. Err: " + err.Error())
+		return errors.Wrapf(err, "Communication with K8s Server threw error, while creating RoleBinding %s", rB.Name)
 	}
+	metrics.ObjectChange(metrics.KindRoleBinding, metrics.ActionCreated)
+	return nil
 }
 
-func DeleteProjectRoleBinding(username, path, accessLevel string) {
-	ns, err := GitlabNameToK8sNamespace(path)
-	if check(err) {
-		log.Fatal(err)
+func DeleteProjectRoleBinding(username, path, accessLevel string) error {
+	ns, err := GetActualNameSpaceNameByGitlabName(path)
+	if err != nil {
+		return err
+	}
+	if ns == "" {
+		// without a namespace there is no RoleBinding to delete
+		return nil
 	}
 
 	rolename := GetProjectRoleName(accessLevel)
 
 	if rolename != "" {
-		roleBindingName := ConstructRoleBindingName(username, rolename, GetActualNameSpaceNameByGitlabName(path))
-		DeleteProjectRoleBindingByName(roleBindingName, ns)
+		roleBindingName := ConstructRoleBindingName(username, rolename, ns)
+		return DeleteProjectRoleBindingByName(roleBindingName, ns)
 	}
+	return nil
 }
 
-func DeleteProjectRoleBindingByName(roleBindingName, actualNamespace string) {
-	ns, errGetNs := getK8sClient().CoreV1().Namespaces().Get(actualNamespace, metav1.GetOptions{})
-	if check(errGetNs) {
-		log.Fatal("Error while retrieving namespace. Error: " + errGetNs.Error())
+func DeleteProjectRoleBindingByName(roleBindingName, actualNamespace string) error {
+	ignored, err := IsNamespaceIgnored(actualNamespace)
+	if err != nil {
+		return err
 	}
-	if ns.Labels["gitlab-ignored"] == "" {
-		err := getK8sClient().RbacV1().RoleBindings(actualNamespace).Delete(roleBindingName, &metav1.DeleteOptions{})
-		if check(err) {
+	if !ignored {
+		client, err := getK8sClient()
+		if err != nil {
+			return err
+		}
+		err = client.RbacV1().RoleBindings(actualNamespace).Delete(roleBindingName, &metav1.DeleteOptions{})
+		if k8serrors.IsNotFound(err) {
 			log.Println("WARNING: Communication with K8s Server threw error, while deleting RoleBinding. Err: " + err.Error())
+		} else if check(err) {
+			return errors.Wrapf(err, "Communication with K8s Server threw error, while deleting RoleBinding %s", roleBindingName)
+		} else {
+			metrics.ObjectChange(metrics.KindRoleBinding, metrics.ActionDeleted)
 		}
 	}
+	return nil
 }
@@ -0,0 +1,301 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/metrics"
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// ReviewOfLabel holds the origin label of the project a review namespace belongs to
+	ReviewOfLabel = "gitlab-review-of"
+	// ReviewIIDLabel holds the iid of the merge request a review namespace belongs to
+	ReviewIIDLabel = "gitlab-review-iid"
+	// ReviewActivityAnnotation holds the time of the last merge request event, from which the TTL is counted
+	ReviewActivityAnnotation = "gitlab-k8s-integrator/review-last-activity"
+)
+
+// EnsureReviewNamespace creates the namespace <project-ns>-mr-<iid> for an open merge request, or refreshes its last
+// activity if it is present. The namespace gets its own ServiceAccount and copies of the project's member RoleBindings.
+// It carries no gitlab-origin label, so the sync leaves it alone.
+func EnsureReviewNamespace(projectPath string, iid int) (string, error) {
+	projectNs, err := GetActualNameSpaceNameByGitlabName(projectPath)
+	if err != nil {
+		return "", err
+	}
+	if projectNs == "" {
+		return "", errors.New("No namespace has been found for " + projectPath)
+	}
+	projectLabel, err := GitlabNameToK8sLabel(projectPath)
+	if check(err) {
+		return "", errors.Wrapf(err, "Error while transforming gitlab name %s to k8s label", projectPath)
+	}
+
+	name := reviewNamespaceName(projectNs, iid)
+	// a review namespace keeps its name when its project is renamed or transferred, so it is looked up by its labels
+	if existing, err := findReviewNamespace(projectLabel, iid); err != nil {
+		return "", err
+	} else if existing != "" {
+		name = existing
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	client, err := getK8sClient()
+	if err != nil {
+		return "", err
+	}
+	_, err = client.CoreV1().Namespaces().Create(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        name,
+		Labels:      map[string]string{ReviewOfLabel: projectLabel, ReviewIIDLabel: strconv.Itoa(iid)},
+		Annotations: map[string]string{ReviewActivityAnnotation: now},
+	}})
+	if k8serrors.IsAlreadyExists(err) {
+		ns, err := client.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
+		if check(err) {
+			return "", errors.Wrapf(err, "Error while retrieving namespace %s", name)
+		}
+		if ns.Labels[ReviewOfLabel] != projectLabel || ns.Labels[ReviewIIDLabel] != strconv.Itoa(iid) || ns.Labels["gitlab-origin"] != "" {
+			return "", errors.Errorf("Namespace %s is taken and no review namespace of %s!%d", name, projectPath, iid)
+		}
+		if ns.Annotations == nil {
+			ns.Annotations = map[string]string{}
+		}
+		ns.Annotations[ReviewActivityAnnotation] = now
+		if _, err := client.CoreV1().Namespaces().Update(ns); check(err) {
+			return "", errors.Wrapf(err, "Error while updating namespace %s", name)
+		}
+	} else if check(err) {
+		return "", errors.Wrapf(err, "Creation of review Namespace %s for %s!%d failed", name, projectPath, iid)
+	} else {
+		metrics.ObjectChange(metrics.KindNamespace, metrics.ActionCreated)
+		log.Println(fmt.Sprintf("Succesfully created review Namespace %s for %s!%d", name, projectPath, iid))
+	}
+
+	if err := DeployNamespaceDefaults(name); err != nil {
+		return name, err
+	}
+	if err := createReviewServiceAccount(name); err != nil {
+		return name, err
+	}
+	return name, syncReviewRoleBindings(projectNs, name)
+}
+
+// findReviewNamespace returns the name of the review namespace of a merge request or an empty string if there is none
+func findReviewNamespace(projectLabel string, iid int) (string, error) {
+	client, err := getK8sClient()
+	if err != nil {
+		return "", err
+	}
+	namespaces, err := client.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: ReviewOfLabel + "=" + projectLabel + "," + ReviewIIDLabel + "=" + strconv.Itoa(iid)})
+	if check(err) {
+		return "", errors.Wrap(err, "Error while retrieving review namespaces")
+	}
+	for _, ns := range namespaces.Items {
+		if ns.Labels["gitlab-origin"] == "" {
+			return ns.Name, nil
+		}
+	}
+	return "", nil
+}
+
+// relabelReviewNamespaces moves the review namespaces of a renamed or transferred project to its new path, so that
+// they are still found by the merge request events and deleted with their merge request. They keep their names.
+func relabelReviewNamespaces(oldLabel, newLabel string) error {
+	client, err := getK8sClient()
+	if err != nil {
+		return err
+	}
+	namespaces, err := client.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: ReviewOfLabel + "=" + oldLabel})
+	if check(err) {
+		return errors.Wrap(err, "Error while retrieving review namespaces")
+	}
+	for _, ns := range namespaces.Items {
+		if ns.Labels["gitlab-origin"] != "" {
+			continue
+		}
+		ns.Labels[ReviewOfLabel] = newLabel
+		if _, err := client.CoreV1().Namespaces().Update(&ns); check(err) {
+			return errors.Wrapf(err, "Error while relabeling review namespace %s", ns.Name)
+		}
+		log.Println(fmt.Sprintf("Relabeled review namespace %s from %s to %s", ns.Name, oldLabel, newLabel))
+	}
+	return nil
+}
+
+// DeleteReviewNamespace deletes the review namespace of a merged or closed merge request
+func DeleteReviewNamespace(projectPath string, iid int) error {
+	projectLabel, err := GitlabNameToK8sLabel(projectPath)
+	if check(err) {
+		return errors.Wrapf(err, "Error while transforming gitlab name %s to k8s label", projectPath)
+	}
+	_, err = deleteReviewNamespaces(ReviewOfLabel+"="+projectLabel+","+ReviewIIDLabel+"="+strconv.Itoa(iid), time.Time{})
+	return err
+}
+
+// DeleteReviewNamespacesOfProject deletes the review namespaces of all merge requests of a project
+func DeleteReviewNamespacesOfProject(projectPath string) error {
+	projectLabel, err := GitlabNameToK8sLabel(projectPath)
+	if check(err) {
+		return errors.Wrapf(err, "Error while transforming gitlab name %s to k8s label", projectPath)
+	}
+	_, err = deleteReviewNamespaces(ReviewOfLabel+"="+projectLabel, time.Time{})
+	return err
+}
+
+// DeleteExpiredReviewNamespaces deletes all review namespaces without merge request event for longer than ttl
+func DeleteExpiredReviewNamespaces(ttl time.Duration) ([]string, error) {
+	return deleteReviewNamespaces(ReviewOfLabel, time.Now().Add(-ttl))
+}
+
+// deleteReviewNamespaces deletes the review namespaces matching the selector, whose last activity was before the
+// given time, or all if it is zero. Namespaces with a gitlab-origin label are managed by the sync and never deleted,
+// even if they carry review labels.
+func deleteReviewNamespaces(selector string, activeBefore time.Time) ([]string, error) {
+	client, err := getK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := client.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: selector})
+	if check(err) {
+		return nil, errors.Wrap(err, "Error while retrieving review namespaces")
+	}
+
+	var deleted, messages []string
+	for _, ns := range namespaces.Items {
+		if ns.Labels["gitlab-origin"] != "" {
+			log.Println(fmt.Sprintf("WARNING: Namespace %s carries review labels, but is managed by the sync, not deleting it", ns.Name))
+			continue
+		}
+		if !activeBefore.IsZero() {
+			lastActivity := ns.CreationTimestamp.Time
+			if t, err := time.Parse(time.RFC3339, ns.Annotations[ReviewActivityAnnotation]); err == nil {
+				lastActivity = t
+			}
+			if !lastActivity.Before(activeBefore) {
+				continue
+			}
+		}
+		err := client.CoreV1().Namespaces().Delete(ns.Name, &metav1.DeleteOptions{})
+		if k8serrors.IsNotFound(err) {
+			continue
+		}
+		if check(err) {
+			messages = append(messages, fmt.Sprintf("%s: %s", ns.Name, err))
+			continue
+		}
+		metrics.ObjectChange(metrics.KindNamespace, metrics.ActionDeleted)
+		log.Println(fmt.Sprintf("Deleted review Namespace %s", ns.Name))
+		deleted = append(deleted, ns.Name)
+	}
+	if len(messages) > 0 {
+		return deleted, errors.Errorf("Deletion of review namespaces failed: %s", strings.Join(messages, "; "))
+	}
+	return deleted, nil
+}
+
+// reviewNamespaceName shortens the project namespace if the name would exceed the maximum length of a namespace
+func reviewNamespaceName(projectNs string, iid int) string {
+	suffix := fmt.Sprintf("-mr-%d", iid)
+	if len(projectNs)+len(suffix) > validation.DNS1123LabelMaxLength {
+		projectNs = strings.TrimRight(projectNs[:validation.DNS1123LabelMaxLength-len(suffix)], "-.")
+	}
+	return projectNs + suffix
+}
+
+// createReviewServiceAccount creates the ServiceAccount of a review namespace, bound to the Master role like the
+// ServiceAccount of the project
+func createReviewServiceAccount(ns string) error {
+	name, err := GetServiceAccountName()
+	if err != nil {
+		return err
+	}
+	client, err := getK8sClient()
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().ServiceAccounts(ns).Create(&v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns}})
+	if err == nil {
+		metrics.ObjectChange(metrics.KindServiceAccount, metrics.ActionCreated)
+	} else if !k8serrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "Error while creating ServiceAccount in %s", ns)
+	}
+
+	rB := rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns},
+		Subjects: []rbacv1.Subject{{Name: name, Kind: "ServiceAccount", Namespace: ns}},
+		RoleRef:  rbacv1.RoleRef{Kind: "ClusterRole", Name: GetProjectRoleName("Master"), APIGroup: "rbac.authorization.k8s.io"}}
+	_, err = client.RbacV1().RoleBindings(ns).Create(&rB)
+	if err == nil {
+		metrics.ObjectChange(metrics.KindRoleBinding, metrics.ActionCreated)
+	} else if !k8serrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "Error while creating ServiceAccount RoleBinding in %s", ns)
+	}
+	return nil
+}
+
+// syncReviewRoleBindings copies the member RoleBindings of the project namespace, which are named after it,
+// to the review namespace and deletes the copies of members which left the project
+func syncReviewRoleBindings(projectNs, reviewNs string) error {
+	client, err := getK8sClient()
+	if err != nil {
+		return err
+	}
+	projectRbs, err := client.RbacV1().RoleBindings(projectNs).List(metav1.ListOptions{})
+	if check(err) {
+		return errors.Wrapf(err, "Error while retrieving rolebindings for namespace %s", projectNs)
+	}
+	present, err := GetRoleBindingsByNamespace(reviewNs)
+	if err != nil {
+		return err
+	}
+
+	expected := map[string]bool{}
+	for _, rb := range projectRbs.Items {
+		if !strings.HasSuffix(rb.Name, "-"+projectNs) {
+			continue
+		}
+		name := strings.TrimSuffix(rb.Name, projectNs) + reviewNs
+		expected[name] = true
+		if present[name] {
+			continue
+		}
+		copied := rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: reviewNs}, Subjects: rb.Subjects, RoleRef: rb.RoleRef}
+		_, err := client.RbacV1().RoleBindings(reviewNs).Create(&copied)
+		if err != nil && !k8serrors.IsAlreadyExists(err) {
+			return errors.Wrapf(err, "Error while creating RoleBinding %s", name)
+		}
+		metrics.ObjectChange(metrics.KindRoleBinding, metrics.ActionCreated)
+	}
+
+	for name := range present {
+		if strings.HasSuffix(name, "-"+reviewNs) && !expected[name] {
+			if err := DeleteProjectRoleBindingByName(name, reviewNs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestReviewNamespaceLifecycle(t *testing.T) {
+	client := setupFakeClient(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "group-project", Labels: map[string]string{"gitlab-origin": "group_project"}}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "alice-gitlab-project-master-group-project", Namespace: "group-project"},
+			Subjects: []rbacv1.Subject{{Kind: "User", Name: "alice"}}, RoleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "gitlab-project-master"}},
+	)
+
+	ns, err := EnsureReviewNamespace("group/project", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ns != "group-project-mr-7" {
+		t.Fatalf("Expected review namespace group-project-mr-7, but was %s", ns)
+	}
+	bindings, _ := GetRoleBindingsByNamespace(ns)
+	if !bindings["alice-gitlab-project-master-group-project-mr-7"] || !bindings["gitlab-serviceaccount"] {
+		t.Errorf("Expected member and ServiceAccount RoleBindings, but found %v", bindings)
+	}
+	if _, err := client.CoreV1().ServiceAccounts(ns).Get("gitlab-serviceaccount", metav1.GetOptions{}); err != nil {
+		t.Errorf("Expected ServiceAccount in review namespace: %s", err)
+	}
+	if origin, _ := GetAllGitlabOriginNamesFromNamespacesWithOriginLabel(); len(origin) != 1 {
+		t.Errorf("Expected review namespace not to be seen by the sync, but origins were %v", origin)
+	}
+
+	// a second event must keep the namespace
+	if again, err := EnsureReviewNamespace("group/project", 7); err != nil || again != ns {
+		t.Errorf("Expected review namespace %s to be kept, but was %s (%v)", ns, again, err)
+	}
+	if expired, _ := DeleteExpiredReviewNamespaces(time.Hour); len(expired) != 0 {
+		t.Errorf("Expected no review namespace to expire, but %v did", expired)
+	}
+
+	if err := DeleteReviewNamespace("group/project", 7); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CoreV1().Namespaces().Get(ns, metav1.GetOptions{}); err == nil {
+		t.Error("Expected review namespace to be deleted")
+	}
+}
+
+func TestDeleteExpiredReviewNamespaces(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)
+	setupFakeClient(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "project-mr-1",
+		Labels:      map[string]string{ReviewOfLabel: "project", ReviewIIDLabel: "1"},
+		Annotations: map[string]string{ReviewActivityAnnotation: old}}},
+		// adopted by the sync before review namespaces were protected from it
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "project-mr-2",
+			Labels:      map[string]string{ReviewOfLabel: "project", ReviewIIDLabel: "2", "gitlab-origin": "project-mr-2"},
+			Annotations: map[string]string{ReviewActivityAnnotation: old}}})
+
+	expired, err := DeleteExpiredReviewNamespaces(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0] != "project-mr-1" {
+		t.Errorf("Expected project-mr-1 to expire, but expired were %v", expired)
+	}
+}
+
+func TestReviewNamespaceNameLength(t *testing.T) {
+	name := reviewNamespaceName(strings.Repeat("a", 60), 1234)
+	if len(name) > 63 || !strings.HasSuffix(name, "-mr-1234") {
+		t.Errorf("Expected a valid namespace name ending with -mr-1234, but was %s", name)
+	}
+}
+
+func TestReviewNamespacesFollowTheirProject(t *testing.T) {
+	client := setupFakeClient(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "group-old", Labels: map[string]string{"gitlab-origin": "group_old"}}})
+	ns, err := EnsureReviewNamespace("group/old", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := MigrateNamespace("group/old", "group/new"); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := EnsureReviewNamespace("group/new", 3); err != nil || again != ns {
+		t.Errorf("Expected review namespace %s to be kept after the rename, but was %s (%v)", ns, again, err)
+	}
+	if err := DeleteReviewNamespace("group/new", 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CoreV1().Namespaces().Get(ns, metav1.GetOptions{}); err == nil {
+		t.Error("Expected the review namespace to be deleted with the merge request of the renamed project")
+	}
+}
@@ -0,0 +1,90 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/pkg/errors"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// UpdateProjectRoleBinding replaces the RoleBinding of a project member with the one for the new access level
+func UpdateProjectRoleBinding(username, path, accessLevel string) error {
+	roles := config.Get().Roles
+	allRoles := []string{roles.ProjectMaster, roles.ProjectDeveloper, roles.ProjectReporter, roles.ProjectDefault}
+	return updateRoleBinding(username, path, GetProjectRoleName(accessLevel), allRoles, func() error {
+		return CreateProjectRoleBinding(username, path, accessLevel)
+	}, DeleteProjectRoleBindingByName)
+}
+
+// UpdateGroupRoleBinding replaces the RoleBinding of a group member with the one for the new access level
+func UpdateGroupRoleBinding(username, path, accessLevel string) error {
+	roles := config.Get().Roles
+	allRoles := []string{roles.GroupMaster, roles.GroupDeveloper, roles.GroupReporter, roles.GroupDefault}
+	return updateRoleBinding(username, path, GetGroupRoleName(accessLevel), allRoles, func() error {
+		return CreateGroupRoleBinding(username, path, accessLevel)
+	}, DeleteGroupRoleBindingByName)
+}
+
+// updateRoleBinding creates the binding to the new role before deleting the bindings to all other roles,
+// so a member never loses access while the role changes
+func updateRoleBinding(username, path, newRole string, allRoles []string, create func() error, deleteByName func(name, ns string) error) error {
+	ns, err := GetActualNameSpaceNameByGitlabName(path)
+	if err != nil {
+		return err
+	}
+
+	present := false
+	if ns != "" {
+		client, err := getK8sClient()
+		if err != nil {
+			return err
+		}
+		_, err = client.RbacV1().RoleBindings(ns).Get(ConstructRoleBindingName(username, newRole, ns), metav1.GetOptions{})
+		if err != nil && !k8serrors.IsNotFound(err) {
+			return errors.Wrapf(err, "Error while retrieving RoleBindings of %s in %s", username, ns)
+		}
+		present = err == nil
+	}
+	if !present {
+		if err := create(); err != nil {
+			return err
+		}
+		if ns, err = GetActualNameSpaceNameByGitlabName(path); err != nil {
+			return err
+		}
+	}
+
+	existing, err := GetRoleBindingsByNamespace(ns)
+	if err != nil {
+		return err
+	}
+	for _, role := range allRoles {
+		name := ConstructRoleBindingName(username, role, ns)
+		if role == newRole || !existing[name] {
+			continue
+		}
+		if err := deleteByName(name, ns); err != nil {
+			return err
+		}
+	}
+	log.Println(fmt.Sprintf("INFO: Updated RoleBinding of user %s in namespace %s to %s", username, ns, newRole))
+	return nil
+}
@@ -0,0 +1,71 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUpdateProjectRoleBinding(t *testing.T) {
+	setupFakeClient(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "project", Labels: map[string]string{"gitlab-origin": "project"}}})
+
+	if err := CreateProjectRoleBinding("alice", "project", "Maintainer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateProjectRoleBinding("alice", "project", "Reporter"); err != nil {
+		t.Fatal(err)
+	}
+
+	bindings, err := GetRoleBindingsByNamespace("project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reporter := ConstructRoleBindingName("alice", GetProjectRoleName("Reporter"), "project")
+	if len(bindings) != 1 || !bindings[reporter] {
+		t.Errorf("Expected only RoleBinding %s, but found %v", reporter, bindings)
+	}
+
+	// an update to the present level keeps the binding
+	if err := UpdateProjectRoleBinding("alice", "project", "Reporter"); err != nil {
+		t.Fatal(err)
+	}
+	if bindings, _ := GetRoleBindingsByNamespace("project"); len(bindings) != 1 || !bindings[reporter] {
+		t.Errorf("Expected only RoleBinding %s, but found %v", reporter, bindings)
+	}
+}
+
+func TestUpdateGroupRoleBinding(t *testing.T) {
+	setupFakeClient(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "group", Labels: map[string]string{"gitlab-origin": "group"}}})
+
+	if err := CreateGroupRoleBinding("bob", "group", "Developer"); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateGroupRoleBinding("bob", "group", "Maintainer"); err != nil {
+		t.Fatal(err)
+	}
+
+	bindings, err := GetRoleBindingsByNamespace("group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	master := ConstructRoleBindingName("bob", GetGroupRoleName("Master"), "group")
+	if len(bindings) != 1 || !bindings[master] {
+		t.Errorf("Expected only RoleBinding %s, but found %v", master, bindings)
+	}
+}
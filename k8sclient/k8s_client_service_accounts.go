@@ -1,14 +1,14 @@
 package k8sclient
 
 import (
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/metrics"
 	"github.com/pkg/errors"
 	"k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/validation"
-	"log"
-	"os"
 	"time"
 )
 
@@ -22,10 +22,22 @@ type ServiceAccountInfo struct {
 // If either of the two already exists, it will instead return their information to the caller
 // returns (InfoAboutServiceAccount, RoleBindingName, error)
 func CreateServiceAccountAndRoleBinding(fullProjectPath string) (ServiceAccountInfo, string, error) {
-	name := getServiceAccountName()
-	namespace := GetActualNameSpaceNameByGitlabName(fullProjectPath)
+	name, err := GetServiceAccountName()
+	if err != nil {
+		return ServiceAccountInfo{}, "", err
+	}
+	namespace, err := GetActualNameSpaceNameByGitlabName(fullProjectPath)
+	if err != nil {
+		return ServiceAccountInfo{}, "", err
+	}
+	if namespace == "" {
+		return ServiceAccountInfo{}, "", errors.New("No namespace has been found for " + fullProjectPath)
+	}
 
-	client := getK8sClient()
+	client, err := getK8sClient()
+	if err != nil {
+		return ServiceAccountInfo{}, "", err
+	}
 
 	sa := &v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
 
@@ -39,6 +51,8 @@ func CreateServiceAccountAndRoleBinding(fullProjectPath string) (ServiceAccountI
 		}
 	} else if err != nil {
 		return ServiceAccountInfo{}, "", err
+	} else {
+		metrics.ObjectChange(metrics.KindServiceAccount, metrics.ActionCreated)
 	}
 
 	// try to retrieve ServiceAccount once as the newly created one won't have the secret set
@@ -64,6 +78,9 @@ func CreateServiceAccountAndRoleBinding(fullProjectPath string) (ServiceAccountI
 
 	secretName := serviceAccount.Secrets[0].Name
 	saSecret, err := client.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+	if err != nil {
+		return ServiceAccountInfo{}, "", err
+	}
 	token := saSecret.Data["token"]
 	if len(token) <= 0 {
 		return ServiceAccountInfo{}, "", errors.New("The token field in the Secret's data was empty!")
@@ -72,15 +89,23 @@ func CreateServiceAccountAndRoleBinding(fullProjectPath string) (ServiceAccountI
 	tokenAsString := string(token[:])
 
 	sAI := ServiceAccountInfo{Namespace: namespace, Name: name, Token: tokenAsString}
-	rbName := createServiceAccountRoleBinding(name, fullProjectPath)
+	rbName, err := createServiceAccountRoleBinding(name, fullProjectPath)
+	if err != nil {
+		return ServiceAccountInfo{}, "", err
+	}
 	return sAI, rbName, nil
 }
 
-func createServiceAccountRoleBinding(saName, path string) string {
-	ns := GetActualNameSpaceNameByGitlabName(path)
+func createServiceAccountRoleBinding(saName, path string) (string, error) {
+	ns, err := GetActualNameSpaceNameByGitlabName(path)
+	if err != nil {
+		return "", err
+	}
 	if ns == "" {
-		CreateNamespace(path)
-		ns = GetActualNameSpaceNameByGitlabName(path)
+		ns, err = CreateNamespace(path)
+		if err != nil {
+			return "", err
+		}
 	}
 	// ServiceAccounts are always bound to Master roles
 	rolename := GetProjectRoleName("Master")
@@ -89,23 +114,31 @@ func createServiceAccountRoleBinding(saName, path string) string {
 		Subjects: []rbacv1.Subject{{Name: saName, Kind: "ServiceAccount", Namespace: ns}},
 		RoleRef:  rbacv1.RoleRef{Kind: "ClusterRole", Name: rolename, APIGroup: "rbac.authorization.k8s.io"}}
 
-	_, err := getK8sClient().RbacV1().RoleBindings(ns).Create(&rB)
+	client, err := getK8sClient()
+	if err != nil {
+		return "", err
+	}
+	_, err = client.RbacV1().RoleBindings(ns).Create(&rB)
 	if err != nil && k8serrors.IsNotFound(err) {
-		CreateNamespace(path)
-		_, err = getK8sClient().RbacV1().RoleBindings(ns).Create(&rB)
+		if _, err := CreateNamespace(path); err != nil {
+			return "", err
+		}
+		_, err = client.RbacV1().RoleBindings(ns).Create(&rB)
 	}
 	if err != nil && !k8serrors.IsAlreadyExists(err) {
-		log.Fatal("Communication with K8s Server threw error, while creating ServiceAccount RoleBinding. Err: " + err.Error())
+		return "", errors.Wrap(err, "Communication with K8s Server threw error, while creating ServiceAccount RoleBinding")
+	}
+	if err == nil {
+		metrics.ObjectChange(metrics.KindRoleBinding, metrics.ActionCreated)
 	}
-	return rB.Name
+	return rB.Name, nil
 }
 
-func getServiceAccountName() string {
-	name := os.Getenv("GITLAB_SERVICEACCOUNT_NAME")
-	if name == "" {
-		name = "gitlab-serviceaccount"
-	} else if errs := validation.IsDNS1123Label(name); len(errs) != 0 {
-		log.Fatalf("The provided value for GITLAB_SERVICEACCOUNT_NAME is not a DNS-1123 compliant name!")
+// GetServiceAccountName returns the name of the ServiceAccount which is created in each namespace
+func GetServiceAccountName() (string, error) {
+	name := config.Get().Gitlab.ServiceAccountName
+	if errs := validation.IsDNS1123Label(name); len(errs) != 0 {
+		return "", errors.New("The provided value for GITLAB_SERVICEACCOUNT_NAME is not a DNS-1123 compliant name!")
 	}
-	return name
+	return name, nil
 }
@@ -0,0 +1,389 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/metrics"
+	"github.com/pkg/errors"
+	rbacv1 "k8s.io/api/rbac/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// AccessRevokedLabel marks the personal namespace of a user whose access has been revoked
+	AccessRevokedLabel = "gitlab-access-revoked"
+	// ReplicasAnnotation keeps the replicas of a workload scaled down on revocation, so they can be restored
+	ReplicasAnnotation = "gitlab-k8s-integrator/replicas-before-revocation"
+)
+
+// RenameUser moves the personal namespace and all RoleBindings of a renamed Gitlab user to the new username.
+// The personal namespace keeps its name and only gets the origin label of the new username. RoleBindings which
+// are named after the old username are recreated under the new name, all others get their subjects updated. Like
+// RevokeUserAccess, only the namespaces managed by the integrator are changed.
+func RenameUser(oldUsername, newUsername string) error {
+	if err := relabelNamespace(oldUsername, newUsername); err != nil {
+		return err
+	}
+
+	namespaces, err := getManagedNamespaces()
+	if err != nil {
+		return err
+	}
+	client, err := getK8sClient()
+	if err != nil {
+		return err
+	}
+	var messages []string
+	for _, ns := range namespaces {
+		rbs, err := client.RbacV1().RoleBindings(ns).List(metav1.ListOptions{})
+		if check(err) {
+			messages = append(messages, fmt.Sprintf("Error while retrieving rolebindings of %s: %s", ns, err))
+			continue
+		}
+		for _, rb := range rbs.Items {
+			if !renameSubjects(&rb, oldUsername, newUsername) {
+				continue
+			}
+			if err := updateRenamedRoleBinding(rb, oldUsername, newUsername); err != nil {
+				messages = append(messages, err.Error())
+			}
+		}
+	}
+	if len(messages) > 0 {
+		return errors.Errorf("Renaming user %s to %s failed: %s", oldUsername, newUsername, strings.Join(messages, "; "))
+	}
+	log.Println(fmt.Sprintf("Renamed user %s to %s", oldUsername, newUsername))
+	return nil
+}
+
+// relabelNamespace points the namespace of a Gitlab entity to its new path without changing the namespace name
+func relabelNamespace(oldPath, newPath string) error {
+	ns, err := GetActualNameSpaceNameByGitlabName(oldPath)
+	if err != nil || ns == "" {
+		return err
+	}
+	newLabel, err := GitlabNameToK8sLabel(newPath)
+	if check(err) {
+		return errors.Wrapf(err, "Error while transforming gitlab name %s to k8s label", newPath)
+	}
+	client, err := getK8sClient()
+	if err != nil {
+		return err
+	}
+	namespace, err := client.CoreV1().Namespaces().Get(ns, metav1.GetOptions{})
+	if check(err) {
+		return errors.Wrapf(err, "Error while retrieving namespace %s", ns)
+	}
+	namespace.Labels["gitlab-origin"] = newLabel
+	if _, err := client.CoreV1().Namespaces().Update(namespace); check(err) {
+		return errors.Wrapf(err, "Error while relabeling namespace %s", ns)
+	}
+	log.Println(fmt.Sprintf("Relabeled namespace %s from %s to %s", ns, oldPath, newPath))
+	return nil
+}
+
+// renameSubjects replaces the old username in the User subjects of the RoleBinding and reports whether it did so
+func renameSubjects(rb *rbacv1.RoleBinding, oldUsername, newUsername string) bool {
+	renamed := false
+	for i, subject := range rb.Subjects {
+		if subject.Kind == "User" && subject.Name == oldUsername {
+			rb.Subjects[i].Name = newUsername
+			renamed = true
+		}
+	}
+	return renamed
+}
+
+func updateRenamedRoleBinding(rb rbacv1.RoleBinding, oldUsername, newUsername string) error {
+	client, err := getK8sClient()
+	if err != nil {
+		return err
+	}
+	if rb.Name != ConstructRoleBindingName(oldUsername, rb.RoleRef.Name, rb.Namespace) {
+		_, err := client.RbacV1().RoleBindings(rb.Namespace).Update(&rb)
+		return errors.Wrapf(err, "Error while updating RoleBinding %s in %s", rb.Name, rb.Namespace)
+	}
+
+	// the names of RoleBindings can't be changed, so the binding is replaced
+	oldName := rb.Name
+	renamed := rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: ConstructRoleBindingName(newUsername, rb.RoleRef.Name, rb.Namespace), Namespace: rb.Namespace, Labels: rb.Labels, Annotations: rb.Annotations},
+		Subjects:   rb.Subjects,
+		RoleRef:    rb.RoleRef,
+	}
+	_, err = client.RbacV1().RoleBindings(rb.Namespace).Create(&renamed)
+	if err == nil {
+		metrics.ObjectChange(metrics.KindRoleBinding, metrics.ActionCreated)
+	} else if !k8serrors.IsAlreadyExists(err) {
+		return errors.Wrapf(err, "Error while creating RoleBinding %s in %s", renamed.Name, rb.Namespace)
+	}
+	err = client.RbacV1().RoleBindings(rb.Namespace).Delete(oldName, &metav1.DeleteOptions{})
+	if err == nil {
+		metrics.ObjectChange(metrics.KindRoleBinding, metrics.ActionDeleted)
+	} else if !k8serrors.IsNotFound(err) {
+		return errors.Wrapf(err, "Error while deleting RoleBinding %s in %s", oldName, rb.Namespace)
+	}
+	return nil
+}
+
+// RevokeUserAccess removes the given users from the subjects of all RoleBindings in the namespaces of Gitlab entities
+// and in review namespaces, except ignored ones, and deletes RoleBindings left without subjects. Namespaces not
+// managed by the integrator are left alone. The personal namespaces are labeled, so the access gets restored on
+// reactivation, and optionally scaled down. It may be called repeatedly, e.g. to revoke bindings created meanwhile.
+func RevokeUserAccess(scaleDown bool, usernames ...string) error {
+	if len(usernames) == 0 {
+		return nil
+	}
+	revoked := map[string]bool{}
+	for _, username := range usernames {
+		revoked[username] = true
+	}
+
+	namespaces, err := getManagedNamespaces()
+	if err != nil {
+		return err
+	}
+	var messages []string
+	for _, ns := range namespaces {
+		messages = append(messages, revokeRoleBindings(ns, revoked)...)
+	}
+
+	for _, username := range usernames {
+		if err := markRevokedNamespace(username, scaleDown); err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+	if len(messages) > 0 {
+		return errors.Errorf("Revoking access of %s failed: %s", strings.Join(usernames, ", "), strings.Join(messages, "; "))
+	}
+	return nil
+}
+
+// getManagedNamespaces returns the namespaces of Gitlab entities and the review namespaces, except ignored ones
+func getManagedNamespaces() ([]string, error) {
+	client, err := getK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	var managed []string
+	for _, selector := range []string{"gitlab-origin", ReviewOfLabel} {
+		namespaces, err := client.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: selector})
+		if check(err) {
+			return nil, errors.Wrap(err, "Error while retrieving namespaces")
+		}
+		for _, ns := range namespaces.Items {
+			if ns.Labels["gitlab-ignored"] != "" {
+				continue
+			}
+			managed = append(managed, ns.Name)
+		}
+	}
+	return managed, nil
+}
+
+// revokeRoleBindings removes the revoked users from the subjects of the RoleBindings of a namespace and returns
+// the problems which occurred
+func revokeRoleBindings(namespace string, revoked map[string]bool) []string {
+	client, err := getK8sClient()
+	if err != nil {
+		return []string{err.Error()}
+	}
+	rbs, err := client.RbacV1().RoleBindings(namespace).List(metav1.ListOptions{})
+	if check(err) {
+		return []string{fmt.Sprintf("Error while retrieving rolebindings of %s: %s", namespace, err)}
+	}
+
+	var messages []string
+	for _, rb := range rbs.Items {
+		kept := make([]rbacv1.Subject, 0, len(rb.Subjects))
+		for _, subject := range rb.Subjects {
+			if subject.Kind != "User" || !revoked[subject.Name] {
+				kept = append(kept, subject)
+			}
+		}
+		if len(kept) == len(rb.Subjects) {
+			continue
+		}
+
+		if len(kept) == 0 {
+			err = client.RbacV1().RoleBindings(rb.Namespace).Delete(rb.Name, &metav1.DeleteOptions{})
+			if err == nil {
+				metrics.ObjectChange(metrics.KindRoleBinding, metrics.ActionDeleted)
+			}
+		} else {
+			rb.Subjects = kept
+			_, err = client.RbacV1().RoleBindings(rb.Namespace).Update(&rb)
+		}
+		if err != nil && !k8serrors.IsNotFound(err) {
+			messages = append(messages, fmt.Sprintf("Error while revoking RoleBinding %s in %s: %s", rb.Name, rb.Namespace, err))
+			continue
+		}
+		log.Println(fmt.Sprintf("INFO: Revoked RoleBinding %s in namespace %s", rb.Name, rb.Namespace))
+	}
+	return messages
+}
+
+// RestoreUserAccess scales up the personal namespace of a reactivated user and removes its revocation label.
+// The RoleBindings are not restored here, the caller recreates them from the memberships of the user in Gitlab. It
+// returns false if the access of the user had not been revoked.
+func RestoreUserAccess(username string) (bool, error) {
+	ns, err := GetActualNameSpaceNameByGitlabName(username)
+	if err != nil || ns == "" {
+		return false, err
+	}
+	client, err := getK8sClient()
+	if err != nil {
+		return false, err
+	}
+	namespace, err := client.CoreV1().Namespaces().Get(ns, metav1.GetOptions{})
+	if check(err) {
+		return false, errors.Wrapf(err, "Error while retrieving namespace %s", ns)
+	}
+	if namespace.Labels[AccessRevokedLabel] == "" {
+		return false, nil
+	}
+
+	if err := scaleNamespace(ns, ReplicasAnnotation, false); err != nil {
+		return false, err
+	}
+	delete(namespace.Labels, AccessRevokedLabel)
+	if _, err := client.CoreV1().Namespaces().Update(namespace); check(err) {
+		return false, errors.Wrapf(err, "Error while updating namespace %s", ns)
+	}
+	log.Println(fmt.Sprintf("INFO: Restored access of user %s", username))
+	return true, nil
+}
+
+// GetUsersWithRevokedAccess returns the usernames whose personal namespace is labeled as revoked
+func GetUsersWithRevokedAccess() ([]string, error) {
+	client, err := getK8sClient()
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := client.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: AccessRevokedLabel})
+	if check(err) {
+		return nil, errors.Wrap(err, "Error while retrieving namespaces")
+	}
+	usernames := make([]string, 0, len(namespaces.Items))
+	for _, ns := range namespaces.Items {
+		username, err := k8sLabelToGitlabName(ns.Labels["gitlab-origin"])
+		if check(err) {
+			continue
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, nil
+}
+
+func markRevokedNamespace(username string, scaleDown bool) error {
+	ns, err := GetActualNameSpaceNameByGitlabName(username)
+	if err != nil || ns == "" {
+		return err
+	}
+	if scaleDown {
+		if err := scaleNamespace(ns, ReplicasAnnotation, true); err != nil {
+			return err
+		}
+	}
+	client, err := getK8sClient()
+	if err != nil {
+		return err
+	}
+	namespace, err := client.CoreV1().Namespaces().Get(ns, metav1.GetOptions{})
+	if check(err) {
+		return errors.Wrapf(err, "Error while retrieving namespace %s", ns)
+	}
+	if namespace.Labels[AccessRevokedLabel] != "" {
+		return nil
+	}
+	namespace.Labels[AccessRevokedLabel] = "true"
+	if _, err := client.CoreV1().Namespaces().Update(namespace); check(err) {
+		return errors.Wrapf(err, "Error while labeling namespace %s", ns)
+	}
+	return nil
+}
+
+// scaleNamespace scales all Deployments and StatefulSets of the namespace down to zero, keeping their replicas in the
+// given annotation, or back up to the replicas kept in it. Revocation and migration keep them in different
+// annotations, so neither revives the workloads stopped by the other.
+func scaleNamespace(ns, annotation string, down bool) error {
+	client, err := getK8sClient()
+	if err != nil {
+		return err
+	}
+	deployments, err := client.AppsV1().Deployments(ns).List(metav1.ListOptions{})
+	if check(err) {
+		return errors.Wrapf(err, "Error while retrieving Deployments of namespace %s", ns)
+	}
+	for _, d := range deployments.Items {
+		if scaleReplicas(&d.ObjectMeta, &d.Spec.Replicas, annotation, down) {
+			if _, err := client.AppsV1().Deployments(ns).Update(&d); check(err) {
+				return errors.Wrapf(err, "Error while scaling Deployment %s in %s", d.Name, ns)
+			}
+		}
+	}
+	statefulSets, err := client.AppsV1().StatefulSets(ns).List(metav1.ListOptions{})
+	if check(err) {
+		return errors.Wrapf(err, "Error while retrieving StatefulSets of namespace %s", ns)
+	}
+	for _, s := range statefulSets.Items {
+		if scaleReplicas(&s.ObjectMeta, &s.Spec.Replicas, annotation, down) {
+			if _, err := client.AppsV1().StatefulSets(ns).Update(&s); check(err) {
+				return errors.Wrapf(err, "Error while scaling StatefulSet %s in %s", s.Name, ns)
+			}
+		}
+	}
+	return nil
+}
+
+// scaleReplicas sets the replicas of a workload for scaleNamespace and reports whether it has been changed
+func scaleReplicas(meta *metav1.ObjectMeta, replicas **int32, annotation string, down bool) bool {
+	kept, scaledDown := meta.Annotations[annotation]
+	if down {
+		if scaledDown || (*replicas != nil && **replicas == 0) {
+			return false
+		}
+		current := int32(1)
+		if *replicas != nil {
+			current = **replicas
+		}
+		if meta.Annotations == nil {
+			meta.Annotations = map[string]string{}
+		}
+		meta.Annotations[annotation] = strconv.Itoa(int(current))
+		zero := int32(0)
+		*replicas = &zero
+		return true
+	}
+
+	if !scaledDown {
+		return false
+	}
+	n, err := strconv.Atoi(kept)
+	if check(err) {
+		return false
+	}
+	restored := int32(n)
+	*replicas = &restored
+	delete(meta.Annotations, annotation)
+	return true
+}
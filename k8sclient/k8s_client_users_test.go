@@ -0,0 +1,135 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package k8sclient
+
+import (
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRenameUser(t *testing.T) {
+	client := setupFakeClient(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alice", Labels: map[string]string{"gitlab-origin": "alice"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "project", Labels: map[string]string{"gitlab-origin": "project"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "ignored", Labels: map[string]string{"gitlab-ignored": "true"}}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "alice-edit-alice", Namespace: "alice"},
+			Subjects: []rbacv1.Subject{{Kind: "User", Name: "alice"}}, RoleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "edit"}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "custom", Namespace: "project"},
+			Subjects: []rbacv1.Subject{{Kind: "User", Name: "alice"}, {Kind: "User", Name: "bob"}}, RoleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "view"}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "manual", Namespace: "ignored"},
+			Subjects: []rbacv1.Subject{{Kind: "User", Name: "alice"}}, RoleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "view"}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "unmanaged"}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "alice-view-unmanaged", Namespace: "unmanaged"},
+			Subjects: []rbacv1.Subject{{Kind: "User", Name: "alice"}}, RoleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "view"}},
+	)
+
+	if err := RenameUser("alice", "alicia"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ns, _ := GetActualNameSpaceNameByGitlabName("alicia"); ns != "alice" {
+		t.Errorf("Expected personal namespace alice to be relabeled for alicia, but found %s", ns)
+	}
+	if _, err := client.RbacV1().RoleBindings("alice").Get("alice-edit-alice", metav1.GetOptions{}); err == nil {
+		t.Error("Expected RoleBinding alice-edit-alice to be replaced")
+	}
+	renamed, err := client.RbacV1().RoleBindings("alice").Get("alicia-edit-alice", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Expected RoleBinding alicia-edit-alice: %s", err)
+	}
+	if renamed.Subjects[0].Name != "alicia" {
+		t.Errorf("Expected subject alicia, but was %s", renamed.Subjects[0].Name)
+	}
+	custom, _ := client.RbacV1().RoleBindings("project").Get("custom", metav1.GetOptions{})
+	if custom.Subjects[0].Name != "alicia" || custom.Subjects[1].Name != "bob" {
+		t.Errorf("Expected subjects alicia and bob, but were %v", custom.Subjects)
+	}
+	manual, _ := client.RbacV1().RoleBindings("ignored").Get("manual", metav1.GetOptions{})
+	if manual.Subjects[0].Name != "alice" {
+		t.Errorf("Expected RoleBinding in ignored namespace to be kept, but subject was %s", manual.Subjects[0].Name)
+	}
+	unmanaged, err := client.RbacV1().RoleBindings("unmanaged").Get("alice-view-unmanaged", metav1.GetOptions{})
+	if err != nil || unmanaged.Subjects[0].Name != "alice" {
+		t.Errorf("Expected RoleBinding in a namespace not managed by the integrator to be kept: %v", err)
+	}
+}
+
+func TestRevokeAndRestoreUserAccess(t *testing.T) {
+	three := int32(3)
+	client := setupFakeClient(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alice", Labels: map[string]string{"gitlab-origin": "alice"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "project", Labels: map[string]string{"gitlab-origin": "project"}}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "alice-edit-alice", Namespace: "alice"},
+			Subjects: []rbacv1.Subject{{Kind: "User", Name: "alice"}}, RoleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "edit"}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "custom", Namespace: "project"},
+			Subjects: []rbacv1.Subject{{Kind: "User", Name: "alice"}, {Kind: "User", Name: "bob"}}, RoleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "view"}},
+		&appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "alice"}, Spec: appsv1.DeploymentSpec{Replicas: &three}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "project-mr-1", Labels: map[string]string{ReviewOfLabel: "project", ReviewIIDLabel: "1"}}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "alice-edit-project-mr-1", Namespace: "project-mr-1"},
+			Subjects: []rbacv1.Subject{{Kind: "User", Name: "alice"}}, RoleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "edit"}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "monitoring"}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "oncall", Namespace: "monitoring"},
+			Subjects: []rbacv1.Subject{{Kind: "User", Name: "alice"}}, RoleRef: rbacv1.RoleRef{Kind: "ClusterRole", Name: "view"}},
+	)
+
+	if err := RevokeUserAccess(true, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.RbacV1().RoleBindings("alice").Get("alice-edit-alice", metav1.GetOptions{}); err == nil {
+		t.Error("Expected RoleBinding alice-edit-alice to be deleted")
+	}
+	custom, _ := client.RbacV1().RoleBindings("project").Get("custom", metav1.GetOptions{})
+	if len(custom.Subjects) != 1 || custom.Subjects[0].Name != "bob" {
+		t.Errorf("Expected only subject bob to be left, but were %v", custom.Subjects)
+	}
+	if _, err := client.RbacV1().RoleBindings("project-mr-1").Get("alice-edit-project-mr-1", metav1.GetOptions{}); err == nil {
+		t.Error("Expected RoleBinding in the review namespace to be deleted")
+	}
+	if _, err := client.RbacV1().RoleBindings("monitoring").Get("oncall", metav1.GetOptions{}); err != nil {
+		t.Error("Expected RoleBinding in a namespace not managed by the integrator to be kept")
+	}
+	web, _ := client.AppsV1().Deployments("alice").Get("web", metav1.GetOptions{})
+	if *web.Spec.Replicas != 0 {
+		t.Errorf("Expected Deployment to be scaled down, but had %d replicas", *web.Spec.Replicas)
+	}
+	if revoked, _ := GetUsersWithRevokedAccess(); len(revoked) != 1 || revoked[0] != "alice" {
+		t.Errorf("Expected access of alice to be revoked, but revoked were %v", revoked)
+	}
+
+	// revoking again must keep the replicas to restore
+	if err := RevokeUserAccess(true, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, err := RestoreUserAccess("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restored {
+		t.Error("Expected access of alice to be restored")
+	}
+	web, _ = client.AppsV1().Deployments("alice").Get("web", metav1.GetOptions{})
+	if *web.Spec.Replicas != 3 {
+		t.Errorf("Expected Deployment to be scaled up to 3 replicas, but had %d", *web.Spec.Replicas)
+	}
+	if revoked, _ := GetUsersWithRevokedAccess(); len(revoked) != 0 {
+		t.Errorf("Expected no revoked users, but were %v", revoked)
+	}
+}
@@ -0,0 +1,163 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+// Package metrics holds the Prometheus metrics of the integrator, which are exposed on the /metrics endpoint
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const namespace = "gitlab_integrator"
+
+// Outcomes of a received webhook
+const (
+	OutcomeSuccess   = "success"
+	OutcomeError     = "error"
+	OutcomeIgnored   = "ignored"
+	OutcomeInvalid   = "invalid"
+	OutcomeRejected  = "rejected"
+	OutcomeDuplicate = "duplicate"
+)
+
+// Actions performed on K8s objects
+const (
+	ActionCreated = "created"
+	ActionDeleted = "deleted"
+)
+
+// Kinds of K8s objects managed by the integrator
+const (
+	KindNamespace      = "namespace"
+	KindRoleBinding    = "rolebinding"
+	KindServiceAccount = "serviceaccount"
+)
+
+var (
+	WebhooksReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhooks_received_total",
+		Help:      "Number of received Gitlab webhooks by event name and processing outcome.",
+	}, []string{"event_name", "outcome"})
+
+	SyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Duration of sync runs.",
+		Buckets:   []float64{10, 30, 60, 120, 300, 600, 1200, 1800, 3600, 7200, 10800},
+	})
+
+	SyncLastSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sync_last_success_timestamp_seconds",
+		Help:      "Unix timestamp of the last sync run which finished without failures.",
+	})
+
+	SyncFailures = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sync_last_run_failures",
+		Help:      "Number of entities which could not be synced in the last sync run.",
+	})
+
+	K8sObjectChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "k8s_objects_total",
+		Help:      "Number of K8s objects created or deleted by the integrator, by kind and action.",
+	}, []string{"kind", "action"})
+
+	SyncObjectChanges = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sync_last_run_objects",
+		Help:      "Number of K8s objects created or deleted during the last sync run, by kind and action.",
+	}, []string{"kind", "action"})
+
+	WebhookRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhook_rejections_total",
+		Help:      "Number of rejected webhook requests by reason: header, token, source, client_cert, unknown_event, payload, event_kind or dry_run.",
+	}, []string{"reason"})
+
+	WebhookQueueLength = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "webhook_queue_length",
+		Help:      "Number of queued webhooks by state, pending or dead.",
+	}, []string{"state"})
+
+	Leader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "leader",
+		Help:      "1 if this replica is the elected leader, 0 otherwise.",
+	})
+
+	GitlabRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gitlab_requests_total",
+		Help:      "Number of requests to the Gitlab API by endpoint and status code.",
+	}, []string{"endpoint", "code"})
+
+	GitlabRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "gitlab_request_duration_seconds",
+		Help:      "Latency of requests to the Gitlab API by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+
+	GitlabRequestRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gitlab_request_retries_total",
+		Help:      "Number of retried requests to the Gitlab API by endpoint.",
+	}, []string{"endpoint"})
+
+	GitlabThrottleSeconds = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gitlab_throttle_seconds_total",
+		Help:      "Time requests to the Gitlab API have been delayed to stay within its rate limit.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(WebhooksReceived, WebhookRejections, SyncDuration, SyncLastSuccess, SyncFailures, K8sObjectChanges,
+		SyncObjectChanges, WebhookQueueLength, Leader, GitlabRequests, GitlabRequestDuration, GitlabRequestRetries, GitlabThrottleSeconds)
+}
+
+// ObjectChange records the creation or deletion of a K8s object
+func ObjectChange(kind, action string) {
+	K8sObjectChanges.WithLabelValues(kind, action).Inc()
+}
+
+// ObjectChangeSnapshot holds the values of the K8s object counters at a point in time
+type ObjectChangeSnapshot map[[2]string]float64
+
+// SnapshotObjectChanges reads the current values of the K8s object counters
+func SnapshotObjectChanges() ObjectChangeSnapshot {
+	snapshot := ObjectChangeSnapshot{}
+	for _, kind := range []string{KindNamespace, KindRoleBinding, KindServiceAccount} {
+		for _, action := range []string{ActionCreated, ActionDeleted} {
+			var m dto.Metric
+			if err := K8sObjectChanges.WithLabelValues(kind, action).Write(&m); err == nil {
+				snapshot[[2]string{kind, action}] = m.GetCounter().GetValue()
+			}
+		}
+	}
+	return snapshot
+}
+
+// RecordSyncObjectChanges sets the per run gauges to the difference between the given snapshot and now
+func RecordSyncObjectChanges(before ObjectChangeSnapshot) {
+	for key, value := range SnapshotObjectChanges() {
+		SyncObjectChanges.WithLabelValues(key[0], key[1]).Set(value - before[key])
+	}
+}
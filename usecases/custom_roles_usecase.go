@@ -11,12 +11,12 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/k8sclient"
 	"k8s.io/api/core/v1"
 	rbacv1 "k8s.io/api/rbac/v1"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/scheme"
-	"k8s.io/client-go/rest"
 )
 
 type CustomRolesAndBindings struct {
@@ -27,7 +27,17 @@ type CustomRolesAndBindings struct {
 	ServiceAccounts     map[string]bool
 }
 
+// ReadAndApplyCustomRolesAndBindings reads the custom roles and bindings from the custom role directory and creates them in K8s
 func ReadAndApplyCustomRolesAndBindings() CustomRolesAndBindings {
+	return readCustomRolesAndBindings(true)
+}
+
+// ReadCustomRolesAndBindings only reads the custom roles and bindings from the custom role directory
+func ReadCustomRolesAndBindings() CustomRolesAndBindings {
+	return readCustomRolesAndBindings(false)
+}
+
+func readCustomRolesAndBindings(apply bool) CustomRolesAndBindings {
 	res := CustomRolesAndBindings{
 		Roles:               make(map[string]bool),
 		RoleBindings:        make(map[string]bool),
@@ -54,7 +64,11 @@ func ReadAndApplyCustomRolesAndBindings() CustomRolesAndBindings {
 	}
 
 	regExp := regexp.MustCompile(`.*(\.yml|\.yaml)`)
-	k8sclient := getK8sClient()
+	client, err := k8sclient.GetClient()
+	if err != nil {
+		log.Printf("An error occurred while trying to apply custom roles from directory %s. Err: %s", customDir, err)
+		return res
+	}
 	for _, f := range files {
 		isYaml := regExp.MatchString(f.Name())
 
@@ -71,7 +85,10 @@ func ReadAndApplyCustomRolesAndBindings() CustomRolesAndBindings {
 
 				case *rbacv1.Role:
 					res.Roles[o.Name] = true
-					_, err := k8sclient.RbacV1().Roles(o.Namespace).Create(o)
+					if !apply {
+						continue
+					}
+					_, err := client.RbacV1().Roles(o.Namespace).Create(o)
 					if err != nil {
 						log.Printf("Error applying Custome Role %s in Namespace %s. Err: %s", o.Name, o.Namespace, err)
 					} else {
@@ -79,7 +96,10 @@ func ReadAndApplyCustomRolesAndBindings() CustomRolesAndBindings {
 					}
 				case *rbacv1.RoleBinding:
 					res.RoleBindings[o.Name] = true
-					_, err := k8sclient.RbacV1().RoleBindings(o.Namespace).Create(o)
+					if !apply {
+						continue
+					}
+					_, err := client.RbacV1().RoleBindings(o.Namespace).Create(o)
 					if err != nil {
 						log.Printf("Error applying Custome RoleBinding %s in Namespace %s. Err: %s", o.Name, o.Namespace, err)
 					} else {
@@ -87,7 +107,10 @@ func ReadAndApplyCustomRolesAndBindings() CustomRolesAndBindings {
 					}
 				case *rbacv1.ClusterRole:
 					res.ClusterRoles[o.Name] = true
-					_, err := k8sclient.RbacV1().ClusterRoles().Create(o)
+					if !apply {
+						continue
+					}
+					_, err := client.RbacV1().ClusterRoles().Create(o)
 					if err != nil {
 						log.Printf("Error applying Custome ClusterRole %s in Namespace %s. Err: %s", o.Name, o.Namespace, err)
 					} else {
@@ -95,7 +118,10 @@ func ReadAndApplyCustomRolesAndBindings() CustomRolesAndBindings {
 					}
 				case *rbacv1.ClusterRoleBinding:
 					res.ClusterRoleBindings[o.Name] = true
-					_, err := k8sclient.RbacV1().ClusterRoleBindings().Create(o)
+					if !apply {
+						continue
+					}
+					_, err := client.RbacV1().ClusterRoleBindings().Create(o)
 					if err != nil {
 						log.Printf("Error applying Custome ClusterRoleBinding %s in Namespace %s. Err: %s", o.Name, o.Namespace, err)
 					} else {
@@ -103,7 +129,10 @@ func ReadAndApplyCustomRolesAndBindings() CustomRolesAndBindings {
 					}
 				case *v1.ServiceAccount:
 					res.ServiceAccounts[o.Name] = true
-					_, err := k8sclient.CoreV1().ServiceAccounts(o.Namespace).Create(o)
+					if !apply {
+						continue
+					}
+					_, err := client.CoreV1().ServiceAccounts(o.Namespace).Create(o)
 					if err != nil {
 						log.Printf("Error applying Custome ServiceAccount %s in Namespace %s. Err: %s", o.Name, o.Namespace, err)
 					} else {
@@ -116,22 +145,6 @@ func ReadAndApplyCustomRolesAndBindings() CustomRolesAndBindings {
 	return res
 }
 
-func getK8sClient() *kubernetes.Clientset {
-	// creates the in-cluster config
-	config, err := rest.InClusterConfig()
-	if check(err) {
-		log.Fatal(err)
-	}
-
-	// creates the clientset
-	clientset, err := kubernetes.NewForConfig(config)
-
-	if check(err) {
-		log.Fatal(err)
-	}
-	return clientset
-}
-
 func parseK8sYaml(fileR []byte) []runtime.Object {
 
 	acceptedK8sTypes := regexp.MustCompile(`(Role|ClusterRole|RoleBinding|ClusterRoleBinding|ServiceAccount)`)
@@ -172,10 +185,5 @@ func fileExists(filename string) (bool, error) {
 }
 
 func getCustomRoleDir() string {
-	dir := "/etc/custom-roles"
-	envDir := os.Getenv("CUSTOM_ROLE_DIR")
-	if envDir != "" {
-		dir = envDir
-	}
-	return dir
+	return config.Get().CustomRoleDir
 }
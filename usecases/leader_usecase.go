@@ -0,0 +1,205 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package usecases
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/k8sclient"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/metrics"
+	"github.com/pkg/errors"
+	"k8s.io/client-go/tools/leaderelection"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+	// reelectionBackoff is the time a replica waits after losing the leadership before it competes again
+	reelectionBackoff = leaseDuration
+)
+
+// leader holds the leader election state of this replica. ctx is cancelled when the leadership is lost.
+var leader = struct {
+	lock    sync.Mutex
+	leading bool
+	ctx     context.Context
+	cancel  context.CancelFunc
+}{}
+
+// LeaderElectionEnabled returns true if several replicas are supposed to elect a leader among themselves
+func LeaderElectionEnabled() bool {
+	return config.Get().LeaderElection.Enabled
+}
+
+// IsLeader returns true if this replica may run syncs and apply mutations. Without leader election every replica is leader.
+func IsLeader() bool {
+	if !LeaderElectionEnabled() {
+		return true
+	}
+	leader.lock.Lock()
+	defer leader.lock.Unlock()
+	return leader.leading
+}
+
+// leaderContext returns the context of the current leadership, which sync runs and hooks are applied with. It is
+// cancelled when the leadership is lost, or already if this replica is not the leader. Without leader election it is
+// never cancelled.
+func leaderContext() context.Context {
+	if !LeaderElectionEnabled() {
+		return context.Background()
+	}
+	leader.lock.Lock()
+	defer leader.lock.Unlock()
+	if !leader.leading {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return ctx
+	}
+	return leader.ctx
+}
+
+// LeaderURL returns the URL under which the current leader accepts forwarded webhooks, or an empty string if there is none
+func LeaderURL() (string, error) {
+	namespace, err := leaseNamespace()
+	if err != nil {
+		return "", err
+	}
+	return k8sclient.GetLeaderURL(namespace, leaseName())
+}
+
+// OwnURL returns the URL under which this replica accepts forwarded webhooks
+func OwnURL() string {
+	leaderElection := config.Get().LeaderElection
+	if leaderElection.URL != "" {
+		return leaderElection.URL
+	}
+	host := leaderElection.PodIP
+	if host == "" {
+		host = leaderIdentity()
+	}
+	scheme := "http"
+	if config.Get().Webhooks.TLS.CertFile != "" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s:8080/hook", scheme, host)
+}
+
+// RunLeaderElection takes part in the leader election until the process ends. The leader handles all webhooks
+// waiting in the queue and performs a sync run right after winning the election, as it may have missed changes.
+func RunLeaderElection() error {
+	namespace, err := leaseNamespace()
+	if err != nil {
+		return err
+	}
+	for {
+		// an elector must not be run again once it returned, so a new one is built for every term
+		elector, lock, err := newLeaderElector(namespace)
+		if err != nil {
+			return err
+		}
+		log.Println(fmt.Sprintf("Leader election: %s is competing for Lease %s", lock.Identity(), lock.Describe()))
+		// Run returns when leadership is lost. Competing again only after the backoff leaves the Lease to another
+		// replica, instead of flapping between terms if e.g. the API server is slow to answer.
+		elector.Run(context.Background())
+		time.Sleep(reelectionBackoff)
+	}
+}
+
+func newLeaderElector(namespace string) (*leaderelection.LeaderElector, *k8sclient.LeaseLock, error) {
+	lock := &k8sclient.LeaseLock{
+		Namespace:    namespace,
+		Name:         leaseName(),
+		LockIdentity: leaderIdentity(),
+		URL:          OwnURL(),
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaseDuration,
+		RenewDeadline: renewDeadline,
+		RetryPeriod:   retryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: startedLeading,
+			OnStoppedLeading: stoppedLeading,
+			OnNewLeader: func(identity string) {
+				log.Println("Leader election: new leader is " + identity)
+			},
+		},
+		Name: lock.Describe(),
+	})
+	return elector, lock, err
+}
+
+// startedLeading is called by the elector with a context, which is cancelled when the leadership is lost. The sync
+// run started here, like all sync runs and hooks applied during the leadership, stops then.
+func startedLeading(ctx context.Context) {
+	log.Println("Leader election: became leader")
+	metrics.Leader.Set(1)
+	leader.lock.Lock()
+	leader.leading = true
+	leader.ctx, leader.cancel = context.WithCancel(ctx)
+	leader.lock.Unlock()
+
+	// hooks which could not be forwarded to the former leader are handled by us now
+	retryQueuedGitlabEvents()
+	PerformGlK8sSync()
+}
+
+func stoppedLeading() {
+	log.Println("Leader election: stopped leading")
+	metrics.Leader.Set(0)
+	leader.lock.Lock()
+	leader.leading = false
+	if leader.cancel != nil {
+		leader.cancel()
+	}
+	leader.lock.Unlock()
+}
+
+func leaderIdentity() string {
+	if identity := config.Get().LeaderElection.Identity; identity != "" {
+		return identity
+	}
+	hostname, err := os.Hostname()
+	if check(err) {
+		return "gitlab-k8s-integrator"
+	}
+	return hostname
+}
+
+func leaseName() string {
+	return config.Get().LeaderElection.LeaseName
+}
+
+// leaseNamespace defaults to the namespace the integrator is running in
+func leaseNamespace() (string, error) {
+	if namespace := config.Get().LeaderElection.Namespace; namespace != "" {
+		return namespace, nil
+	}
+	namespace, err := ioutil.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		return "", errors.Wrap(err, "Could not determine namespace of the leader election Lease, please set LEADER_ELECTION_NAMESPACE")
+	}
+	return strings.TrimSpace(string(namespace)), nil
+}
@@ -0,0 +1,95 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package usecases
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/gitlabclient"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/k8sclient"
+	"github.com/pkg/errors"
+)
+
+const reviewNamespaceCleanupInterval = 10 * time.Minute
+
+// handleMergeRequestEvent creates the review namespace of an open merge request and deletes it once the merge request
+// is merged or closed. The state is used instead of the action, so replayed hooks lead to the same result.
+func handleMergeRequestEvent(event *MergeRequestEvent) error {
+	if !config.Get().ReviewNamespaces.Enabled {
+		return errUnknownEvent
+	}
+	project, iid := event.Project.PathWithNamespace, event.ObjectAttributes.IID
+	state, err := verifyMergeRequest(event)
+	if err != nil {
+		return err
+	}
+
+	switch state {
+	case "opened":
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Ensure review Namespace for %s!%d", project, iid))
+		_, err := k8sclient.EnsureReviewNamespace(project, iid)
+		return err
+	case "merged", "closed":
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Delete review Namespace for %s!%d", project, iid))
+		return k8sclient.DeleteReviewNamespace(project, iid)
+	default:
+		return errUnknownEvent
+	}
+}
+
+// verifyMergeRequest returns the state of the merge request of the event as known to Gitlab. The tokens of project
+// webhooks are shared by all projects, so the payload is not trusted: the project id must belong to the project path
+// and the state is read from Gitlab. A merge request which does not exist is reported as closed.
+func verifyMergeRequest(event *MergeRequestEvent) (string, error) {
+	project, err := gitlabclient.GetProject(event.Project.ID)
+	if err != nil {
+		return "", err
+	}
+	if project == nil || project.PathWithNameSpace != event.Project.PathWithNamespace {
+		return "", &InvalidEventError{Err: errors.Errorf("project %d is not %s", event.Project.ID, event.Project.PathWithNamespace)}
+	}
+	mr, err := gitlabclient.GetMergeRequest(project.Id, event.ObjectAttributes.IID)
+	if err != nil {
+		return "", err
+	}
+	if mr == nil {
+		return "closed", nil
+	}
+	return mr.State, nil
+}
+
+// StartReviewNamespaceCleanup periodically deletes the review namespaces whose merge request had no event for longer
+// than the configured TTL, e.g. because the hook of its merge or close was missed
+func StartReviewNamespaceCleanup() {
+	review := config.Get().ReviewNamespaces
+	if !review.Enabled || review.TTLHours == 0 {
+		return
+	}
+	ttl := time.Duration(review.TTLHours) * time.Hour
+	log.Println(fmt.Sprintf("Starting review Namespace cleanup for a TTL of %s...", ttl))
+	ticker := time.NewTicker(reviewNamespaceCleanupInterval)
+	go func() {
+		for range ticker.C {
+			if IsLeader() && !dryRun() {
+				_, err := k8sclient.DeleteExpiredReviewNamespaces(ttl)
+				check(err)
+			}
+		}
+	}()
+}
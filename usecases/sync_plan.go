@@ -0,0 +1,334 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package usecases
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/gitlabclient"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/k8sclient"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	ActionCreate = "create"
+	ActionDelete = "delete"
+	ActionUpdate = "update"
+)
+
+// PlannedAction is a single mutation a sync run would perform
+type PlannedAction struct {
+	Action    string `json:"action"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Details   string `json:"details,omitempty"`
+}
+
+// SyncPlan holds all mutations a sync run would perform, without any of them being applied
+type SyncPlan struct {
+	Actions  []PlannedAction `json:"actions"`
+	Failures []SyncFailure   `json:"failures,omitempty"`
+	lock     sync.Mutex
+}
+
+func (p *SyncPlan) add(action PlannedAction) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.Actions = append(p.Actions, action)
+}
+
+// sortActions orders the actions by kind, namespace and name, so that plans of different runs can be compared
+func (p *SyncPlan) sortActions() {
+	sort.SliceStable(p.Actions, func(i, j int) bool {
+		a, b := p.Actions[i], p.Actions[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		return a.Name < b.Name
+	})
+}
+
+// Count returns the number of planned actions of the given type
+func (p *SyncPlan) Count(action string) int {
+	count := 0
+	for _, a := range p.Actions {
+		if a.Action == action {
+			count++
+		}
+	}
+	return count
+}
+
+// String renders the plan as a diff, with + for creations, - for deletions and ~ for updates
+func (p *SyncPlan) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Sync plan: %d to create, %d to update, %d to delete\n", p.Count(ActionCreate), p.Count(ActionUpdate), p.Count(ActionDelete))
+	for _, a := range p.Actions {
+		symbol := "~"
+		switch a.Action {
+		case ActionCreate:
+			symbol = "+"
+		case ActionDelete:
+			symbol = "-"
+		}
+		name := a.Name
+		if a.Namespace != "" {
+			name = a.Namespace + "/" + a.Name
+		}
+		fmt.Fprintf(&b, "%s %s %s", symbol, a.Kind, name)
+		if a.Details != "" {
+			fmt.Fprintf(&b, " (%s)", a.Details)
+		}
+		b.WriteString("\n")
+	}
+	for _, f := range p.Failures {
+		fmt.Fprintf(&b, "! %s %s could not be planned: %s\n", f.Kind, f.Name, f.Err)
+	}
+	return b.String()
+}
+
+// JSON renders the plan as JSON document
+func (p *SyncPlan) JSON() ([]byte, error) {
+	return json.MarshalIndent(p, "", "  ")
+}
+
+// syncTarget receives all mutations of a sync run. The applyingTarget writes them to K8s and Gitlab,
+// the planningTarget only records them in a SyncPlan.
+type syncTarget interface {
+	deleteNamespace(originalName string) error
+	createNamespace(gitlabName string) error
+	createGroupRoleBinding(username, path, accessLevel string) error
+	createProjectRoleBinding(username, path, accessLevel string) error
+	deleteGroupRoleBindingByName(roleBindingName, actualNamespace string) error
+	deleteProjectRoleBindingByName(roleBindingName, actualNamespace string) error
+	createServiceAccountAndRoleBinding(path string) (k8sclient.ServiceAccountInfo, string, error)
+	setupK8sIntegrationForGitlabProject(projectId int, namespace, token string)
+	deployNamespaceDefaults(actualNamespace string) error
+	deleteExpiredMigratedNamespaces(ttl time.Duration) error
+}
+
+type applyingTarget struct{}
+
+func (applyingTarget) deleteNamespace(originalName string) error {
+	_, err := k8sclient.DeleteNamespace(originalName)
+	return err
+}
+
+func (applyingTarget) createNamespace(gitlabName string) error {
+	_, err := k8sclient.CreateNamespace(gitlabName)
+	return err
+}
+
+func (applyingTarget) createGroupRoleBinding(username, path, accessLevel string) error {
+	return k8sclient.CreateGroupRoleBinding(username, path, accessLevel)
+}
+
+func (applyingTarget) createProjectRoleBinding(username, path, accessLevel string) error {
+	return k8sclient.CreateProjectRoleBinding(username, path, accessLevel)
+}
+
+func (applyingTarget) deleteGroupRoleBindingByName(roleBindingName, actualNamespace string) error {
+	return k8sclient.DeleteGroupRoleBindingByName(roleBindingName, actualNamespace)
+}
+
+func (applyingTarget) deleteProjectRoleBindingByName(roleBindingName, actualNamespace string) error {
+	return k8sclient.DeleteProjectRoleBindingByName(roleBindingName, actualNamespace)
+}
+
+func (applyingTarget) createServiceAccountAndRoleBinding(path string) (k8sclient.ServiceAccountInfo, string, error) {
+	return k8sclient.CreateServiceAccountAndRoleBinding(path)
+}
+
+func (applyingTarget) setupK8sIntegrationForGitlabProject(projectId int, namespace, token string) {
+	go func() {
+		err := gitlabclient.SetupK8sIntegrationForGitlabProject(strconv.Itoa(projectId), namespace, token)
+		check(err)
+	}()
+}
+
+func (applyingTarget) deployNamespaceDefaults(actualNamespace string) error {
+	return k8sclient.DeployNamespaceDefaults(actualNamespace)
+}
+
+func (applyingTarget) deleteExpiredMigratedNamespaces(ttl time.Duration) error {
+	_, err := k8sclient.DeleteExpiredRedirectNamespaces(ttl)
+	return err
+}
+
+type planningTarget struct {
+	plan *SyncPlan
+}
+
+// namespaceFor returns the namespace of a gitlab entity or, if not yet present, the name CreateNamespace would give it,
+// including the suffix it adds when the name is taken
+func (t planningTarget) namespaceFor(path string) (string, error) {
+	ns, err := k8sclient.GetActualNameSpaceNameByGitlabName(path)
+	if err != nil || ns != "" {
+		return ns, err
+	}
+	ns, _, err = k8sclient.ProposeNamespaceName(path)
+	return ns, err
+}
+
+// addNamespaceDefaults plans the creation of the given namespace defaults
+func (t planningTarget) addNamespaceDefaults(namespace string, defaults []k8sclient.NamespaceDefault) {
+	for _, d := range defaults {
+		t.plan.add(PlannedAction{Action: ActionCreate, Kind: d.Kind, Namespace: namespace, Name: d.Name, Details: "namespace default"})
+	}
+}
+
+func (t planningTarget) deleteNamespace(originalName string) error {
+	ns, err := k8sclient.GetActualNameSpaceNameByGitlabName(originalName)
+	if err != nil {
+		return err
+	}
+	if ns != "" && ns != "kube-system" {
+		t.plan.add(PlannedAction{Action: ActionDelete, Kind: "Namespace", Name: ns, Details: "gitlab: " + originalName})
+	}
+	return nil
+}
+
+func (t planningTarget) createNamespace(gitlabName string) error {
+	if gitlabName == "kube-system" {
+		return nil
+	}
+	ns, err := k8sclient.GetActualNameSpaceNameByGitlabName(gitlabName)
+	if err != nil || ns != "" {
+		return err
+	}
+	ns, adopt, err := k8sclient.ProposeNamespaceName(gitlabName)
+	if err != nil {
+		return err
+	}
+	if adopt {
+		// the present namespace only gets a gitlab-origin label and keeps the defaults it already has
+		t.plan.add(PlannedAction{Action: ActionUpdate, Kind: "Namespace", Name: ns, Details: "adopted by gitlab: " + gitlabName})
+		return t.deployNamespaceDefaults(ns)
+	}
+	t.plan.add(PlannedAction{Action: ActionCreate, Kind: "Namespace", Name: ns, Details: "gitlab: " + gitlabName})
+	t.addNamespaceDefaults(ns, k8sclient.GetNamespaceDefaults())
+	return nil
+}
+
+func (t planningTarget) createGroupRoleBinding(username, path, accessLevel string) error {
+	return t.createRoleBinding(username, path, k8sclient.GetGroupRoleName(accessLevel))
+}
+
+func (t planningTarget) createProjectRoleBinding(username, path, accessLevel string) error {
+	return t.createRoleBinding(username, path, k8sclient.GetProjectRoleName(accessLevel))
+}
+
+func (t planningTarget) createRoleBinding(username, path, roleName string) error {
+	ns, err := t.namespaceFor(path)
+	if err != nil {
+		return err
+	}
+	t.plan.add(PlannedAction{Action: ActionCreate, Kind: "RoleBinding", Namespace: ns, Name: k8sclient.ConstructRoleBindingName(username, roleName, ns), Details: fmt.Sprintf("user %s as %s", username, roleName)})
+	return nil
+}
+
+func (t planningTarget) deleteGroupRoleBindingByName(roleBindingName, actualNamespace string) error {
+	return t.deleteRoleBindingByName(roleBindingName, actualNamespace)
+}
+
+func (t planningTarget) deleteProjectRoleBindingByName(roleBindingName, actualNamespace string) error {
+	return t.deleteRoleBindingByName(roleBindingName, actualNamespace)
+}
+
+func (t planningTarget) deleteRoleBindingByName(roleBindingName, actualNamespace string) error {
+	ignored, err := k8sclient.IsNamespaceIgnored(actualNamespace)
+	if err != nil {
+		return err
+	}
+	if !ignored {
+		t.plan.add(PlannedAction{Action: ActionDelete, Kind: "RoleBinding", Namespace: actualNamespace, Name: roleBindingName})
+	}
+	return nil
+}
+
+func (t planningTarget) createServiceAccountAndRoleBinding(path string) (k8sclient.ServiceAccountInfo, string, error) {
+	name, err := k8sclient.GetServiceAccountName()
+	if err != nil {
+		return k8sclient.ServiceAccountInfo{}, "", err
+	}
+	ns, err := k8sclient.GetActualNameSpaceNameByGitlabName(path)
+	if err != nil {
+		return k8sclient.ServiceAccountInfo{}, "", err
+	}
+
+	saPresent := false
+	roleBindings := map[string]bool{}
+	if ns != "" {
+		client, err := k8sclient.GetClient()
+		if err != nil {
+			return k8sclient.ServiceAccountInfo{}, "", err
+		}
+		_, err = client.CoreV1().ServiceAccounts(ns).Get(name, metav1.GetOptions{})
+		saPresent = err == nil
+		roleBindings, err = k8sclient.GetRoleBindingsByNamespace(ns)
+		if err != nil {
+			return k8sclient.ServiceAccountInfo{}, "", err
+		}
+	} else if ns, err = t.namespaceFor(path); err != nil {
+		return k8sclient.ServiceAccountInfo{}, "", err
+	}
+
+	if !saPresent {
+		t.plan.add(PlannedAction{Action: ActionCreate, Kind: "ServiceAccount", Namespace: ns, Name: name})
+	}
+	if !roleBindings[name] {
+		t.plan.add(PlannedAction{Action: ActionCreate, Kind: "RoleBinding", Namespace: ns, Name: name, Details: "serviceaccount " + name + " as " + k8sclient.GetProjectRoleName("Master")})
+	}
+	return k8sclient.ServiceAccountInfo{Name: name, Namespace: ns}, name, nil
+}
+
+func (t planningTarget) setupK8sIntegrationForGitlabProject(projectId int, namespace, token string) {
+	if config.Get().Kubernetes.ExternalAPIURL == "" {
+		return
+	}
+	t.plan.add(PlannedAction{Action: ActionUpdate, Kind: "GitlabIntegration", Name: "project-" + strconv.Itoa(projectId), Details: "namespace: " + namespace})
+}
+
+func (t planningTarget) deployNamespaceDefaults(actualNamespace string) error {
+	missing, err := k8sclient.GetMissingNamespaceDefaults(actualNamespace)
+	if err != nil {
+		return err
+	}
+	t.addNamespaceDefaults(actualNamespace, missing)
+	return nil
+}
+
+func (t planningTarget) deleteExpiredMigratedNamespaces(ttl time.Duration) error {
+	expired, err := k8sclient.GetExpiredRedirectNamespaces(ttl)
+	if err != nil {
+		return err
+	}
+	for _, ns := range expired {
+		t.plan.add(PlannedAction{Action: ActionDelete, Kind: "Namespace", Name: ns, Details: "left behind by a migration"})
+	}
+	return nil
+}
@@ -16,15 +16,17 @@
 package usecases
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os"
-	"strconv"
 	"sync"
 	"time"
 
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
 	"github.com/k8s-tamias/gitlab-k8s-integrator/gitlabclient"
 	"github.com/k8s-tamias/gitlab-k8s-integrator/k8sclient"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/metrics"
+	"github.com/pkg/errors"
 )
 
 /*
@@ -56,285 +58,674 @@ Algo:
 
 */
 
-// TODO : Cache Webhooks while Sync is running and execute them later!
-
-func PerformGlK8sSync() {
-	log.Println("Starting new Synchronization run!")
-	log.Println("Getting Gitlab Contents...")
-	gitlabContent, err := gitlabclient.GetFullGitlabContent()
-	if check(err) {
-		return
+// syncRun makes sure at most one sync run is performed at a time. The webhook queue is paused during a run, as the
+// run works on a snapshot of Gitlab taken at its start and would otherwise undo the changes of the webhooks. Requests for a
+// run while one is in progress are remembered in followUp, as the running one may have read Gitlab before the change
+// which caused the request. One more run is performed after it, a full one if any of the requests was for a full run.
+var syncRun = struct {
+	lock         sync.Mutex
+	running      bool
+	followUp     bool
+	followUpFull bool
+}{}
+
+// syncState remembers when the last successful sync runs started. Incremental runs fetch the changes since then.
+// It is kept in memory only, so the first run after a start or a change of the leader is a full one and catches up
+// with the hooks missed in the meantime.
+var syncState = struct {
+	lock     sync.Mutex
+	lastFull time.Time
+	since    time.Time
+}{}
+
+// changedEntities remembers the ids of the groups, projects and users hooks have been received for, with the time
+// the last hook for each of them has been received. Incremental runs read them again, as Gitlab can't filter groups
+// and memberships by their changes. A successful run forgets the entities whose hooks were received before its start.
+var changedEntities = struct {
+	lock     sync.Mutex
+	groups   map[int]time.Time
+	projects map[int]time.Time
+	users    map[int]time.Time
+}{groups: map[int]time.Time{}, projects: map[int]time.Time{}, users: map[int]time.Time{}}
+
+// recordChangedEntities remembers the entities the event changed for the next incremental run
+func recordChangedEntities(event gitlabEvent, now time.Time) {
+	changedEntities.lock.Lock()
+	defer changedEntities.lock.Unlock()
+	switch e := event.(type) {
+	case *ProjectEvent:
+		changedEntities.projects[e.ProjectID] = now
+	case *ProjectMemberEvent:
+		changedEntities.projects[e.ProjectID] = now
+		changedEntities.users[e.UserID] = now
+	case *GroupEvent:
+		changedEntities.groups[e.GroupID] = now
+	case *GroupMemberEvent:
+		changedEntities.groups[e.GroupID] = now
+		changedEntities.users[e.UserID] = now
+	case *UserEvent:
+		changedEntities.users[e.UserID] = now
 	}
+}
 
-	// 1. delete all Namespaces which are not in the gitlab set
-	log.Println("Getting K8s Contents...")
-	gitlabNamespacesInK8s := k8sclient.GetAllGitlabOriginNamesFromNamespacesWithOriginLabel()
+// getChangedEntities returns the ids of all remembered entities
+func getChangedEntities() gitlabclient.ChangedEntities {
+	changedEntities.lock.Lock()
+	defer changedEntities.lock.Unlock()
+	return gitlabclient.ChangedEntities{
+		Groups:   changedIds(changedEntities.groups),
+		Projects: changedIds(changedEntities.projects),
+		Users:    changedIds(changedEntities.users),
+	}
+}
 
-	log.Println("Deleting all namespaces which are no longer in the gitlab namespace...")
-	for _, originalName := range gitlabNamespacesInK8s {
-		delete := true
+func changedIds(entities map[int]time.Time) map[int]bool {
+	ids := make(map[int]bool, len(entities))
+	for id := range entities {
+		ids[id] = true
+	}
+	return ids
+}
 
-		for _, user := range gitlabContent.Users {
-			if originalName == user.Username {
-				delete = false
-				break
+// forgetChangedEntities forgets the entities whose last hook was received before the given time
+func forgetChangedEntities(before time.Time) {
+	changedEntities.lock.Lock()
+	defer changedEntities.lock.Unlock()
+	for _, entities := range []map[int]time.Time{changedEntities.groups, changedEntities.projects, changedEntities.users} {
+		for id, received := range entities {
+			if received.Before(before) {
+				delete(entities, id)
 			}
 		}
+	}
+}
 
-		if delete {
-			for _, project := range gitlabContent.Projects {
-				if originalName == project.PathWithNameSpace {
-					delete = false
-					break
-				}
-			}
+// incrementalSyncOverlap is subtracted from the start of the last run, to cover clock skew between the integrator
+// and Gitlab and activity which was stored in Gitlab after its start
+const incrementalSyncOverlap = 5 * time.Minute
+
+// PerformGlK8sSync performs a full sync run. If a sync run is already in progress, another run follows it.
+func PerformGlK8sSync() {
+	performSyncRun(time.Time{})
+}
+
+// PerformIncrementalGlK8sSync syncs only the projects updated and the users created since the last successful sync
+// run and the entities hooks have been received for since then. It performs a full run instead, if there was no
+// successful run since the start of the integrator.
+func PerformIncrementalGlK8sSync() {
+	syncState.lock.Lock()
+	since := syncState.since
+	syncState.lock.Unlock()
+	if !since.IsZero() {
+		since = since.Add(-incrementalSyncOverlap)
+	}
+	performSyncRun(since)
+}
+
+// performScheduledSync performs an incremental run, unless incremental runs are disabled or the last full run is
+// older than the full sync interval
+func performScheduledSync(now time.Time) {
+	if scheduledSyncIsFull(now) {
+		PerformGlK8sSync()
+		return
+	}
+	PerformIncrementalGlK8sSync()
+}
+
+func scheduledSyncIsFull(now time.Time) bool {
+	cfg := config.Get().Sync
+	if cfg.IncrementalIntervalMinutes == 0 {
+		return true
+	}
+	syncState.lock.Lock()
+	defer syncState.lock.Unlock()
+	return syncState.since.IsZero() || now.Sub(syncState.lastFull) >= time.Duration(cfg.FullIntervalMinutes)*time.Minute
+}
+
+// performSyncRun performs a full run if since is zero, an incremental run otherwise
+func performSyncRun(since time.Time) {
+	if dryRun() {
+		plan, err := PlanGlK8sSync()
+		if err == ErrSyncRunInProgress {
+			requestFollowUpSyncRun(since.IsZero())
+			log.Println("Synchronization run already in progress, another run will follow it")
+			return
+		}
+		if check(err) {
+			return
 		}
+		logSyncPlan(plan)
+		return
+	}
+	// the run stops once the leadership is lost
+	ctx := leaderContext()
+	if ctx.Err() != nil {
+		log.Println("Not the leader, skipping synchronization run")
+		return
+	}
+	if !startSyncRun() {
+		requestFollowUpSyncRun(since.IsZero())
+		log.Println("Synchronization run already in progress, another run will follow it")
+		return
+	}
+	defer endSyncRun()
 
-		if delete {
-			for _, group := range gitlabContent.Groups {
-				if originalName == group.FullPath {
-					delete = false
-					break
-				}
-			}
+	start := time.Now()
+	before := metrics.SnapshotObjectChanges()
+	failures, err := performGlK8sSync(ctx, applyingTarget{}, since, getChangedEntities())
+	metrics.SyncDuration.Observe(time.Since(start).Seconds())
+	metrics.RecordSyncObjectChanges(before)
+	if check(err) {
+		log.Println("Synchronization run has been cancelled!")
+		return
+	}
+	metrics.SyncFailures.Set(float64(len(failures)))
+	if len(failures) == 0 {
+		metrics.SyncLastSuccess.SetToCurrentTime()
+		// the changes of entities which failed are fetched again by the next run
+		syncState.lock.Lock()
+		syncState.since = start
+		if since.IsZero() {
+			syncState.lastFull = start
 		}
+		syncState.lock.Unlock()
+		forgetChangedEntities(start)
+	}
+	logSyncFailures(failures)
+}
 
-		if delete {
-			k8sclient.DeleteNamespace(originalName)
+func startSyncRun() bool {
+	syncRun.lock.Lock()
+	defer syncRun.lock.Unlock()
+	if syncRun.running {
+		return false
+	}
+	syncRun.running = true
+	pauseWebhookQueue()
+	return true
+}
+
+// endSyncRun ends the sync run in progress and starts the run requested meanwhile, if any
+func endSyncRun() {
+	if followUp, full := finishSyncRun(); followUp {
+		log.Println("Performing the synchronization run requested during the last one")
+		if full {
+			go PerformGlK8sSync()
+		} else {
+			go PerformIncrementalGlK8sSync()
 		}
 	}
+}
+
+// finishSyncRun ends the sync run in progress and returns whether another run has been requested meanwhile and
+// whether it has to be a full one
+func finishSyncRun() (bool, bool) {
+	syncRun.lock.Lock()
+	defer syncRun.lock.Unlock()
+	syncRun.running = false
+	resumeWebhookQueue()
+	followUp, full := syncRun.followUp, syncRun.followUpFull
+	syncRun.followUp, syncRun.followUpFull = false, false
+	return followUp, full
+}
+
+// requestFollowUpSyncRun remembers a request for a run while one is in progress
+func requestFollowUpSyncRun(full bool) {
+	syncRun.lock.Lock()
+	defer syncRun.lock.Unlock()
+	syncRun.followUp = true
+	syncRun.followUpFull = syncRun.followUpFull || full
+}
+
+var (
+	// ErrSyncRunInProgress is returned by PlanGlK8sSync while a sync run or another plan is in progress
+	ErrSyncRunInProgress = errors.New("A synchronization run is in progress")
+	// ErrNotLeader is returned by PlanGlK8sSync on replicas which are not the leader
+	ErrNotLeader = errors.New("This replica is not the leader")
+)
+
+// PlanGlK8sSync computes all mutations a sync run would perform against K8s and Gitlab without applying any of them.
+// As it reads all of Gitlab like a sync run, it is only performed by the leader and never alongside a sync run.
+func PlanGlK8sSync() (*SyncPlan, error) {
+	ctx := leaderContext()
+	if ctx.Err() != nil {
+		return nil, ErrNotLeader
+	}
+	if !startSyncRun() {
+		return nil, ErrSyncRunInProgress
+	}
+	defer endSyncRun()
+
+	plan := &SyncPlan{Actions: make([]PlannedAction, 0)}
+	failures, err := performGlK8sSync(ctx, planningTarget{plan: plan}, time.Time{}, gitlabclient.ChangedEntities{})
+	if err != nil {
+		return nil, err
+	}
+	plan.Failures = failures
+	plan.sortActions()
+	return plan, nil
+}
+
+// SyncFailure describes a single Gitlab entity or namespace which could not be synced
+type SyncFailure struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+	Err  string `json:"error"`
+}
+
+type syncFailures struct {
+	failures []SyncFailure
+	lock     sync.Mutex
+}
+
+func (f *syncFailures) add(kind, name string, err error) {
+	log.Printf("ERROR: Sync of %s %s failed, skipping it. Err: %s", kind, name, err)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.failures = append(f.failures, SyncFailure{Kind: kind, Name: name, Err: err.Error()})
+}
+
+func logSyncFailures(failures []SyncFailure) {
+	if len(failures) == 0 {
+		return
+	}
+	log.Printf("WARNING: %d entities could not be synced:", len(failures))
+	for _, f := range failures {
+		log.Printf("  %s %s: %s", f.Kind, f.Name, f.Err)
+	}
+}
+
+// performGlK8sSync runs a sync against the given target. An error is only returned if the run could not
+// be performed at all or Gitlab could not be read completely. Entities which failed to sync are skipped and returned
+// as failures. The entities are synced while their pages are read from Gitlab. Namespaces are deleted only after all
+// of Gitlab has been read, so a failed read never deletes a namespace.
+// If since is set, only the projects updated and the users created since then and the given changed entities are
+// synced, and no namespace is deleted.
+// Once ctx is cancelled, no further entity is synced and an error is returned.
+func performGlK8sSync(ctx context.Context, target syncTarget, since time.Time, changed gitlabclient.ChangedEntities) ([]SyncFailure, error) {
+	var gitlabContent *gitlabclient.GitlabStream
+	var err error
+	if since.IsZero() {
+		log.Println("Starting new Synchronization run!")
+		log.Println("Getting Gitlab Contents...")
+		gitlabContent, err = gitlabclient.StreamFullGitlabContent(ctx)
+	} else {
+		log.Println("Starting new incremental Synchronization run!")
+		log.Println("Getting Gitlab Contents changed since " + since.Format(time.RFC3339) + "...")
+		log.Println(fmt.Sprintf("Incremental runs only sync updated projects, new users and the %d groups, %d "+
+			"projects and %d users hooks were received for, other changes of groups and memberships are left to the "+
+			"next full run!", len(changed.Groups), len(changed.Projects), len(changed.Users)))
+		gitlabContent, err = gitlabclient.StreamChangedGitlabContent(ctx, since, changed)
+	}
+	if check(err) {
+		return nil, err
+	}
 
 	log.Println("Reading custom-rolebindings if any...")
 
-	cRaB := ReadAndApplyCustomRolesAndBindings()
+	var cRaB CustomRolesAndBindings
+	if _, planning := target.(planningTarget); planning {
+		cRaB = ReadCustomRolesAndBindings()
+	} else {
+		cRaB = ReadAndApplyCustomRolesAndBindings()
+	}
 
+	failures := &syncFailures{}
 	var syncDoneWg sync.WaitGroup
 	syncDoneWg.Add(3)
 
 	log.Println("Syncing Gitlab Users...")
-	go syncUsers(gitlabContent, cRaB, &syncDoneWg)
+	go syncUsers(ctx, gitlabContent.Users, cRaB, target, failures, &syncDoneWg)
 
 	log.Println("Syncing Gitlab Groups...")
-	go syncGroups(gitlabContent, cRaB, &syncDoneWg)
+	go syncGroups(ctx, gitlabContent.Groups, cRaB, target, failures, &syncDoneWg)
 
 	log.Println("Syncing Gitlab Projects...")
-	go syncProjects(gitlabContent, cRaB, &syncDoneWg)
+	go syncProjects(ctx, gitlabContent.Projects, cRaB, target, failures, &syncDoneWg)
 
 	syncDoneWg.Wait()
+	if ctx.Err() != nil {
+		return nil, errors.New("Synchronization run has been stopped as the leadership was lost, no namespaces were deleted")
+	}
+	if err := gitlabContent.Err(); check(err) {
+		return nil, errors.Wrap(err, "Gitlab could not be read completely, no namespaces were deleted")
+	}
+
+	if since.IsZero() {
+		if err := deleteRemovedNamespaces(gitlabContent.Names(), target, failures); err != nil {
+			return nil, err
+		}
+	}
 	log.Println("Finished Synchronization run.")
+	return failures.failures, nil
+}
+
+// deleteRemovedNamespaces deletes all Namespaces whose origin is not among the names of the Gitlab entities
+func deleteRemovedNamespaces(gitlabNames map[string]bool, target syncTarget, failures *syncFailures) error {
+	log.Println("Getting K8s Contents...")
+	gitlabNamespacesInK8s, err := k8sclient.GetAllGitlabOriginNamesFromNamespacesWithOriginLabel()
+	if check(err) {
+		return err
+	}
+
+	log.Println("Deleting all namespaces which are no longer in the gitlab namespace...")
+	for _, originalName := range gitlabNamespacesInK8s {
+		if !gitlabNames[originalName] {
+			if err := target.deleteNamespace(originalName); err != nil {
+				failures.add("Namespace", originalName, err)
+			}
+		}
+	}
+
+	if ttlHours := config.Get().Sync.MigratedNamespaceTTLHours; ttlHours > 0 {
+		log.Println("Deleting all namespaces left behind by migrations which are expired...")
+		if err := target.deleteExpiredMigratedNamespaces(time.Duration(ttlHours) * time.Hour); err != nil {
+			failures.add("Namespace", "migrated namespaces", err)
+		}
+	}
+	return nil
 }
 
-func syncUsers(gitlabContent *gitlabclient.GitlabContent, cRaB CustomRolesAndBindings, syncDoneWg *sync.WaitGroup) {
+func syncUsers(ctx context.Context, users <-chan gitlabclient.GitlabUser, cRaB CustomRolesAndBindings, target syncTarget, failures *syncFailures, syncDoneWg *sync.WaitGroup) {
 	defer syncDoneWg.Done()
-	for _, user := range gitlabContent.Users {
-		if user.State != gitlabclient.UserStateBlocked {
-			actualNamespace := k8sclient.GetActualNameSpaceNameByGitlabName(user.Username)
-			if actualNamespace != "" {
-
-				// namespace is present, check rolebindings
-				k8sRoleBindings := k8sclient.GetRoleBindingsByNamespace(actualNamespace)
-				roleName := k8sclient.GetGroupRoleName("Master")
-				expectedGitlabRolebindingName := k8sclient.ConstructRoleBindingName(user.Username, roleName, actualNamespace)
-
-				// 2.1 Iterate all roleBindings
-				for rb := range k8sRoleBindings {
-					if rb != expectedGitlabRolebindingName && !cRaB.RoleBindings[rb] {
-						k8sclient.DeleteGroupRoleBindingByName(rb, actualNamespace)
-					}
-				}
-				// make sure the project's role binding is present
-				if !k8sRoleBindings[expectedGitlabRolebindingName] {
-					k8sclient.CreateGroupRoleBinding(user.Username, user.Username, "Master")
-				}
+	for user := range users {
+		if ctx.Err() != nil {
+			// the entities still buffered by the stream are drained without syncing them
+			continue
+		}
+		if !gitlabclient.IsInactiveUserState(user.State) {
+			if err := syncUser(user, cRaB, target); err != nil {
+				failures.add("User", user.Username, err)
+			}
+		}
+	}
+}
 
-				// finally check if namespace has CEPHSecretUser
-				k8sclient.DeployCEPHSecretUser(actualNamespace)
-				k8sclient.DeployAdditionalServiceAccounts(actualNamespace)
-				k8sclient.CreateLimitRange(actualNamespace)
+func syncUser(user gitlabclient.GitlabUser, cRaB CustomRolesAndBindings, target syncTarget) error {
+	actualNamespace, err := k8sclient.GetActualNameSpaceNameByGitlabName(user.Username)
+	if err != nil {
+		return err
+	}
+	if actualNamespace == "" {
+		// create Namespace & RoleBinding
+		if err := target.createNamespace(user.Username); err != nil {
+			return err
+		}
+		return target.createGroupRoleBinding(user.Username, user.Username, "Master")
+	}
 
-			} else {
-				// create Namespace & RoleBinding
-				k8sclient.CreateNamespace(user.Username)
-				k8sclient.CreateGroupRoleBinding(user.Username, user.Username, "Master")
+	// namespace is present, check rolebindings
+	k8sRoleBindings, err := k8sclient.GetRoleBindingsByNamespace(actualNamespace)
+	if err != nil {
+		return err
+	}
+	roleName := k8sclient.GetGroupRoleName("Master")
+	expectedGitlabRolebindingName := k8sclient.ConstructRoleBindingName(user.Username, roleName, actualNamespace)
+
+	// 2.1 Iterate all roleBindings
+	for rb := range k8sRoleBindings {
+		if rb != expectedGitlabRolebindingName && !cRaB.RoleBindings[rb] {
+			if err := target.deleteGroupRoleBindingByName(rb, actualNamespace); err != nil {
+				return err
 			}
 		}
 	}
+	// make sure the project's role binding is present
+	if !k8sRoleBindings[expectedGitlabRolebindingName] {
+		if err := target.createGroupRoleBinding(user.Username, user.Username, "Master"); err != nil {
+			return err
+		}
+	}
+
+	// finally check if namespace has CEPHSecretUser
+	return target.deployNamespaceDefaults(actualNamespace)
 }
 
-func syncGroups(gitlabContent *gitlabclient.GitlabContent, cRaB CustomRolesAndBindings, syncDoneWg *sync.WaitGroup) {
+func syncGroups(ctx context.Context, groups <-chan gitlabclient.GitlabGroup, cRaB CustomRolesAndBindings, target syncTarget, failures *syncFailures, syncDoneWg *sync.WaitGroup) {
 	defer syncDoneWg.Done()
 	// same same for Groups
-	for _, group := range gitlabContent.Groups {
+	for group := range groups {
+		if ctx.Err() != nil {
+			continue
+		}
 		if group.FullPath == "kube-system" {
 			continue
 		} // ignore kube-system group
 
-		if debugSync() {
-			log.Println("Syncing: " + group.FullPath)
+		if err := syncGroup(group, cRaB, target); err != nil {
+			failures.add("Group", group.FullPath, err)
 		}
+	}
+}
+
+func syncGroup(group gitlabclient.GitlabGroup, cRaB CustomRolesAndBindings, target syncTarget) error {
+	if debugSync() {
+		log.Println("Syncing: " + group.FullPath)
+	}
+	if group.MembersError != nil {
+		return errors.Wrap(group.MembersError, "members could not be retrieved from Gitlab")
+	}
 
-		actualNamespace := k8sclient.GetActualNameSpaceNameByGitlabName(group.FullPath)
+	actualNamespace, err := k8sclient.GetActualNameSpaceNameByGitlabName(group.FullPath)
+	if err != nil {
+		return err
+	}
+	if debugSync() {
+		log.Println("ActualNamespace: " + actualNamespace)
+	}
+	if actualNamespace == "" {
+		// create Namespace & RoleBinding
 		if debugSync() {
-			log.Println("ActualNamespace: " + actualNamespace)
+			log.Println("Creating Namespace for " + group.FullPath)
 		}
-		if actualNamespace != "" {
-
-			// namespace is present, check rolebindings
-			k8sRoleBindings := k8sclient.GetRoleBindingsByNamespace(actualNamespace)
-			if debugSync() {
-				log.Printf("Found %d rolebindings \n", len(k8sRoleBindings))
+		if err := target.createNamespace(group.FullPath); err != nil {
+			return err
+		}
+		if _, _, err := target.createServiceAccountAndRoleBinding(group.FullPath); err != nil {
+			return errors.Wrap(err, "creating a ServiceAccount failed")
+		}
+		for _, member := range group.Members {
+			if !gitlabclient.IsInactiveUserState(member.State) {
+				accessLevel := gitlabclient.TranslateIntAccessLevels(member.AccessLevel)
+				if err := target.createGroupRoleBinding(member.Username, group.FullPath, accessLevel); err != nil {
+					return err
+				}
 			}
+		}
+		return nil
+	}
+
+	// namespace is present, check rolebindings
+	k8sRoleBindings, err := k8sclient.GetRoleBindingsByNamespace(actualNamespace)
+	if err != nil {
+		return err
+	}
+	if debugSync() {
+		log.Printf("Found %d rolebindings \n", len(k8sRoleBindings))
+	}
 
-			// get expectedRoleBindings by retrieved Members
-			expectedRoleBindings := map[string]bool{}
+	// get expectedRoleBindings by retrieved Members
+	expectedRoleBindings := map[string]bool{}
 
-			// create or get ServiceAccount
-			_, roleBindingName, err := k8sclient.CreateServiceAccountAndRoleBinding(group.FullPath)
-			if err != nil {
-				log.Fatalln(fmt.Sprintf("A fatal error occurred while creating a ServiceAccount for group %s. Err was: %s", group.FullPath, err))
+	// create or get ServiceAccount
+	_, roleBindingName, err := target.createServiceAccountAndRoleBinding(group.FullPath)
+	if err != nil {
+		return errors.Wrap(err, "creating a ServiceAccount failed")
+	}
+	expectedRoleBindings[roleBindingName] = true
+
+	for _, member := range group.Members {
+		if !gitlabclient.IsInactiveUserState(member.State) {
+
+			if debugSync() {
+				log.Println("Processing member " + member.Name)
 			}
-			expectedRoleBindings[roleBindingName] = true
-
-			for _, member := range group.Members {
-				if member.State != gitlabclient.UserStateBlocked {
-
-					if debugSync() {
-						log.Println("Processing member " + member.Name)
-					}
-					accessLevel := gitlabclient.TranslateIntAccessLevels(member.AccessLevel)
-					roleName := k8sclient.GetGroupRoleName(accessLevel)
-					rbName := k8sclient.ConstructRoleBindingName(member.Username, roleName, actualNamespace)
-					expectedRoleBindings[rbName] = true
-
-					if debugSync() {
-						log.Printf("AccessLevel: %s, roleName: %s, rbName: %s", accessLevel, roleName, rbName)
-					}
-
-					// make sure the groups's expected rolebindings are present
-					if !k8sRoleBindings[rbName] {
-						if debugSync() {
-							log.Println("Creating RoleBinding " + rbName)
-						}
-						k8sclient.CreateGroupRoleBinding(member.Username, group.FullPath, accessLevel)
-					}
-				}
+			accessLevel := gitlabclient.TranslateIntAccessLevels(member.AccessLevel)
+			roleName := k8sclient.GetGroupRoleName(accessLevel)
+			rbName := k8sclient.ConstructRoleBindingName(member.Username, roleName, actualNamespace)
+			expectedRoleBindings[rbName] = true
+
+			if debugSync() {
+				log.Printf("AccessLevel: %s, roleName: %s, rbName: %s", accessLevel, roleName, rbName)
 			}
 
-			// 2.1 Iterate all roleBindings and delete those which are not anymore present in gitlab or in custom roles
-			for rb := range k8sRoleBindings {
-				if !expectedRoleBindings[rb] && !cRaB.RoleBindings[rb] {
-					if debugSync() {
-						log.Println("Deleting RoleBinding " + rb)
-					}
-					k8sclient.DeleteGroupRoleBindingByName(rb, actualNamespace)
+			// make sure the groups's expected rolebindings are present
+			if !k8sRoleBindings[rbName] {
+				if debugSync() {
+					log.Println("Creating RoleBinding " + rbName)
+				}
+				if err := target.createGroupRoleBinding(member.Username, group.FullPath, accessLevel); err != nil {
+					return err
 				}
 			}
+		}
+	}
 
-			// finally check if namespace has CEPHSecretUser
-			k8sclient.DeployCEPHSecretUser(actualNamespace)
-			k8sclient.DeployAdditionalServiceAccounts(actualNamespace)
-			k8sclient.CreateLimitRange(actualNamespace)
-
-		} else {
-			// create Namespace & RoleBinding
-			k8sclient.CreateNamespace(group.FullPath)
-			_, _, err := k8sclient.CreateServiceAccountAndRoleBinding(group.FullPath)
-			if err != nil {
-				log.Fatalln(fmt.Sprintf("A fatal error occurred while creating a ServiceAccount for group %s. Err was: %s", group.FullPath, err))
-			}
+	// 2.1 Iterate all roleBindings and delete those which are not anymore present in gitlab or in custom roles
+	for rb := range k8sRoleBindings {
+		if !expectedRoleBindings[rb] && !cRaB.RoleBindings[rb] {
 			if debugSync() {
-				log.Println("Creating Namespace for " + group.FullPath)
+				log.Println("Deleting RoleBinding " + rb)
 			}
-			for _, member := range group.Members {
-				if member.State != gitlabclient.UserStateBlocked {
-					accessLevel := gitlabclient.TranslateIntAccessLevels(member.AccessLevel)
-					k8sclient.CreateGroupRoleBinding(member.Username, group.FullPath, accessLevel)
-				}
+			if err := target.deleteGroupRoleBindingByName(rb, actualNamespace); err != nil {
+				return err
 			}
 		}
 	}
+
+	// finally check if namespace has CEPHSecretUser
+	return target.deployNamespaceDefaults(actualNamespace)
 }
 
-func syncProjects(gitlabContent *gitlabclient.GitlabContent, cRaB CustomRolesAndBindings, syncDoneWg *sync.WaitGroup) {
+func syncProjects(ctx context.Context, projects <-chan gitlabclient.GitlabProject, cRaB CustomRolesAndBindings, target syncTarget, failures *syncFailures, syncDoneWg *sync.WaitGroup) {
 	defer syncDoneWg.Done()
-	for _, project := range gitlabContent.Projects {
-		actualNamespace := k8sclient.GetActualNameSpaceNameByGitlabName(project.PathWithNameSpace)
-		if actualNamespace != "" {
-			// get expectedRoleBindings by retrieved Members
-			expectedRoleBindings := map[string]bool{}
-
-			// create or get ServiceAccount
-			serviceAccountInfo, roleBindingName, err := k8sclient.CreateServiceAccountAndRoleBinding(project.PathWithNameSpace)
-			if err != nil {
-				log.Fatalln(fmt.Sprintf("A fatal error occurred while creating a ServiceAccount. Err was: %s", err))
-			}
-			expectedRoleBindings[roleBindingName] = true
-
-			// configure project in gitlab for K8s integration
-			go gitlabclient.SetupK8sIntegrationForGitlabProject(strconv.Itoa(project.Id), serviceAccountInfo.Namespace, serviceAccountInfo.Token)
+	for project := range projects {
+		if ctx.Err() != nil {
+			continue
+		}
+		if err := syncProject(project, cRaB, target); err != nil {
+			failures.add("Project", project.PathWithNameSpace, err)
+		}
+	}
+}
 
-			// namespace is present, check rolebindings
-			k8sRoleBindings := k8sclient.GetRoleBindingsByNamespace(actualNamespace)
+func syncProject(project gitlabclient.GitlabProject, cRaB CustomRolesAndBindings, target syncTarget) error {
+	if project.MembersError != nil {
+		return errors.Wrap(project.MembersError, "members could not be retrieved from Gitlab")
+	}
 
-			for _, member := range project.Members {
-				if member.State != gitlabclient.UserStateBlocked {
+	actualNamespace, err := k8sclient.GetActualNameSpaceNameByGitlabName(project.PathWithNameSpace)
+	if err != nil {
+		return err
+	}
+	if actualNamespace == "" {
+		// create Namespace & RoleBinding
+		if err := target.createNamespace(project.PathWithNameSpace); err != nil {
+			return err
+		}
+		serviceAccountInfo, _, err := target.createServiceAccountAndRoleBinding(project.PathWithNameSpace)
+		if err != nil {
+			return errors.Wrap(err, "creating a ServiceAccount failed")
+		}
 
-					accessLevel := gitlabclient.TranslateIntAccessLevels(member.AccessLevel)
-					roleName := k8sclient.GetProjectRoleName(accessLevel)
-					rbName := k8sclient.ConstructRoleBindingName(member.Username, roleName, actualNamespace)
-					expectedRoleBindings[rbName] = true
+		// configure project in gitlab for K8s integration
+		target.setupK8sIntegrationForGitlabProject(project.Id, serviceAccountInfo.Namespace, serviceAccountInfo.Token)
 
-					// make sure the project's expected rolebindings are present
-					if !k8sRoleBindings[rbName] {
-						k8sclient.CreateProjectRoleBinding(member.Username, project.PathWithNameSpace, accessLevel)
-					}
+		for _, member := range project.Members {
+			if !gitlabclient.IsInactiveUserState(member.State) {
+				accessLevel := gitlabclient.TranslateIntAccessLevels(member.AccessLevel)
+				if err := target.createProjectRoleBinding(member.Username, project.PathWithNameSpace, accessLevel); err != nil {
+					return err
 				}
 			}
+		}
+		return nil
+	}
 
-			// 2.1 Iterate all roleBindings and delete those which are not anymore present in gitlab
-			// or through logic of this service
-			for rb := range k8sRoleBindings {
-				if !expectedRoleBindings[rb] && !cRaB.RoleBindings[rb] {
-					k8sclient.DeleteProjectRoleBindingByName(rb, actualNamespace)
-				}
-			}
+	// get expectedRoleBindings by retrieved Members
+	expectedRoleBindings := map[string]bool{}
 
-			// finally check if namespace has CEPHSecretUser
-			k8sclient.DeployCEPHSecretUser(actualNamespace)
-			k8sclient.DeployAdditionalServiceAccounts(actualNamespace)
-			k8sclient.CreateLimitRange(actualNamespace)
-		} else {
-			// create Namespace & RoleBinding
-			k8sclient.CreateNamespace(project.PathWithNameSpace)
-			serviceAccountInfo, _, err := k8sclient.CreateServiceAccountAndRoleBinding(project.PathWithNameSpace)
-			if err != nil {
-				log.Fatalln(fmt.Sprintf("A fatal error occurred while creating a ServiceAccount. Err was: %s", err))
-			}
+	// create or get ServiceAccount
+	serviceAccountInfo, roleBindingName, err := target.createServiceAccountAndRoleBinding(project.PathWithNameSpace)
+	if err != nil {
+		return errors.Wrap(err, "creating a ServiceAccount failed")
+	}
+	expectedRoleBindings[roleBindingName] = true
 
-			// configure project in gitlab for K8s integration
-			go gitlabclient.SetupK8sIntegrationForGitlabProject(strconv.Itoa(project.Id), serviceAccountInfo.Namespace, serviceAccountInfo.Token)
+	// configure project in gitlab for K8s integration
+	target.setupK8sIntegrationForGitlabProject(project.Id, serviceAccountInfo.Namespace, serviceAccountInfo.Token)
 
-			for _, member := range project.Members {
-				if member.State != gitlabclient.UserStateBlocked {
-					accessLevel := gitlabclient.TranslateIntAccessLevels(member.AccessLevel)
-					k8sclient.CreateProjectRoleBinding(member.Username, project.PathWithNameSpace, accessLevel)
+	// namespace is present, check rolebindings
+	k8sRoleBindings, err := k8sclient.GetRoleBindingsByNamespace(actualNamespace)
+	if err != nil {
+		return err
+	}
+
+	for _, member := range project.Members {
+		if !gitlabclient.IsInactiveUserState(member.State) {
+
+			accessLevel := gitlabclient.TranslateIntAccessLevels(member.AccessLevel)
+			roleName := k8sclient.GetProjectRoleName(accessLevel)
+			rbName := k8sclient.ConstructRoleBindingName(member.Username, roleName, actualNamespace)
+			expectedRoleBindings[rbName] = true
+
+			// make sure the project's expected rolebindings are present
+			if !k8sRoleBindings[rbName] {
+				if err := target.createProjectRoleBinding(member.Username, project.PathWithNameSpace, accessLevel); err != nil {
+					return err
 				}
 			}
+		}
+	}
 
+	// 2.1 Iterate all roleBindings and delete those which are not anymore present in gitlab
+	// or through logic of this service
+	for rb := range k8sRoleBindings {
+		if !expectedRoleBindings[rb] && !cRaB.RoleBindings[rb] {
+			if err := target.deleteProjectRoleBindingByName(rb, actualNamespace); err != nil {
+				return err
+			}
 		}
 	}
+
+	// finally check if namespace has CEPHSecretUser
+	return target.deployNamespaceDefaults(actualNamespace)
 }
 
+// StartRecurringSyncTimer starts the scheduled sync runs. With incremental runs enabled, a run is started every
+// incremental interval and a full run is performed once the last full run is older than the full interval.
 func StartRecurringSyncTimer() {
-	log.Println("Starting Sync Timer...")
-	ticker := time.NewTicker(time.Hour * 3)
+	cfg := config.Get().Sync
+	interval := time.Duration(cfg.FullIntervalMinutes) * time.Minute
+	if cfg.IncrementalIntervalMinutes > 0 {
+		interval = time.Duration(cfg.IncrementalIntervalMinutes) * time.Minute
+	}
+	log.Println(fmt.Sprintf("Starting Sync Timer with an interval of %s...", interval))
+	ticker := time.NewTicker(interval)
 	go func() {
-		for range ticker.C {
-			go PerformGlK8sSync()
+		for now := range ticker.C {
+			go performScheduledSync(now)
 		}
 	}()
 }
 
+func logSyncPlan(plan *SyncPlan) {
+	if config.Get().Sync.PlanFormat == "json" {
+		planJson, err := plan.JSON()
+		if check(err) {
+			return
+		}
+		log.Println("DRY RUN: No changes have been applied. Plan was:\n" + string(planJson))
+		return
+	}
+	log.Println("DRY RUN: No changes have been applied. Plan was:\n" + plan.String())
+}
+
+// dryRun returns true if syncs and hooks shall only be planned, but not applied
+func dryRun() bool {
+	return config.Get().Sync.DryRun
+}
+
 func debugSync() bool {
-	return os.Getenv("ENABLE_GITLAB_SYNC_DEBUG") == "true"
+	return config.Get().Sync.Debug
 }
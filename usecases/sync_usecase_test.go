@@ -0,0 +1,316 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/gitlabclient"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/k8sclient"
+	"k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// usersOf returns a closed channel delivering the given users, like a GitlabStream
+func usersOf(users ...gitlabclient.GitlabUser) <-chan gitlabclient.GitlabUser {
+	ch := make(chan gitlabclient.GitlabUser, len(users))
+	for _, user := range users {
+		ch <- user
+	}
+	close(ch)
+	return ch
+}
+
+func TestSyncUsersReconcilesRoleBindings(t *testing.T) {
+	expected := k8sclient.ConstructRoleBindingName("alice", "gitlab-group-master", "alice")
+	k8sclient.SetClient(fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alice", Labels: map[string]string{"gitlab-origin": "alice"}}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "stale-binding", Namespace: "alice"}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "custom-binding", Namespace: "alice"}},
+	))
+
+	users := usersOf(gitlabclient.GitlabUser{Username: "alice"}, gitlabclient.GitlabUser{Username: "bob"}, gitlabclient.GitlabUser{Username: "eve", State: gitlabclient.UserStateBlocked})
+	cRaB := CustomRolesAndBindings{RoleBindings: map[string]bool{"custom-binding": true}}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	syncUsers(context.Background(), users, cRaB, applyingTarget{}, &syncFailures{}, &wg)
+	wg.Wait()
+
+	rbs, _ := k8sclient.GetRoleBindingsByNamespace("alice")
+	if !rbs[expected] {
+		t.Errorf("Expected RoleBinding %s to be created", expected)
+	}
+	if rbs["stale-binding"] {
+		t.Error("Expected stale RoleBinding to be deleted")
+	}
+	if !rbs["custom-binding"] {
+		t.Error("Expected custom RoleBinding to be kept")
+	}
+
+	if ns, _ := k8sclient.GetActualNameSpaceNameByGitlabName("bob"); ns != "bob" {
+		t.Errorf("Expected namespace bob to be created, but was %q", ns)
+	}
+	if ns, _ := k8sclient.GetActualNameSpaceNameByGitlabName("eve"); ns != "" {
+		t.Errorf("Expected no namespace for blocked user eve, but was %q", ns)
+	}
+}
+
+func TestPlanningTargetDoesNotApplyChanges(t *testing.T) {
+	k8sclient.SetClient(fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "alice", Labels: map[string]string{"gitlab-origin": "alice"}}},
+		&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "stale-binding", Namespace: "alice"}},
+	))
+
+	users := usersOf(gitlabclient.GitlabUser{Username: "alice"}, gitlabclient.GitlabUser{Username: "bob"})
+	plan := &SyncPlan{}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	syncUsers(context.Background(), users, CustomRolesAndBindings{RoleBindings: map[string]bool{}}, planningTarget{plan: plan}, &syncFailures{}, &wg)
+	wg.Wait()
+	plan.sortActions()
+
+	expected := []PlannedAction{
+		{Action: ActionCreate, Kind: "Namespace", Name: "bob", Details: "gitlab: bob"},
+		{Action: ActionCreate, Kind: "RoleBinding", Namespace: "alice", Name: "alice-gitlab-group-master-alice", Details: "user alice as gitlab-group-master"},
+		{Action: ActionDelete, Kind: "RoleBinding", Namespace: "alice", Name: "stale-binding"},
+		{Action: ActionCreate, Kind: "RoleBinding", Namespace: "bob", Name: "bob-gitlab-group-master-bob", Details: "user bob as gitlab-group-master"},
+	}
+	if len(plan.Actions) != len(expected) {
+		t.Fatalf("Expected %d planned actions, but got %d: %v", len(expected), len(plan.Actions), plan.Actions)
+	}
+	for i := range expected {
+		if plan.Actions[i] != expected[i] {
+			t.Errorf("Expected action %v, but got %v", expected[i], plan.Actions[i])
+		}
+	}
+
+	if rbs, _ := k8sclient.GetRoleBindingsByNamespace("alice"); !rbs["stale-binding"] || len(rbs) != 1 {
+		t.Errorf("Planning changed the RoleBindings of namespace alice: %v", rbs)
+	}
+	if ns, _ := k8sclient.GetActualNameSpaceNameByGitlabName("bob"); ns != "" {
+		t.Errorf("Planning created namespace %s", ns)
+	}
+
+	text := plan.String()
+	if !strings.HasPrefix(text, "Sync plan: 3 to create, 0 to update, 1 to delete\n") || !strings.Contains(text, "- RoleBinding alice/stale-binding\n") {
+		t.Errorf("Unexpected text rendering of plan:\n%s", text)
+	}
+}
+
+func TestSyncSkipsFailingEntities(t *testing.T) {
+	k8sclient.SetClient(fake.NewSimpleClientset())
+
+	users := usersOf(gitlabclient.GitlabUser{Username: "-broken-"}, gitlabclient.GitlabUser{Username: "carol"})
+	groups := make(chan gitlabclient.GitlabGroup, 1)
+	groups <- gitlabclient.GitlabGroup{FullPath: "unreachable", MembersError: errors.New("timeout")}
+	close(groups)
+	cRaB := CustomRolesAndBindings{RoleBindings: map[string]bool{}}
+	failures := &syncFailures{}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	syncUsers(context.Background(), users, cRaB, applyingTarget{}, failures, &wg)
+	syncGroups(context.Background(), groups, cRaB, applyingTarget{}, failures, &wg)
+	wg.Wait()
+
+	if len(failures.failures) != 2 {
+		t.Fatalf("Expected 2 failures, but got %v", failures.failures)
+	}
+	if failures.failures[0].Kind != "User" || failures.failures[0].Name != "-broken-" {
+		t.Errorf("Expected failure of user -broken-, but got %v", failures.failures[0])
+	}
+	if failures.failures[1].Kind != "Group" || failures.failures[1].Name != "unreachable" {
+		t.Errorf("Expected failure of group unreachable, but got %v", failures.failures[1])
+	}
+	if ns, _ := k8sclient.GetActualNameSpaceNameByGitlabName("carol"); ns != "carol" {
+		t.Errorf("Expected namespace carol to be created despite other failures, but was %q", ns)
+	}
+	if ns, _ := k8sclient.GetActualNameSpaceNameByGitlabName("unreachable"); ns != "" {
+		t.Errorf("Expected no namespace for group with unknown members, but was %q", ns)
+	}
+}
+
+func TestSyncRunsAreSingleFlight(t *testing.T) {
+	hookApplied := make(chan struct{})
+	q, cleanup := newTestQueue(t, func(event *QueuedEvent) error {
+		close(hookApplied)
+		return nil
+	})
+	defer cleanup()
+	if err := q.start(); err != nil {
+		t.Fatal(err)
+	}
+	queue = q
+	defer func() { queue = nil }()
+
+	if !startSyncRun() {
+		t.Fatal("Expected sync run to start")
+	}
+	if startSyncRun() {
+		t.Fatal("Expected second sync run not to start while the first is in progress")
+	}
+	// remembered for after the running sync, so it returns without touching Gitlab or K8s
+	PerformGlK8sSync()
+
+	if err := q.enqueue(newEventID(time.Now()), []byte(`{"event_name":"project_create"}`), "", ""); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-hookApplied:
+		t.Fatal("Expected hook to wait for the sync run")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if followUp, full := finishSyncRun(); !followUp || !full {
+		t.Error("Expected a full run to follow the run in progress")
+	}
+	select {
+	case <-hookApplied:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected hook to be applied after the sync run")
+	}
+	if !startSyncRun() {
+		t.Fatal("Expected sync run to start after the previous one finished")
+	}
+	if followUp, _ := finishSyncRun(); followUp {
+		t.Error("Expected no run to follow without a request")
+	}
+}
+
+func TestPlansAreRejectedDuringSyncRuns(t *testing.T) {
+	if !startSyncRun() {
+		t.Fatal("Expected sync run to start")
+	}
+	if _, err := PlanGlK8sSync(); err != ErrSyncRunInProgress {
+		t.Errorf("Expected the plan to be rejected while a sync run is in progress, got %v", err)
+	}
+	if followUp, _ := finishSyncRun(); followUp {
+		t.Error("Expected a rejected plan not to request another run")
+	}
+
+	cfg := config.Default()
+	cfg.LeaderElection.Enabled = true
+	config.Set(cfg)
+	defer config.Set(config.Default())
+	if _, err := PlanGlK8sSync(); err != ErrNotLeader {
+		t.Errorf("Expected the plan to be rejected on a follower, got %v", err)
+	}
+	if !startSyncRun() {
+		t.Fatal("Expected a rejected plan not to block sync runs")
+	}
+	finishSyncRun()
+}
+
+func TestSyncRequestsDuringRunAreFollowedUp(t *testing.T) {
+	defer func() { syncState.since, syncState.lastFull = time.Time{}, time.Time{} }()
+	syncState.since = time.Now().Add(-time.Hour)
+
+	if !startSyncRun() {
+		t.Fatal("Expected sync run to start")
+	}
+	PerformIncrementalGlK8sSync()
+	PerformIncrementalGlK8sSync()
+	if followUp, full := finishSyncRun(); !followUp || full {
+		t.Errorf("Expected a single incremental run to follow, got %t and full %t", followUp, full)
+	}
+
+	if !startSyncRun() {
+		t.Fatal("Expected sync run to start")
+	}
+	PerformIncrementalGlK8sSync()
+	PerformGlK8sSync()
+	if followUp, full := finishSyncRun(); !followUp || !full {
+		t.Errorf("Expected a full run to follow if any request was for a full run, got %t and full %t", followUp, full)
+	}
+}
+
+func TestScheduledSyncIsFull(t *testing.T) {
+	cfg := config.Default()
+	cfg.Sync.FullIntervalMinutes = 180
+	cfg.Sync.IncrementalIntervalMinutes = 15
+	config.Set(cfg)
+	defer config.Set(config.Default())
+
+	now := time.Now()
+	syncState.since, syncState.lastFull = time.Time{}, time.Time{}
+	if !scheduledSyncIsFull(now) {
+		t.Error("Expected a full run without a successful run before")
+	}
+
+	syncState.since, syncState.lastFull = now.Add(-15*time.Minute), now.Add(-time.Hour)
+	if scheduledSyncIsFull(now) {
+		t.Error("Expected an incremental run within the full interval")
+	}
+
+	syncState.lastFull = now.Add(-3 * time.Hour)
+	if !scheduledSyncIsFull(now) {
+		t.Error("Expected a full run once the full interval has passed")
+	}
+
+	cfg.Sync.IncrementalIntervalMinutes = 0
+	syncState.lastFull = now.Add(-time.Hour)
+	if !scheduledSyncIsFull(now) {
+		t.Error("Expected full runs only with incremental runs disabled")
+	}
+	syncState.since, syncState.lastFull = time.Time{}, time.Time{}
+}
+
+func TestChangedEntitiesAreForgottenAfterTheirRun(t *testing.T) {
+	start := time.Now()
+	recordChangedEntities(&GroupMemberEvent{EventName: "user_add_to_group", GroupID: 1, UserID: 2}, start.Add(-time.Minute))
+	recordChangedEntities(&ProjectEvent{EventName: "project_rename", ProjectID: 3}, start.Add(-time.Minute))
+	recordChangedEntities(&ProjectEvent{EventName: "project_rename", ProjectID: 4}, start.Add(time.Minute))
+	recordChangedEntities(&MergeRequestEvent{ObjectKind: "merge_request"}, start)
+
+	changed := getChangedEntities()
+	if !changed.Groups[1] || !changed.Users[2] || !changed.Projects[3] || !changed.Projects[4] || len(changed.Projects) != 2 {
+		t.Errorf("Expected the entities of all hooks, got %+v", changed)
+	}
+
+	forgetChangedEntities(start)
+	changed = getChangedEntities()
+	if len(changed.Groups) != 0 || len(changed.Users) != 0 || len(changed.Projects) != 1 || !changed.Projects[4] {
+		t.Errorf("Expected only the entities of hooks received after the run started, got %+v", changed)
+	}
+	forgetChangedEntities(start.Add(time.Hour))
+}
+
+func TestSyncStopsWhenLeadershipIsLost(t *testing.T) {
+	k8sclient.SetClient(fake.NewSimpleClientset())
+	cfg := config.Default()
+	cfg.LeaderElection.Enabled = true
+	config.Set(cfg)
+	defer config.Set(config.Default())
+
+	if leaderContext().Err() == nil {
+		t.Fatal("Expected no leader context before winning the election")
+	}
+	// like startedLeading, without the sync run
+	leader.lock.Lock()
+	leader.leading = true
+	leader.ctx, leader.cancel = context.WithCancel(context.Background())
+	leader.lock.Unlock()
+	ctx := leaderContext()
+	if ctx.Err() != nil {
+		t.Fatal("Expected the leader context to be active while leading")
+	}
+
+	stoppedLeading()
+	if ctx.Err() == nil {
+		t.Fatal("Expected the leader context to be cancelled when the leadership is lost")
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	syncUsers(ctx, usersOf(gitlabclient.GitlabUser{Username: "alice"}), CustomRolesAndBindings{RoleBindings: map[string]bool{}}, applyingTarget{}, &syncFailures{}, &wg)
+	if ns, _ := k8sclient.GetActualNameSpaceNameByGitlabName("alice"); ns != "" {
+		t.Errorf("Expected no user to be synced after the leadership was lost, but namespace %s was created", ns)
+	}
+}
@@ -0,0 +1,159 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package usecases
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/gitlabclient"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/k8sclient"
+	"github.com/pkg/errors"
+)
+
+// StartUserStateCheck periodically revokes the access of blocked, banned and deactivated users, in case a hook
+// has been missed or a binding has been created again, and restores the access of reactivated users. As it lists all
+// users of Gitlab, it runs every few minutes only, the hooks are applied right away.
+func StartUserStateCheck() {
+	interval := config.Get().Users.StateCheckIntervalMinutes
+	if interval == 0 {
+		return
+	}
+	log.Println(fmt.Sprintf("Starting User State Check every %d minutes...", interval))
+	ticker := time.NewTicker(time.Duration(interval) * time.Minute)
+	go func() {
+		for range ticker.C {
+			if IsLeader() && !dryRun() {
+				check(checkUserStates())
+			}
+		}
+	}()
+}
+
+func checkUserStates() error {
+	users, err := gitlabclient.GetUsers()
+	if err != nil {
+		return err
+	}
+	active := map[string]int{}
+	var inactive []string
+	for _, user := range users {
+		if gitlabclient.IsInactiveUserState(user.State) {
+			inactive = append(inactive, user.Username)
+		} else {
+			active[user.Username] = user.Id
+		}
+	}
+	if err := k8sclient.RevokeUserAccess(config.Get().Users.ScaleDownInactive, inactive...); err != nil {
+		return err
+	}
+
+	revoked, err := k8sclient.GetUsersWithRevokedAccess()
+	if err != nil {
+		return err
+	}
+	var messages []string
+	for _, username := range revoked {
+		if id, ok := active[username]; ok {
+			if err := restoreUserAccess(username, id); err != nil {
+				messages = append(messages, err.Error())
+			}
+		}
+	}
+	if len(messages) > 0 {
+		return errors.Errorf("Access of %d users could not be restored: %s", len(messages), strings.Join(messages, "; "))
+	}
+	return nil
+}
+
+// revokeUserAccess removes all RoleBindings of an inactive user right away
+func revokeUserAccess(username string) error {
+	if username == "" {
+		return &InvalidEventError{Err: errors.New("user event without username")}
+	}
+	log.Println(fmt.Sprintf("Revoking access of user %s", username))
+	return k8sclient.RevokeUserAccess(config.Get().Users.ScaleDownInactive, username)
+}
+
+// restoreUserAccess recreates the RoleBindings of a reactivated user and scales up its personal namespace. The
+// namespace stays labeled as revoked until all RoleBindings have been recreated, so a failed restore is repeated by
+// the next user state check.
+func restoreUserAccess(username string, userId int) error {
+	if username == "" || userId == 0 {
+		return &InvalidEventError{Err: errors.New("user event without username or user_id")}
+	}
+	log.Println(fmt.Sprintf("Restoring access of user %s", username))
+	if err := restoreUserRoleBindings(username, userId); err != nil {
+		return errors.Wrapf(err, "RoleBindings of user %s could not be restored", username)
+	}
+	_, err := k8sclient.RestoreUserAccess(username)
+	return err
+}
+
+// restoreUserRoleBindings recreates the RoleBinding of the user in its personal namespace and in the namespaces of
+// its memberships. Only the groups and projects the user is a member of and the subgroups and projects below its
+// groups are read from Gitlab, each binding gets the access level of the user listed among the members.
+func restoreUserRoleBindings(username string, userId int) error {
+	if err := k8sclient.CreateGroupRoleBinding(username, username, "Master"); err != nil {
+		return err
+	}
+	memberships, err := gitlabclient.GetUserMemberships(userId)
+	if err != nil {
+		return err
+	}
+	stream, err := gitlabclient.StreamGitlabEntities(leaderContext(), memberships)
+	if err != nil {
+		return err
+	}
+
+	var messages []string
+	for group := range stream.Groups {
+		if err := restoreMemberRoleBinding(username, group.FullPath, group.Members, group.MembersError, k8sclient.CreateGroupRoleBinding); err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+	for project := range stream.Projects {
+		if err := restoreMemberRoleBinding(username, project.PathWithNameSpace, project.Members, project.MembersError, k8sclient.CreateProjectRoleBinding); err != nil {
+			messages = append(messages, err.Error())
+		}
+	}
+	for range stream.Users {
+	}
+	if err := stream.Err(); err != nil {
+		return err
+	}
+	if len(messages) > 0 {
+		return errors.New(strings.Join(messages, "; "))
+	}
+	return nil
+}
+
+// restoreMemberRoleBinding creates the RoleBinding of the user in the namespace of the given group or project, if
+// the user is among its members
+func restoreMemberRoleBinding(username, path string, members []gitlabclient.Member, membersErr error, create func(username, path, accessLevel string) error) error {
+	if membersErr != nil {
+		return errors.Wrapf(membersErr, "members of %s could not be retrieved from Gitlab", path)
+	}
+	for _, member := range members {
+		if member.Username == username {
+			return create(username, path, gitlabclient.TranslateIntAccessLevels(member.AccessLevel))
+		}
+	}
+	return nil
+}
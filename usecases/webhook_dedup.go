@@ -0,0 +1,79 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package usecases
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// deliveryCache remembers the hooks delivered within the last window, to drop repeated deliveries of Gitlab.
+// A nil cache never reports a duplicate.
+type deliveryCache struct {
+	window time.Duration
+	lock   sync.Mutex
+	seen   map[string]time.Time
+}
+
+var deliveries *deliveryCache
+
+func newDeliveryCache(window time.Duration) *deliveryCache {
+	if window <= 0 {
+		return nil
+	}
+	return &deliveryCache{window: window, seen: map[string]time.Time{}}
+}
+
+// deliveryKey identifies a delivery by its X-Gitlab-Event-UUID, or by the hash of its body for Gitlab versions
+// which don't send the header
+func deliveryKey(body []byte, uuid string) string {
+	if uuid != "" {
+		return "uuid:" + uuid
+	}
+	hash := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+// duplicate records the delivery and reports whether it has been seen within the window before
+func (c *deliveryCache) duplicate(key string, now time.Time) bool {
+	if c == nil {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for k, t := range c.seen {
+		if now.Sub(t) > c.window {
+			delete(c.seen, k)
+		}
+	}
+	if _, ok := c.seen[key]; ok {
+		return true
+	}
+	c.seen[key] = now
+	return false
+}
+
+// forget removes a delivery which could not be queued, so that the retry of Gitlab is accepted
+func (c *deliveryCache) forget(key string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.seen, key)
+}
@@ -0,0 +1,47 @@
+package usecases
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeliveryCacheDropsRepeatedDeliveries(t *testing.T) {
+	c := newDeliveryCache(time.Minute)
+	now := time.Now()
+
+	key := deliveryKey([]byte(`{"event_name":"project_rename"}`), "d7a1")
+	if c.duplicate(key, now) {
+		t.Error("Expected first delivery to be accepted")
+	}
+	if !c.duplicate(key, now.Add(30*time.Second)) {
+		t.Error("Expected repeated delivery within the window to be dropped")
+	}
+	if c.duplicate(key, now.Add(2*time.Minute)) {
+		t.Error("Expected delivery after the window to be accepted")
+	}
+
+	c.forget(key)
+	if c.duplicate(key, now.Add(2*time.Minute)) {
+		t.Error("Expected forgotten delivery to be accepted")
+	}
+}
+
+func TestDeliveryKey(t *testing.T) {
+	body := []byte(`{"event_name":"project_create"}`)
+	if deliveryKey(body, "a") == deliveryKey(body, "b") {
+		t.Error("Expected deliveries with different UUIDs to differ")
+	}
+	if deliveryKey(body, "") != deliveryKey([]byte(`{"event_name":"project_create"}`), "") {
+		t.Error("Expected deliveries without UUID to be identified by their body")
+	}
+	if deliveryKey(body, "") == deliveryKey([]byte(`{"event_name":"project_destroy"}`), "") {
+		t.Error("Expected deliveries with different bodies to differ")
+	}
+}
+
+func TestDisabledDeliveryCache(t *testing.T) {
+	c := newDeliveryCache(0)
+	if c.duplicate("key", time.Now()) || c.duplicate("key", time.Now()) {
+		t.Error("Expected disabled cache to accept all deliveries")
+	}
+}
@@ -0,0 +1,354 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package usecases
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// gitlabEvent is a decoded Gitlab hook. See https://docs.gitlab.com/ce/system_hooks/system_hooks.html
+// The timestamps of the hooks are kept as strings, as Gitlab sends them in formats like "2012-07-21 07:30:54 UTC",
+// which are no RFC 3339.
+type gitlabEvent interface {
+	// name returns the event_name of system hooks or the object_kind of project hooks
+	name() string
+	// validate returns an error listing the missing fields the handler of the event requires
+	validate() error
+}
+
+// ProjectEvent is sent for project_create, project_destroy, project_rename and project_transfer
+type ProjectEvent struct {
+	EventName            string `json:"event_name"`
+	CreatedAt            string `json:"created_at"`
+	UpdatedAt            string `json:"updated_at"`
+	Name                 string `json:"name"`
+	Path                 string `json:"path"`
+	PathWithNamespace    string `json:"path_with_namespace"`
+	ProjectID            int    `json:"project_id"`
+	OwnerName            string `json:"owner_name"`
+	OwnerEmail           string `json:"owner_email"`
+	ProjectVisibility    string `json:"project_visibility"`
+	OldPathWithNamespace string `json:"old_path_with_namespace"`
+}
+
+// ProjectMemberEvent is sent for user_add_to_team, user_remove_from_team and user_update_for_team
+type ProjectMemberEvent struct {
+	EventName                string `json:"event_name"`
+	CreatedAt                string `json:"created_at"`
+	UpdatedAt                string `json:"updated_at"`
+	ProjectID                int    `json:"project_id"`
+	ProjectName              string `json:"project_name"`
+	ProjectPath              string `json:"project_path"`
+	ProjectPathWithNamespace string `json:"project_path_with_namespace"`
+	AccessLevel              string `json:"access_level"`
+	UserID                   int    `json:"user_id"`
+	UserName                 string `json:"user_name"`
+	UserUsername             string `json:"user_username"`
+	UserEmail                string `json:"user_email"`
+}
+
+// GroupEvent is sent for group_create, group_destroy and group_rename
+type GroupEvent struct {
+	EventName   string `json:"event_name"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+	GroupID     int    `json:"group_id"`
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	FullPath    string `json:"full_path"`
+	OldPath     string `json:"old_path"`
+	OldFullPath string `json:"old_full_path"`
+}
+
+// GroupMemberEvent is sent for user_add_to_group, user_remove_from_group and user_update_for_group
+type GroupMemberEvent struct {
+	EventName    string `json:"event_name"`
+	CreatedAt    string `json:"created_at"`
+	UpdatedAt    string `json:"updated_at"`
+	GroupID      int    `json:"group_id"`
+	GroupName    string `json:"group_name"`
+	GroupPath    string `json:"group_path"`
+	GroupAccess  string `json:"group_access"`
+	UserID       int    `json:"user_id"`
+	UserName     string `json:"user_name"`
+	UserUsername string `json:"user_username"`
+	UserEmail    string `json:"user_email"`
+}
+
+// UserEvent is sent for user_create, user_destroy, user_rename, user_failed_login and the changes of the state of a
+// user, like user_block
+type UserEvent struct {
+	EventName   string `json:"event_name"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+	UserID      int    `json:"user_id"`
+	Name        string `json:"name"`
+	Email       string `json:"email"`
+	Username    string `json:"username"`
+	OldUsername string `json:"old_username"`
+	State       string `json:"state"`
+}
+
+// MergeRequestEvent is sent by the Merge Request Hooks of projects
+type MergeRequestEvent struct {
+	ObjectKind       string                      `json:"object_kind"`
+	Project          MergeRequestEventProject    `json:"project"`
+	ObjectAttributes MergeRequestEventAttributes `json:"object_attributes"`
+}
+
+type MergeRequestEventProject struct {
+	ID                int    `json:"id"`
+	PathWithNamespace string `json:"path_with_namespace"`
+}
+
+type MergeRequestEventAttributes struct {
+	IID    int    `json:"iid"`
+	State  string `json:"state"`
+	Action string `json:"action"`
+}
+
+// gitlabEventTypes maps the names of all handled hooks to a constructor of their payload
+var gitlabEventTypes = map[string]func() gitlabEvent{}
+
+func init() {
+	for _, name := range []string{"project_create", "project_destroy", "project_rename", "project_transfer"} {
+		gitlabEventTypes[name] = func() gitlabEvent { return &ProjectEvent{} }
+	}
+	for _, name := range []string{"user_add_to_team", "user_remove_from_team", "user_update_for_team"} {
+		gitlabEventTypes[name] = func() gitlabEvent { return &ProjectMemberEvent{} }
+	}
+	for _, name := range []string{"group_create", "group_destroy", "group_rename"} {
+		gitlabEventTypes[name] = func() gitlabEvent { return &GroupEvent{} }
+	}
+	for _, name := range []string{"user_add_to_group", "user_remove_from_group", "user_update_for_group"} {
+		gitlabEventTypes[name] = func() gitlabEvent { return &GroupMemberEvent{} }
+	}
+	for _, name := range []string{"user_create", "user_destroy", "user_rename", "user_failed_login",
+		"user_block", "user_unblock", "user_ban", "user_unban", "user_deactivate", "user_activate"} {
+		gitlabEventTypes[name] = func() gitlabEvent { return &UserEvent{} }
+	}
+	gitlabEventTypes["merge_request"] = func() gitlabEvent { return &MergeRequestEvent{} }
+}
+
+// UnknownEventError is returned for hooks the integrator does not handle
+type UnknownEventError struct {
+	Name string
+}
+
+func (e *UnknownEventError) Error() string {
+	return "unknown Gitlab hook: " + e.Name
+}
+
+// ForbiddenEventError is returned for hooks which are not accepted from the sender, like system events sent by a
+// project webhook
+type ForbiddenEventError struct {
+	Name string
+}
+
+func (e *ForbiddenEventError) Error() string {
+	return "Gitlab hook not accepted from project webhooks: " + e.Name
+}
+
+// decodeGitlabEvent decodes a hook into the payload of its type and validates it. An UnknownEventError is returned
+// for hooks which are not handled, an InvalidEventError for malformed hooks or hooks missing required fields.
+func decodeGitlabEvent(body []byte) (gitlabEvent, error) {
+	var header struct {
+		EventName  string `json:"event_name"`
+		ObjectKind string `json:"object_kind"`
+	}
+	if err := json.Unmarshal(body, &header); err != nil {
+		return nil, &InvalidEventError{Err: err}
+	}
+	// project hooks and some system hooks carry only the kind of object they refer to
+	name := header.EventName
+	if name == "" {
+		name = header.ObjectKind
+	}
+	if name == "" {
+		return nil, &InvalidEventError{Err: errors.New("neither event_name nor object_kind is set")}
+	}
+
+	newEvent, ok := gitlabEventTypes[name]
+	if !ok {
+		return nil, &UnknownEventError{Name: name}
+	}
+	event := newEvent()
+	if err := json.Unmarshal(body, event); err != nil {
+		return nil, &InvalidEventError{Err: errors.Wrapf(err, "malformed %s", name)}
+	}
+	if err := event.validate(); err != nil {
+		return nil, &InvalidEventError{Err: errors.Wrapf(err, "incomplete %s", name)}
+	}
+	return event, nil
+}
+
+// eventEntity returns the Gitlab entity a webhook changes, e.g. project:42, by which webhooks are processed in order.
+// The id is preferred over the path, so the webhooks of an entity keep their order across renames. An empty string is
+// returned for webhooks which can't be decoded.
+func eventEntity(body []byte) string {
+	event, err := decodeGitlabEvent(body)
+	if err != nil {
+		return ""
+	}
+	entity := func(kind string, id int, path string) string {
+		if id != 0 {
+			return fmt.Sprintf("%s:%d", kind, id)
+		}
+		return kind + ":" + path
+	}
+	switch e := event.(type) {
+	case *ProjectEvent:
+		return entity("project", e.ProjectID, e.PathWithNamespace)
+	case *ProjectMemberEvent:
+		return entity("project", e.ProjectID, e.ProjectPathWithNamespace)
+	case *MergeRequestEvent:
+		return entity("project", e.Project.ID, e.Project.PathWithNamespace)
+	case *GroupEvent:
+		return entity("group", e.GroupID, e.namespacePath())
+	case *GroupMemberEvent:
+		return entity("group", e.GroupID, e.GroupPath)
+	case *UserEvent:
+		return entity("user", e.UserID, e.Username)
+	}
+	return ""
+}
+
+// ValidateGitlabEvent checks a hook before it is queued, so it can be rejected right away
+func ValidateGitlabEvent(body []byte) error {
+	_, err := decodeGitlabEvent(body)
+	return err
+}
+
+// ValidateMergeRequestHook checks a hook sent with the Merge Request Hook header. Such hooks come from project
+// webhooks, whose tokens the project maintainers know, so they may only carry merge request events. A
+// ForbiddenEventError is returned for any other event.
+func ValidateMergeRequestHook(body []byte) error {
+	event, err := decodeGitlabEvent(body)
+	if err != nil {
+		return err
+	}
+	if e, ok := event.(*MergeRequestEvent); !ok || e.ObjectKind != "merge_request" {
+		return &ForbiddenEventError{Name: event.name()}
+	}
+	return nil
+}
+
+func (e *ProjectEvent) name() string { return e.EventName }
+
+func (e *ProjectEvent) validate() error {
+	missing := requiredFields{}
+	missing.string("path_with_namespace", e.PathWithNamespace)
+	if e.EventName != "project_destroy" {
+		missing.int("project_id", e.ProjectID)
+	}
+	if e.EventName == "project_rename" || e.EventName == "project_transfer" {
+		missing.string("old_path_with_namespace", e.OldPathWithNamespace)
+	}
+	return missing.err()
+}
+
+func (e *ProjectMemberEvent) name() string { return e.EventName }
+
+func (e *ProjectMemberEvent) validate() error {
+	missing := requiredFields{}
+	missing.string("project_path_with_namespace", e.ProjectPathWithNamespace)
+	missing.string("user_username", e.UserUsername)
+	missing.string("access_level", e.AccessLevel)
+	return missing.err()
+}
+
+func (e *GroupEvent) name() string { return e.EventName }
+
+// namespacePath returns the full path of the group, which older Gitlab versions don't send for top level groups
+func (e *GroupEvent) namespacePath() string {
+	if e.FullPath != "" {
+		return e.FullPath
+	}
+	return e.Path
+}
+
+func (e *GroupEvent) validate() error {
+	missing := requiredFields{}
+	if e.EventName == "group_rename" {
+		missing.string("full_path", e.FullPath)
+		missing.string("old_full_path", e.OldFullPath)
+	} else {
+		missing.string("full_path or path", e.namespacePath())
+	}
+	return missing.err()
+}
+
+func (e *GroupMemberEvent) name() string { return e.EventName }
+
+func (e *GroupMemberEvent) validate() error {
+	missing := requiredFields{}
+	missing.string("group_path", e.GroupPath)
+	missing.string("user_username", e.UserUsername)
+	missing.string("group_access", e.GroupAccess)
+	return missing.err()
+}
+
+func (e *UserEvent) name() string { return e.EventName }
+
+func (e *UserEvent) validate() error {
+	missing := requiredFields{}
+	missing.string("username", e.Username)
+	if e.EventName == "user_rename" {
+		missing.string("old_username", e.OldUsername)
+	}
+	switch e.EventName {
+	case "user_unblock", "user_unban", "user_activate":
+		missing.int("user_id", e.UserID)
+	}
+	return missing.err()
+}
+
+func (e *MergeRequestEvent) name() string { return e.ObjectKind }
+
+func (e *MergeRequestEvent) validate() error {
+	missing := requiredFields{}
+	missing.int("project.id", e.Project.ID)
+	missing.string("project.path_with_namespace", e.Project.PathWithNamespace)
+	missing.int("object_attributes.iid", e.ObjectAttributes.IID)
+	missing.string("object_attributes.state", e.ObjectAttributes.State)
+	return missing.err()
+}
+
+// requiredFields collects the names of required fields which are empty
+type requiredFields []string
+
+func (r *requiredFields) string(field, value string) {
+	if value == "" {
+		*r = append(*r, field)
+	}
+}
+
+func (r *requiredFields) int(field string, value int) {
+	if value == 0 {
+		*r = append(*r, field)
+	}
+}
+
+func (r requiredFields) err() error {
+	if len(r) == 0 {
+		return nil
+	}
+	return errors.Errorf("missing %s", strings.Join(r, ", "))
+}
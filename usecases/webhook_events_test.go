@@ -0,0 +1,145 @@
+package usecases
+
+import "testing"
+
+func TestDecodeGitlabEvent(t *testing.T) {
+	event, err := decodeGitlabEvent([]byte(`{"event_name":"user_add_to_team","project_path_with_namespace":"group/project",` +
+		`"user_username":"alice","access_level":"Developer"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	member, ok := event.(*ProjectMemberEvent)
+	if !ok {
+		t.Fatalf("Expected ProjectMemberEvent, got %T", event)
+	}
+	if member.ProjectPathWithNamespace != "group/project" || member.UserUsername != "alice" || member.AccessLevel != "Developer" {
+		t.Errorf("Unexpected event %+v", member)
+	}
+
+	event, err = decodeGitlabEvent([]byte(`{"object_kind":"merge_request","project":{"id":42,"path_with_namespace":"group/project"},` +
+		`"object_attributes":{"iid":3,"state":"opened"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mr, ok := event.(*MergeRequestEvent); !ok || mr.ObjectAttributes.IID != 3 || mr.name() != "merge_request" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+}
+
+func TestDecodeGitlabEventWithGitlabTimestamps(t *testing.T) {
+	// payload of the Gitlab documentation for project_create
+	event, err := decodeGitlabEvent([]byte(`{
+		"created_at": "2012-07-21 07:30:54 UTC",
+		"updated_at": "2012-07-21 07:38:22 UTC",
+		"event_name": "project_create",
+		"name": "StoreCloud",
+		"owner_email": "johnsmith@gmail.com",
+		"owner_name": "John Smith",
+		"path": "storecloud",
+		"path_with_namespace": "jsmith/storecloud",
+		"project_id": 74,
+		"project_visibility": "private"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	project, ok := event.(*ProjectEvent)
+	if !ok {
+		t.Fatalf("Expected ProjectEvent, got %T", event)
+	}
+	if project.PathWithNamespace != "jsmith/storecloud" || project.CreatedAt != "2012-07-21 07:30:54 UTC" {
+		t.Errorf("Unexpected event %+v", project)
+	}
+
+	// payload of the Gitlab documentation for user_add_to_group
+	event, err = decodeGitlabEvent([]byte(`{
+		"created_at": "2012-07-21 07:30:56 UTC",
+		"updated_at": "2012-07-21 07:38:22 UTC",
+		"event_name": "user_add_to_group",
+		"group_access": "Master",
+		"group_id": 78,
+		"group_name": "StoreCloud",
+		"group_path": "storecloud",
+		"user_email": "johnsmith@gmail.com",
+		"user_name": "John Smith",
+		"user_username": "johnsmith",
+		"user_id": 41
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if member, ok := event.(*GroupMemberEvent); !ok || member.GroupPath != "storecloud" || member.UserUsername != "johnsmith" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+}
+
+func TestDecodeGitlabEventRejectsUnknownEvents(t *testing.T) {
+	_, err := decodeGitlabEvent([]byte(`{"event_name":"key_create","username":"alice"}`))
+	if unknown, ok := err.(*UnknownEventError); !ok || unknown.Name != "key_create" {
+		t.Errorf("Expected UnknownEventError for key_create, got %v", err)
+	}
+}
+
+func TestDecodeGitlabEventRejectsInvalidEvents(t *testing.T) {
+	for _, body := range []string{
+		`invalid`,
+		`{}`,
+		`{"event_name":"project_create","project_id":"1"}`,
+		`{"event_name":"project_create","path_with_namespace":"group/project"}`,
+		`{"event_name":"project_rename","path_with_namespace":"group/project","project_id":1}`,
+		`{"event_name":"user_create","access_level":"Master"}`,
+		`{"event_name":"user_rename","username":"bob"}`,
+		`{"event_name":"user_add_to_group","group_path":"group","user_username":"alice"}`,
+		`{"event_name":"group_rename","full_path":"new"}`,
+		`{"object_kind":"merge_request","project":{"path_with_namespace":"group/project"}}`,
+		`{"object_kind":"merge_request","project":{"path_with_namespace":"group/project"},"object_attributes":{"iid":1,"state":"opened"}}`,
+	} {
+		if _, err := decodeGitlabEvent([]byte(body)); err == nil {
+			t.Errorf("Expected %s to be rejected", body)
+		} else if _, ok := err.(*InvalidEventError); !ok {
+			t.Errorf("Expected InvalidEventError for %s, got %T: %s", body, err, err)
+		}
+	}
+}
+
+func TestValidateMergeRequestHook(t *testing.T) {
+	mr := `{"object_kind":"merge_request","project":{"id":42,"path_with_namespace":"group/project"},"object_attributes":{"iid":1,"state":"opened"}}`
+	if err := ValidateMergeRequestHook([]byte(mr)); err != nil {
+		t.Errorf("Expected merge request event to be accepted, got %v", err)
+	}
+	for _, body := range []string{
+		`{"event_name":"project_destroy","path_with_namespace":"group/project"}`,
+		`{"event_name":"user_block","username":"alice"}`,
+		`{"event_name":"group_destroy","full_path":"group","object_kind":"merge_request"}`,
+	} {
+		if _, ok := ValidateMergeRequestHook([]byte(body)).(*ForbiddenEventError); !ok {
+			t.Errorf("Expected %s to be forbidden in Merge Request Hooks", body)
+		}
+	}
+}
+
+func TestGroupEventFallsBackToPath(t *testing.T) {
+	event, err := decodeGitlabEvent([]byte(`{"event_name":"group_create","path":"group"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path := event.(*GroupEvent).namespacePath(); path != "group" {
+		t.Errorf("Expected path group, got %s", path)
+	}
+}
+
+func TestEventEntity(t *testing.T) {
+	cases := map[string]string{
+		`{"event_name":"project_rename","project_id":42,"path_with_namespace":"group/new","old_path_with_namespace":"group/old"}`:                        "project:42",
+		`{"event_name":"user_add_to_team","project_id":42,"project_path_with_namespace":"group/new","user_username":"alice","access_level":"Developer"}`: "project:42",
+		`{"object_kind":"merge_request","project":{"id":42,"path_with_namespace":"group/new"},"object_attributes":{"iid":1,"state":"opened"}}`:           "project:42",
+		`{"event_name":"user_add_to_group","group_path":"group","user_username":"alice","group_access":"Developer"}`:                                     "group:group",
+		`{"event_name":"user_block","user_id":7,"username":"alice"}`:                                                                                     "user:7",
+		`{"event_name":"push"}`: "",
+	}
+	for body, expected := range cases {
+		if entity := eventEntity([]byte(body)); entity != expected {
+			t.Errorf("Expected entity %q of %s, got %q", expected, body, entity)
+		}
+	}
+}
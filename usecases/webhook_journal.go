@@ -0,0 +1,301 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package usecases
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/metrics"
+	"github.com/pkg/errors"
+)
+
+const (
+	journalFile = "journal.jsonl"
+	// outcomes of a hook besides those of the metrics
+	outcomeReceived  = "received"
+	outcomeQueued    = "queued"
+	outcomeForwarded = "forwarded"
+	outcomeDead      = "dead"
+)
+
+// JournalEntry is a line of the webhook journal. The receipt of a hook is recorded with its body and X-Gitlab-Event
+// header before it is checked, the outcome of the checks as intake and every attempt to process it afterwards with its
+// outcome. A replayed hook is recorded as new receipt, which refers to the replayed one.
+type JournalEntry struct {
+	ID        string    `json:"id"`
+	UUID      string    `json:"uuid,omitempty"`
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event,omitempty"`
+	EventName string    `json:"event_name,omitempty"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+	Intake    bool      `json:"intake,omitempty"`
+	ReplayOf  string    `json:"replay_of,omitempty"`
+	Body      string    `json:"body,omitempty"`
+}
+
+// JournalEvent is a received hook together with the outcome of its checks, the intake, and its latest outcome.
+// Attempts only counts the processing attempts.
+type JournalEvent struct {
+	ID        string    `json:"id"`
+	UUID      string    `json:"uuid,omitempty"`
+	Received  time.Time `json:"received"`
+	Event     string    `json:"event,omitempty"`
+	EventName string    `json:"event_name"`
+	ReplayOf  string    `json:"replay_of,omitempty"`
+	Intake    string    `json:"intake,omitempty"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+	Attempts  int       `json:"attempts"`
+	Body      string    `json:"body,omitempty"`
+}
+
+// webhookJournal appends all journal entries to a file. Once the file exceeds half of maxBytes, it replaces the
+// previous file, so the journal never takes more than maxBytes and keeps at least the newer half of them.
+type webhookJournal struct {
+	dir      string
+	maxBytes int64
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+}
+
+var journal *webhookJournal
+
+func newWebhookJournal(dir string, maxBytes int64) (*webhookJournal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "Could not create webhook journal directory %s", dir)
+	}
+	j := &webhookJournal{dir: dir, maxBytes: maxBytes}
+	return j, j.open()
+}
+
+func (j *webhookJournal) open() error {
+	f, err := os.OpenFile(filepath.Join(j.dir, journalFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return errors.Wrap(err, "Could not open webhook journal")
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Wrap(err, "Could not open webhook journal")
+	}
+	j.file, j.size = f, info.Size()
+	return nil
+}
+
+// received records the receipt of a hook with its body and its X-Gitlab-Event header
+func (j *webhookJournal) received(id, uuid, event string, at time.Time, body []byte) {
+	j.append(JournalEntry{ID: id, UUID: uuid, Time: at, Event: event, EventName: eventName(body), Result: outcomeReceived, Body: string(body)})
+}
+
+// intake records the outcome of the checks of a hook: rejected, invalid, duplicate or queued
+func (j *webhookJournal) intake(id, outcome string, err error) {
+	entry := JournalEntry{ID: id, Time: time.Now(), Result: outcome, Intake: true}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	j.append(entry)
+}
+
+// result records the outcome of an attempt to process a hook
+func (j *webhookJournal) result(id, outcome string, err error) {
+	entry := JournalEntry{ID: id, Time: time.Now(), Result: outcome}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	j.append(entry)
+}
+
+// append writes an entry, failures are only logged, as the journal must never hold back the processing of hooks
+func (j *webhookJournal) append(entry JournalEntry) {
+	if j == nil {
+		return
+	}
+	line, err := json.Marshal(entry)
+	if check(err) {
+		return
+	}
+	line = append(line, '\n')
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.size+int64(len(line)) > j.maxBytes/2 {
+		check(j.rotate())
+	}
+	if j.file == nil {
+		return
+	}
+	n, err := j.file.Write(line)
+	j.size += int64(n)
+	check(err)
+}
+
+func (j *webhookJournal) rotate() error {
+	if j.file != nil {
+		j.file.Close()
+		j.file = nil
+	}
+	path := filepath.Join(j.dir, journalFile)
+	if err := os.Rename(path, path+".1"); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "Could not rotate webhook journal")
+	}
+	return j.open()
+}
+
+// events returns the journaled hooks, newest first. Bodies are only included if requested.
+func (j *webhookJournal) events(withBody bool) ([]JournalEvent, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	byID := map[string]*JournalEvent{}
+	for _, name := range []string{journalFile + ".1", journalFile} {
+		f, err := os.Open(filepath.Join(j.dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not read webhook journal")
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var entry JournalEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+				continue
+			}
+			if entry.Result == outcomeReceived {
+				event := &JournalEvent{ID: entry.ID, UUID: entry.UUID, Received: entry.Time, Event: entry.Event, EventName: entry.EventName,
+					ReplayOf: entry.ReplayOf, Result: outcomeReceived}
+				if withBody {
+					event.Body = entry.Body
+				}
+				byID[entry.ID] = event
+				continue
+			}
+			// results of hooks whose receipt has been rotated out are dropped
+			if event := byID[entry.ID]; event != nil {
+				event.Result, event.Error = entry.Result, entry.Error
+				if entry.Intake {
+					event.Intake = entry.Result
+				} else {
+					event.Attempts++
+				}
+			}
+		}
+		f.Close()
+	}
+
+	events := make([]JournalEvent, 0, len(byID))
+	for _, event := range byID {
+		events = append(events, *event)
+	}
+	sort.Slice(events, func(a, b int) bool { return events[a].ID > events[b].ID })
+	return events, nil
+}
+
+// eventName returns the name of the event in the hook body, or an empty string if it can't be parsed
+func eventName(body []byte) string {
+	var event struct {
+		EventName  string `json:"event_name"`
+		ObjectKind string `json:"object_kind"`
+	}
+	if json.Unmarshal(body, &event) != nil {
+		return ""
+	}
+	if event.EventName == "" {
+		return event.ObjectKind
+	}
+	return event.EventName
+}
+
+// StartWebhookJournal opens the journal in the webhook queue directory, unless it is disabled
+func StartWebhookJournal() error {
+	maxMegabytes := config.Get().Webhooks.JournalMaxMegabytes
+	if maxMegabytes == 0 {
+		return nil
+	}
+	j, err := newWebhookJournal(filepath.Join(config.Get().Webhooks.QueueDir, "journal"), int64(maxMegabytes)*1024*1024)
+	if err != nil {
+		return err
+	}
+	journal = j
+	return nil
+}
+
+// JournalGitlabWebhook records the receipt of a hook in the journal, before it is authenticated or checked, and
+// returns the id of the hook. The outcome of the checks is recorded under this id with JournalGitlabWebhookIntake,
+// the queue processes the hook under it as well. Hooks whose body has not been read are journaled without body.
+func JournalGitlabWebhook(body []byte, uuid, event string) string {
+	now := time.Now()
+	id := newEventID(now)
+	journal.received(id, uuid, event, now, body)
+	return id
+}
+
+// JournalGitlabWebhookIntake records the outcome of the checks of a hook which has been journaled before
+func JournalGitlabWebhookIntake(id, outcome string, err error) {
+	journal.intake(id, outcome, err)
+}
+
+// GetJournal returns the journaled hooks, newest first, at most limit if it is greater than zero
+func GetJournal(limit int, withBody bool) ([]JournalEvent, error) {
+	if journal == nil {
+		return nil, errors.New("Webhook journal is disabled")
+	}
+	events, err := journal.events(withBody)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+// ReplayJournalEvent queues the journaled hook with the given id again and returns the id of the replay, under which
+// it is journaled and processed like a received hook, but without deduplication. Only hooks which have been queued or
+// dropped as duplicate on receipt can be replayed, all others did not pass the authentication or the checks.
+func ReplayJournalEvent(id string) (string, error) {
+	if journal == nil {
+		return "", errors.New("Webhook journal is disabled")
+	}
+	events, err := journal.events(true)
+	if err != nil {
+		return "", err
+	}
+	for _, event := range events {
+		if event.ID != id {
+			continue
+		}
+		if event.Intake != outcomeQueued && event.Intake != metrics.OutcomeDuplicate {
+			return "", errors.Errorf("Hook %s can't be replayed, as it has not been queued on receipt", id)
+		}
+		now := time.Now()
+		replay := newEventID(now)
+		journal.append(JournalEntry{ID: replay, UUID: event.UUID, Time: now, Event: event.Event, EventName: event.EventName,
+			Result: outcomeReceived, ReplayOf: id, Body: event.Body})
+		return replay, enqueueGitlabEvent(replay, []byte(event.Body), event.UUID, event.Event, false)
+	}
+	return "", errors.Errorf("Hook %s is not in the journal", id)
+}
@@ -0,0 +1,161 @@
+package usecases
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func newTestJournal(t *testing.T, maxBytes int64) (*webhookJournal, func()) {
+	dir, err := ioutil.TempDir("", "webhook-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := newWebhookJournal(dir, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j, func() { os.RemoveAll(dir) }
+}
+
+func TestWebhookJournalMergesResults(t *testing.T) {
+	j, cleanup := newTestJournal(t, 1024*1024)
+	defer cleanup()
+
+	j.received("1", "uuid-1", "", time.Now(), []byte(`{"event_name":"project_create"}`))
+	j.received("2", "", "", time.Now(), []byte(`{"object_kind":"merge_request"}`))
+	j.result("1", "error", errors.New("boom"))
+	j.result("1", "success", nil)
+
+	events, err := j.events(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("Expected 2 events, got %d", len(events))
+	}
+	if events[0].ID != "2" || events[0].EventName != "merge_request" || events[0].Result != "received" || events[0].Body != "" {
+		t.Errorf("Unexpected newest event %+v", events[0])
+	}
+	if events[1].UUID != "uuid-1" || events[1].EventName != "project_create" || events[1].Result != "success" || events[1].Error != "" || events[1].Attempts != 2 {
+		t.Errorf("Unexpected oldest event %+v", events[1])
+	}
+
+	events, err = j.events(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events[1].Body != `{"event_name":"project_create"}` {
+		t.Errorf("Expected body, got %q", events[1].Body)
+	}
+}
+
+func TestWebhookJournalRecordsIntake(t *testing.T) {
+	j, cleanup := newTestJournal(t, 1024*1024)
+	defer cleanup()
+
+	j.received("1", "", "", time.Now(), nil)
+	j.intake("1", "rejected", errors.New("source address is not within the allowed CIDRs"))
+	j.received("2", "uuid-2", "", time.Now(), []byte(`{"event_name":"project_create"}`))
+	j.intake("2", "queued", nil)
+	j.result("2", "success", nil)
+	j.received("3", "uuid-2", "", time.Now(), []byte(`{"event_name":"project_create"}`))
+	j.intake("3", "duplicate", nil)
+
+	events, err := j.events(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(events))
+	}
+	if events[0].Result != "duplicate" || events[0].Intake != "duplicate" || events[0].Attempts != 0 {
+		t.Errorf("Unexpected duplicate event %+v", events[0])
+	}
+	if events[1].Result != "success" || events[1].Intake != "queued" || events[1].Attempts != 1 {
+		t.Errorf("Unexpected queued event %+v", events[1])
+	}
+	if events[2].Result != "rejected" || events[2].Error == "" || events[2].Body != "" || events[2].Attempts != 0 {
+		t.Errorf("Unexpected rejected event %+v", events[2])
+	}
+}
+
+func TestReplayJournalEventQueuesAcceptedHooksOnly(t *testing.T) {
+	j, cleanup := newTestJournal(t, 1024*1024)
+	defer cleanup()
+	processed := make(chan *QueuedEvent, 1)
+	q, cleanupQueue := newTestQueue(t, func(event *QueuedEvent) error {
+		processed <- event
+		return nil
+	})
+	defer cleanupQueue()
+	if err := q.start(); err != nil {
+		t.Fatal(err)
+	}
+	journal, queue = j, q
+	defer func() { journal, queue = nil, nil }()
+
+	body := `{"event_name":"project_destroy","path_with_namespace":"group/project"}`
+	rejected, accepted := newEventID(time.Now()), newEventID(time.Now())
+	j.received(rejected, "", "Merge Request Hook", time.Now(), []byte(body))
+	j.intake(rejected, "rejected", errors.New("project_destroy is not allowed for Merge Request Hooks"))
+	if _, err := ReplayJournalEvent(rejected); err == nil {
+		t.Error("Expected a rejected hook not to be replayed")
+	}
+
+	j.received(accepted, "uuid-2", "System Hook", time.Now(), []byte(body))
+	j.intake(accepted, "queued", nil)
+	replay, err := ReplayJournalEvent(accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-processed:
+		if event.ID != replay || event.Event != "System Hook" || event.Body != body {
+			t.Errorf("Unexpected replayed event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the replayed hook")
+	}
+
+	events, err := j.events(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if events[0].ID != replay || events[0].ReplayOf != accepted || events[0].Intake != "queued" {
+		t.Errorf("Unexpected replay %+v", events[0])
+	}
+}
+
+func TestWebhookJournalRotates(t *testing.T) {
+	j, cleanup := newTestJournal(t, 1024)
+	defer cleanup()
+
+	ids := []string{"01", "02", "03", "04", "05", "06", "07", "08", "09", "10"}
+	for _, id := range ids {
+		j.received(id, "", "", time.Now(), []byte(`{"event_name":"project_create","path_with_namespace":"group/project"}`))
+	}
+
+	events, err := j.events(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) == 0 || len(events) == len(ids) {
+		t.Fatalf("Expected the oldest events to be rotated out, got %d events", len(events))
+	}
+	if events[0].ID != "10" {
+		t.Errorf("Expected the newest event to be kept, got %s", events[0].ID)
+	}
+	if j.size > j.maxBytes/2 {
+		t.Errorf("Journal file exceeds half of its limit with %d bytes", j.size)
+	}
+}
+
+func TestNilWebhookJournalIgnoresEntries(t *testing.T) {
+	var j *webhookJournal
+	j.received("1", "", "", time.Now(), nil)
+	j.intake("1", "queued", nil)
+	j.result("1", "success", nil)
+}
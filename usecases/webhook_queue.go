@@ -0,0 +1,501 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package usecases
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/metrics"
+	"github.com/pkg/errors"
+)
+
+const (
+	pendingDir    = "pending"
+	deadLetterDir = "dead"
+)
+
+// QueuedEvent is a webhook which has been accepted, but not yet been processed successfully. Event is the
+// X-Gitlab-Event header it has been received with.
+type QueuedEvent struct {
+	ID          string    `json:"id"`
+	UUID        string    `json:"uuid,omitempty"`
+	Event       string    `json:"event,omitempty"`
+	Received    time.Time `json:"received"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+	Body        string    `json:"body"`
+}
+
+var (
+	eventSeq     int
+	eventSeqLock sync.Mutex
+)
+
+// newEventID returns the id of a received hook, which orders the hooks by their reception
+func newEventID(now time.Time) string {
+	eventSeqLock.Lock()
+	defer eventSeqLock.Unlock()
+	eventSeq++
+	return fmt.Sprintf("%020d-%06d", now.UnixNano(), eventSeq%1000000)
+}
+
+// InvalidEventError is returned for webhooks which can never be processed, so retrying them is pointless
+type InvalidEventError struct {
+	Err error
+}
+
+func (e *InvalidEventError) Error() string {
+	return "invalid Gitlab hook: " + e.Err.Error()
+}
+
+// webhookQueue persists every accepted webhook to disk before it gets processed by a pool of workers.
+// Failed webhooks are retried with exponential backoff and moved to the dead letters after maxAttempts.
+// Webhooks of the same entity, see eventEntity, are processed one after another in the order of their reception:
+// only the first of them is handed to the workers, the others wait until it succeeded or became a dead letter,
+// even while it waits for a retry.
+// While the queue is paused, the webhooks which become due are held back and handed to the workers on resume.
+type webhookQueue struct {
+	dir         string
+	workers     int
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	process     func(event *QueuedEvent) error
+
+	ready  chan *QueuedEvent
+	lock   sync.Mutex
+	timers map[string]*time.Timer
+	// entities holds the webhooks of each entity in the order of their reception, the first one is in progress
+	entities map[string][]*QueuedEvent
+	paused   bool
+	held     []*QueuedEvent
+}
+
+var queue *webhookQueue
+
+// StartWebhookQueue loads all webhooks which have not been processed before the last shutdown and starts the workers.
+// The leader handles the webhooks itself, followers and a leader which lost its leadership meanwhile hand them to
+// forward. The queue is paused while a sync run is in progress, see startSyncRun.
+// Every attempt is recorded in the webhook journal.
+func StartWebhookQueue(forward func(body []byte, uuid, event string) error) error {
+	if err := StartWebhookJournal(); err != nil {
+		return err
+	}
+	q, err := newWebhookQueue(config.Get().Webhooks.QueueDir, func(event *QueuedEvent) error {
+		if IsLeader() {
+			// the leadership may have been lost meanwhile, then the hook is forwarded to the new leader
+			if leaderContext().Err() == nil {
+				outcome, err := applyGitlabEvent([]byte(event.Body))
+				journal.result(event.ID, outcome, err)
+				return err
+			}
+		}
+		err := forward([]byte(event.Body), event.UUID, event.Event)
+		if err != nil {
+			journal.result(event.ID, metrics.OutcomeError, err)
+		} else {
+			journal.result(event.ID, outcomeForwarded, nil)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	q.workers = config.Get().Webhooks.Workers
+	q.maxAttempts = config.Get().Webhooks.MaxAttempts
+	queue = q
+	deliveries = newDeliveryCache(time.Duration(config.Get().Webhooks.DedupWindowSeconds) * time.Second)
+	return q.start()
+}
+
+// EnqueueGitlabEvent durably stores a webhook for processing under the id it has been journaled with, see
+// JournalGitlabWebhook. The uuid is the X-Gitlab-Event-UUID header, if given, event the X-Gitlab-Event header, which
+// is kept for forwarding the hook to the leader.
+// Repeated deliveries of a webhook within the dedup window are acknowledged, but dropped. Unknown and invalid
+// webhooks are not queued, but an UnknownEventError or InvalidEventError is returned. The outcome is recorded in the
+// journal.
+func EnqueueGitlabEvent(id string, body []byte, uuid, event string) error {
+	return enqueueGitlabEvent(id, body, uuid, event, true)
+}
+
+// enqueueGitlabEvent queues a webhook like EnqueueGitlabEvent, the dedup window is only applied if dedup is set
+func enqueueGitlabEvent(id string, body []byte, uuid, event string, dedup bool) error {
+	if queue == nil {
+		err := errors.New("Webhook queue has not been started")
+		journal.intake(id, metrics.OutcomeError, err)
+		return err
+	}
+	if err := ValidateGitlabEvent(body); err != nil {
+		outcome := metrics.OutcomeInvalid
+		if _, unknown := err.(*UnknownEventError); unknown {
+			outcome = metrics.OutcomeRejected
+		}
+		journal.intake(id, outcome, err)
+		return err
+	}
+	key := deliveryKey(body, uuid)
+	if dedup && deliveries.duplicate(key, time.Now()) {
+		log.Println(fmt.Sprintf("Dropping repeated delivery of Gitlab hook %s", key))
+		metrics.WebhooksReceived.WithLabelValues(eventName(body), metrics.OutcomeDuplicate).Inc()
+		journal.intake(id, metrics.OutcomeDuplicate, nil)
+		return nil
+	}
+	if err := queue.enqueue(id, body, uuid, event); err != nil {
+		if dedup {
+			deliveries.forget(key)
+		}
+		journal.intake(id, metrics.OutcomeError, err)
+		return err
+	}
+	return nil
+}
+
+// GetDeadLetters returns all webhooks which could not be processed after all retries
+func GetDeadLetters() ([]QueuedEvent, error) {
+	if queue == nil {
+		return nil, errors.New("Webhook queue has not been started")
+	}
+	return queue.deadLetters()
+}
+
+// ReplayDeadLetters queues the dead letters with the given ids again, or all dead letters if no id is given.
+// It returns the number of replayed webhooks.
+func ReplayDeadLetters(ids ...string) (int, error) {
+	if queue == nil {
+		return 0, errors.New("Webhook queue has not been started")
+	}
+	return queue.replay(ids...)
+}
+
+// pauseWebhookQueue holds back the webhooks until resumeWebhookQueue is called, the webhooks in progress are finished
+func pauseWebhookQueue() {
+	if queue != nil {
+		queue.pause()
+	}
+}
+
+// resumeWebhookQueue hands the webhooks held back by pauseWebhookQueue to the workers
+func resumeWebhookQueue() {
+	if queue != nil {
+		queue.resume()
+	}
+}
+
+// retryQueuedGitlabEvents processes all webhooks waiting for their next attempt right away
+func retryQueuedGitlabEvents() {
+	if queue != nil {
+		queue.retryNow()
+	}
+}
+
+func newWebhookQueue(dir string, process func(event *QueuedEvent) error) (*webhookQueue, error) {
+	for _, d := range []string{pendingDir, deadLetterDir} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			return nil, errors.Wrapf(err, "Could not create webhook queue directory %s", dir)
+		}
+	}
+	return &webhookQueue{
+		dir:         dir,
+		workers:     4,
+		maxAttempts: 10,
+		baseDelay:   time.Second,
+		maxDelay:    5 * time.Minute,
+		process:     process,
+		ready:       make(chan *QueuedEvent),
+		timers:      map[string]*time.Timer{},
+		entities:    map[string][]*QueuedEvent{},
+	}, nil
+}
+
+func (q *webhookQueue) start() error {
+	pending, err := q.readEvents(pendingDir)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		log.Println(fmt.Sprintf("Resuming %d queued Gitlab hooks", len(pending)))
+	}
+	for i := 0; i < q.workers; i++ {
+		go q.work()
+	}
+	for i := range pending {
+		q.admit(&pending[i])
+	}
+	q.updateMetrics()
+	return nil
+}
+
+// enqueue stores the hook in the pending webhooks and hands it to the workers. Its queuing is journaled before it is
+// handed to them, so the outcome of the first attempt always follows it in the journal.
+func (q *webhookQueue) enqueue(id string, body []byte, uuid, event string) error {
+	now := time.Now()
+	queued := &QueuedEvent{
+		ID:          id,
+		UUID:        uuid,
+		Event:       event,
+		Received:    now,
+		NextAttempt: now,
+		Body:        string(body),
+	}
+
+	if err := q.write(pendingDir, queued); err != nil {
+		return err
+	}
+	journal.intake(id, outcomeQueued, nil)
+	q.admit(queued)
+	q.updateMetrics()
+	return nil
+}
+
+// admit schedules the event, unless an earlier webhook of the same entity is still in progress. Then it waits until
+// that one is done.
+func (q *webhookQueue) admit(event *QueuedEvent) {
+	entity := eventEntity([]byte(event.Body))
+	if entity == "" {
+		q.schedule(event)
+		return
+	}
+	q.lock.Lock()
+	q.entities[entity] = append(q.entities[entity], event)
+	first := len(q.entities[entity]) == 1
+	q.lock.Unlock()
+	if first {
+		q.schedule(event)
+	}
+}
+
+// done schedules the next webhook of the same entity after the event succeeded or became a dead letter
+func (q *webhookQueue) done(event *QueuedEvent) {
+	entity := eventEntity([]byte(event.Body))
+	if entity == "" {
+		return
+	}
+	q.lock.Lock()
+	waiting := q.entities[entity]
+	for i, e := range waiting {
+		if e.ID == event.ID {
+			waiting = append(waiting[:i:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(waiting) == 0 {
+		delete(q.entities, entity)
+	} else {
+		q.entities[entity] = waiting
+	}
+	q.lock.Unlock()
+	if len(waiting) > 0 {
+		q.schedule(waiting[0])
+	}
+}
+
+// schedule hands the event to the workers once its next attempt is due
+func (q *webhookQueue) schedule(event *QueuedEvent) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.timers[event.ID] = time.AfterFunc(time.Until(event.NextAttempt), func() {
+		q.lock.Lock()
+		delete(q.timers, event.ID)
+		if q.paused {
+			q.held = append(q.held, event)
+			q.lock.Unlock()
+			return
+		}
+		q.lock.Unlock()
+		q.ready <- event
+	})
+}
+
+// pause holds back the webhooks which become due, so the workers stay idle instead of waiting for them to be resumed
+func (q *webhookQueue) pause() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.paused = true
+}
+
+// resume hands the webhooks held back in the order they became due to the workers
+func (q *webhookQueue) resume() {
+	q.lock.Lock()
+	held := q.held
+	q.paused, q.held = false, nil
+	q.lock.Unlock()
+	go func() {
+		for _, event := range held {
+			q.ready <- event
+		}
+	}()
+}
+
+func (q *webhookQueue) retryNow() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, timer := range q.timers {
+		if timer.Stop() {
+			timer.Reset(0)
+		}
+	}
+}
+
+func (q *webhookQueue) work() {
+	for event := range q.ready {
+		err := q.process(event)
+		if err == nil {
+			check(q.remove(pendingDir, event.ID))
+			q.done(event)
+			q.updateMetrics()
+			continue
+		}
+
+		event.Attempts++
+		event.LastError = err.Error()
+		if _, invalid := errors.Cause(err).(*InvalidEventError); invalid || event.Attempts >= q.maxAttempts {
+			log.Println(fmt.Sprintf("Gitlab hook %s failed after %d attempts, moving it to the dead letters. Err: %s", event.ID, event.Attempts, err))
+			if check(q.write(deadLetterDir, event)) {
+				// the hook stays pending, blocking the later hooks of its entity, until it has been moved
+				event.NextAttempt = time.Now().Add(q.backoff(event.Attempts))
+				log.Println(fmt.Sprintf("Could not move Gitlab hook %s to the dead letters, trying again at %s", event.ID, event.NextAttempt.Format(time.RFC3339)))
+				check(q.write(pendingDir, event))
+				q.schedule(event)
+				continue
+			}
+			journal.result(event.ID, outcomeDead, err)
+			check(q.remove(pendingDir, event.ID))
+			q.done(event)
+			q.updateMetrics()
+			continue
+		}
+
+		event.NextAttempt = time.Now().Add(q.backoff(event.Attempts))
+		log.Println(fmt.Sprintf("Gitlab hook %s failed on attempt %d, retrying at %s. Err: %s", event.ID, event.Attempts, event.NextAttempt.Format(time.RFC3339), err))
+		check(q.write(pendingDir, event))
+		q.schedule(event)
+	}
+}
+
+// backoff doubles the delay with every attempt, up to maxDelay
+func (q *webhookQueue) backoff(attempts int) time.Duration {
+	delay := q.baseDelay
+	for i := 1; i < attempts && delay < q.maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > q.maxDelay {
+		delay = q.maxDelay
+	}
+	return delay
+}
+
+func (q *webhookQueue) deadLetters() ([]QueuedEvent, error) {
+	return q.readEvents(deadLetterDir)
+}
+
+func (q *webhookQueue) replay(ids ...string) (int, error) {
+	deadLetters, err := q.deadLetters()
+	if err != nil {
+		return 0, err
+	}
+	wanted := map[string]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	replayed := 0
+	for i := range deadLetters {
+		event := &deadLetters[i]
+		if len(ids) > 0 && !wanted[event.ID] {
+			continue
+		}
+		event.Attempts = 0
+		event.NextAttempt = time.Now()
+		if err := q.write(pendingDir, event); err != nil {
+			return replayed, err
+		}
+		if err := q.remove(deadLetterDir, event.ID); err != nil {
+			return replayed, err
+		}
+		q.admit(event)
+		replayed++
+	}
+	q.updateMetrics()
+	return replayed, nil
+}
+
+// write stores the event atomically, so a crash never leaves a partially written event behind
+func (q *webhookQueue) write(subDir string, event *QueuedEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrapf(err, "Error while serializing Gitlab hook %s", event.ID)
+	}
+	path := filepath.Join(q.dir, subDir, event.ID+".json")
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return errors.Wrapf(err, "Error while storing Gitlab hook %s", event.ID)
+	}
+	return errors.Wrapf(os.Rename(path+".tmp", path), "Error while storing Gitlab hook %s", event.ID)
+}
+
+func (q *webhookQueue) remove(subDir, id string) error {
+	err := os.Remove(filepath.Join(q.dir, subDir, id+".json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return errors.Wrapf(err, "Error while removing Gitlab hook %s", id)
+}
+
+// readEvents returns the events stored in the given sub directory, ordered by their reception
+func (q *webhookQueue) readEvents(subDir string) ([]QueuedEvent, error) {
+	files, err := ioutil.ReadDir(filepath.Join(q.dir, subDir))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error while reading webhook queue directory %s", subDir)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name() < files[j].Name() })
+
+	events := make([]QueuedEvent, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(q.dir, subDir, f.Name()))
+		if check(err) {
+			continue
+		}
+		var event QueuedEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			log.Println(fmt.Sprintf("WARNING: Skipping corrupt queued Gitlab hook %s. Err: %s", f.Name(), err))
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (q *webhookQueue) updateMetrics() {
+	for state, subDir := range map[string]string{"pending": pendingDir, "dead": deadLetterDir} {
+		files, err := filepath.Glob(filepath.Join(q.dir, subDir, "*.json"))
+		if err == nil {
+			metrics.WebhookQueueLength.WithLabelValues(state).Set(float64(len(files)))
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package usecases
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestQueue(t *testing.T, process func(event *QueuedEvent) error) (*webhookQueue, func()) {
+	dir, err := ioutil.TempDir("", "webhook-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := newWebhookQueue(dir, process)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.baseDelay = time.Millisecond
+	q.maxDelay = 5 * time.Millisecond
+	return q, func() { os.RemoveAll(dir) }
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the webhook queue")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookQueueRetriesFailedEvents(t *testing.T) {
+	var lock sync.Mutex
+	attempts := 0
+	q, cleanup := newTestQueue(t, func(event *QueuedEvent) error {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		if attempts < 3 {
+			return errors.New("K8s unavailable")
+		}
+		return nil
+	})
+	defer cleanup()
+	if err := q.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.enqueue(newEventID(time.Now()), []byte(`{"event_name":"project_create"}`), "", ""); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		pending, _ := q.readEvents(pendingDir)
+		return len(pending) == 0
+	})
+	lock.Lock()
+	defer lock.Unlock()
+	if attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts)
+	}
+	if deadLetters, _ := q.deadLetters(); len(deadLetters) != 0 {
+		t.Errorf("Expected no dead letters, got %d", len(deadLetters))
+	}
+}
+
+func TestWebhookQueueDeadLettersAndReplay(t *testing.T) {
+	var lock sync.Mutex
+	failing := true
+	processed := 0
+	q, cleanup := newTestQueue(t, func(event *QueuedEvent) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if event.Body == "invalid" {
+			return &InvalidEventError{Err: errors.New("not JSON")}
+		}
+		if failing {
+			return errors.New("K8s unavailable")
+		}
+		processed++
+		return nil
+	})
+	defer cleanup()
+	q.maxAttempts = 2
+	if err := q.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	q.enqueue(newEventID(time.Now()), []byte(`{"event_name":"project_create"}`), "", "")
+	q.enqueue(newEventID(time.Now()), []byte("invalid"), "", "")
+	waitFor(t, func() bool {
+		deadLetters, _ := q.deadLetters()
+		return len(deadLetters) == 2
+	})
+	deadLetters, _ := q.deadLetters()
+	for _, d := range deadLetters {
+		if d.Body == "invalid" && d.Attempts != 1 {
+			t.Errorf("Expected invalid hook to be dead lettered without retries, got %d attempts", d.Attempts)
+		}
+		if d.Body != "invalid" && (d.Attempts != 2 || d.LastError != "K8s unavailable") {
+			t.Errorf("Unexpected dead letter %+v", d)
+		}
+	}
+
+	lock.Lock()
+	failing = false
+	lock.Unlock()
+	var replayID string
+	for _, d := range deadLetters {
+		if d.Body != "invalid" {
+			replayID = d.ID
+		}
+	}
+	replayed, err := q.replay(replayID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != 1 {
+		t.Errorf("Expected 1 replayed hook, got %d", replayed)
+	}
+	waitFor(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return processed == 1
+	})
+	if deadLetters, _ := q.deadLetters(); len(deadLetters) != 1 {
+		t.Errorf("Expected only the invalid hook to remain a dead letter, got %d", len(deadLetters))
+	}
+}
+
+func TestWebhookQueueResumesAfterRestart(t *testing.T) {
+	q, cleanup := newTestQueue(t, nil)
+	defer cleanup()
+	// the first instance never starts its workers, as if it was killed right after accepting the hook
+	if err := q.write(pendingDir, &QueuedEvent{ID: "1", Body: "hook", NextAttempt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan string, 1)
+	restarted, err := newWebhookQueue(q.dir, func(event *QueuedEvent) error {
+		received <- event.Body
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case body := <-received:
+		if body != "hook" {
+			t.Errorf("Expected resumed hook, got %s", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Queued hook has not been resumed")
+	}
+}
+
+func TestWebhookQueueKeepsOrderPerEntity(t *testing.T) {
+	member := func(projectID int, user string) []byte {
+		return []byte(fmt.Sprintf(`{"event_name":"user_add_to_team","project_id":%d,"project_path_with_namespace":"group/project-%d","user_username":"%s","access_level":"Developer"}`, projectID, projectID, user))
+	}
+	var lock sync.Mutex
+	var processed []string
+	attempts := 0
+	q, cleanup := newTestQueue(t, func(event *QueuedEvent) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if strings.Contains(event.Body, "alice") {
+			attempts++
+			if attempts < 3 {
+				return errors.New("K8s unavailable")
+			}
+		}
+		processed = append(processed, event.Body)
+		return nil
+	})
+	defer cleanup()
+	if err := q.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range [][]byte{member(1, "alice"), member(1, "bob"), member(2, "carol")} {
+		if err := q.enqueue(newEventID(time.Now()), body, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(processed) == 3
+	})
+
+	lock.Lock()
+	defer lock.Unlock()
+	position := map[string]int{}
+	for i, body := range processed {
+		for _, user := range []string{"alice", "bob", "carol"} {
+			if strings.Contains(body, user) {
+				position[user] = i
+			}
+		}
+	}
+	if position["bob"] < position["alice"] {
+		t.Errorf("Expected the hook of bob to wait for the retried hook of alice in the same project, got %v", position)
+	}
+	if position["carol"] > position["alice"] {
+		t.Errorf("Expected the hook of another project not to wait for the retried hook, got %v", position)
+	}
+	waitFor(t, func() bool {
+		q.lock.Lock()
+		defer q.lock.Unlock()
+		return len(q.entities) == 0
+	})
+}
+
+func TestWebhookQueueRetriesFailedDeadLetterWrites(t *testing.T) {
+	member := func(user string) []byte {
+		return []byte(`{"event_name":"user_add_to_team","project_id":1,"project_path_with_namespace":"group/project","user_username":"` + user + `","access_level":"Developer"}`)
+	}
+	var lock sync.Mutex
+	var q *webhookQueue
+	attempts := 0
+	processed := false
+	q, cleanup := newTestQueue(t, func(event *QueuedEvent) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if !strings.Contains(event.Body, "alice") {
+			processed = true
+			return nil
+		}
+		attempts++
+		if attempts == 2 {
+			// the disk is writable again
+			deadLetters := filepath.Join(q.dir, deadLetterDir)
+			os.Remove(deadLetters)
+			os.Mkdir(deadLetters, 0700)
+		}
+		return errors.New("K8s unavailable")
+	})
+	defer cleanup()
+	q.maxAttempts = 1
+	deadLetters := filepath.Join(q.dir, deadLetterDir)
+	os.RemoveAll(deadLetters)
+	if err := ioutil.WriteFile(deadLetters, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range [][]byte{member("alice"), member("bob")} {
+		if err := q.enqueue(newEventID(time.Now()), body, "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return processed
+	})
+	if dead, _ := q.deadLetters(); len(dead) != 1 {
+		t.Errorf("Expected the hook to be moved to the dead letters once possible, got %d dead letters", len(dead))
+	}
+}
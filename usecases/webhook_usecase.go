@@ -16,136 +16,229 @@
 package usecases
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
-	"os"
 	"strconv"
 	"time"
 
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
 	"github.com/k8s-tamias/gitlab-k8s-integrator/gitlabclient"
 	"github.com/k8s-tamias/gitlab-k8s-integrator/k8sclient"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/metrics"
+	"github.com/pkg/errors"
 )
 
-type GitlabEvent struct {
-	CreatedAt                time.Time `json:"created_at"`
-	UpdatedAt                time.Time `json:"updated_at"`
-	EventName                string    `json:"event_name"`
-	Name                     string    `json:"name"`
-	OwnerEmail               string    `json:"owner_email"`
-	OwnerName                string    `json:"owner_name"`
-	Path                     string    `json:"path"`
-	PathWithNameSpace        string    `json:"path_with_namespace"`
-	ProjectPathWithNameSpace string    `json:"project_path_with_namespace"`
-	ProjectId                int       `json:"project_id"`
-	ProjectVisibility        string    `json:"project_visibility"`
-	OldPathWithNamespace     string    `json:"old_path_with_namespace"`
-	ProjectAccess            string    `json:"access_level"`
-	GroupAccess              string    `json:"group_access"`
-	UserEmail                string    `json:"user_email"`
-	UserName                 string    `json:"user_name"`
-	UserUsername             string    `json:"user_username"`
-	UserCreatedUserName      string    `json:"username"`
-	UserId                   int       `json:"user_id"`
-	GroupId                  int       `json:"group_id"`
-	GroupName                string    `json:"group_name"`
-	GroupPath                string    `json:"group_path"`
+// HandleGitlabEvent applies a Gitlab System Hook event to K8s. An error is returned if the event
+// could not be parsed or applied.
+func HandleGitlabEvent(body []byte) error {
+	_, err := applyGitlabEvent(body)
+	return err
 }
 
-func HandleGitlabEvent(body []byte) {
+// applyGitlabEvent applies the event and returns the outcome recorded in the metrics
+func applyGitlabEvent(body []byte) (string, error) {
 
-	if os.Getenv("ENABLE_GITLAB_HOOKS_DEBUG") == "true" {
+	if config.Get().Webhooks.Debug {
 		rawMsg := string(body[:])
 		log.Println(fmt.Sprintf("DEBUG: Raw Hook Contents Received= %s", rawMsg))
 	}
 
-	var event GitlabEvent
-	err := json.Unmarshal(body, &event)
+	event, err := decodeGitlabEvent(body)
+	if unknown, ok := err.(*UnknownEventError); ok {
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Unknown Hook Type. Type was: %s", unknown.Name))
+		metrics.WebhooksReceived.WithLabelValues(unknown.Name, metrics.OutcomeIgnored).Inc()
+		return metrics.OutcomeIgnored, nil
+	}
 	if check(err) {
-		return
+		log.Println(fmt.Sprintf("Invalid hook! Err: %s", err))
+		metrics.WebhooksReceived.WithLabelValues("unknown", metrics.OutcomeInvalid).Inc()
+		return metrics.OutcomeInvalid, err
 	}
 
-	switch event.EventName {
+	// hooks are rejected on receipt in dry run, those queued before it was enabled stay queued or dead lettered
+	if dryRun() {
+		metrics.WebhooksReceived.WithLabelValues(event.name(), metrics.OutcomeError).Inc()
+		return metrics.OutcomeError, errors.Errorf("Hook of type %s has not been applied in dry run", event.name())
+	}
+
+	// the entities are synced again by the next incremental run, in case the hook failed or did not cover all changes
+	recordChangedEntities(event, time.Now())
+	outcome := metrics.OutcomeSuccess
+	err = handleGitlabEvent(event)
+	switch {
+	case err == errUnknownEvent:
+		outcome, err = metrics.OutcomeIgnored, nil
+	case err != nil:
+		outcome = metrics.OutcomeError
+	}
+	metrics.WebhooksReceived.WithLabelValues(event.name(), outcome).Inc()
+	return outcome, err
+}
 
-	// project operations
+// errUnknownEvent is returned by the handlers for events the integrator does not act upon
+var errUnknownEvent = errors.New("unknown event")
+
+func handleGitlabEvent(event gitlabEvent) error {
+	switch e := event.(type) {
+	case *ProjectEvent:
+		return handleProjectEvent(e)
+	case *ProjectMemberEvent:
+		return handleProjectMemberEvent(e)
+	case *GroupEvent:
+		return handleGroupEvent(e)
+	case *GroupMemberEvent:
+		return handleGroupMemberEvent(e)
+	case *UserEvent:
+		return handleUserEvent(e)
+	case *MergeRequestEvent:
+		return handleMergeRequestEvent(e)
+	default:
+		return errUnknownEvent
+	}
+}
 
+func handleProjectEvent(event *ProjectEvent) error {
+	switch event.EventName {
 	case "project_create":
-		log.Println(fmt.Sprintf("HOOK RECEIVED: Creating Namespace for %s", event.PathWithNameSpace))
-		createdNs := k8sclient.CreateNamespace(event.PathWithNameSpace)
-		sai, _, err := k8sclient.CreateServiceAccountAndRoleBinding(event.PathWithNameSpace)
-		if err != nil {
-			log.Printf("Creation of ServiceAccount and RoleBinding failed for project %s", event.Name)
-		} else {
-			gitlabclient.SetupK8sIntegrationForGitlabProject(strconv.Itoa(event.ProjectId), createdNs, sai.Token)
-		}
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Creating Namespace for %s", event.PathWithNamespace))
+		return createProjectNamespace(event)
 	case "project_destroy":
-		log.Println(fmt.Sprintf("HOOK RECEIVED: Deleting Namespace for %s", event.PathWithNameSpace))
-		k8sclient.DeleteNamespace(event.PathWithNameSpace)
-	case "project_rename":
-		log.Println(fmt.Sprintf("HOOK RECEIVED: Rename: Deleting %s and Recreating Namespace for %s", event.OldPathWithNamespace, event.PathWithNameSpace))
-		k8sclient.DeleteNamespace(event.OldPathWithNamespace)
-		createdNs := k8sclient.CreateNamespace(event.PathWithNameSpace)
-		sai, _, err := k8sclient.CreateServiceAccountAndRoleBinding(event.PathWithNameSpace)
-		if err != nil {
-			log.Printf("Creation of ServiceAccount and RoleBinding failed for project %s", event.Name)
-		} else {
-			gitlabclient.SetupK8sIntegrationForGitlabProject(strconv.Itoa(event.ProjectId), createdNs, sai.Token)
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Deleting Namespace for %s", event.PathWithNamespace))
+		if err := k8sclient.DeleteReviewNamespacesOfProject(event.PathWithNamespace); err != nil {
+			return err
 		}
+		_, err := k8sclient.DeleteNamespace(event.PathWithNamespace)
+		return err
+	case "project_rename":
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Rename: Migrating Namespace of %s to %s", event.OldPathWithNamespace, event.PathWithNamespace))
+		return migrateProjectNamespace(event)
 	case "project_transfer":
-		log.Println(fmt.Sprintf("HOOK RECEIVED: Transfer: Deleting %s and Recreating Namespace for %s", event.OldPathWithNamespace, event.PathWithNameSpace))
-		k8sclient.DeleteNamespace(event.OldPathWithNamespace)
-		createdNs := k8sclient.CreateNamespace(event.PathWithNameSpace)
-		sai, _, err := k8sclient.CreateServiceAccountAndRoleBinding(event.PathWithNameSpace)
-		if err != nil {
-			log.Printf("Creation of ServiceAccount and RoleBinding failed for project %s", event.Name)
-		} else {
-			gitlabclient.SetupK8sIntegrationForGitlabProject(strconv.Itoa(event.ProjectId), createdNs, sai.Token)
-		}
-		// project member operations
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Transfer: Migrating Namespace of %s to %s", event.OldPathWithNamespace, event.PathWithNamespace))
+		return migrateProjectNamespace(event)
+	}
+	return errUnknownEvent
+}
 
+func handleProjectMemberEvent(event *ProjectMemberEvent) error {
+	switch event.EventName {
 	case "user_add_to_team":
-		log.Println(fmt.Sprintf("HOOK RECEIVED: Create RoleBinding for %s in %s as %s", event.UserUsername, event.ProjectPathWithNameSpace, event.ProjectAccess))
-		k8sclient.CreateProjectRoleBinding(event.UserUsername, event.ProjectPathWithNameSpace, event.ProjectAccess)
-		k8sclient.GetActualNameSpaceNameByGitlabName(event.ProjectPathWithNameSpace)
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Create RoleBinding for %s in %s as %s", event.UserUsername, event.ProjectPathWithNamespace, event.AccessLevel))
+		return k8sclient.CreateProjectRoleBinding(event.UserUsername, event.ProjectPathWithNamespace, event.AccessLevel)
 	case "user_remove_from_team":
-		log.Println(fmt.Sprintf("HOOK RECEIVED: Delete RoleBinding for %s in %s as %s", event.UserUsername, event.ProjectPathWithNameSpace, event.ProjectAccess))
-		k8sclient.DeleteProjectRoleBinding(event.UserUsername, event.ProjectPathWithNameSpace, event.ProjectAccess)
-		k8sclient.GetActualNameSpaceNameByGitlabName(event.ProjectPathWithNameSpace)
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Delete RoleBinding for %s in %s as %s", event.UserUsername, event.ProjectPathWithNamespace, event.AccessLevel))
+		return k8sclient.DeleteProjectRoleBinding(event.UserUsername, event.ProjectPathWithNamespace, event.AccessLevel)
+	case "user_update_for_team":
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Update RoleBinding for %s in %s to %s", event.UserUsername, event.ProjectPathWithNamespace, event.AccessLevel))
+		return k8sclient.UpdateProjectRoleBinding(event.UserUsername, event.ProjectPathWithNamespace, event.AccessLevel)
+	}
+	return errUnknownEvent
+}
 
-		// group operations
+func handleGroupEvent(event *GroupEvent) error {
+	switch event.EventName {
 	case "group_create":
-		log.Println(fmt.Sprintf("HOOK RECEIVED: Creating Namespace for %s", event.Path))
-		k8sclient.CreateNamespace(event.Path)
-
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Creating Namespace for %s", event.namespacePath()))
+		_, err := k8sclient.CreateNamespace(event.namespacePath())
+		return err
 	case "group_destroy":
-		log.Println(fmt.Sprintf("HOOK RECEIVED: Deleting Namespace for %s", event.Path))
-		k8sclient.DeleteNamespace(event.Path)
-
-		// group member operations
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Deleting Namespace for %s", event.namespacePath()))
+		_, err := k8sclient.DeleteNamespace(event.namespacePath())
+		return err
+	case "group_rename":
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Group Rename: Migrating Namespaces below %s to %s", event.OldFullPath, event.FullPath))
+		_, err := k8sclient.MigrateNamespaceTree(event.OldFullPath, event.FullPath)
+		return err
+	}
+	return errUnknownEvent
+}
 
+func handleGroupMemberEvent(event *GroupMemberEvent) error {
+	switch event.EventName {
 	case "user_add_to_group":
 		log.Println(fmt.Sprintf("HOOK RECEIVED: Create RoleBinding for %s in %s as %s", event.UserUsername, event.GroupPath, event.GroupAccess))
-		k8sclient.CreateGroupRoleBinding(event.UserUsername, event.GroupPath, event.GroupAccess)
-		k8sclient.GetActualNameSpaceNameByGitlabName(event.GroupPath)
-
+		return k8sclient.CreateGroupRoleBinding(event.UserUsername, event.GroupPath, event.GroupAccess)
 	case "user_remove_from_group":
 		log.Println(fmt.Sprintf("HOOK RECEIVED: Delete RoleBinding for %s in %s as %s", event.UserUsername, event.GroupPath, event.GroupAccess))
-		k8sclient.DeleteGroupRoleBinding(event.UserUsername, event.GroupPath, event.GroupAccess)
-		k8sclient.GetActualNameSpaceNameByGitlabName(event.GroupPath)
+		return k8sclient.DeleteGroupRoleBinding(event.UserUsername, event.GroupPath, event.GroupAccess)
+	case "user_update_for_group":
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Update RoleBinding for %s in %s to %s", event.UserUsername, event.GroupPath, event.GroupAccess))
+		return k8sclient.UpdateGroupRoleBinding(event.UserUsername, event.GroupPath, event.GroupAccess)
+	}
+	return errUnknownEvent
+}
 
+func handleUserEvent(event *UserEvent) error {
+	switch event.EventName {
 	case "user_create":
-		log.Println(fmt.Sprintf("HOOK RECEIVED: Create Namespace and RoleBinding for %s in %s as %s", event.UserCreatedUserName, event.UserCreatedUserName, event.ProjectAccess))
-		k8sclient.CreateNamespace(event.UserCreatedUserName)
-		k8sclient.CreateGroupRoleBinding(event.UserCreatedUserName, event.UserCreatedUserName, "Master")
-		k8sclient.GetActualNameSpaceNameByGitlabName(event.UserCreatedUserName)
-
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Create Namespace and RoleBinding for %s in %s as Master", event.Username, event.Username))
+		if _, err := k8sclient.CreateNamespace(event.Username); err != nil {
+			return err
+		}
+		return k8sclient.CreateGroupRoleBinding(event.Username, event.Username, "Master")
 	case "user_destroy":
-		log.Println(fmt.Sprintf("HOOK RECEIVED: Delete Namespace for %s", event.UserCreatedUserName))
-		k8sclient.DeleteNamespace(event.UserCreatedUserName)
-		k8sclient.DeleteGroupRoleBinding(event.UserCreatedUserName, event.UserCreatedUserName, "Master")
-		k8sclient.GetActualNameSpaceNameByGitlabName(event.UserCreatedUserName)
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Delete Namespace for %s", event.Username))
+		if err := k8sclient.DeleteGroupRoleBinding(event.Username, event.Username, "Master"); err != nil {
+			return err
+		}
+		_, err := k8sclient.DeleteNamespace(event.Username)
+		return err
+	case "user_rename":
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Rename user %s to %s", event.OldUsername, event.Username))
+		return k8sclient.RenameUser(event.OldUsername, event.Username)
+	case "user_block", "user_ban", "user_deactivate":
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Revoke access of %s", event.Username))
+		return revokeUserAccess(event.Username)
+	case "user_unblock", "user_unban", "user_activate":
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Restore access of %s", event.Username))
+		return restoreUserAccess(event.Username, event.UserID)
+	case "user_failed_login":
+		// Gitlab reports login attempts of blocked users with their state
+		if !gitlabclient.IsInactiveUserState(event.State) {
+			return errUnknownEvent
+		}
+		log.Println(fmt.Sprintf("HOOK RECEIVED: Revoke access of %s user %s", event.State, event.Username))
+		return revokeUserAccess(event.Username)
+	}
+	return errUnknownEvent
+}
 
-	default:
-		log.Println(fmt.Sprintf("HOOK RECEIVED: Unknown Hook Type. Type was: %s", event.EventName))
+// createProjectNamespace creates the namespace and ServiceAccount of a project and sets up the
+// K8s integration of the project in Gitlab
+func createProjectNamespace(event *ProjectEvent) error {
+	createdNs, err := k8sclient.CreateNamespace(event.PathWithNamespace)
+	if err != nil {
+		return err
+	}
+	return setupProjectNamespace(event, createdNs)
+}
+
+// migrateProjectNamespace keeps the workloads of a renamed or transferred project, instead of recreating its namespace.
+// The RoleBindings of the members are not migrated, but created from the members the project has at its new path.
+func migrateProjectNamespace(event *ProjectEvent) error {
+	members, err := gitlabclient.GetProjectMembers(event.ProjectID)
+	if err != nil {
+		return err
+	}
+	migratedNs, err := k8sclient.MigrateNamespace(event.OldPathWithNamespace, event.PathWithNamespace)
+	if err != nil {
+		return err
+	}
+	for _, member := range members {
+		if !gitlabclient.IsInactiveUserState(member.State) {
+			accessLevel := gitlabclient.TranslateIntAccessLevels(member.AccessLevel)
+			if err := k8sclient.CreateProjectRoleBinding(member.Username, event.PathWithNamespace, accessLevel); err != nil {
+				return err
+			}
+		}
+	}
+	return setupProjectNamespace(event, migratedNs)
+}
+
+func setupProjectNamespace(event *ProjectEvent, namespace string) error {
+	sai, _, err := k8sclient.CreateServiceAccountAndRoleBinding(event.PathWithNamespace)
+	if err != nil {
+		log.Printf("Creation of ServiceAccount and RoleBinding failed for project %s", event.Name)
+		return err
 	}
+	return gitlabclient.SetupK8sIntegrationForGitlabProject(strconv.Itoa(event.ProjectID), namespace, sai.Token)
 }
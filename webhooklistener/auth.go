@@ -0,0 +1,286 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package webhooklistener
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/pkg/errors"
+)
+
+// Reasons for rejecting a hook, used as metric label
+const (
+	rejectedHeader     = "header"
+	rejectedToken      = "token"
+	rejectedSource     = "source"
+	rejectedClientCert = "client_cert"
+	// hooks which pass authentication, but are rejected by their content
+	rejectedUnknownEvent = "unknown_event"
+	rejectedPayload      = "payload"
+	rejectedEventKind    = "event_kind"
+	rejectedDryRun       = "dry_run"
+)
+
+// Values of the X-Gitlab-Event header of the hooks handled, System Hooks and the Merge Request Hooks of projects
+const (
+	systemHookEvent       = "System Hook"
+	mergeRequestHookEvent = "Merge Request Hook"
+)
+
+// webhookAuth decides whether a hook request is accepted. It only keeps the hashes of the tokens, besides the token
+// presented when forwarding hooks to the leader.
+type webhookAuth struct {
+	networks []*net.IPNet
+	// forwardingNetworks are the addresses of the replicas, hooks with the forwarding token are accepted from them
+	forwardingNetworks []*net.IPNet
+	requireClientCert  bool
+	// allowUnauthenticated accepts System Hooks without token as long as no token is configured
+	allowUnauthenticated bool
+	// adminTokenHash is the hash of the token of the admin endpoints, which are closed without one
+	adminTokenHash *[sha256.Size]byte
+	// forwardingTokenHash is the hash of the token followers present when forwarding hooks to the leader
+	forwardingTokenHash *[sha256.Size]byte
+	// mergeRequestTokenHashes are the hashes of the tokens of project webhooks, Merge Request Hooks are rejected
+	// without one
+	mergeRequestTokenHashes [][sha256.Size]byte
+	// mergeRequestToken is presented to the leader when forwarding Merge Request Hooks
+	mergeRequestToken string
+
+	lock         sync.RWMutex
+	tokenHashes  [][sha256.Size]byte
+	fileHashes   [][sha256.Size]byte
+	forwardToken string
+	fileToken    string
+}
+
+func newWebhookAuth(cfg *config.Config) (*webhookAuth, error) {
+	auth := &webhookAuth{requireClientCert: cfg.Webhooks.TLS.ClientCAFile != "", allowUnauthenticated: cfg.Webhooks.AllowUnauthenticated}
+	for _, token := range append([]string{cfg.Gitlab.SecretToken}, cfg.Gitlab.SecretTokens...) {
+		if token != "" {
+			auth.tokenHashes = append(auth.tokenHashes, sha256.Sum256([]byte(token)))
+			if auth.forwardToken == "" {
+				auth.forwardToken = token
+			}
+		}
+	}
+	for _, token := range cfg.ReviewNamespaces.SecretTokens {
+		if token != "" {
+			auth.mergeRequestTokenHashes = append(auth.mergeRequestTokenHashes, sha256.Sum256([]byte(token)))
+			if auth.mergeRequestToken == "" {
+				auth.mergeRequestToken = token
+			}
+		}
+	}
+	if cfg.Webhooks.AdminToken != "" {
+		hash := sha256.Sum256([]byte(cfg.Webhooks.AdminToken))
+		auth.adminTokenHash = &hash
+	}
+	if cfg.LeaderElection.ForwardingToken != "" {
+		hash := sha256.Sum256([]byte(cfg.LeaderElection.ForwardingToken))
+		auth.forwardingTokenHash = &hash
+	}
+	var err error
+	if auth.networks, err = parseCIDRs(cfg.Webhooks.AllowedCIDRs); err != nil {
+		return nil, err
+	}
+	if auth.forwardingNetworks, err = parseCIDRs(cfg.LeaderElection.ForwardingCIDRs); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid CIDR %s", cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// reject returns the reason for rejecting the request or an empty string if it is accepted. Hooks forwarded by a
+// follower with the forwarding token are accepted from the addresses of the replicas as well, as the follower checked
+// the original sender. A leaked forwarding token is thus of no use outside of them.
+// Merge Request Hooks are checked against the tokens of the project webhooks only, their payload is checked by
+// usecases.ValidateMergeRequestHook.
+func (a *webhookAuth) reject(r *http.Request) string {
+	if !a.allowedSource(r.RemoteAddr) && !(a.forwarded(r) && inNetworks(r.RemoteAddr, a.forwardingNetworks)) {
+		return rejectedSource
+	}
+	if a.requireClientCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return rejectedClientCert
+	}
+	switch r.Header.Get("X-Gitlab-Event") {
+	case systemHookEvent:
+		if !a.validToken(r.Header.Get("X-Gitlab-Token")) {
+			return rejectedToken
+		}
+	case mergeRequestHookEvent:
+		if !matchesToken(r.Header.Get("X-Gitlab-Token"), a.mergeRequestTokenHashes) {
+			return rejectedToken
+		}
+	default:
+		return rejectedHeader
+	}
+	return ""
+}
+
+// rejectAdmin returns the reason for rejecting a request to the admin endpoints or an empty string if it is accepted.
+// Besides the source and client certificate checks of hooks, it requires the admin token as bearer token. The secret
+// tokens of the hooks are not accepted, as Gitlab and everyone who configures a project webhook knows them.
+func (a *webhookAuth) rejectAdmin(r *http.Request) string {
+	if !a.allowedSource(r.RemoteAddr) {
+		return rejectedSource
+	}
+	if a.requireClientCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+		return rejectedClientCert
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	hash := sha256.Sum256([]byte(token))
+	if a.adminTokenHash == nil || subtle.ConstantTimeCompare(hash[:], a.adminTokenHash[:]) != 1 {
+		return rejectedToken
+	}
+	return ""
+}
+
+// forwarded returns true if the request presents the forwarding token of the replicas
+func (a *webhookAuth) forwarded(r *http.Request) bool {
+	token := r.Header.Get(forwardingTokenHeader)
+	if a.forwardingTokenHash == nil || token == "" {
+		return false
+	}
+	hash := sha256.Sum256([]byte(token))
+	return subtle.ConstantTimeCompare(hash[:], a.forwardingTokenHash[:]) == 1
+}
+
+// setFileTokens replaces the tokens read from the secret token file, one per line, which are accepted besides the
+// configured tokens
+func (a *webhookAuth) setFileTokens(content string) {
+	var hashes [][sha256.Size]byte
+	first := ""
+	for _, token := range strings.Split(content, "\n") {
+		if token = strings.TrimSpace(token); token != "" {
+			hashes = append(hashes, sha256.Sum256([]byte(token)))
+			if first == "" {
+				first = token
+			}
+		}
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.fileHashes = hashes
+	a.fileToken = first
+}
+
+// forwardingToken returns the token presented to the leader for a hook with the given X-Gitlab-Event header. Merge
+// Request Hooks get the first token of the project webhooks, System Hooks the first configured token or else the
+// first token of the secret token file.
+func (a *webhookAuth) forwardingToken(event string) string {
+	if event == mergeRequestHookEvent {
+		return a.mergeRequestToken
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if a.forwardToken != "" {
+		return a.forwardToken
+	}
+	return a.fileToken
+}
+
+// validToken compares the hash of the given token with all configured tokens in constant time,
+// so neither the position of the first differing byte nor the matching token can be timed. Without any configured
+// token, no token is valid, unless unauthenticated hooks are explicitly allowed.
+func (a *webhookAuth) validToken(token string) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	if len(a.tokenHashes) == 0 && len(a.fileHashes) == 0 {
+		return a.allowUnauthenticated
+	}
+	return matchesToken(token, append(append([][sha256.Size]byte{}, a.tokenHashes...), a.fileHashes...))
+}
+
+// matchesToken compares the hash of the given token with all hashes in constant time, no hashes match no token
+func matchesToken(token string, hashes [][sha256.Size]byte) bool {
+	hash := sha256.Sum256([]byte(token))
+	valid := 0
+	for _, expected := range hashes {
+		valid |= subtle.ConstantTimeCompare(hash[:], expected[:])
+	}
+	return valid == 1
+}
+
+func (a *webhookAuth) allowedSource(remoteAddr string) bool {
+	if len(a.networks) == 0 {
+		return true
+	}
+	return inNetworks(remoteAddr, a.networks)
+}
+
+// inNetworks returns true if the address lies within one of the networks
+func inNetworks(remoteAddr string, networks []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsConfig returns the TLS configuration of the listener, or nil if it serves plain HTTP. Client certificates are
+// verified if given, the hook endpoint requires them, so that probes and metrics scrapes work without one.
+func tlsConfig(cfg config.WebhookTLS) (*tls.Config, error) {
+	if cfg.CertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not load TLS certificate")
+	}
+	tlsCfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if cfg.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.ClientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not read client CA")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("Client CA file contains no certificate")
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsCfg, nil
+}
@@ -0,0 +1,264 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package webhooklistener
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+)
+
+func TestWebhookAuth(t *testing.T) {
+	cfg := config.Default()
+	cfg.Gitlab.SecretToken = "current"
+	cfg.Gitlab.SecretTokens = []string{"next"}
+	cfg.Webhooks.AllowedCIDRs = []string{"10.0.0.0/8", "fd00::/8"}
+	auth, err := newWebhookAuth(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		remoteAddr, event, token, reason string
+	}{
+		{"10.1.2.3:4567", "System Hook", "current", ""},
+		{"10.1.2.3:4567", "System Hook", "next", ""},
+		{"[fd00::1]:4567", "System Hook", "next", ""},
+		{"10.1.2.3:4567", "System Hook", "curren", rejectedToken},
+		{"10.1.2.3:4567", "System Hook", "", rejectedToken},
+		{"10.1.2.3:4567", "Push Hook", "current", rejectedHeader},
+		{"192.168.1.1:4567", "System Hook", "current", rejectedSource},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/hook", nil)
+		r.RemoteAddr = c.remoteAddr
+		r.Header.Set("X-Gitlab-Event", c.event)
+		r.Header.Set("X-Gitlab-Token", c.token)
+		if reason := auth.reject(r); reason != c.reason {
+			t.Errorf("Expected %+v to be rejected for %q, but was %q", c, c.reason, reason)
+		}
+	}
+}
+
+func TestMergeRequestHooksRequireProjectWebhookTokens(t *testing.T) {
+	cfg := config.Default()
+	cfg.Gitlab.SecretToken = "system"
+	cfg.ReviewNamespaces.SecretTokens = []string{"project"}
+	auth, err := newWebhookAuth(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		event, token, reason string
+	}{
+		{"Merge Request Hook", "project", ""},
+		{"Merge Request Hook", "system", rejectedToken},
+		{"System Hook", "project", rejectedToken},
+		{"System Hook", "system", ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/hook", nil)
+		r.Header.Set("X-Gitlab-Event", c.event)
+		r.Header.Set("X-Gitlab-Token", c.token)
+		if reason := auth.reject(r); reason != c.reason {
+			t.Errorf("Expected %+v to be rejected for %q, but was %q", c, c.reason, reason)
+		}
+	}
+
+	auth, _ = newWebhookAuth(config.Default())
+	r := httptest.NewRequest("POST", "/hook", nil)
+	r.Header.Set("X-Gitlab-Event", "Merge Request Hook")
+	if reason := auth.reject(r); reason != rejectedToken {
+		t.Errorf("Expected Merge Request Hooks to be rejected without project webhook tokens, but was %q", reason)
+	}
+}
+
+func TestWebhookAuthRejectsHooksWithoutConfiguredToken(t *testing.T) {
+	cfg := config.Default()
+	auth, err := newWebhookAuth(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", "/hook", nil)
+	r.Header.Set("X-Gitlab-Event", "System Hook")
+	if reason := auth.reject(r); reason != rejectedToken {
+		t.Errorf("Expected a hook to be rejected without configured token, but was %q", reason)
+	}
+
+	cfg.Webhooks.AllowUnauthenticated = true
+	if auth, err = newWebhookAuth(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if reason := auth.reject(r); reason != "" {
+		t.Errorf("Expected a hook to be accepted with unauthenticated hooks allowed, but was rejected for %q", reason)
+	}
+}
+
+func TestWebhookAuthRequiresClientCert(t *testing.T) {
+	cfg := config.Default()
+	cfg.Webhooks.TLS.ClientCAFile = "/etc/ca.pem"
+	auth, err := newWebhookAuth(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("POST", "/hook", nil)
+	r.Header.Set("X-Gitlab-Event", "System Hook")
+	if reason := auth.reject(r); reason != rejectedClientCert {
+		t.Errorf("Expected request without client certificate to be rejected, but was %q", reason)
+	}
+}
+
+func TestWebhookAuthAcceptsFileTokens(t *testing.T) {
+	cfg := config.Default()
+	cfg.Gitlab.SecretTokens = []string{"configured"}
+	auth, err := newWebhookAuth(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.setFileTokens("old\nnew\n")
+
+	for token, valid := range map[string]bool{"configured": true, "old": true, "new": true, "other": false} {
+		if auth.validToken(token) != valid {
+			t.Errorf("Expected token %s to be valid: %t", token, valid)
+		}
+	}
+	if auth.forwardingToken("System Hook") != "configured" {
+		t.Errorf("Expected the configured token to be forwarded, got %s", auth.forwardingToken("System Hook"))
+	}
+
+	// rotated out of the file
+	auth.setFileTokens("new")
+	if auth.validToken("old") {
+		t.Error("Expected the removed token to be rejected")
+	}
+
+	auth, _ = newWebhookAuth(config.Default())
+	auth.setFileTokens("new")
+	if auth.forwardingToken("System Hook") != "new" {
+		t.Errorf("Expected the first token of the file to be forwarded, got %s", auth.forwardingToken("System Hook"))
+	}
+}
+
+func TestAdminEndpointsRequireAdminToken(t *testing.T) {
+	defer func(previous *webhookAuth) { auth = previous }(auth)
+	cfg := config.Default()
+	cfg.Gitlab.SecretToken = "hook-secret"
+	cfg.Webhooks.AdminToken = "admin-secret"
+	var err error
+	if auth, err = newWebhookAuth(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	replayed := false
+	replay := requireAdmin(func(w http.ResponseWriter, r *http.Request) { replayed = true })
+	cases := []struct {
+		header string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer hook-secret", http.StatusUnauthorized},
+		{"Bearer admin-secre", http.StatusUnauthorized},
+		{"Bearer admin-secret", http.StatusOK},
+	}
+	for _, c := range cases {
+		replayed = false
+		r := httptest.NewRequest("POST", "/hook/journal/replay?id=1", nil)
+		r.Header.Set("X-Gitlab-Event", "System Hook")
+		r.Header.Set("X-Gitlab-Token", "hook-secret")
+		if c.header != "" {
+			r.Header.Set("Authorization", c.header)
+		}
+		w := httptest.NewRecorder()
+		replay(w, r)
+		if w.Code != c.status || replayed != (c.status == http.StatusOK) {
+			t.Errorf("Expected replay with %q to answer %d, got %d and replayed: %t", c.header, c.status, w.Code, replayed)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	requireAdmin(handleReplayDeadLetters)(w, httptest.NewRequest("POST", "/hook/deadletters/replay", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected unauthenticated replay of all dead letters to be rejected, got %d", w.Code)
+	}
+
+	// without admin token, the admin endpoints are closed
+	auth, _ = newWebhookAuth(config.Default())
+	replayed = false
+	w = httptest.NewRecorder()
+	replay(w, httptest.NewRequest("POST", "/hook/journal/replay?id=1", nil))
+	if w.Code != http.StatusUnauthorized || replayed {
+		t.Errorf("Expected replay without admin token to be rejected, got %d", w.Code)
+	}
+}
+
+func TestWebhookAuthAcceptsForwardedHooks(t *testing.T) {
+	defer config.Set(config.Default())
+	cfg := config.Default()
+	cfg.Gitlab.SecretToken = "current"
+	cfg.Webhooks.AllowedCIDRs = []string{"192.0.2.0/24"}
+	cfg.LeaderElection.ForwardingToken = "replicas"
+	cfg.LeaderElection.ForwardingCIDRs = []string{"10.244.0.0/16"}
+	cfg.ReviewNamespaces.SecretTokens = []string{"project"}
+	config.Set(cfg)
+	var err error
+	defer func(previous *webhookAuth) { auth = previous }(auth)
+	if auth, err = newWebhookAuth(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	// a follower forwards a hook it accepted to the leader from its pod IP
+	var forwarded *http.Request
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+	}))
+	defer leader.Close()
+	if err := forwardToLeader(leader.URL, []byte("{}"), "", ""); err != nil {
+		t.Fatal(err)
+	}
+	forwarded.RemoteAddr = "10.244.1.7:40000"
+	if reason := auth.reject(forwarded); reason != "" {
+		t.Errorf("Expected the forwarded hook to be accepted, but was rejected for %q", reason)
+	}
+
+	// a leaked forwarding token is of no use outside of the replicas
+	forwarded.RemoteAddr = "198.51.100.1:40000"
+	if reason := auth.reject(forwarded); reason != rejectedSource {
+		t.Errorf("Expected a forwarded hook from outside the replicas to be rejected for its source, but was %q", reason)
+	}
+
+	// Merge Request Hooks are forwarded with their header and the token of the project webhooks
+	if err := forwardToLeader(leader.URL, []byte("{}"), "", "Merge Request Hook"); err != nil {
+		t.Fatal(err)
+	}
+	forwarded.RemoteAddr = "10.244.1.7:40000"
+	if forwarded.Header.Get("X-Gitlab-Event") != "Merge Request Hook" || forwarded.Header.Get("X-Gitlab-Token") != "project" {
+		t.Errorf("Expected the Merge Request Hook to be forwarded with its header and token, got %v", forwarded.Header)
+	}
+	if reason := auth.reject(forwarded); reason != "" {
+		t.Errorf("Expected the forwarded Merge Request Hook to be accepted, but was rejected for %q", reason)
+	}
+
+	for _, token := range []string{"", "other"} {
+		forwarded.Header.Set(forwardingTokenHeader, token)
+		if reason := auth.reject(forwarded); reason != rejectedSource {
+			t.Errorf("Expected a hook from a pod IP with forwarding token %q to be rejected for its source, but was %q", token, reason)
+		}
+	}
+}
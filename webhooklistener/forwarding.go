@@ -0,0 +1,107 @@
+/*
+	Copyright 2017 by Christian Hüning (christianhuening@googlemail.com).
+
+	Licensed under the Apache License, Version 2.0 (the "License");
+	you may not use this file except in compliance with the License.
+	You may obtain a copy of the License at
+		http://www.apache.org/licenses/LICENSE-2.0
+
+	Unless required by applicable law or agreed to in writing, software
+	distributed under the License is distributed on an "AS IS" BASIS,
+	WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+	See the License for the specific language governing permissions and
+	limitations under the License.
+*/
+
+package webhooklistener
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/usecases"
+	"github.com/pkg/errors"
+)
+
+var forwardingClient = &http.Client{Timeout: 10 * time.Second}
+
+// forwardingTokenHeader carries the forwarding token of the replicas on hooks forwarded to the leader
+const forwardingTokenHeader = "X-Gitlab-Integrator-Forwarding-Token"
+
+// setupForwardingClient presents the configured client certificate to the leader, as it may require client
+// certificates, and trusts the client CA besides the system roots for the certificate of the leader
+func setupForwardingClient(tlsCfg *tls.Config, cfg config.LeaderElection) error {
+	if tlsCfg == nil {
+		return nil
+	}
+	var certificates []tls.Certificate
+	if cfg.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return errors.Wrap(err, "Could not load forwarding client certificate")
+		}
+		certificates = append(certificates, cert)
+	}
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	if caFile := config.Get().Webhooks.TLS.ClientCAFile; caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return errors.Wrap(err, "Could not read client CA")
+		}
+		roots.AppendCertsFromPEM(pem)
+	}
+	forwardingClient.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{Certificates: certificates, RootCAs: roots, MinVersion: tls.VersionTLS12},
+	}
+	return nil
+}
+
+// forwardGitlabEvent hands a hook queued by a follower to the current leader, which queues it again on its side
+func forwardGitlabEvent(body []byte, uuid, event string) error {
+	leaderURL, err := usecases.LeaderURL()
+	if err != nil {
+		return err
+	}
+	if leaderURL == "" || leaderURL == usecases.OwnURL() {
+		return errors.New("No leader to forward the hook to")
+	}
+	return forwardToLeader(leaderURL, body, uuid, event)
+}
+
+// forwardToLeader posts a hook to the given leader with the X-Gitlab-Event header it was received with and the
+// tokens of this replica for it. Hooks queued before their header was kept are System Hooks.
+func forwardToLeader(leaderURL string, body []byte, uuid, event string) error {
+	req, err := http.NewRequest("POST", leaderURL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "Error while creating forward request")
+	}
+	if event == "" {
+		event = systemHookEvent
+	}
+	req.Header.Set("X-Gitlab-Event", event)
+	req.Header.Set("X-Gitlab-Token", getGitlabSecretToken(event))
+	if token := config.Get().LeaderElection.ForwardingToken; token != "" {
+		req.Header.Set(forwardingTokenHeader, token)
+	}
+	if uuid != "" {
+		req.Header.Set("X-Gitlab-Event-UUID", uuid)
+	}
+	resp, err := forwardingClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "Error while forwarding hook to leader %s", leaderURL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("Leader %s answered forwarded hook with status %d", leaderURL, resp.StatusCode))
+	}
+	return nil
+}
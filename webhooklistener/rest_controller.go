@@ -21,24 +21,72 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
-	"os"
+	"strconv"
+	"time"
 
+	"github.com/k8s-tamias/gitlab-k8s-integrator/config"
+	"github.com/k8s-tamias/gitlab-k8s-integrator/metrics"
 	"github.com/k8s-tamias/gitlab-k8s-integrator/usecases"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func Listen(quit chan int) {
 	router := http.NewServeMux()
 	router.HandleFunc("/healthz", handleHealthz)
-	if enableSyncEndpoint := os.Getenv("ENABLE_SYNC_ENDPOINT"); enableSyncEndpoint == "true" {
+	router.Handle("/metrics", promhttp.Handler())
+	if config.Get().Sync.EnableEndpoint {
 		log.Println("WARNING: Sync Endpoint enabled")
 		router.HandleFunc("/sync", handleSync)
+		router.HandleFunc("/sync/plan", requireAdmin(handleSyncPlan))
 	}
 	router.HandleFunc("/hook", handleGitlabWebhook)
+	if config.Get().Webhooks.EnableAdminEndpoints {
+		log.Println("WARNING: Admin Endpoints enabled")
+		router.HandleFunc("/hook/deadletters", requireAdmin(handleDeadLetters))
+		router.HandleFunc("/hook/deadletters/replay", requireAdmin(handleReplayDeadLetters))
+		router.HandleFunc("/hook/journal", requireAdmin(handleJournal))
+		router.HandleFunc("/hook/journal/replay", requireAdmin(handleReplayJournal))
+	}
+
+	var err error
+	if auth, err = newWebhookAuth(config.Get()); err != nil {
+		log.Fatal("Could not set up webhook authentication! Err: " + err.Error())
+	}
+	if gitlab := config.Get().Gitlab; gitlab.SecretToken == "" && len(gitlab.SecretTokens) == 0 && gitlab.SecretTokenFile == "" {
+		log.Println("WARNING: No secret token is configured and unauthenticated hooks are allowed! Anyone who can reach " +
+			"the integrator can create and delete namespaces and RoleBindings. Set GITLAB_SECRET_TOKEN in production!")
+	}
+	if gitlab := config.Get().Gitlab; gitlab.SecretTokenFile != "" {
+		interval := time.Duration(gitlab.CredentialReloadSeconds) * time.Second
+		if err := config.WatchSecretFile(gitlab.SecretTokenFile, interval, auth.setFileTokens); err != nil {
+			log.Fatal("Could not read the secret token file! Err: " + err.Error())
+		}
+	}
+	tlsCfg, err := tlsConfig(config.Get().Webhooks.TLS)
+	if err != nil {
+		log.Fatal("Could not set up TLS! Err: " + err.Error())
+	}
+	if err := setupForwardingClient(tlsCfg, config.Get().LeaderElection); err != nil {
+		log.Fatal("Could not set up forwarding to the leader! Err: " + err.Error())
+	}
+
+	if err := usecases.StartWebhookQueue(forwardGitlabEvent); err != nil {
+		log.Fatal("Could not start webhook queue! Err: " + err.Error())
+	}
 
-	log.Fatal(http.ListenAndServe(":8080", router))
+	server := &http.Server{Addr: ":8080", Handler: router, TLSConfig: tlsCfg}
+	if tlsCfg != nil {
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	} else {
+		log.Fatal(server.ListenAndServe())
+	}
 	quit <- 0
 }
 
+// auth checks the source, client certificate and token of all hook requests
+var auth *webhookAuth
+
 func handleSync(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
@@ -47,33 +95,269 @@ func handleSync(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleSyncPlan answers with the mutations a sync run would perform, without applying them.
+// The plan is rendered as JSON, or as text diff if the format=text query parameter is given.
+func handleSyncPlan(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		plan, err := usecases.PlanGlK8sSync()
+		switch err {
+		case usecases.ErrSyncRunInProgress:
+			HandleError(err, w, "Could not compute sync plan! ", http.StatusConflict)
+			return
+		case usecases.ErrNotLeader:
+			HandleError(err, w, "Could not compute sync plan! ", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			HandleError(err, w, "Could not compute sync plan! ", http.StatusInternalServerError)
+			return
+		}
+		if r.URL.Query().Get("format") == "text" {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(plan.String()))
+			return
+		}
+		planJson, err := plan.JSON()
+		if err != nil {
+			HandleError(err, w, "Could not render sync plan! ", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(planJson)
+	}
+}
+
 // handleGitlabWebhook listens for the following events from the
 // Gitlab System Webhooks Events: https://docs.gitlab.com/ce/system_hooks/system_hooks.html
+// and for the Merge Request events of project webhooks
 func handleGitlabWebhook(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 
 	case "POST":
-		if r.Header.Get("X-Gitlab-Event") != "System Hook" {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Printf("Received bad request from Gitlab. Problem was: X-Gitlab-Event Header was set to %s", r.Header.Get("X-Gitlab-Event"))
-			return
-		}
-		// if GITLAB_SECRET_TOKEN env is set and is unequal to provided token, deny request
-		if getGitlabSecretToken() != "" && r.Header.Get("X-Gitlab-Token") != getGitlabSecretToken() {
-			w.WriteHeader(http.StatusBadRequest)
-			fmt.Printf("Received bad request from Gitlab. Problem was: X-Gitlab-Token (%s) didn't match stored secret token %s", r.Header.Get("X-Gitlab-Token"), getGitlabSecretToken())
+		uuid, event := r.Header.Get("X-Gitlab-Event-UUID"), r.Header.Get("X-Gitlab-Event")
+		if reason := auth.reject(r); reason != "" {
+			// the body of an unauthenticated hook is not read, so only its receipt and rejection are journaled
+			id := usecases.JournalGitlabWebhook(nil, uuid, event)
+			usecases.JournalGitlabWebhookIntake(id, metrics.OutcomeRejected, errors.New(rejectionMessages[reason]))
+			rejectGitlabWebhook(w, r, reason)
 			return
 		}
 
 		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
+			id := usecases.JournalGitlabWebhook(nil, uuid, event)
+			usecases.JournalGitlabWebhookIntake(id, metrics.OutcomeInvalid, err)
+			metrics.WebhooksReceived.WithLabelValues("unknown", metrics.OutcomeInvalid).Inc()
 			HandleError(err, w, "Could not read body!", http.StatusBadRequest)
+			return
+		}
+		id := usecases.JournalGitlabWebhook(body, uuid, event)
+		// hooks are not applied in dry run, so they are rejected for Gitlab to deliver them again once it is disabled
+		if config.Get().Sync.DryRun {
+			err := errors.New("hooks are not applied in dry run")
+			usecases.JournalGitlabWebhookIntake(id, metrics.OutcomeRejected, err)
+			rejectGitlabEvent(w, r, rejectedDryRun, err)
+			return
+		}
+		// project webhooks may only send merge request events, their tokens are known to the project maintainers
+		if event == mergeRequestHookEvent {
+			if err := usecases.ValidateMergeRequestHook(body); err != nil {
+				usecases.JournalGitlabWebhookIntake(id, metrics.OutcomeRejected, err)
+				rejectGitlabEvent(w, r, rejectedEventKind, err)
+				return
+			}
+		}
+		// the hook is only acknowledged once it has been stored, so it is neither lost on failures nor on restarts
+		err = usecases.EnqueueGitlabEvent(id, body, uuid, event)
+		switch err.(type) {
+		case nil:
+		case *usecases.UnknownEventError:
+			rejectGitlabEvent(w, r, rejectedUnknownEvent, err)
+			return
+		case *usecases.InvalidEventError:
+			rejectGitlabEvent(w, r, rejectedPayload, err)
+			return
+		default:
+			HandleError(err, w, "Could not queue hook! ", http.StatusInternalServerError)
+			return
 		}
-		go usecases.HandleGitlabEvent(body)
 		w.WriteHeader(http.StatusOK)
 	}
 }
 
+// rejectGitlabWebhook answers a rejected hook and logs the reason, but never the token
+func rejectGitlabWebhook(w http.ResponseWriter, r *http.Request, reason string) {
+	metrics.WebhooksReceived.WithLabelValues("unknown", metrics.OutcomeRejected).Inc()
+	metrics.WebhookRejections.WithLabelValues(reason).Inc()
+	status := http.StatusForbidden
+	switch reason {
+	case rejectedHeader:
+		status = http.StatusBadRequest
+	case rejectedToken:
+		status = http.StatusUnauthorized
+	}
+	w.WriteHeader(status)
+	log.Println(fmt.Sprintf("Rejected hook from %s. Problem was: %s", r.RemoteAddr, rejectionMessages[reason]))
+}
+
+// rejectGitlabEvent answers a hook which is unknown or can't be decoded and logs why
+func rejectGitlabEvent(w http.ResponseWriter, r *http.Request, reason string, err error) {
+	metrics.WebhooksReceived.WithLabelValues("unknown", metrics.OutcomeRejected).Inc()
+	metrics.WebhookRejections.WithLabelValues(reason).Inc()
+	status := http.StatusBadRequest
+	switch reason {
+	case rejectedUnknownEvent:
+		status = http.StatusUnprocessableEntity
+	case rejectedEventKind:
+		status = http.StatusForbidden
+	case rejectedDryRun:
+		status = http.StatusServiceUnavailable
+	}
+	log.Println(fmt.Sprintf("Rejected hook from %s. Problem was: %s", r.RemoteAddr, err))
+	w.WriteHeader(status)
+	answer, _ := json.Marshal(ErrorMessage{err.Error()})
+	w.Write(answer)
+}
+
+// requireAdmin only passes requests to the admin endpoints on to the handler which present the admin token
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if reason := auth.rejectAdmin(r); reason != "" {
+			status := http.StatusForbidden
+			if reason == rejectedToken {
+				status = http.StatusUnauthorized
+			}
+			w.WriteHeader(status)
+			log.Println(fmt.Sprintf("Rejected request to %s from %s. Problem was: %s", r.URL.Path, r.RemoteAddr, adminRejectionMessages[reason]))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+var adminRejectionMessages = map[string]string{
+	rejectedToken:      "Authorization header didn't contain the admin token",
+	rejectedSource:     rejectionMessages[rejectedSource],
+	rejectedClientCert: rejectionMessages[rejectedClientCert],
+}
+
+var rejectionMessages = map[string]string{
+	rejectedHeader:     "X-Gitlab-Event Header was neither System Hook nor Merge Request Hook",
+	rejectedToken:      "X-Gitlab-Token didn't match any of the secret tokens",
+	rejectedSource:     "source address is not within the allowed CIDRs",
+	rejectedClientCert: "no valid client certificate was presented",
+}
+
+// handleDeadLetters lists all hooks which could not be processed after all retries
+func handleDeadLetters(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		deadLetters, err := usecases.GetDeadLetters()
+		if err != nil {
+			HandleError(err, w, "Could not read dead letters! ", http.StatusInternalServerError)
+			return
+		}
+		answer, err := json.Marshal(deadLetters)
+		if err != nil {
+			HandleError(err, w, "Could not render dead letters! ", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(answer)
+	}
+}
+
+// handleReplayDeadLetters queues the dead letters given by the id query parameters again, or all if none is given
+func handleReplayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		replayed, err := usecases.ReplayDeadLetters(r.URL.Query()["id"]...)
+		if err != nil {
+			HandleError(err, w, "Could not replay dead letters! ", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		answer, _ := json.Marshal(map[string]int{"replayed": replayed})
+		w.Write(answer)
+	}
+}
+
+// handleJournal lists the journaled hooks, newest first. The limit query parameter restricts their number, with the
+// id query parameter only the given hook is answered, including its body.
+func handleJournal(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		id := r.URL.Query().Get("id")
+		limit := 100
+		if l := r.URL.Query().Get("limit"); l != "" {
+			parsed, err := strconv.Atoi(l)
+			if err != nil || parsed < 0 {
+				HandleError(errors.New("limit must be a non-negative number"), w, "Invalid limit! ", http.StatusBadRequest)
+				return
+			}
+			limit = parsed
+		}
+		if id != "" {
+			limit = 0
+		}
+		events, err := usecases.GetJournal(limit, id != "")
+		if err != nil {
+			HandleError(err, w, "Could not read journal! ", http.StatusInternalServerError)
+			return
+		}
+		var answer []byte
+		if id != "" {
+			for _, event := range events {
+				if event.ID == id {
+					answer, err = json.Marshal(event)
+				}
+			}
+			if answer == nil && err == nil {
+				HandleError(errors.Errorf("Hook %s is not in the journal", id), w, "", http.StatusNotFound)
+				return
+			}
+		} else {
+			answer, err = json.Marshal(events)
+		}
+		if err != nil {
+			HandleError(err, w, "Could not render journal! ", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(answer)
+	}
+}
+
+// handleReplayJournal queues the journaled hook given by the id query parameter again and answers with the id of the
+// replay, whose outcome is journaled like that of any other hook
+func handleReplayJournal(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		id := r.URL.Query().Get("id")
+		if id == "" {
+			HandleError(errors.New("id query parameter is missing"), w, "Could not replay hook! ", http.StatusBadRequest)
+			return
+		}
+		replay, err := usecases.ReplayJournalEvent(id)
+		answer := map[string]string{"id": id, "replay": replay}
+		if err != nil {
+			answer["error"] = err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case replay == "":
+			w.WriteHeader(http.StatusConflict)
+		case err != nil:
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusAccepted)
+		}
+		data, _ := json.Marshal(answer)
+		w.Write(data)
+	}
+}
+
 func handleHealthz(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("ok"))
@@ -93,6 +377,7 @@ func HandleError(err error, w http.ResponseWriter, msg string, statusCode int) {
 	return
 }
 
-func getGitlabSecretToken() string {
-	return os.Getenv("GITLAB_SECRET_TOKEN")
+// getGitlabSecretToken returns the token used for forwarding hooks with the given X-Gitlab-Event header to the leader
+func getGitlabSecretToken(event string) string {
+	return auth.forwardingToken(event)
 }